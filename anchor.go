@@ -0,0 +1,348 @@
+package daisy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Anchoring periodically publishes the hash of the latest block to external systems, so
+// a private chain's history can later be checked against records its operators don't
+// control. Each publisher gets a statement binding the chain's genesis hash, the height
+// and the block hash, and returns a proof that it has recorded it, which is kept in the
+// anchors table of the main database. The built-in publishers write the statement as a
+// document into the pending directory of another Daisy chain's node (type "daisy"), or
+// have it timestamped by an RFC 3161 time stamping authority (type "rfc3161"). Other
+// systems, like public blockchains, are supported with publishers registered with
+// RegisterAnchorPublisher or exported by plugins as DaisyAnchorPublisher. The
+// verify-anchors command checks the local blockchain against all the recorded anchors.
+
+// DefaultAnchorInterval is the default interval of publishing anchors
+const DefaultAnchorInterval = "1h"
+
+// AnchorPublisher records block hashes in an external system
+type AnchorPublisher interface {
+	// Name identifies the publisher in the recorded anchors, so it must not change
+	Name() string
+	// Publish records the statement about the block in the external system, and returns
+	// the proof that it has, which is given to Verify
+	Publish(statement *AnchorStatement) (proof []byte, err error)
+	// Verify checks that the proof records the statement, and returns the time at which
+	// the external system recorded it
+	Verify(statement *AnchorStatement, proof []byte) (time.Time, error)
+}
+
+// AnchorStatement is what is anchored: the hash of the block at the height of the chain
+type AnchorStatement struct {
+	Chain  string `json:"chain"`
+	Height int    `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+// Bytes returns the canonical encoding of the statement, which is what publishers record
+// or hash
+func (s *AnchorStatement) Bytes() []byte {
+	data, err := json.Marshal(s)
+	if err != nil {
+		log.Panicln(err)
+	}
+	return data
+}
+
+// AnchorConfig configures one of the built-in anchor publishers
+type AnchorConfig struct {
+	// "daisy" or "rfc3161"
+	Type string `json:"type"`
+	// The name under which the anchors are recorded, by default the type and the URL
+	Name string `json:"name"`
+	// The HTTP API of the anchoring Daisy node, or the TSA's URL
+	URL string `json:"url"`
+	// The pending directory of the anchoring Daisy node, in which the statements are written
+	PendingDir string `json:"pending_dir"`
+	// The genesis hash of the anchoring Daisy chain
+	ChainRoot string `json:"chain_root"`
+	// The public key hashes of the anchoring Daisy chain's signers, which must have
+	// signed the receipts
+	TrustedSigners []string `json:"trusted_signers"`
+	// The CA certificates (PEM) which the TSA's certificate must chain to
+	CAFile string `json:"ca_file"`
+}
+
+var anchorPublishers struct {
+	lock       WithMutex
+	publishers []AnchorPublisher
+}
+
+// The parsed -anchor-interval
+var anchorInterval time.Duration
+
+// RegisterAnchorPublisher adds an anchor publisher to the node. It should be called
+// before the node is started.
+func RegisterAnchorPublisher(p AnchorPublisher) {
+	anchorPublishers.lock.With(func() {
+		anchorPublishers.publishers = append(anchorPublishers.publishers, p)
+	})
+}
+
+// Returns the registered anchor publishers
+func anchorGetPublishers() []AnchorPublisher {
+	var result []AnchorPublisher
+	anchorPublishers.lock.With(func() {
+		result = anchorPublishers.publishers
+	})
+	return result
+}
+
+// Creates the built-in anchor publishers from the configuration
+func anchorConfigure() error {
+	var err error
+	if anchorInterval, err = parseDurationSetting("anchor-interval", cfg.AnchorInterval, time.Minute, 7*24*time.Hour); err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, ac := range cfg.Anchors {
+		if !strings.HasPrefix(ac.URL, "http://") && !strings.HasPrefix(ac.URL, "https://") {
+			return fmt.Errorf("Invalid anchor URL: %q", ac.URL)
+		}
+		if ac.Name == "" {
+			ac.Name = ac.Type + ":" + ac.URL
+		}
+		if names[ac.Name] {
+			return fmt.Errorf("Duplicate anchor name: %s", ac.Name)
+		}
+		names[ac.Name] = true
+		var p AnchorPublisher
+		switch ac.Type {
+		case "daisy":
+			if ac.PendingDir == "" {
+				return fmt.Errorf("The daisy anchor %s needs the pending_dir of the anchoring node", ac.Name)
+			}
+			// Without them, whoever runs the anchoring node could forge the receipts
+			if ac.ChainRoot == "" || len(ac.TrustedSigners) == 0 {
+				return fmt.Errorf("The daisy anchor %s needs the chain_root and the trusted_signers of the anchoring chain", ac.Name)
+			}
+			p = &daisyAnchorPublisher{config: ac}
+		case "rfc3161":
+			if ac.CAFile == "" {
+				return fmt.Errorf("The rfc3161 anchor %s needs the ca_file to check the TSA's certificate against", ac.Name)
+			}
+			tp := &rfc3161AnchorPublisher{config: ac}
+			if tp.roots, err = rfc3161LoadRoots(ac.CAFile); err != nil {
+				return fmt.Errorf("Cannot load the CA certificates of the anchor %s: %v", ac.Name, err)
+			}
+			p = tp
+		default:
+			return fmt.Errorf("Unknown anchor type %q (expecting daisy or rfc3161)", ac.Type)
+		}
+		RegisterAnchorPublisher(p)
+	}
+	return nil
+}
+
+// Returns the statement about the block at the height
+func anchorStatement(height int) (*AnchorStatement, error) {
+	hash := dbGetBlockHashByHeight(height)
+	if hash == "" {
+		return nil, fmt.Errorf("No block at height %d", height)
+	}
+	return &AnchorStatement{Chain: chainParams.GenesisBlockHash, Height: height, Hash: hash}, nil
+}
+
+// Publishes the latest block to the publishers which haven't anchored it yet
+func anchorPublish() {
+	height := dbGetBlockchainHeight()
+	if height < 0 {
+		return
+	}
+	statement, err := anchorStatement(height)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, p := range anchorGetPublishers() {
+		if last, ok := dbGetLastAnchorHeight(p.Name()); ok && last >= height {
+			continue
+		}
+		proof, err := p.Publish(statement)
+		if err != nil {
+			log.Println("Cannot anchor block", height, "with", p.Name(), err)
+			continue
+		}
+		if err = dbInsertAnchor(p.Name(), statement, proof); err != nil {
+			log.Println("Cannot record the anchor of block", height, "with", p.Name(), err)
+			continue
+		}
+		log.Println("Anchored block", height, "with", p.Name())
+	}
+}
+
+// Publishes anchors at the configured interval, until the node stops
+func anchorRun() {
+	ticker := time.NewTicker(anchorInterval)
+	defer ticker.Stop()
+	for {
+		anchorPublish()
+		select {
+		case <-nodeQuit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns the last anchored height of every publisher, for /status
+func anchorStatus() map[string]int {
+	status := map[string]int{}
+	for _, p := range anchorGetPublishers() {
+		if height, ok := dbGetLastAnchorHeight(p.Name()); ok {
+			status[p.Name()] = height
+		} else {
+			status[p.Name()] = -1
+		}
+	}
+	return status
+}
+
+// Checks the local blockchain against the recorded anchors, run as: verify-anchors. Fails
+// if a configured publisher has no recorded anchors, since the chain couldn't have been
+// checked against it.
+func actionVerifyAnchors() {
+	anchors, err := dbGetAnchors()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	publishers := map[string]AnchorPublisher{}
+	for _, p := range anchorGetPublishers() {
+		publishers[p.Name()] = p
+	}
+	if len(anchors) == 0 {
+		fmt.Println("No anchors have been recorded")
+		if len(publishers) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	recorded := map[string]bool{}
+	for _, a := range anchors {
+		recorded[a.publisher] = true
+	}
+	failed := 0
+	for name := range publishers {
+		if !recorded[name] {
+			fmt.Println("FAILED:", name, "has no recorded anchors")
+			failed++
+		}
+	}
+	for _, a := range anchors {
+		local := dbGetBlockHashByHeight(a.statement.Height)
+		var result string
+		switch {
+		case a.statement.Chain != chainParams.GenesisBlockHash:
+			result = "FAILED: the anchor is of another chain"
+		case local == "":
+			result = "FAILED: the block is missing"
+		case local != a.statement.Hash:
+			result = "FAILED: the block's hash is " + local
+		case publishers[a.publisher] == nil:
+			result = "hash matches, but the proof cannot be checked since the publisher is not configured"
+		default:
+			if t, err := publishers[a.publisher].Verify(a.statement, a.proof); err != nil {
+				result = "FAILED: " + err.Error()
+			} else {
+				result = "OK, anchored at " + t.UTC().Format(time.RFC3339)
+			}
+		}
+		if strings.HasPrefix(result, "FAILED") {
+			failed++
+		}
+		fmt.Printf("%-8d %s  %s: %s\n", a.statement.Height, a.statement.Hash, a.publisher, result)
+	}
+	if failed > 0 {
+		fmt.Println(failed, "of", len(anchors), "anchors failed verification")
+		os.Exit(1)
+	}
+	fmt.Println("All", len(anchors), "anchors verified")
+}
+
+// Anchors into another Daisy chain, by writing the statements as documents into the
+// pending directory of one of its producing nodes. The proof is the document's hash, and
+// the document's receipt is fetched from the node's HTTP API when verifying.
+type daisyAnchorPublisher struct {
+	config AnchorConfig
+}
+
+type daisyAnchorProof struct {
+	DocumentHash string `json:"document_hash"`
+}
+
+func (p *daisyAnchorPublisher) Name() string {
+	return p.config.Name
+}
+
+func (p *daisyAnchorPublisher) Publish(statement *AnchorStatement) ([]byte, error) {
+	data := statement.Bytes()
+	fileName := fmt.Sprintf("anchor-%s-%d.json", statement.Chain[:16], statement.Height)
+	// Files with names starting with a dot are skipped until they're complete
+	tmpName := filepath.Join(p.config.PendingDir, "."+fileName)
+	if err := ioutil.WriteFile(tmpName, data, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpName, filepath.Join(p.config.PendingDir, fileName)); err != nil {
+		os.Remove(tmpName)
+		return nil, err
+	}
+	return json.Marshal(daisyAnchorProof{DocumentHash: hashBytesToHexString(data)})
+}
+
+func (p *daisyAnchorPublisher) Verify(statement *AnchorStatement, proof []byte) (time.Time, error) {
+	var dp daisyAnchorProof
+	if err := json.Unmarshal(proof, &dp); err != nil {
+		return time.Time{}, err
+	}
+	if dp.DocumentHash != hashBytesToHexString(statement.Bytes()) {
+		return time.Time{}, fmt.Errorf("The proof is of another statement")
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	url := strings.TrimSuffix(p.config.URL, "/") + "/proof/" + dp.DocumentHash
+	resp, err := client.Get(url)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return time.Time{}, fmt.Errorf("The anchoring chain doesn't have the statement (yet)")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var receipt TimestampReceipt
+	if err = json.Unmarshal(body, &receipt); err != nil {
+		return time.Time{}, err
+	}
+	if receipt.DocumentHash != dp.DocumentHash {
+		return time.Time{}, fmt.Errorf("The anchoring chain returned the receipt of another document")
+	}
+	if receipt.ChainRoot != p.config.ChainRoot {
+		return time.Time{}, fmt.Errorf("The receipt is from the chain %s instead of %s", receipt.ChainRoot, p.config.ChainRoot)
+	}
+	signers, err := receipt.Verify()
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, signer := range signers {
+		if !inStrings(signer, p.config.TrustedSigners) {
+			return time.Time{}, fmt.Errorf("The receipt is signed by an untrusted key %s", signer)
+		}
+	}
+	return time.Parse(time.RFC3339, receipt.Block.Timestamp)
+}
@@ -0,0 +1,323 @@
+package daisy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// The RFC 3161 anchor publisher has the SHA-256 hash of the statement timestamped by a
+// time stamping authority. The proof is the timestamp token, a CMS SignedData structure,
+// which is verified by checking that it covers the statement's hash and that it's signed
+// by the certificate it contains, which with ca_file must chain to one of the given CAs.
+// The token can also be checked with other tools, e.g. openssl ts -verify.
+
+var (
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidAttrContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrDigest      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+)
+
+type rfc3161MessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type rfc3161Request struct {
+	Version        int
+	MessageImprint rfc3161MessageImprint
+	Nonce          *big.Int
+	CertReq        bool
+}
+
+type rfc3161Response struct {
+	Status         asn1.RawValue
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// Only the leading fields of TSTInfo are needed
+type rfc3161TSTInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint rfc3161MessageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+}
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type cmsEncapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type cmsRawCertificates struct {
+	Raw asn1.RawContent
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapContentInfo
+	Certificates     cmsRawCertificates     `asn1:"optional,tag:0"`
+	CRLs             []pkix.CertificateList `asn1:"optional,tag:1"`
+	SignerInfos      []cmsSignerInfo        `asn1:"set"`
+}
+
+type cmsIssuerAndSerial struct {
+	IssuerName   asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// Anchors with an RFC 3161 time stamping authority
+type rfc3161AnchorPublisher struct {
+	config AnchorConfig
+	roots  *x509.CertPool
+}
+
+// Loads the CA certificates from the PEM file
+func rfc3161LoadRoots(fileName string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", fileName)
+	}
+	return pool, nil
+}
+
+func (p *rfc3161AnchorPublisher) Name() string {
+	return p.config.Name
+}
+
+func (p *rfc3161AnchorPublisher) Publish(statement *AnchorStatement) ([]byte, error) {
+	digest := sha256.Sum256(statement.Bytes())
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	req, err := asn1.Marshal(rfc3161Request{
+		Version:        1,
+		MessageImprint: rfc3161MessageImprint{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256}, HashedMessage: digest[:]},
+		Nonce:          nonce,
+		CertReq:        true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(p.config.URL, "application/timestamp-query", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("The TSA returned %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var tsResp rfc3161Response
+	if _, err = asn1.Unmarshal(body, &tsResp); err != nil {
+		return nil, fmt.Errorf("Cannot decode the TSA's response: %v", err)
+	}
+	var status int
+	if _, err = asn1.Unmarshal(tsResp.Status.Bytes, &status); err != nil {
+		return nil, fmt.Errorf("Cannot decode the TSA's response status: %v", err)
+	}
+	// 0 is granted, 1 is granted with modifications
+	if status > 1 || len(tsResp.TimeStampToken.FullBytes) == 0 {
+		return nil, fmt.Errorf("The TSA rejected the request with the status %d", status)
+	}
+	token := tsResp.TimeStampToken.FullBytes
+	if _, err = p.Verify(statement, token); err != nil {
+		return nil, fmt.Errorf("The TSA returned an invalid timestamp token: %v", err)
+	}
+	return token, nil
+}
+
+func (p *rfc3161AnchorPublisher) Verify(statement *AnchorStatement, proof []byte) (time.Time, error) {
+	info, err := rfc3161VerifyToken(proof, p.roots)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) {
+		return time.Time{}, fmt.Errorf("The timestamp token doesn't use SHA-256")
+	}
+	digest := sha256.Sum256(statement.Bytes())
+	if !bytes.Equal(info.MessageImprint.HashedMessage, digest[:]) {
+		return time.Time{}, fmt.Errorf("The timestamp token is of another statement")
+	}
+	return info.GenTime, nil
+}
+
+// Returns the hash function with the OID
+func rfc3161Hash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("Unsupported digest algorithm %v", oid)
+}
+
+// Returns the X.509 signature algorithm for the hash and the certificate's key
+func rfc3161SignatureAlgorithm(h crypto.Hash, cert *x509.Certificate) (x509.SignatureAlgorithm, error) {
+	algorithms := map[x509.PublicKeyAlgorithm]map[crypto.Hash]x509.SignatureAlgorithm{
+		x509.RSA:   {crypto.SHA256: x509.SHA256WithRSA, crypto.SHA384: x509.SHA384WithRSA, crypto.SHA512: x509.SHA512WithRSA},
+		x509.ECDSA: {crypto.SHA256: x509.ECDSAWithSHA256, crypto.SHA384: x509.ECDSAWithSHA384, crypto.SHA512: x509.ECDSAWithSHA512},
+	}
+	if alg, ok := algorithms[cert.PublicKeyAlgorithm][h]; ok {
+		return alg, nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("Unsupported signature key %v", cert.PublicKeyAlgorithm)
+}
+
+// Verifies the signature of the timestamp token and the TSA's certificate, and returns its
+// TSTInfo
+func rfc3161VerifyToken(token []byte, roots *x509.CertPool) (*rfc3161TSTInfo, error) {
+	if roots == nil {
+		return nil, fmt.Errorf("No CA certificates to check the TSA's certificate against")
+	}
+	var ci cmsContentInfo
+	if _, err := asn1.Unmarshal(token, &ci); err != nil {
+		return nil, fmt.Errorf("Cannot decode the timestamp token: %v", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("The timestamp token is not signed data")
+	}
+	var sd cmsSignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("Cannot decode the timestamp token's signed data: %v", err)
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) || len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("The timestamp token doesn't have one signed TSTInfo")
+	}
+	var info rfc3161TSTInfo
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent, &info); err != nil {
+		return nil, fmt.Errorf("Cannot decode the TSTInfo: %v", err)
+	}
+
+	var certs []*x509.Certificate
+	if len(sd.Certificates.Raw) > 0 {
+		var raw asn1.RawValue
+		if _, err := asn1.Unmarshal(sd.Certificates.Raw, &raw); err != nil {
+			return nil, err
+		}
+		var err error
+		if certs, err = x509.ParseCertificates(raw.Bytes); err != nil {
+			return nil, fmt.Errorf("Cannot decode the timestamp token's certificates: %v", err)
+		}
+	}
+	si := sd.SignerInfos[0]
+	var signer *x509.Certificate
+	var ias cmsIssuerAndSerial
+	if _, err := asn1.Unmarshal(si.SID.FullBytes, &ias); err == nil {
+		for _, c := range certs {
+			if c.SerialNumber.Cmp(ias.SerialNumber) == 0 && bytes.Equal(c.RawIssuer, ias.IssuerName.FullBytes) {
+				signer = c
+			}
+		}
+	} else if si.SID.Class == asn1.ClassContextSpecific && si.SID.Tag == 0 {
+		for _, c := range certs {
+			if bytes.Equal(c.SubjectKeyId, si.SID.Bytes) {
+				signer = c
+			}
+		}
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("The timestamp token doesn't contain the signer's certificate")
+	}
+
+	// The signature covers the signed attributes, one of which is the digest of the TSTInfo
+	if si.SignedAttrs.Class != asn1.ClassContextSpecific || si.SignedAttrs.Tag != 0 {
+		return nil, fmt.Errorf("The timestamp token has no signed attributes")
+	}
+	signed := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...) // signed as a SET
+	var attrs []cmsAttribute
+	if _, err := asn1.UnmarshalWithParams(signed, &attrs, "set"); err != nil {
+		return nil, fmt.Errorf("Cannot decode the signed attributes: %v", err)
+	}
+	h, err := rfc3161Hash(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	hasher := h.New()
+	hasher.Write(sd.EncapContentInfo.EContent)
+	digestOK, contentTypeOK := false, false
+	for _, attr := range attrs {
+		switch {
+		case attr.Type.Equal(oidAttrDigest):
+			var digest []byte
+			if _, err = asn1.Unmarshal(attr.Values.Bytes, &digest); err == nil && bytes.Equal(digest, hasher.Sum(nil)) {
+				digestOK = true
+			}
+		case attr.Type.Equal(oidAttrContentType):
+			var contentType asn1.ObjectIdentifier
+			if _, err = asn1.Unmarshal(attr.Values.Bytes, &contentType); err == nil && contentType.Equal(oidTSTInfo) {
+				contentTypeOK = true
+			}
+		}
+	}
+	if !digestOK || !contentTypeOK {
+		return nil, fmt.Errorf("The signed attributes don't match the TSTInfo")
+	}
+	alg, err := rfc3161SignatureAlgorithm(h, signer)
+	if err != nil {
+		return nil, err
+	}
+	if err = signer.CheckSignature(alg, signed, si.Signature); err != nil {
+		return nil, fmt.Errorf("The timestamp token's signature is invalid: %v", err)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs {
+		intermediates.AddCert(c)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   info.GenTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}
+	if _, err = signer.Verify(opts); err != nil {
+		return nil, fmt.Errorf("The TSA's certificate is not trusted: %v", err)
+	}
+	return &info, nil
+}
@@ -0,0 +1,299 @@
+package daisy
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Attachments are (possibly large) files referenced from blocks. They are split into
+// content-addressed chunks which are stored outside of the block files, in the chunk store,
+// and transferred between peers separately from the blocks.
+
+// Chunks are stored as flat files in a directory, named by their hash
+const chunksSubdirectoryBaseName = "chunks"
+
+// The size of attachment chunks. The last chunk of a file can be shorter.
+const attachmentChunkSize = 1024 * 1024
+
+// BlockAttachment is the representation of a record from the blocks' _attachments table.
+type BlockAttachment struct {
+	hash   string
+	name   string
+	size   int64
+	chunks []string
+}
+
+// Returns the file name under which the chunk with the given hash is stored
+func chunkGetFilename(hash string) string {
+	digest := hashHex(hash)
+	return filepath.Join(cfg.DataDir, chunksSubdirectoryBaseName, digest[0:2], digest)
+}
+
+// Checks if the string looks like a hash made with the chain's hash algorithm
+func isValidChunkHash(hash string) bool {
+	return isValidChainHash(hash)
+}
+
+// Checks if a chunk is present in the local chunk store
+func chunkExists(hash string) bool {
+	return isValidChunkHash(hash) && fileExists(chunkGetFilename(hash))
+}
+
+// Verifies that the data matches the given hash and writes it to the chunk store
+func chunkStore(hash string, data []byte) error {
+	if hashBytesToHexString(data) != hash {
+		return fmt.Errorf("Chunk data doesn't match hash %s", hash)
+	}
+	fileName := chunkGetFilename(hash)
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+	tmpFileName := fileName + ".tmp"
+	if err := ioutil.WriteFile(tmpFileName, data, 0644); err != nil {
+		return err
+	}
+	return renameFile(tmpFileName, fileName)
+}
+
+// Reads a chunk from the local chunk store
+func chunkRead(hash string) ([]byte, error) {
+	if !isValidChunkHash(hash) {
+		return nil, fmt.Errorf("Invalid chunk hash: %s", hash)
+	}
+	return ioutil.ReadFile(chunkGetFilename(hash))
+}
+
+// Splits the given file into chunks, writes the chunks to the chunk store and returns
+// the attachment record describing the file.
+func attachmentChunkFile(fileName string) (*BlockAttachment, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	att := BlockAttachment{name: filepath.Base(fileName)}
+	fileHash := chainHash.newHash()
+	buf := make([]byte, attachmentChunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			chunk := buf[0:n]
+			chunkHash := hashBytesToHexString(chunk)
+			if !chunkExists(chunkHash) {
+				if err := chunkStore(chunkHash, chunk); err != nil {
+					return nil, err
+				}
+			}
+			fileHash.Write(chunk)
+			att.chunks = append(att.chunks, chunkHash)
+			att.size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	att.hash = chainHash.format(fileHash.Sum(nil))
+	return &att, nil
+}
+
+// Reassembles an attachment from the chunk store into the given file, verifying its hash
+func attachmentWriteFile(att *BlockAttachment, fileName string) error {
+	out, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	fileHash := chainHash.newHash()
+	w := io.MultiWriter(out, fileHash)
+	for _, chunkHash := range att.chunks {
+		chunk, err := chunkRead(chunkHash)
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("Missing chunk %s: %v", chunkHash, err)
+		}
+		if _, err = w.Write(chunk); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if chainHash.format(fileHash.Sum(nil)) != att.hash {
+		return fmt.Errorf("Reassembled attachment doesn't match its hash %s", att.hash)
+	}
+	return nil
+}
+
+// Ensures the attachment tables exist in a SQLite database
+func dbEnsureAttachmentTables(db *sql.DB) {
+	if !dbTableExists(db, "_attachments") {
+		if _, err := db.Exec(attachmentsTableCreate); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if !dbTableExists(db, "_attachment_chunks") {
+		if _, err := db.Exec(attachmentChunksTableCreate); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Records an attachment into the attachment tables in the given SQLite database
+func dbInsertAttachment(db *sql.DB, att *BlockAttachment) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO _attachments (hash, name, size, chunk_count) VALUES (?, ?, ?, ?)",
+		att.hash, att.name, att.size, len(att.chunks))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i, chunkHash := range att.chunks {
+		_, err = tx.Exec("INSERT INTO _attachment_chunks (attachment_hash, idx, chunk_hash) VALUES (?, ?, ?)", att.hash, i, chunkHash)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Returns the list of attachments referenced by the block, or an empty list if the
+// block doesn't have attachment tables.
+func (b *Block) dbGetAttachments() ([]BlockAttachment, error) {
+	var result []BlockAttachment
+	if !dbTableExists(b.db, "_attachments") {
+		return result, nil
+	}
+	rows, err := b.db.Query("SELECT hash, name, size, chunk_count FROM _attachments ORDER BY hash")
+	if err != nil {
+		return nil, err
+	}
+	var chunkCounts []int
+	for rows.Next() {
+		var att BlockAttachment
+		var chunkCount int
+		if err = rows.Scan(&att.hash, &att.name, &att.size, &chunkCount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result = append(result, att)
+		chunkCounts = append(chunkCounts, chunkCount)
+	}
+	rows.Close()
+	for i := range result {
+		att := &result[i]
+		rows, err := b.db.Query("SELECT chunk_hash FROM _attachment_chunks WHERE attachment_hash=? ORDER BY idx", att.hash)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var chunkHash string
+			if err = rows.Scan(&chunkHash); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if !isValidChunkHash(chunkHash) {
+				rows.Close()
+				return nil, fmt.Errorf("Invalid chunk hash %s in attachment %s", chunkHash, att.hash)
+			}
+			att.chunks = append(att.chunks, chunkHash)
+		}
+		rows.Close()
+		if len(att.chunks) != chunkCounts[i] {
+			return nil, fmt.Errorf("Attachment %s should have %d chunks, found %d", att.hash, chunkCounts[i], len(att.chunks))
+		}
+		if att.size > int64(len(att.chunks))*attachmentChunkSize {
+			return nil, fmt.Errorf("Attachment %s is too large for its %d chunks", att.hash, len(att.chunks))
+		}
+	}
+	return result, nil
+}
+
+// Records the chunks of the block's attachments which are not present in the local chunk
+// store, so they can be fetched from peers.
+func blockchainRegisterMissingChunks(b *Block) error {
+	atts, err := b.dbGetAttachments()
+	if err != nil {
+		return err
+	}
+	for _, att := range atts {
+		for _, chunkHash := range att.chunks {
+			if chunkExists(chunkHash) {
+				continue
+			}
+			dbAddMissingChunk(chunkHash, b.Height)
+		}
+	}
+	return nil
+}
+
+// Finds the attachment with the given hash in the blockchain, returns it and the height of
+// the block which contains it. The block is looked up in the documents table, so only
+// that block is opened.
+func blockchainFindAttachment(hash string) (*BlockAttachment, int, error) {
+	if _, ok := dbGetConfig(documentsIndexedKey); !ok {
+		return nil, 0, fmt.Errorf("The documents aren't indexed yet, the node must be started without -readonly once")
+	}
+	h, ok := dbGetDocumentHeight(hash)
+	if !ok {
+		return nil, 0, fmt.Errorf("Attachment %s not found", hash)
+	}
+	b, err := OpenBlockByHeight(h)
+	if err != nil {
+		return nil, 0, err
+	}
+	atts, err := b.dbGetAttachments()
+	b.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range atts {
+		if strings.EqualFold(atts[i].hash, hash) {
+			return &atts[i], h, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("Attachment %s not found in block %d", hash, h)
+}
+
+// Records the documents of the block in the documents table
+func blockchainIndexDocuments(b *Block) error {
+	hashes, err := b.dbGetDocumentHashes()
+	if err != nil {
+		return err
+	}
+	return dbInsertDocuments(b.Height, hashes)
+}
+
+// Fills the documents table with the documents of all the blocks, once after it's created
+func blockchainIndexAllDocuments() {
+	if _, ok := dbGetConfig(documentsIndexedKey); ok {
+		return
+	}
+	height := dbGetBlockchainHeight()
+	log.Println("Indexing the documents of", height+1, "blocks")
+	for h := 0; h <= height; h++ {
+		b, err := OpenBlockByHeight(h)
+		if err != nil {
+			log.Println("Cannot index the documents of block", h, err)
+			continue
+		}
+		err = blockchainIndexDocuments(b)
+		b.Close()
+		if err != nil {
+			log.Println("Cannot index the documents of block", h, err)
+		}
+	}
+	dbSetConfig(documentsIndexedKey, "1")
+}
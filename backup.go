@@ -0,0 +1,252 @@
+package daisy
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// The backup command takes a consistent snapshot of a data directory while its node keeps
+// running. The main database is copied first, with the SQLite online backup API, which
+// copies it in a single step, so the snapshot is of one committed state; the node's writes
+// wait for the copy (up to SQLite's busy timeout). The snapshot's last block is the height
+// of the backup: the block files up to it, which never change once accepted, are then
+// copied and checked against the hashes in the snapshot, so blocks accepted during the
+// backup are not included. The private database, the chain params and the chunks are
+// copied too, and the backup.json manifest is written last, so a backup without one is
+// incomplete. To restore, the backup directory is used as the data directory. The blocks
+// are in the default layout, and can be moved to the block_storage layout with movestorage.
+
+// The name of the backup manifest
+const backupManifestBaseName = "backup.json"
+
+// BackupManifest describes a backup
+type BackupManifest struct {
+	Chain       string `json:"chain"`
+	Height      int    `json:"height"`
+	Hash        string `json:"hash"`
+	TimeCreated string `json:"time_created"`
+	Blocks      int    `json:"blocks"`
+	Chunks      int    `json:"chunks"`
+	Bytes       int64  `json:"bytes"`
+	// The SHA256 hashes of the database and chain params files
+	Files map[string]string `json:"files"`
+}
+
+// Copies the database into the file with the SQLite online backup API
+func backupDatabase(db *sql.DB, fileName string) error {
+	dest, err := sql.Open("sqlite3", fileName)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	ctx := context.Background()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			destSqlite, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			srcSqlite, ok2 := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return fmt.Errorf("The databases are not SQLite connections")
+			}
+			b, err := destSqlite.Backup("main", srcSqlite, "main")
+			if err != nil {
+				return err
+			}
+			// All the pages at once, for a snapshot of a single state
+			done, err := b.Step(-1)
+			if err == nil && !done {
+				err = fmt.Errorf("The database backup didn't complete")
+			}
+			if ferr := b.Finish(); err == nil {
+				err = ferr
+			}
+			return err
+		})
+	})
+}
+
+// Returns the hashes of the blocks in the database snapshot
+func backupSnapshotBlocks(fileName string) (map[int]string, int, error) {
+	db, err := dbOpen(fileName, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT height, hash FROM blockchain ORDER BY height")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	hashes := map[int]string{}
+	height := -1
+	for rows.Next() {
+		var h int
+		var hash string
+		if err = rows.Scan(&h, &hash); err != nil {
+			return nil, 0, err
+		}
+		hashes[h] = hash
+		height = h
+	}
+	return hashes, height, rows.Err()
+}
+
+// Copies the file and returns its size
+func backupCopyFile(src, dst string) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return 0, err
+	}
+	if err := copyFile(src, dst); err != nil {
+		return 0, err
+	}
+	st, err := os.Stat(dst)
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+// Copies the chunk files, which are immutable and named by their hashes
+func backupChunks(outDir string) (int, int64, error) {
+	count := 0
+	var size int64
+	chunksDir := filepath.Join(cfg.DataDir, chunksSubdirectoryBaseName)
+	if !fileExists(chunksDir) {
+		return 0, 0, nil
+	}
+	err := filepath.Walk(chunksDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isValidHashHex(info.Name()) {
+			// Including the chunks still being written
+			return nil
+		}
+		n, err := backupCopyFile(path, filepath.Join(outDir, chunksSubdirectoryBaseName, info.Name()[0:2], info.Name()))
+		if err != nil {
+			return err
+		}
+		count++
+		size += n
+		return nil
+	})
+	return count, size, err
+}
+
+// Backs up the data directory of a running node, run as: backup -output dir
+func actionBackup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := fs.String("output", "", "The directory to write the backup to, which must be empty or not exist")
+	fs.Parse(args)
+	if *output == "" {
+		log.Fatalln("The backup needs an -output directory")
+	}
+	if fileExists(*output) {
+		if empty, _ := isDirEmpty(*output); !empty {
+			log.Fatalln("The output directory must be empty:", *output)
+		}
+	}
+	if err := os.MkdirAll(*output, 0700); err != nil {
+		log.Fatalln(err)
+	}
+	// The node keeps running in the data directory, so the databases are only opened for
+	// reading, without the checks and repairs the node makes when it starts
+	dbInitReadOnly()
+	blockchainLoadChainParams()
+	start := time.Now()
+	manifest := BackupManifest{Chain: chainParams.GenesisBlockHash, Files: map[string]string{}}
+
+	mainFile := filepath.Join(*output, mainDbFileName)
+	if err := backupDatabase(mainDb, mainFile); err != nil {
+		log.Fatalln("Cannot back up the main database:", err)
+	}
+	hashes, height, err := backupSnapshotBlocks(mainFile)
+	if err != nil {
+		log.Fatalln("Cannot read the backed up main database:", err)
+	}
+	if height < 0 {
+		log.Fatalln("The blockchain is empty")
+	}
+	log.Println("Backing up the blockchain up to block", height)
+	manifest.Height, manifest.Hash = height, hashes[height]
+	if privateDb != nil {
+		if err = backupDatabase(privateDb, filepath.Join(*output, privateDbFilename)); err != nil {
+			log.Fatalln("Cannot back up the private database:", err)
+		}
+	}
+	if cpFilename := filepath.Join(cfg.DataDir, chainParamsBaseName); fileExists(cpFilename) {
+		if _, err = backupCopyFile(cpFilename, filepath.Join(*output, chainParamsBaseName)); err != nil {
+			log.Fatalln("Cannot back up the chain params:", err)
+		}
+	}
+	for _, name := range []string{mainDbFileName, privateDbFilename, chainParamsBaseName} {
+		fileName := filepath.Join(*output, name)
+		if !fileExists(fileName) {
+			continue
+		}
+		if manifest.Files[name], err = hashFileToHexString(fileName); err != nil {
+			log.Fatalln(err)
+		}
+		st, err := os.Stat(fileName)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		manifest.Bytes += st.Size()
+	}
+
+	blocksDir := filepath.Join(*output, blockchainSubdirectoryBaseName)
+	for h := 0; h <= height; h++ {
+		dst := blockStorageFilename(blocksDir, h)
+		n, err := backupCopyFile(blockchainGetFilename(h), dst)
+		if err != nil {
+			log.Fatalln("Cannot back up block", h, err)
+		}
+		hash, err := hashFileToHexString(dst)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if hash != hashes[h] {
+			log.Fatalln("The backed up block", h, "doesn't match its hash: the block file is damaged, repair it first")
+		}
+		manifest.Blocks++
+		manifest.Bytes += n
+		if h%10000 == 0 && h > 0 {
+			log.Println("Backed up", h, "blocks")
+		}
+	}
+	chunks, chunksSize, err := backupChunks(*output)
+	if err != nil {
+		log.Fatalln("Cannot back up the chunks:", err)
+	}
+	manifest.Chunks = chunks
+	manifest.Bytes += chunksSize
+
+	manifest.TimeCreated = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(*output, backupManifestBaseName), data, 0600); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("Backed up %d blocks (up to %s) and %d chunks, %d bytes, in %v", manifest.Blocks, manifest.Hash, manifest.Chunks, manifest.Bytes, time.Since(start).Round(time.Second))
+}
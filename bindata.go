@@ -3,7 +3,7 @@
 // bindata/genesis.db
 // DO NOT EDIT!
 
-package main
+package daisy
 
 import (
 	"bytes"
@@ -1,4 +1,4 @@
-package main
+package daisy
 
 import (
 	"database/sql"
@@ -10,6 +10,7 @@ import (
 	"log"
 	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 )
@@ -81,10 +82,39 @@ func ensureBlockchainSubdirectoryExists() {
 	}
 }
 
+// Loads the custom blockchain params from the data directory. Returns false if the chain
+// uses the default params.
+func blockchainLoadChainParams() bool {
+	// The chainparams file will only exist for non-default blockchains
+	cpFilename := fmt.Sprintf("%s/%s", cfg.DataDir, chainParamsBaseName)
+	if !fileExists(cpFilename) {
+		return false
+	}
+	log.Println("Loading custom blockchain params from", cpFilename)
+	cpJSON, err := ioutil.ReadFile(cpFilename)
+	if err != nil {
+		log.Fatal("Error reading chainparams file", cpFilename, err)
+	}
+	err = json.Unmarshal(cpJSON, &chainParams)
+	if err != nil {
+		log.Fatal("Error decoding chainparams file", cpFilename, err)
+	}
+	if err = chainHashInit(&chainParams); err != nil {
+		log.Fatalln("Error in chainparams file", cpFilename, err)
+	}
+	return true
+}
+
 // Initializes the blockchain: creates database entries and the genesis block file
 func blockchainInit(createDefault bool) {
 	ensureBlockchainSubdirectoryExists()
+	if dbGetBlockchainHeight() == -1 && cfg.readOnly {
+		log.Fatalln("The blockchain is empty, nothing to serve in read-only mode")
+	}
 	if dbGetBlockchainHeight() == -1 && createDefault {
+		if err := profileCheckGenesis(); err != nil {
+			log.Fatalln(err)
+		}
 		log.Println("Writing down the default Genesis block. Let there be light.")
 
 		// This is basically testing the crypto code, no real purpose.
@@ -171,23 +201,14 @@ func blockchainInit(createDefault bool) {
 			log.Panicln(err)
 		}
 	} else {
-		// The chainparams file will only exist for non-default blockchains
-		cpFilename := fmt.Sprintf("%s/%s", cfg.DataDir, chainParamsBaseName)
-		if fileExists(cpFilename) {
-			log.Println("Loading custom blockchain params from", cpFilename)
-			cpJSON, err := ioutil.ReadFile(cpFilename)
-			if err != nil {
-				log.Fatal("Error reading chainparams file", cpFilename, err)
-			}
-			err = json.Unmarshal(cpJSON, &chainParams)
-			if err != nil {
-				log.Fatal("Error decoding chainparams file", cpFilename, err)
-			}
-			peers := dbGetSavedPeers()
-			for _, peer := range chainParams.BootstrapPeers {
-				_, ok := peers[peer]
-				if !ok {
-					dbSavePeer(peer)
+		if blockchainLoadChainParams() {
+			if !cfg.readOnly {
+				peers := dbGetSavedPeers()
+				for _, peer := range chainParams.BootstrapPeers {
+					_, ok := peers[peer]
+					if !ok {
+						dbSavePeer(peer)
+					}
 				}
 			}
 		} else {
@@ -195,114 +216,177 @@ func blockchainInit(createDefault bool) {
 		}
 		log.Println("P2P peers:", dbGetSavedPeers())
 	}
-	err := blockchainVerifyEverything()
-	if err != nil {
-		log.Fatalf("blockchainVerifyEverything: %v", err)
+	if err := blockLimitsInit(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := keyOpQuorumInit(); err != nil {
+		log.Fatalln(err)
+	}
+	if cfg.relay {
+		// Relay nodes only have the block headers, not the blocks
+		log.Println("Relay mode: skipping blockchain verification")
+		return
+	}
+	badHeight, err := blockchainVerifyEverything()
+	for err != nil {
+		log.Println("Blockchain verification failed:", err)
+		if cfg.readOnly {
+			log.Fatalln("Cannot recover the blockchain in read-only mode")
+		}
+		if badHeight <= genesisBlockHeight {
+			log.Fatalln("The genesis block is damaged, cannot recover automatically")
+		}
+		// Damaged blocks are repaired with copies from the peers, and the verification
+		// goes on with the blocks above them
+		repairErr := blockRepairStart(badHeight)
+		if repairErr == nil {
+			badHeight, err = blockchainVerifyRange(badHeight+1, dbGetBlockchainHeight())
+			continue
+		}
+		log.Println(repairErr)
+		if err = blockchainQuarantineFrom(badHeight); err != nil {
+			log.Fatalf("blockchainQuarantineFrom: %v", err)
+		}
+		log.Println("Rolled back the blockchain to height", dbGetBlockchainHeight(), "- missing blocks will be fetched from peers")
+		break
+	}
+	if !cfg.readOnly {
+		blockchainQuarantineStrayFiles()
+		// No block is being copied yet, so all the temporary files are left over by crashes
+		if removed := blockStorageRemoveTmpFiles(0); removed > 0 {
+			log.Println("Removed", removed, "stale temporary files from the block storage")
+		}
+		blockchainIndexAllDocuments()
 	}
 }
 
-// Verifies the entire blockchain to see if there are errors.
+// Verifies the entire blockchain to see if there are errors. On error, returns the
+// height of the first block which failed verification.
 // TODO: Dynamic adding and revoking of key is not yet checked
-func blockchainVerifyEverything() error {
+func blockchainVerifyEverything() (int, error) {
+	maxHeight := dbGetBlockchainHeight()
+	minHeight := 0
 	if cfg.faster {
-		log.Println("Skipping blockchain consistency checks")
-		return nil
+		// Only check the last block, which is the one most likely damaged by a crash
+		log.Println("Skipping blockchain consistency checks except for the last block")
+		minHeight = maxHeight
+	} else {
+		log.Println("Verifying all the blocks (use --faster to skip)...")
 	}
-	log.Println("Verifying all the blocks (use --faster to skip)...")
-	maxHeight := dbGetBlockchainHeight()
-	for height := 0; height <= maxHeight; height++ {
+	return blockchainVerifyRange(minHeight, maxHeight)
+}
+
+// Verifies the blocks in the range of heights. On error, returns the height of the first
+// block which failed verification.
+func blockchainVerifyRange(minHeight, maxHeight int) (int, error) {
+	for height := minHeight; height <= maxHeight; height++ {
 		if height > 0 && height%1000 == 0 {
 			log.Println("Verifying block", height)
 		}
-		if err := blockchainEnsureBlockDir(height); err != nil {
-			return err
-		}
-		blockFilename := blockchainGetFilename(height)
-		fileHash, err := hashFileToHexString(blockFilename)
-		if err != nil {
-			return fmt.Errorf("block %d: %v", height, err)
+		if err := blockchainVerifyBlock(height); err != nil {
+			return height, err
 		}
-		dbb, err := dbGetBlockByHeight(height)
-		if err != nil {
-			return fmt.Errorf("block %d: %v", height, err)
-		}
-		if fileHash != dbb.Hash {
-			return fmt.Errorf("block %d: file hash %s doesn't match db hash %s", height, fileHash, dbb.Hash)
-		}
-		if height == 0 && fileHash != chainParams.GenesisBlockHash {
-			return fmt.Errorf("block %d: it's supposed to be the genesis block but its hash doesn't match %s",
-				height, chainParams.GenesisBlockHash)
-		}
-		dbpk, err := dbGetPublicKey(dbb.SignaturePublicKeyHash)
-		if err != nil {
-			return fmt.Errorf("block %d: error getting public key %s", height, dbb.SignaturePublicKeyHash)
-		}
-		creatorPublicKey, err := cryptoDecodePublicKeyBytes(dbpk.publicKeyBytes)
-		if err != nil {
-			return fmt.Errorf("block %d: cannot decode public key %s", height, dbb.SignaturePublicKeyHash)
-		}
-		hashBytes, err := hex.DecodeString(dbb.Hash)
-		if err != nil {
-			return fmt.Errorf("block %d: cannot decode hash %s", height, dbb.Hash)
-		}
-		err = cryptoVerifyBytes(creatorPublicKey, hashBytes, dbb.HashSignature)
-		if err != nil {
-			log.Println(creatorPublicKey, hashBytes, dbb.HashSignature)
-			return fmt.Errorf("block %d: block hash signature is invalid (%v)", height, err)
-		}
-		previousHashBytes, err := hex.DecodeString(dbb.PreviousBlockHash)
-		if err != nil {
-			return fmt.Errorf("block %d: cannot decode previous block hash %s", height, dbb.PreviousBlockHash)
-		}
-		err = cryptoVerifyBytes(creatorPublicKey, previousHashBytes, dbb.PreviousBlockHashSignature)
-		if err != nil {
-			return fmt.Errorf("block %d: previous block hash signature is invalid (%v)", height, err)
+	}
+	return 0, nil
+}
+
+// Verifies a single block recorded in the blockchain index, at the given height
+func blockchainVerifyBlock(height int) error {
+	if err := blockchainEnsureBlockDir(height); err != nil {
+		return err
+	}
+	blockFilename := blockchainGetFilename(height)
+	fileHash, err := hashFileToHexString(blockFilename)
+	if err != nil {
+		return fmt.Errorf("block %d: %v", height, err)
+	}
+	dbb, err := dbGetBlockByHeight(height)
+	if err != nil {
+		return fmt.Errorf("block %d: %v", height, err)
+	}
+	if fileHash != dbb.Hash {
+		return blockDamagedError{fmt.Errorf("block %d: file hash %s doesn't match db hash %s", height, fileHash, dbb.Hash)}
+	}
+	if height == 0 && fileHash != chainParams.GenesisBlockHash {
+		return blockDamagedError{fmt.Errorf("block %d: it's supposed to be the genesis block but its hash doesn't match %s",
+			height, chainParams.GenesisBlockHash)}
+	}
+	dbpk, err := dbGetPublicKey(dbb.SignaturePublicKeyHash)
+	if err != nil {
+		return fmt.Errorf("block %d: error getting public key %s", height, dbb.SignaturePublicKeyHash)
+	}
+	creatorPublicKey, err := cryptoDecodePublicKeyBytes(dbpk.publicKeyBytes)
+	if err != nil {
+		return fmt.Errorf("block %d: cannot decode public key %s", height, dbb.SignaturePublicKeyHash)
+	}
+	hashBytes, err := hashDigest(dbb.Hash)
+	if err != nil {
+		return fmt.Errorf("block %d: cannot decode hash %s", height, dbb.Hash)
+	}
+	err = cryptoVerifyBytes(creatorPublicKey, hashBytes, dbb.HashSignature)
+	if err != nil {
+		log.Println(creatorPublicKey, hashBytes, dbb.HashSignature)
+		return fmt.Errorf("block %d: block hash signature is invalid (%v)", height, err)
+	}
+	previousHashBytes, err := hashDigest(dbb.PreviousBlockHash)
+	if err != nil {
+		return fmt.Errorf("block %d: cannot decode previous block hash %s", height, dbb.PreviousBlockHash)
+	}
+	err = cryptoVerifyBytes(creatorPublicKey, previousHashBytes, dbb.PreviousBlockHashSignature)
+	if err != nil {
+		return fmt.Errorf("block %d: previous block hash signature is invalid (%v)", height, err)
+	}
+	b, err := OpenBlockByHeight(height)
+	if err != nil {
+		return fmt.Errorf("block %d: cannot open block db file: %v", height, err)
+	}
+	blockKeyOps, err := b.dbGetKeyOps()
+	if err != nil {
+		if err := b.Close(); err != nil {
+			panic(err)
 		}
-		b, err := OpenBlockByHeight(height)
-		if err != nil {
-			return fmt.Errorf("block %d: cannot open block db file: %v", height, err)
+		return fmt.Errorf("block %d: cannot get key ops: %v", height, err)
+	}
+	if err = b.Close(); err != nil {
+		panic(err)
+	}
+	Q := QuorumForHeight(height)
+	for keyOpKeyHash, keyOps := range blockKeyOps {
+		if len(keyOps) != Q {
+			return fmt.Errorf("block %d: key ops for %s don't have quorum: %d vs Q=%d",
+				height, keyOpKeyHash, len(keyOps), Q)
 		}
-		blockKeyOps, err := b.dbGetKeyOps()
-		if err != nil {
-			if err := b.Close(); err != nil {
-				panic(err)
+		op := keyOps[0].op
+		for _, kop := range keyOps {
+			if kop.op != op {
+				return fmt.Errorf("block %d: key ops for %s don't match: %s vs %s",
+					height, keyOpKeyHash, kop.op, op)
 			}
-			return fmt.Errorf("block %d: cannot get key ops: %v", height, err)
-		}
-		if err = b.Close(); err != nil {
-			panic(err)
-		}
-		Q := QuorumForHeight(height)
-		for keyOpKeyHash, keyOps := range blockKeyOps {
-			if len(keyOps) != Q {
-				return fmt.Errorf("block %d: key ops for %s don't have quorum: %d vs Q=%d",
-					height, keyOpKeyHash, len(keyOps), Q)
+			dbSigningKey, err := dbGetPublicKey(kop.signatureKeyHash)
+			if err != nil {
+				return fmt.Errorf("block %d: cannot get public key %s from main db", height, kop.signatureKeyHash)
 			}
-			op := keyOps[0].op
-			for _, kop := range keyOps {
-				if kop.op != op {
-					return fmt.Errorf("block %d: key ops for %s don't match: %s vs %s",
-						height, keyOpKeyHash, kop.op, op)
-				}
-				dbSigningKey, err := dbGetPublicKey(kop.signatureKeyHash)
-				if err != nil {
-					return fmt.Errorf("block %d: cannot get public key %s from main db", height, kop.signatureKeyHash)
-				}
-				signingKey, err := cryptoDecodePublicKeyBytes(dbSigningKey.publicKeyBytes)
-				if err != nil {
-					return fmt.Errorf("block %d: cannot decode public key %s", height, dbSigningKey.publicKeyHash)
-				}
-				if err = cryptoVerifyPublicKeyHashSignature(signingKey, kop.publicKeyHash, kop.signature); err != nil {
-					return fmt.Errorf("block %d: key op signature invalid for signer %s: %v", height, kop.signatureKeyHash, err)
-				}
+			signingKey, err := cryptoDecodePublicKeyBytes(dbSigningKey.publicKeyBytes)
+			if err != nil {
+				return fmt.Errorf("block %d: cannot decode public key %s", height, dbSigningKey.publicKeyHash)
+			}
+			if err = cryptoVerifyPublicKeyHashSignature(signingKey, kop.publicKeyHash, kop.signature); err != nil {
+				return fmt.Errorf("block %d: key op signature invalid for signer %s: %v", height, kop.signatureKeyHash, err)
 			}
 		}
 	}
 	return nil
 }
 
-// Checks if a new block can be accepted to extend the blockchain
+// Checks if a new block can be accepted to extend the blockchain, and applies its key ops
 func checkAcceptBlock(blk *Block) (int, error) {
+	return blockchainCheckBlock(blk, true)
+}
+
+// Checks if a new block can be accepted to extend the blockchain. The block's key ops are
+// only applied to the public keys if apply is true, so a block can be validated without
+// changing any state.
+func blockchainCheckBlock(blk *Block, apply bool) (int, error) {
 	// Step 1: Does the block fit, i.e. does it extend the chain?
 	if blk.Version != CurrentBlockVersion {
 		return 0, fmt.Errorf("Unsupported block version: %d", blk.Version)
@@ -335,6 +419,31 @@ func checkAcceptBlock(blk *Block) (int, error) {
 	if err != nil {
 		return 0, fmt.Errorf("Verification of block hash has failed: %v", err)
 	}
+	if _, err = blk.dbGetAttachments(); err != nil {
+		return 0, fmt.Errorf("Invalid attachments: %v", err)
+	}
+	if err = blockLimitsCheckBlock(blk); err != nil {
+		return 0, err
+	}
+	if err = blk.dbCheckKeyEnvelopes(); err != nil {
+		return 0, err
+	}
+	if err = blk.dbCheckBundles(); err != nil {
+		return 0, err
+	}
+	if err = blk.dbVerifyDocumentsRoot(signatoryPubKey.publicKeyBytes); err != nil {
+		return 0, fmt.Errorf("Invalid documents root: %v", err)
+	}
+	if err = blk.dbVerifySeal(thisBlockHeight, signatoryPubKey.publicKeyBytes); err != nil {
+		return 0, fmt.Errorf("Invalid seal: %v", err)
+	}
+	blk.Height = thisBlockHeight
+	if err = blockchainValidateRecordTypes(blk); err != nil {
+		return 0, err
+	}
+	if err = hooksCheckBlock(blk); err != nil {
+		return 0, err
+	}
 	allKeyOps, err := blk.dbGetKeyOps()
 	if err != nil {
 		return 0, err
@@ -365,7 +474,9 @@ func checkAcceptBlock(blk *Block) (int, error) {
 			if err == nil {
 				return 0, fmt.Errorf("Attempt to add an already existing key to the list of signatores")
 			}
-			dbWritePublicKey(keyOps[0].publicKeyBytes, key, thisBlockHeight)
+			if apply {
+				dbWritePublicKey(keyOps[0].publicKeyBytes, key, thisBlockHeight)
+			}
 		} else if keyOps[0].op == "R" {
 			// Revoke the key. But first, check if it's already revoked.
 			dbpk, err := dbGetPublicKey(key)
@@ -375,7 +486,9 @@ func checkAcceptBlock(blk *Block) (int, error) {
 			if dbpk.isRevoked {
 				return 0, fmt.Errorf("Attempt to revoke a key which is already revoked: %s", key)
 			}
-			dbRevokePublicKey(key)
+			if apply {
+				dbRevokePublicKey(key, thisBlockHeight)
+			}
 		} else {
 			return 0, fmt.Errorf("Invalid key op: %s", keyOps[0].op)
 		}
@@ -384,21 +497,76 @@ func checkAcceptBlock(blk *Block) (int, error) {
 	return thisBlockHeight, nil
 }
 
-// QuorumForHeight calculates the required key op quorum for the given block height
+// QuorumForHeight calculates the required key op quorum for the given block height. The
+// chain's key_op_quorum param, if set, fixes it for all heights, so every node of the
+// chain agrees on it whichever profile it runs with.
 func QuorumForHeight(h int) int {
+	if chainParams.KeyOpQuorum > 0 {
+		return chainParams.KeyOpQuorum
+	}
 	if h < 149 {
 		return 1
 	}
 	return int(math.Log(float64(h)) * 2)
 }
 
-// Formats the block height into a blockchain file (SQLite database) filename
+// The key under which the key op quorum is recorded in the genesis block's _meta table
+const keyOpQuorumMeta = "KeyOpQuorum"
+
+// Records the chain's fixed key op quorum in the genesis block, so it's covered by its hash
+func keyOpQuorumWriteGenesis(db *sql.DB, cp *ChainParams) error {
+	if cp.KeyOpQuorum < 0 {
+		return fmt.Errorf("The key op quorum cannot be negative")
+	}
+	if cp.KeyOpQuorum == 0 {
+		return nil
+	}
+	return dbSetMetaInt(db, keyOpQuorumMeta, cp.KeyOpQuorum)
+}
+
+// Checks that the key op quorum in the chain params is the one recorded in the genesis
+// block. A genesis block without one means the quorum grows with the height.
+func keyOpQuorumInit() error {
+	if chainParams.KeyOpQuorum < 0 {
+		return fmt.Errorf("The key op quorum cannot be negative")
+	}
+	fileName := blockchainGetFilename(genesisBlockHeight)
+	if !fileExists(fileName) {
+		return nil
+	}
+	blk, err := OpenBlockFile(fileName)
+	if err != nil {
+		return err
+	}
+	defer blk.Close()
+	quorum, err := blk.dbGetMetaInt(keyOpQuorumMeta)
+	if err != nil {
+		quorum = 0
+	}
+	if quorum != chainParams.KeyOpQuorum {
+		return fmt.Errorf("The key op quorum in the chain params (%d) is not the one in the genesis block (%d)", chainParams.KeyOpQuorum, quorum)
+	}
+	return nil
+}
+
+// Formats the block height into a blockchain file (SQLite database) filename. If the
+// block isn't where the block storage layout puts it, the other storage directories are
+// searched for it.
 func blockchainGetFilename(h int) string {
-	return fmt.Sprintf(rawBlockFilenameFormat, blockchainSubdirectory, h/65536, h)
+	fileName := blockStorageFilename(blockStorageDir(h, blockStorageHash(h)), h)
+	if len(blockStorageRules) == 0 || fileExists(fileName) {
+		return fileName
+	}
+	for _, dir := range blockStorageAllDirs() {
+		if other := blockStorageFilename(dir, h); other != fileName && fileExists(other) {
+			return other
+		}
+	}
+	return fileName
 }
 
 func blockchainEnsureBlockDir(h int) error {
-	dirName := fmt.Sprintf(rawBlockDirnameFormat, blockchainSubdirectory, h/65536)
+	dirName := fmt.Sprintf(rawBlockDirnameFormat, blockStorageDir(h, blockStorageHash(h)), h/65536)
 	return os.MkdirAll(dirName, 0755)
 }
 
@@ -587,12 +755,274 @@ func dbSetMetaInt(db *sql.DB, key string, value int) error {
 	return err
 }
 
-// Copies a given file to the blockchain directory and names it as a block with the given height
-func blockchainCopyFile(fn string, height int) error {
-	if err := blockchainEnsureBlockDir(height); err != nil {
+// Opens the given block file (SQLite database), creates metadata tables in it, signs the
+// block with one of the private keys, and accepts the resulting block into the blockchain.
+// Returns the height of the new block.
+func blockchainSignImportBlock(fn string) (int, error) {
+	if checkDiskSpace() == diskSpaceCritical {
+		return 0, fmt.Errorf("Disk space is critically low in %s", cfg.DataDir)
+	}
+	newBlock, err := blockchainSignBlock(fn)
+	if err != nil {
+		return 0, err
+	}
+	maintenanceLock.With(func() {
+		if err = blockchainCopyFile(fn, newBlock.Height, newBlock.Hash); err != nil {
+			return
+		}
+		err = dbInsertBlock(newBlock)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if b, err := OpenBlockByHeight(newBlock.Height); err == nil {
+		err = blockchainIndexDocuments(b)
+		b.Close()
+		if err != nil {
+			log.Println("Cannot index the documents of block", newBlock.Hash, err)
+		}
+	} else {
+		log.Println("Cannot index the documents of block", newBlock.Hash, err)
+	}
+	return newBlock.Height, nil
+}
+
+// Creates metadata tables in the given block file and signs the block with one of the
+// private keys, as the next block of the blockchain, without adding it to the blockchain
+func blockchainSignBlock(fn string) (*DbBlockchainBlock, error) {
+	db, err := dbOpen(fn, false)
+	if err != nil {
+		return nil, err
+	}
+	dbOpened := true
+	defer func() {
+		if dbOpened {
+			db.Close()
+		}
+	}()
+	dbEnsureBlockchainTables(db)
+	keypair, publicKeyHash, err := cryptoGetAPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	lastBlockHeight := dbGetBlockchainHeight()
+	dbb, err := dbGetBlockByHeight(lastBlockHeight)
+	if err != nil {
+		return nil, err
+	}
+	if err = dbSetMetaInt(db, "Version", CurrentBlockVersion); err != nil {
+		return nil, err
+	}
+	if err = dbSetMetaString(db, "PreviousBlockHash", dbb.Hash); err != nil {
+		return nil, err
+	}
+	signature, err := cryptoSignHex(keypair, dbb.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if err = dbSetMetaString(db, "PreviousBlockHashSignature", signature); err != nil {
+		return nil, err
+	}
+	timestamp := time.Now().Format(time.RFC3339)
+	if err = dbSetMetaString(db, "Timestamp", timestamp); err != nil {
+		return nil, err
+	}
+
+	pkdb, err := dbGetPublicKey(publicKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	previousBlockHashSignature, err := hex.DecodeString(signature)
+	if err != nil {
+		return nil, err
+	}
+	if creatorString, ok := pkdb.metadata["BlockCreator"]; ok {
+		if err = dbSetMetaString(db, "Creator", creatorString); err != nil {
+			return nil, err
+		}
+	}
+	if err = dbSetMetaString(db, "CreatorPublicKey", pkdb.publicKeyHash); err != nil {
+		return nil, err
+	}
+	blk := Block{DbBlockchainBlock: &DbBlockchainBlock{Height: lastBlockHeight + 1}, db: db}
+	if err = blockchainValidateRecordTypes(&blk); err != nil {
+		return nil, fmt.Errorf("Block validation failed: %v", err)
+	}
+	blk.PreviousBlockHash = dbb.Hash
+	blk.SignaturePublicKeyHash = pkdb.publicKeyHash
+	if err = hooksCheckBlock(&blk); err != nil {
+		return nil, err
+	}
+	documentHashes, err := blk.dbGetDocumentHashes()
+	if err != nil {
+		return nil, err
+	}
+	seal := BlockHeader{Height: lastBlockHeight + 1, PreviousBlockHash: dbb.Hash, Timestamp: timestamp}
+	if len(documentHashes) > 0 {
+		documentsRoot, _, err := merkleRootAndProof(documentHashes, -1)
+		if err != nil {
+			return nil, err
+		}
+		if err = dbSetMetaString(db, "DocumentsRoot", documentsRoot); err != nil {
+			return nil, err
+		}
+		// Still signed alone for the nodes which don't know about seals
+		signature, err := cryptoSignHex(keypair, documentsRoot)
+		if err != nil {
+			return nil, err
+		}
+		if err = dbSetMetaString(db, "DocumentsRootSignature", signature); err != nil {
+			return nil, err
+		}
+		seal.DocumentsRoot = documentsRoot
+	}
+	signature, err = cryptoSignHex(keypair, hashBytesToHexString(canonicalSealBytes(chainParams.GenesisBlockHash, &seal)))
+	if err != nil {
+		return nil, err
+	}
+	if err = dbSetMetaString(db, "SealSignature", signature); err != nil {
+		return nil, err
+	}
+	dbOpened = false
+	if err = db.Close(); err != nil {
+		return nil, err
+	}
+	blockHashHex, err := hashFileToHexString(fn)
+	if err != nil {
+		return nil, err
+	}
+	signature, err = cryptoSignHex(keypair, blockHashHex)
+	if err != nil {
+		return nil, err
+	}
+	blockHashSignature, _ := hex.DecodeString(signature)
+
+	newBlockHeight := lastBlockHeight + 1
+	newBlock := DbBlockchainBlock{Hash: blockHashHex, HashSignature: blockHashSignature, PreviousBlockHash: dbb.Hash, PreviousBlockHashSignature: previousBlockHashSignature,
+		Version: CurrentBlockVersion, SignaturePublicKeyHash: pkdb.publicKeyHash, Height: newBlockHeight, TimeAccepted: time.Now()}
+	return &newBlock, nil
+}
+
+// Serialises the creation of new blocks by this node
+var blockCreateLock WithMutex
+
+// Creates a new block with the given files as documents, and the files in each of the
+// bundles as documents recorded together as a bundle, signs it and adds it to the
+// blockchain. Returns the height of the new block.
+func blockchainCreateBlock(fileNames []string, bundles [][]string) (int, error) {
+	height := 0
+	var err error
+	blockCreateLock.With(func() {
+		height, err = blockchainCreateBlockLocked(fileNames, bundles)
+	})
+	return height, err
+}
+
+func blockchainCreateBlockLocked(fileNames []string, bundles [][]string) (int, error) {
+	fn, err := blockchainBuildBlockFile(fileNames, bundles)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(fn)
+	return blockchainSignImportBlock(fn)
+}
+
+// Creates an unsigned block file with the given documents and bundles in the temporary
+// directory. Returns its file name; the caller must remove it.
+func blockchainBuildBlockFile(fileNames []string, bundles [][]string) (string, error) {
+	f, err := ioutil.TempFile("", "daisy-block")
+	if err != nil {
+		return "", err
+	}
+	fn := f.Name()
+	f.Close()
+	db, err := dbOpen(fn, false)
+	if err != nil {
+		os.Remove(fn)
+		return "", err
+	}
+	dbEnsureAttachmentTables(db)
+	for _, fileName := range fileNames {
+		att, err := attachmentChunkFile(fileName)
+		if err == nil {
+			err = dbInsertAttachment(db, att)
+		}
+		if err != nil {
+			db.Close()
+			os.Remove(fn)
+			return "", err
+		}
+	}
+	for _, bundle := range bundles {
+		if err = dbAttachBundle(db, bundle); err != nil {
+			db.Close()
+			os.Remove(fn)
+			return "", err
+		}
+	}
+	if err = db.Close(); err != nil {
+		os.Remove(fn)
+		return "", err
+	}
+	if err = blockLimitsCheckFiles(fn, fileNames, bundles); err != nil {
+		os.Remove(fn)
+		return "", err
+	}
+	return fn, nil
+}
+
+// Verifies the block in the given file and, if it can be accepted, copies it into the
+// blockchain. The returned block must be closed by the caller. The validation and the
+// commit are traced under the given sync trace ID, if any.
+func blockchainImportBlockFile(fileName string, hashSignature []byte, traceID string) (*Block, error) {
+	start := time.Now()
+	blk, err := OpenBlockFile(fileName)
+	if err != nil {
+		err = fmt.Errorf("Error opening block file: %v", err)
+		traceStage(traceID, traceStageValidate, start, err)
+		return nil, err
+	}
+	blk.HashSignature = hashSignature
+	height, err := checkAcceptBlock(blk)
+	traceStage(traceID, traceStageValidate, start, err, "hash", blk.Hash, "height", strconv.Itoa(height))
+	if err != nil {
+		blk.Close()
+		return nil, err
+	}
+	start = time.Now()
+	blk.Height = height
+	blk.DbBlockchainBlock.TimeAccepted = time.Now()
+	maintenanceLock.With(func() {
+		if err = blockchainCopyFile(fileName, height, blk.Hash); err != nil {
+			err = fmt.Errorf("Cannot copy block file: %v", err)
+			return
+		}
+		if err = dbInsertBlock(blk.DbBlockchainBlock); err != nil {
+			err = fmt.Errorf("Cannot insert block: %v", err)
+		}
+	})
+	if err != nil {
+		blk.Close()
+		traceStage(traceID, traceStageCommit, start, err, "hash", blk.Hash, "height", strconv.Itoa(height))
+		return nil, err
+	}
+	traceStage(traceID, traceStageCommit, start, nil, "hash", blk.Hash, "height", strconv.Itoa(height))
+	if err = blockchainIndexDocuments(blk); err != nil {
+		log.Println("Cannot index the documents of block", blk.Hash, err)
+	}
+	if err = blockchainRegisterMissingChunks(blk); err != nil {
+		log.Println("Cannot read attachments of block", blk.Hash, err)
+	}
+	return blk, nil
+}
+
+// Copies a given file to the blockchain directory and names it as a block with the given
+// height. The hash selects the storage directory if the layout is by hash prefixes.
+func blockchainCopyFile(fn string, height int, hash string) error {
+	blockFilename := blockStorageFilename(blockStorageDir(height, hash), height)
+	if err := os.MkdirAll(filepath.Dir(blockFilename), 0755); err != nil {
 		return err
 	}
-	blockFilename := blockchainGetFilename(height)
 	in, err := os.Open(fn)
 	if err != nil {
 		return err
@@ -603,13 +1033,25 @@ func blockchainCopyFile(fn string, height int) error {
 			log.Printf("blockchainCopyFile in.Close: %v", err)
 		}
 	}()
-	out, err := os.Create(blockFilename)
+	// Write to a temporary file first so that a crash never leaves a partial block file
+	// under its final name.
+	tmpFilename := blockFilename + ".tmp"
+	out, err := os.Create(tmpFilename)
 	if err != nil {
 		return err
 	}
 	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
 	if err != nil {
+		out.Close()
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err = out.Close(); err != nil {
+		os.Remove(tmpFilename)
 		return err
 	}
-	return out.Close()
+	return renameFile(tmpFilename, blockFilename)
 }
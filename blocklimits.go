@@ -0,0 +1,225 @@
+package daisy
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// A chain can limit the size and the number of documents of its blocks with the
+// max_block_size and max_block_documents chain params. The size of a block is the size of
+// its block file plus the sizes of its documents. The limits are checked when blocks are
+// produced and when they are validated, and they are announced in the hello message, so
+// nodes with different limits, which would reject each other's blocks, refuse to connect.
+
+// The keys under which the limits are recorded in the genesis block's _meta table
+const (
+	blockLimitsMetaMaxSize      = "MaxBlockSize"
+	blockLimitsMetaMaxDocuments = "MaxBlockDocuments"
+)
+
+// The feature of announcing the block limits in the hello message
+const p2pFeatureBlockLimits = "block_limits"
+
+// Returns true if the chain limits its blocks
+func blockLimitsEnabled() bool {
+	return chainParams.MaxBlockSize > 0 || chainParams.MaxBlockDocuments > 0
+}
+
+// Records the chain's block limits in the genesis block, so they are covered by its hash
+func blockLimitsWriteGenesis(db *sql.DB, cp *ChainParams) error {
+	if cp.MaxBlockSize < 0 || cp.MaxBlockDocuments < 0 {
+		return fmt.Errorf("The block limits cannot be negative")
+	}
+	if cp.MaxBlockSize > 0 {
+		if err := dbSetMetaString(db, blockLimitsMetaMaxSize, strconv.FormatInt(cp.MaxBlockSize, 10)); err != nil {
+			return err
+		}
+	}
+	if cp.MaxBlockDocuments > 0 {
+		if err := dbSetMetaInt(db, blockLimitsMetaMaxDocuments, cp.MaxBlockDocuments); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks that the block limits in the chain params are the ones recorded in the genesis
+// block, if it has them. Chains whose genesis blocks don't record them only have the
+// limits of the chain params.
+func blockLimitsInit() error {
+	if chainParams.MaxBlockSize < 0 || chainParams.MaxBlockDocuments < 0 {
+		return fmt.Errorf("The block limits cannot be negative")
+	}
+	fileName := blockchainGetFilename(genesisBlockHeight)
+	if !fileExists(fileName) {
+		return nil
+	}
+	blk, err := OpenBlockFile(fileName)
+	if err != nil {
+		return err
+	}
+	defer blk.Close()
+	var maxSize int64
+	recorded := false
+	if value, err := blk.dbGetMetaString(blockLimitsMetaMaxSize); err == nil {
+		if maxSize, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("Invalid block size limit in the genesis block: %q", value)
+		}
+		recorded = true
+	}
+	maxDocuments, err := blk.dbGetMetaInt(blockLimitsMetaMaxDocuments)
+	if err == nil {
+		recorded = true
+	} else {
+		maxDocuments = 0
+	}
+	if recorded && (maxSize != chainParams.MaxBlockSize || maxDocuments != chainParams.MaxBlockDocuments) {
+		return fmt.Errorf("The block limits in the chain params (%d bytes, %d documents) are not the ones in the genesis block (%d bytes, %d documents)",
+			chainParams.MaxBlockSize, chainParams.MaxBlockDocuments, maxSize, maxDocuments)
+	}
+	return nil
+}
+
+// Checks the block against the chain's limits
+func blockLimitsCheckBlock(blk *Block) error {
+	if !blockLimitsEnabled() {
+		return nil
+	}
+	atts, err := blk.dbGetAttachments()
+	if err != nil {
+		return err
+	}
+	if chainParams.MaxBlockDocuments > 0 && len(atts) > chainParams.MaxBlockDocuments {
+		return fmt.Errorf("The block has %d documents, more than the maximum of %d", len(atts), chainParams.MaxBlockDocuments)
+	}
+	if chainParams.MaxBlockSize > 0 {
+		var pageCount, pageSize int64
+		if err = blk.db.QueryRow("PRAGMA page_count").Scan(&pageCount); err != nil {
+			return err
+		}
+		if err = blk.db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+			return err
+		}
+		size := pageCount * pageSize
+		for _, att := range atts {
+			size += att.size
+		}
+		if size > chainParams.MaxBlockSize {
+			return fmt.Errorf("The block's size of %d bytes is over the maximum of %d", size, chainParams.MaxBlockSize)
+		}
+	}
+	return nil
+}
+
+// Returns the total size of the files
+func blockLimitsFilesSize(fileNames []string) (int64, error) {
+	var size int64
+	for _, fileName := range fileNames {
+		fi, err := os.Stat(fileName)
+		if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+	return size, nil
+}
+
+// Returns the leading documents and bundles which fit into a block under the chain's
+// limits, not counting the size of the block file itself. Returns an error if not even
+// the first one fits.
+func blockLimitsFit(fileNames []string, bundles [][]string) ([]string, [][]string, error) {
+	if !blockLimitsEnabled() {
+		return fileNames, bundles, nil
+	}
+	var size int64
+	docs := 0
+	fits := func(names []string) (bool, error) {
+		s, err := blockLimitsFilesSize(names)
+		if err != nil {
+			return false, err
+		}
+		if (chainParams.MaxBlockSize > 0 && size+s > chainParams.MaxBlockSize) || (chainParams.MaxBlockDocuments > 0 && docs+len(names) > chainParams.MaxBlockDocuments) {
+			return false, nil
+		}
+		size += s
+		docs += len(names)
+		return true, nil
+	}
+	var fitFiles []string
+	for _, fileName := range fileNames {
+		ok, err := fits([]string{fileName})
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			break
+		}
+		fitFiles = append(fitFiles, fileName)
+	}
+	var fitBundles [][]string
+	if len(fitFiles) == len(fileNames) {
+		for _, bundle := range bundles {
+			ok, err := fits(bundle)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !ok {
+				break
+			}
+			fitBundles = append(fitBundles, bundle)
+		}
+	}
+	if len(fitFiles) == 0 && len(fitBundles) == 0 && (len(fileNames) > 0 || len(bundles) > 0) {
+		first := ""
+		if len(fileNames) > 0 {
+			first = fileNames[0]
+		} else {
+			first = bundles[0][0]
+		}
+		return nil, nil, fmt.Errorf("The document or bundle %s doesn't fit into a block under the chain's limits", first)
+	}
+	return fitFiles, fitBundles, nil
+}
+
+// Checks the documents and bundles to be sealed into a block against the chain's limits,
+// with the size of the unsigned block file they are in
+func blockLimitsCheckFiles(blockFileName string, fileNames []string, bundles [][]string) error {
+	if !blockLimitsEnabled() {
+		return nil
+	}
+	all := append([]string{blockFileName}, fileNames...)
+	docs := len(fileNames)
+	for _, bundle := range bundles {
+		all = append(all, bundle...)
+		docs += len(bundle)
+	}
+	if chainParams.MaxBlockDocuments > 0 && docs > chainParams.MaxBlockDocuments {
+		return fmt.Errorf("The block would have %d documents, more than the maximum of %d", docs, chainParams.MaxBlockDocuments)
+	}
+	size, err := blockLimitsFilesSize(all)
+	if err != nil {
+		return err
+	}
+	if chainParams.MaxBlockSize > 0 && size > chainParams.MaxBlockSize {
+		return fmt.Errorf("The block's size of %d bytes would be over the maximum of %d", size, chainParams.MaxBlockSize)
+	}
+	return nil
+}
+
+// Checks that the peer has the same block limits as this node. Peers not announcing
+// their limits are assumed to have the same.
+func (p2pc *p2pConnection) checkBlockLimits(msg StrIfMap) error {
+	if !inStrings(p2pFeatureBlockLimits, p2pc.features) {
+		return nil
+	}
+	// Absent limits are zero, i.e. none
+	maxSize, _ := msg.GetInt64("max_block_size")
+	maxDocuments, _ := msg.GetInt("max_block_documents")
+	if maxSize != chainParams.MaxBlockSize || maxDocuments != chainParams.MaxBlockDocuments {
+		return fmt.Errorf("Incompatible block limits: the peer allows %d bytes and %d documents, we allow %d bytes and %d documents (0 is no limit)",
+			maxSize, maxDocuments, chainParams.MaxBlockSize, chainParams.MaxBlockDocuments)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package daisy
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// A block whose file is found damaged, at startup or by the integrity sampler, is repaired
+// in place: its file is quarantined and the block is requested by its hash, with the
+// getblock message, from a peer whose chain includes it. The received file must have the
+// hash recorded in the blockchain index, so it replaces the damaged one without the
+// blocks above it being rolled back and fetched again. Until a peer delivers it, the
+// block is requested from another peer every minute. The blocks being repaired are listed
+// in /status.
+
+// How long a peer has to deliver a block being repaired before it's asked from another
+const blockRepairRetryInterval = time.Minute
+
+// A block being repaired
+type blockRepair struct {
+	height      int
+	requestTime time.Time
+	triedPeers  map[string]bool
+}
+
+// The blocks being repaired, by hash
+var blockRepairs = struct {
+	lock   WithMutex
+	blocks map[string]*blockRepair
+}{
+	blocks: map[string]*blockRepair{},
+}
+
+// Quarantines the damaged file of the block at the given height, and registers the block
+// to be fetched again from the peers. Returns an error if the block cannot be repaired,
+// e.g. if it's not in the blockchain index.
+func blockRepairStart(height int) error {
+	if height <= genesisBlockHeight {
+		return fmt.Errorf("The genesis block cannot be repaired from peers")
+	}
+	dbb, err := dbGetBlockByHeight(height)
+	if err != nil {
+		return fmt.Errorf("Cannot repair block %d: %v", height, err)
+	}
+	fileName := blockchainGetFilename(height)
+	if fileExists(fileName) {
+		// A copy cannot fix a block whose file is the one which was accepted
+		if hash, err := hashFileToHexString(fileName); err == nil && hash == dbb.Hash {
+			return fmt.Errorf("Cannot repair block %d: its file is intact", height)
+		}
+		if err = quarantineBlockFile(fileName, height); err != nil {
+			return err
+		}
+	}
+	blockRepairs.lock.With(func() {
+		blockRepairs.blocks[dbb.Hash] = &blockRepair{height: height, triedPeers: map[string]bool{}}
+	})
+	log.Println("Block", height, "will be repaired with a copy from the peers")
+	return nil
+}
+
+// Returns true if the block with the given hash is being repaired
+func blockRepairPending(hash string) bool {
+	pending := false
+	blockRepairs.lock.With(func() {
+		_, pending = blockRepairs.blocks[hash]
+	})
+	return pending
+}
+
+// Returns the heights of the blocks being repaired
+func blockRepairHeights() []int {
+	heights := []int{}
+	blockRepairs.lock.With(func() {
+		for _, r := range blockRepairs.blocks {
+			heights = append(heights, r.height)
+		}
+	})
+	sort.Ints(heights)
+	return heights
+}
+
+// Requests the blocks being repaired from the peers which haven't delivered them yet.
+// Called periodically by the coordinator.
+func blockRepairRequest() {
+	type request struct {
+		hash string
+		peer *p2pConnection
+	}
+	var requests []request
+	p2pPeers.lock.With(func() {
+		blockRepairs.lock.With(func() {
+			for hash, r := range blockRepairs.blocks {
+				if time.Since(r.requestTime) < blockRepairRetryInterval {
+					continue
+				}
+				var candidate *p2pConnection
+				for p2pc := range p2pPeers.peers {
+					if p2pc.chainHeight < r.height || !p2pc.helloReceived {
+						continue
+					}
+					if !r.triedPeers[p2pc.address] {
+						candidate = p2pc
+						break
+					}
+				}
+				if candidate == nil && len(r.triedPeers) > 0 {
+					// All the peers have been tried, start again
+					r.triedPeers = map[string]bool{}
+					continue
+				}
+				if candidate == nil {
+					continue
+				}
+				r.triedPeers[candidate.address] = true
+				r.requestTime = time.Now()
+				requests = append(requests, request{hash: hash, peer: candidate})
+			}
+		})
+	})
+	for _, req := range requests {
+		log.Println("Requesting block", req.hash, "from", req.peer.address, "to repair it")
+		req.peer.queueMsg(p2pMsgGetBlockStruct{
+			p2pMsgHeader: p2pMsgHeader{
+				P2pID: p2pEphemeralID,
+				Root:  chainParams.GenesisBlockHash,
+				Msg:   p2pMsgGetBlock,
+			},
+			Hash: req.hash,
+		})
+	}
+}
+
+// Replaces the damaged file of the block being repaired with the received one, which must
+// have the block's hash
+func blockRepairReplace(hash, fileName string) error {
+	var height int
+	blockRepairs.lock.With(func() {
+		if r, ok := blockRepairs.blocks[hash]; ok {
+			height = r.height
+		} else {
+			height = -1
+		}
+	})
+	if height == -1 {
+		return fmt.Errorf("Block %s is not being repaired", hash)
+	}
+	fileHash, err := hashFileToHexString(fileName)
+	if err != nil {
+		return err
+	}
+	if fileHash != hash {
+		return fmt.Errorf("The received copy of block %d has the hash %s instead of %s", height, fileHash, hash)
+	}
+	if current := blockchainGetFilename(height); fileExists(current) {
+		// Damaged again since the repair was started
+		if err = quarantineBlockFile(current, height); err != nil {
+			return err
+		}
+	}
+	if err = blockchainCopyFile(fileName, height, hash); err != nil {
+		return err
+	}
+	if err = blockchainVerifyBlock(height); err != nil {
+		os.Remove(blockchainGetFilename(height))
+		return err
+	}
+	blockRepairs.lock.With(func() {
+		delete(blockRepairs.blocks, hash)
+	})
+	if blk, err := OpenBlockByHeight(height); err == nil {
+		if err = blockchainRegisterMissingChunks(blk); err != nil {
+			log.Println("Cannot read attachments of block", hash, err)
+		}
+		blk.Close()
+	}
+	log.Println("Repaired block", height, "with a copy from the peers")
+	return nil
+}
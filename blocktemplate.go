@@ -0,0 +1,229 @@
+package daisy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The node can show the block it would produce right now from the pending documents (the
+// block template), and validate a candidate block with all the checks and the plugins a
+// block must pass to be accepted, but without adding it to the blockchain (a dry run).
+// Unsigned candidates, i.e. block files with only documents in them, are signed by the
+// node the way it signs the blocks it produces, so that they pass the signature checks,
+// but the signatures are never returned: the node would otherwise sign any block it's
+// given, skipping the documents' way through the pending queue. The template's hash differs from the one
+// of the block eventually sealed, since the blocks are timestamped, but the documents,
+// their manifest hash and the documents root are the same.
+
+// The largest candidate block accepted by /block-dry-run
+const blockDryRunMaxSize = 64 * 1024 * 1024
+
+// BlockDryRun is the result of validating a block without accepting it
+type BlockDryRun struct {
+	Block *ExportBlock `json:"block"`
+	Valid bool         `json:"valid"`
+	Error string       `json:"error,omitempty"`
+}
+
+// Describes the block, at the height set by the checks
+func blockchainDescribeBlock(blk *Block) (*ExportBlock, error) {
+	hdr := BlockHeader{
+		Height:                     blk.Height,
+		Hash:                       blk.Hash,
+		HashSignature:              hex.EncodeToString(blk.HashSignature),
+		PreviousBlockHash:          blk.PreviousBlockHash,
+		PreviousBlockHashSignature: hex.EncodeToString(blk.PreviousBlockHashSignature),
+		CreatorPublicKeyHash:       blk.SignaturePublicKeyHash,
+	}
+	hdr.HeaderHash = canonicalHeaderHash(&hdr)
+	if dbpk, err := dbGetPublicKey(blk.SignaturePublicKeyHash); err == nil {
+		hdr.CreatorPublicKey = hex.EncodeToString(dbpk.publicKeyBytes)
+	}
+	if ts, err := blk.dbGetMetaString("Timestamp"); err == nil {
+		hdr.Timestamp = ts
+	}
+	if root, err := blk.dbGetMetaString("DocumentsRoot"); err == nil {
+		hdr.DocumentsRoot = root
+		hdr.DocumentsRootSignature, _ = blk.dbGetMetaString("DocumentsRootSignature")
+	}
+	hdr.SealSignature, _ = blk.dbGetMetaString("SealSignature")
+	eb := ExportBlock{BlockHeader: hdr, Documents: []ExportDocument{}}
+	atts, err := blk.dbGetAttachments()
+	if err != nil {
+		return nil, err
+	}
+	bundles, err := blk.dbGetBundles()
+	if err != nil {
+		return nil, err
+	}
+	for _, att := range atts {
+		eb.Documents = append(eb.Documents, ExportDocument{Hash: att.hash, Name: att.name, Size: att.size, Bundle: bundles[strings.ToLower(att.hash)]})
+	}
+	eb.ManifestHash = canonicalManifestHash(eb.Documents)
+	return &eb, nil
+}
+
+// Validates the signed block in the given file as the next block of the blockchain,
+// without accepting it
+func blockchainDryRunBlockFile(fileName string, hashSignature []byte) (*BlockDryRun, error) {
+	blk, err := OpenBlockFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening block file: %v", err)
+	}
+	defer blk.Close()
+	blk.HashSignature = hashSignature
+	result := BlockDryRun{Valid: true}
+	height, err := blockchainCheckBlock(blk, false)
+	if err != nil {
+		result.Valid = false
+		result.Error = err.Error()
+	}
+	blk.Height = height
+	if result.Block, err = blockchainDescribeBlock(blk); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Signs a copy of the unsigned block in the given file as the node would sign it when
+// producing it, and validates it without accepting it. The signatures are removed from
+// the result.
+func blockchainDryRunUnsignedBlockFile(fileName string) (*BlockDryRun, error) {
+	f, err := ioutil.TempFile("", "daisy-dry-run")
+	if err != nil {
+		return nil, err
+	}
+	fn := f.Name()
+	defer os.Remove(fn)
+	in, err := os.Open(fileName)
+	if err == nil {
+		_, err = io.Copy(f, in)
+		in.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result *BlockDryRun
+	blockCreateLock.With(func() {
+		var dbb *DbBlockchainBlock
+		if dbb, err = blockchainSignBlock(fn); err != nil {
+			return
+		}
+		result, err = blockchainDryRunBlockFile(fn, dbb.HashSignature)
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Block.HashSignature = ""
+	result.Block.PreviousBlockHashSignature = ""
+	result.Block.DocumentsRootSignature = ""
+	result.Block.SealSignature = ""
+	return result, nil
+}
+
+// Returns the block which would be sealed from the pending documents, validated, or nil
+// if there are no pending documents
+func blockchainBlockTemplate() (*BlockDryRun, error) {
+	files, bundles, _, err := pendingGetFiles()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 && len(bundles) == 0 {
+		return nil, nil
+	}
+	fn, err := blockchainBuildBlockFile(files, bundles)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fn)
+	return blockchainDryRunUnsignedBlockFile(fn)
+}
+
+// Returns the block the node would produce from the pending documents right now
+func blockWebSendBlockTemplate(w http.ResponseWriter, r *http.Request) {
+	if cfg.readOnly || cfg.relay {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	result, err := blockchainBlockTemplate()
+	if err != nil {
+		log.Println("Cannot make the block template for", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(jsonifyWhateverToBytes(result)); err != nil {
+		log.Println(err)
+	}
+}
+
+// Validates the candidate block file in the request body without accepting it. The block
+// is signed if the hash_signature parameter is given, and unsigned otherwise.
+func blockWebDryRunBlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var hashSignature []byte
+	var err error
+	if sig := r.FormValue("hash_signature"); sig != "" {
+		if hashSignature, err = hex.DecodeString(sig); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	} else if cfg.readOnly || cfg.relay {
+		// Unsigned blocks are signed with the node's keys
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	f, err := ioutil.TempFile("", "daisy-candidate")
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	fn := f.Name()
+	defer os.Remove(fn)
+	_, err = io.Copy(f, http.MaxBytesReader(w, r.Body, blockDryRunMaxSize))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Println("Cannot receive the candidate block from", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var result *BlockDryRun
+	if hashSignature != nil {
+		result, err = blockchainDryRunBlockFile(fn, hashSignature)
+	} else {
+		result, err = blockchainDryRunUnsignedBlockFile(fn)
+	}
+	if err != nil {
+		// The file isn't a block at all
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write(jsonifyWhateverToBytes(BlockDryRun{Error: err.Error()}))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(jsonifyWhateverToBytes(result)); err != nil {
+		log.Println(err)
+	}
+}
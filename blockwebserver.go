@@ -1,11 +1,16 @@
-package main
+package daisy
 
 import (
+	"crypto/tls"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -34,6 +39,16 @@ func blockWebSendBlock(w http.ResponseWriter, r *http.Request) {
 	// log.Println("Done serving block", blockHeight)
 }
 
+func blockWebSendChunk(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	if !chunkExists(hash) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, chunkGetFilename(hash))
+}
+
 func blockWebSendChainParams(w http.ResponseWriter, r *http.Request) {
 	log.Println("HTTP serving chainparams.json to", r.RemoteAddr)
 
@@ -45,16 +60,320 @@ func blockWebSendChainParams(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Runs a SQL query over all the blocks and streams the results as newline-separated JSON objects
+func blockWebQuery(w http.ResponseWriter, r *http.Request) {
+	q := r.FormValue("q")
+	if _, err := queryCheck(q); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Println("HTTP running query", strconv.Quote(q), "for", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	errCount, err := blockchainQuery(q, func(height int, row map[string]interface{}) error {
+		if _, err := w.Write(jsonifyWhateverToBytes(row)); err != nil {
+			return err
+		}
+		_, err := w.Write([]byte("\n"))
+		return err
+	})
+	if err == errQueryNotReadOnly {
+		// Found when the statement is prepared, before any rows are sent
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println("Error running query for", r.RemoteAddr, err)
+		return
+	}
+	if errCount != 0 {
+		log.Println("Query for", r.RemoteAddr, "failed in", errCount, "blocks")
+	}
+}
+
+// Long-polling for new blocks: waits until there are blocks above the "after" height (or the
+// timeout in seconds expires) and returns their notification payloads as a JSON array.
+func blockWebWait(w http.ResponseWriter, r *http.Request) {
+	after, err := strconv.Atoi(r.FormValue("after"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	timeout := 30
+	if r.FormValue("timeout") != "" {
+		if timeout, err = strconv.Atoi(r.FormValue("timeout")); err != nil || timeout < 0 || timeout > 300 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	height := blockEventsWaitHeight(after, time.Duration(timeout)*time.Second, r.Context().Done())
+	events := []*BlockEvent{}
+	for h := after + 1; h <= height && h <= after+longPollMaxBlocks; h++ {
+		if h < 0 {
+			continue
+		}
+		evt, err := blockchainGetBlockEvent(h)
+		if err != nil {
+			log.Println("Cannot read block", h, "for", r.RemoteAddr, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		events = append(events, evt)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonifyWhateverToBytes(events))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Returns the headers of blocks in the range given by the "from" and "to" heights, for light
+// clients, paginated like the other listings
+func blockWebSendHeaders(w http.ResponseWriter, r *http.Request) {
+	lp, err := parseListParams(r, p2pMaxHeadersPerMsg, p2pMaxHeadersPerMsg, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	blocks, next, err := listBlocks(lp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	headers := []BlockHeader{}
+	for _, dbb := range blocks {
+		hdr, err := blockchainGetAnyHeader(dbb.Height)
+		if err != nil {
+			log.Println("Error getting headers for", r.RemoteAddr, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		headers = append(headers, *hdr)
+	}
+	if next != "" {
+		listSetNextCursor(w, next)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonifyWhateverToBytes(headers))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Returns the Merkle proof of a document, as a receipt without confirmations, for light clients
+func blockWebSendProof(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	if !isValidChunkHash(hash) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	receipt, err := blockchainMakeReceipt(hash, 0)
+	if err != nil {
+		log.Println("Cannot make proof for", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonifyWhateverToBytes(receipt))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func blockWebSendStatus(w http.ResponseWriter, r *http.Request) {
+	diskState, diskFree := getDiskSpaceStatus()
+	status := map[string]interface{}{
+		"version":         p2pClientVersionString,
+		"chain_height":    dbGetBlockchainHeight(),
+		"read_only":       cfg.readOnly,
+		"disk_state":      diskState,
+		"disk_free_bytes": diskFree,
+	}
+	if reason, _ := stallStatus(); reason != "" {
+		status["stall"] = reason
+	}
+	if maintenanceHours != nil {
+		status["maintenance"] = maintenanceStatus()
+	}
+	if cfg.profile != DefaultProfile {
+		status["profile"] = cfg.profile
+	}
+	if len(anchorGetPublishers()) > 0 {
+		status["anchors"] = anchorStatus()
+	}
+	if len(replicators) > 0 {
+		status["replication"] = replicationStatus()
+	}
+	if tc := tipCheckStatus(); tc != nil {
+		status["tip_check"] = tc
+	}
+	if failoverEnabled() {
+		status["failover"] = failoverStatus()
+	}
+	if repairs := blockRepairHeights(); len(repairs) > 0 {
+		status["repairing_blocks"] = repairs
+	}
+	if role, _ := httpRequestRole(r); role >= httpRoleAdmin {
+		// The remaining times of the bans, in seconds, which reveal peer addresses
+		status["banned_peers"] = ttlsToSeconds(p2pCoordinator.badPeers.TTLs())
+		status["rotated_peers"] = ttlsToSeconds(p2pCoordinator.rotatedPeers.TTLs())
+		status["panic_banned_peers"] = ttlsToSeconds(p2pPanics.bans.TTLs())
+		if governanceEnabled() {
+			status["governance"] = governanceStatus()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err := w.Write(jsonifyWhateverToBytes(status))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Converts the remaining times of a StringSetWithExpiry to whole seconds, rounded up
+func ttlsToSeconds(ttls map[string]time.Duration) map[string]int64 {
+	result := map[string]int64{}
+	for s, ttl := range ttls {
+		result[s] = int64((ttl + time.Second - 1) / time.Second)
+	}
+	return result
+}
+
+// Lists the connected peers by the time they connected, filtered by their chain heights
+// and connection times
+func blockWebSendPeers(w http.ResponseWriter, r *http.Request) {
+	lp, err := parseListParams(r, listDefaultLimit, listMaxLimit, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The cursor is the connection time in nanoseconds and the address of the last peer
+	var afterTime int64
+	var afterAddress string
+	if lp.cursor != "" {
+		i := strings.Index(lp.cursor, "/")
+		if i < 0 {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		if afterTime, err = strconv.ParseInt(lp.cursor[:i], 10, 64); err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		afterAddress = lp.cursor[i+1:]
+	}
+	type listedPeer struct {
+		connected time.Time
+		p2pc      *p2pConnection
+	}
+	var listed []listedPeer
+	p2pPeers.lock.With(func() {
+		for p2pc, connected := range p2pPeers.peers {
+			if (lp.from >= 0 && p2pc.chainHeight < lp.from) || (lp.to >= 0 && p2pc.chainHeight > lp.to) || !lp.timeMatches(connected) {
+				continue
+			}
+			listed = append(listed, listedPeer{connected: connected, p2pc: p2pc})
+		}
+	})
+	before := func(a, b listedPeer) bool {
+		if !a.connected.Equal(b.connected) {
+			return a.connected.Before(b.connected)
+		}
+		return a.p2pc.address < b.p2pc.address
+	}
+	sort.Slice(listed, func(i, j int) bool {
+		if lp.desc {
+			return before(listed[j], listed[i])
+		}
+		return before(listed[i], listed[j])
+	})
+	if lp.cursor != "" {
+		cursor := listedPeer{connected: time.Unix(0, afterTime), p2pc: &p2pConnection{address: afterAddress}}
+		i := sort.Search(len(listed), func(i int) bool {
+			if lp.desc {
+				return before(listed[i], cursor)
+			}
+			return before(cursor, listed[i])
+		})
+		listed = listed[i:]
+	}
+	if len(listed) > lp.limit {
+		listed = listed[:lp.limit]
+		last := listed[len(listed)-1]
+		listSetNextCursor(w, fmt.Sprintf("%d/%s", last.connected.UnixNano(), last.p2pc.address))
+	}
+	peers := []map[string]interface{}{}
+	for _, lpeer := range listed {
+		p2pc := lpeer.p2pc
+		peers = append(peers, map[string]interface{}{
+			"address":      p2pc.address,
+			"chain_height": p2pc.chainHeight,
+			"relay":        p2pc.isRelay,
+			"features":     p2pc.features,
+			"user_agent":   p2pc.userAgent,
+			"node_key":     p2pc.nodeKey,
+			"outbound":     p2pc.outbound,
+			"connected_at": lpeer.connected.UTC().Format(time.RFC3339),
+			"sync":         p2pc.syncStatsMap(),
+			"tags":         p2pc.tags(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonifyWhateverToBytes(peers))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 func blockWebServer() {
 	r := mux.NewRouter()
 	r.HandleFunc("/block/{height}", blockWebSendBlock)
+	r.HandleFunc("/chunk/{hash}", blockWebSendChunk)
 	r.HandleFunc("/chainparams.json", blockWebSendChainParams)
+	r.HandleFunc("/headers", httpLimit(blockWebSendHeaders))
+	r.HandleFunc("/blocks", httpRequireRole(httpRoleReadOnly, httpLimit(blockWebListBlocks)))
+	r.HandleFunc("/documents", httpRequireRole(httpRoleReadOnly, httpLimit(blockWebListDocuments)))
+	r.HandleFunc("/proof/{hash}", httpLimit(blockWebSendProof))
+	r.HandleFunc("/status", httpRequireRole(httpRoleReadOnly, blockWebSendStatus))
+	if cfg.HTTPQueryRole != httpQueryRoleOff {
+		r.HandleFunc("/query", httpRequireRole(httpRoleNames[cfg.HTTPQueryRole], httpLimit(blockWebQuery)))
+	}
+	r.HandleFunc("/wait", httpRequireRole(httpRoleReadOnly, httpLimit(blockWebWait)))
+	r.HandleFunc("/peers", httpRequireRole(httpRoleAdmin, blockWebSendPeers))
+	r.HandleFunc("/peer-tags", httpRequireRole(httpRoleAdmin, blockWebPeerTags))
+	r.HandleFunc("/governance", httpRequireRole(httpRoleAdmin, blockWebGovernance))
+	r.HandleFunc("/tip-check", httpRequireRole(httpRoleAdmin, blockWebTipCheck))
+	r.HandleFunc("/block-template", httpRequireRole(httpRoleSubmitter, blockWebSendBlockTemplate))
+	r.HandleFunc("/block-dry-run", httpRequireRole(httpRoleSubmitter, blockWebDryRunBlock))
+	metricsInit()
+	r.HandleFunc("/debug/vars", httpRequireRole(httpRoleAdmin, expvar.Handler().ServeHTTP))
 
 	serverAddress := fmt.Sprintf(":%d", cfg.httpPort)
+	tlsConfig, err := httpTLSConfig()
+	if err != nil {
+		log.Fatalln("Cannot configure HTTP TLS:", err)
+	}
+	server := http.Server{Addr: serverAddress, Handler: r, TLSConfig: tlsConfig}
+	if tlsConfig != nil && p2pTLSEnabled() {
+		// Connections negotiating the p2p protocol are passed to the p2p server. This
+		// disables HTTP/2, which is only enabled automatically without TLSNextProto.
+		tlsConfig.NextProtos = []string{quicALPN, "http/1.1"}
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){quicALPN: p2pServeTLS}
+	}
+	nodeServers.lock.With(func() {
+		nodeServers.httpServer = &server
+	})
 
-	log.Println("HTTP listening on", serverAddress)
-	err := http.ListenAndServe(serverAddress, r)
+	l, err := handoverListen("http", serverAddress, tcpTransport{}.Listen)
 	if err != nil {
+		log.Fatalln("Cannot listen on", serverAddress, err)
+	}
+	if tlsConfig != nil {
+		log.Println("HTTPS listening on", serverAddress)
+		err = server.ServeTLS(l, "", "")
+	} else {
+		log.Println("HTTP listening on", serverAddress)
+		err = server.Serve(l)
+	}
+	if err != nil && err != http.ErrServerClosed {
 		panic(err)
 	}
 }
@@ -0,0 +1,165 @@
+package daisy
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A bundle is a group of attachments which belong together, e.g. a document with its
+// metadata and signatures. A bundle is recorded in the _bundles table of the block which
+// contains its attachments, and a block is only accepted if all the members of each of its
+// bundles are in it, so a bundle can never be split between blocks (or forks). The bundle
+// ID is the hash of the canonical encoding of its sorted member hashes, which are compared
+// in lower case, like the table name:
+//
+//	"DAISYBDL" 0x01 count { hash } * count
+
+const canonicalBundleMagic = "DAISYBDL"
+
+const bundlesTableCreate = `
+CREATE TABLE _bundles (
+    bundle_id       VARCHAR NOT NULL,
+    attachment_hash VARCHAR NOT NULL UNIQUE,
+    member_count    INTEGER NOT NULL,
+    PRIMARY KEY (bundle_id, attachment_hash)
+);
+`
+
+// Returns the ID of the bundle with the given member hashes
+func bundleID(hashes []string) string {
+	sorted := make([]string, len(hashes))
+	for i, h := range hashes {
+		sorted[i] = strings.ToLower(h)
+	}
+	sort.Strings(sorted)
+	var w canonicalWriter
+	w.WriteString(canonicalBundleMagic)
+	w.WriteByte(CanonicalVersion)
+	w.writeUint(uint64(len(sorted)))
+	for _, h := range sorted {
+		w.writeString(h)
+	}
+	return hashBytesToHexString(w.Bytes())
+}
+
+// Records the attachments with the given hashes as a bundle in the given block file.
+// Returns the bundle ID.
+func dbInsertBundle(db *sql.DB, hashes []string) (string, error) {
+	if len(hashes) < 2 {
+		return "", fmt.Errorf("A bundle needs at least two documents")
+	}
+	if !dbTableExists(db, "_bundles") {
+		if _, err := db.Exec(bundlesTableCreate); err != nil {
+			return "", err
+		}
+	}
+	id := bundleID(hashes)
+	for _, h := range hashes {
+		if _, err := db.Exec("INSERT INTO _bundles(bundle_id, attachment_hash, member_count) VALUES (?, ?, ?)", id, h, len(hashes)); err != nil {
+			return "", fmt.Errorf("Cannot add %s to the bundle: %v", h, err)
+		}
+	}
+	return id, nil
+}
+
+// Attaches the files to the given block file and records them as a bundle
+func dbAttachBundle(db *sql.DB, fileNames []string) error {
+	dbEnsureAttachmentTables(db)
+	var hashes []string
+	for _, fileName := range fileNames {
+		att, err := attachmentChunkFile(fileName)
+		if err == nil {
+			err = dbInsertAttachment(db, att)
+		}
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, att.hash)
+	}
+	_, err := dbInsertBundle(db, hashes)
+	return err
+}
+
+// Returns the bundle IDs of the block's attachments which are in bundles, keyed by the lower-case hashes
+func (b *Block) dbGetBundles() (map[string]string, error) {
+	result := map[string]string{}
+	if !dbTableExists(b.db, "_bundles") {
+		return result, nil
+	}
+	rows, err := b.db.Query("SELECT bundle_id, attachment_hash FROM _bundles")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, hash string
+		if err = rows.Scan(&id, &hash); err != nil {
+			return nil, err
+		}
+		result[strings.ToLower(hash)] = id
+	}
+	return result, rows.Err()
+}
+
+// Checks that all the members of every bundle in the block are attachments of the block,
+// and that the bundle IDs match their members
+func (b *Block) dbCheckBundles() error {
+	if !dbTableExists(b.db, "_bundles") {
+		return nil
+	}
+	atts, err := b.dbGetAttachments()
+	if err != nil {
+		return err
+	}
+	attHashes := map[string]bool{}
+	for _, att := range atts {
+		attHashes[strings.ToLower(att.hash)] = true
+	}
+	rows, err := b.db.Query("SELECT bundle_id, attachment_hash, member_count FROM _bundles ORDER BY bundle_id")
+	if err != nil {
+		return err
+	}
+	members := map[string][]string{}
+	counts := map[string]int{}
+	seen := map[string]bool{}
+	for rows.Next() {
+		var id, hash string
+		var count int
+		if err = rows.Scan(&id, &hash, &count); err != nil {
+			rows.Close()
+			return err
+		}
+		hash = strings.ToLower(hash)
+		if !attHashes[hash] {
+			rows.Close()
+			return fmt.Errorf("Bundle %s contains %s, which is not in the block", id, hash)
+		}
+		if seen[hash] {
+			rows.Close()
+			return fmt.Errorf("Document %s is in more than one bundle", hash)
+		}
+		seen[hash] = true
+		if c, ok := counts[id]; ok && c != count {
+			rows.Close()
+			return fmt.Errorf("Bundle %s has inconsistent member counts", id)
+		}
+		counts[id] = count
+		members[id] = append(members[id], hash)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	for id, hashes := range members {
+		if len(hashes) != counts[id] {
+			return fmt.Errorf("Bundle %s is incomplete: the block has %d of its %d documents", id, len(hashes), counts[id])
+		}
+		if bundleID(hashes) != id {
+			return fmt.Errorf("Bundle %s doesn't match its documents", id)
+		}
+	}
+	return nil
+}
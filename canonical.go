@@ -0,0 +1,135 @@
+package daisy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// The canonical serialization gives block headers and payload manifests (the lists of a
+// block's documents) a byte encoding which doesn't depend on JSON field order, whitespace
+// or letter case, so any implementation computes the same header and manifest hashes.
+// It is versioned: a future version gets a new magic string and never changes the old one.
+//
+// Version 1 of the encoding is a sequence of fields, starting with an 8-byte magic string
+// and the version byte. Integers are unsigned 64-bit big-endian, and strings are a 32-bit
+// big-endian length followed by the UTF-8 bytes. Hashes are lowercase hex strings.
+//
+//	header:   "DAISYHDR" 0x01 height hash previous_block_hash creator_public_key_hash
+//	manifest: "DAISYMAN" 0x01 count { hash name size } * count
+//	seal:     "DAISYSEL" 0x01 chain_root height previous_block_hash timestamp documents_root
+//
+// The documents in a manifest are in the same order as the leaves of the documents root.
+// The header doesn't contain the timestamp, the documents root or the signatures: the
+// first two are in the block's metadata, bound to the header by the seal which the
+// block's creator signs, and the signatures don't identify a block.
+// The hashes of the encodings are made with the chain's hash algorithm.
+
+// CanonicalVersion is the version of the canonical serialization
+const CanonicalVersion = 1
+
+const (
+	canonicalHeaderMagic   = "DAISYHDR"
+	canonicalManifestMagic = "DAISYMAN"
+	canonicalSealMagic     = "DAISYSEL"
+)
+
+// The golden vectors which every implementation of version 1 must reproduce
+var canonicalGoldenHeader = BlockHeader{
+	Height:               1,
+	Hash:                 "9A3B6D8D3A0BB66E9CDE25A99B2C7F1D32D4F5E7B0C4A9E1F2D3C4B5A6978877",
+	PreviousBlockHash:    "ba3b6d8d3a0bb66e9cde25a99b2c7f1d32d4f5e7b0c4a9e1f2d3c4b5a6978866",
+	CreatorPublicKeyHash: "1:8a3f1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8",
+}
+
+var canonicalGoldenManifest = []ExportDocument{
+	{Hash: "2CF24DBA5FB0A30E26E83B2AC5B9E29E1B161E5C1FA7425E73043362938B9824", Name: "hello.txt", Size: 5},
+	{Hash: "486ea46224d1bb4fb680f34f7c9ad96a8f24ec88be73ea8e5a6c65260e9cb8a7", Name: "world.txt", Size: 5},
+}
+
+const (
+	canonicalGoldenHeaderHash   = "ef8c55597f57fdbd3076ab33d14e0369395a7385468478131ca9234d8c7880b0"
+	canonicalGoldenManifestHash = "caca5eace9050c1e202f970c0ce1894e2f458d210206fb4c0adcbe2c2950a94c"
+)
+
+type canonicalWriter struct {
+	bytes.Buffer
+}
+
+func (w *canonicalWriter) writeUint(v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	w.Write(buf[:])
+}
+
+func (w *canonicalWriter) writeString(s string) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(len(s)))
+	w.Write(buf[:])
+	w.WriteString(s)
+}
+
+// Returns the canonical encoding of the block header
+func canonicalHeaderBytes(hdr *BlockHeader) []byte {
+	var w canonicalWriter
+	w.WriteString(canonicalHeaderMagic)
+	w.WriteByte(CanonicalVersion)
+	w.writeUint(uint64(hdr.Height))
+	w.writeString(strings.ToLower(hdr.Hash))
+	w.writeString(strings.ToLower(hdr.PreviousBlockHash))
+	w.writeString(strings.ToLower(hdr.CreatorPublicKeyHash))
+	return w.Bytes()
+}
+
+// Returns the canonical encoding of the block's payload manifest
+func canonicalManifestBytes(docs []ExportDocument) []byte {
+	var w canonicalWriter
+	w.WriteString(canonicalManifestMagic)
+	w.WriteByte(CanonicalVersion)
+	w.writeUint(uint64(len(docs)))
+	for _, doc := range docs {
+		w.writeString(strings.ToLower(doc.Hash))
+		w.writeString(doc.Name)
+		w.writeUint(uint64(doc.Size))
+	}
+	return w.Bytes()
+}
+
+// Returns the canonical encoding of the block's seal, which the block's creator signs to
+// bind the timestamp and the documents root to the block. The documents root is empty in
+// blocks without documents.
+func canonicalSealBytes(chainRoot string, hdr *BlockHeader) []byte {
+	var w canonicalWriter
+	w.WriteString(canonicalSealMagic)
+	w.WriteByte(CanonicalVersion)
+	w.writeString(strings.ToLower(chainRoot))
+	w.writeUint(uint64(hdr.Height))
+	w.writeString(strings.ToLower(hdr.PreviousBlockHash))
+	w.writeString(hdr.Timestamp)
+	w.writeString(strings.ToLower(hdr.DocumentsRoot))
+	return w.Bytes()
+}
+
+// Returns the hex-encoded hash of the canonical encoding of the block header
+func canonicalHeaderHash(hdr *BlockHeader) string {
+	return hashBytesToHexString(canonicalHeaderBytes(hdr))
+}
+
+// Returns the hex-encoded hash of the canonical encoding of the payload manifest
+func canonicalManifestHash(docs []ExportDocument) string {
+	return hashBytesToHexString(canonicalManifestBytes(docs))
+}
+
+// Checks that this build reproduces the golden vectors, so a change to the encoding which
+// would make this node disagree with the others is caught at startup
+func canonicalSelfCheck() error {
+	// The golden hashes are SHA256, whichever the chain's hash algorithm is
+	if h := hashSHA256.hashBytes(canonicalHeaderBytes(&canonicalGoldenHeader)); h != canonicalGoldenHeaderHash {
+		return fmt.Errorf("Canonical header hash self-check failed: got %s, expected %s", h, canonicalGoldenHeaderHash)
+	}
+	if h := hashSHA256.hashBytes(canonicalManifestBytes(canonicalGoldenManifest)); h != canonicalGoldenManifestHash {
+		return fmt.Errorf("Canonical manifest hash self-check failed: got %s, expected %s", h, canonicalGoldenManifestHash)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package daisy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// The seal of the golden header's successor, in a chain whose genesis hash is given in
+// mixed case
+var canonicalGoldenSeal = BlockHeader{
+	Height:            1,
+	PreviousBlockHash: "ba3b6d8d3a0bb66e9cde25a99b2c7f1d32d4f5e7b0c4a9e1f2d3c4b5a6978866",
+	Timestamp:         "2026-01-02T03:04:05Z",
+	DocumentsRoot:     "2CF24DBA5FB0A30E26E83B2AC5B9E29E1B161E5C1FA7425E73043362938B9824",
+}
+
+const (
+	canonicalGoldenSealChainRoot = "ABCDEF0123456789abcdef0123456789abcdef0123456789abcdef0123456789"
+	canonicalGoldenSealHash      = "c65af598152e6b8aa5ba533ddb253e5f2d7faad410393be0d9ce4373d379d99b"
+)
+
+func TestCanonicalSelfCheck(t *testing.T) {
+	if err := canonicalSelfCheck(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCanonicalGoldenVectors(t *testing.T) {
+	if h := hashSHA256.hashBytes(canonicalHeaderBytes(&canonicalGoldenHeader)); h != canonicalGoldenHeaderHash {
+		t.Errorf("header hash: got %s, expected %s", h, canonicalGoldenHeaderHash)
+	}
+	if h := hashSHA256.hashBytes(canonicalManifestBytes(canonicalGoldenManifest)); h != canonicalGoldenManifestHash {
+		t.Errorf("manifest hash: got %s, expected %s", h, canonicalGoldenManifestHash)
+	}
+	if h := hashSHA256.hashBytes(canonicalSealBytes(canonicalGoldenSealChainRoot, &canonicalGoldenSeal)); h != canonicalGoldenSealHash {
+		t.Errorf("seal hash: got %s, expected %s", h, canonicalGoldenSealHash)
+	}
+}
+
+func TestCanonicalManifestLayout(t *testing.T) {
+	got := canonicalManifestBytes([]ExportDocument{{Hash: "AB", Name: "x", Size: 5}})
+	expected, _ := hex.DecodeString("44414953594d414e01" + // "DAISYMAN", version 1
+		"0000000000000001" + // the count
+		"00000002" + "6162" + // the hash, in lower case
+		"00000001" + "78" + // the name
+		"0000000000000005") // the size
+	if !bytes.Equal(got, expected) {
+		t.Errorf("got %x, expected %x", got, expected)
+	}
+}
+
+func TestCanonicalCaseInsensitive(t *testing.T) {
+	lower := canonicalGoldenHeader
+	lower.Hash = strings.ToLower(lower.Hash)
+	upper := canonicalGoldenHeader
+	upper.PreviousBlockHash = strings.ToUpper(upper.PreviousBlockHash)
+	if !bytes.Equal(canonicalHeaderBytes(&lower), canonicalHeaderBytes(&upper)) {
+		t.Error("the header encoding depends on the case of the hashes")
+	}
+	seal := canonicalGoldenSeal
+	seal.DocumentsRoot = strings.ToLower(seal.DocumentsRoot)
+	if !bytes.Equal(canonicalSealBytes(strings.ToLower(canonicalGoldenSealChainRoot), &seal), canonicalSealBytes(canonicalGoldenSealChainRoot, &canonicalGoldenSeal)) {
+		t.Error("the seal encoding depends on the case of the hashes")
+	}
+}
+
+func TestCanonicalFieldsAreDelimited(t *testing.T) {
+	// Moving bytes from one string to the next mustn't give the same encoding
+	a := []ExportDocument{{Hash: "ab", Name: "cd", Size: 1}}
+	b := []ExportDocument{{Hash: "abc", Name: "d", Size: 1}}
+	if bytes.Equal(canonicalManifestBytes(a), canonicalManifestBytes(b)) {
+		t.Error("the manifest fields aren't delimited")
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package daisy
 
 const (
 	ChainConsensusPoA = 0
@@ -7,7 +7,7 @@ const (
 
 // ChainParams holds blockchain configuration
 type ChainParams struct {
-	// GenesisBlockHash is the SHA256 hash of the genesis block payload
+	// GenesisBlockHash is the hash of the genesis block payload
 	GenesisBlockHash string `json:"genesis_block_hash"`
 
 	// GenesisBlockHashSignature is the signature of the genesis block's hash, with the key in the genesis block
@@ -28,4 +28,18 @@ type ChainParams struct {
 
 	// Description of the blockchain (e.g. its purpose)
 	Description string `json:"description"`
+
+	// The maximum size of a block, its block file plus its documents, in bytes (0 for no limit)
+	MaxBlockSize int64 `json:"max_block_size,omitempty"`
+
+	// The maximum number of documents in a block (0 for no limit)
+	MaxBlockDocuments int `json:"max_block_documents,omitempty"`
+
+	// The hash algorithm of the blocks and documents: "sha256" (if empty) or "sha3-256", or
+	// one added with RegisterHashAlgorithm
+	HashAlgorithm string `json:"hash_algorithm,omitempty"`
+
+	// The number of signatures the key ops need at every height, instead of the number
+	// growing with the height (0 for that)
+	KeyOpQuorum int `json:"key_op_quorum,omitempty"`
 }
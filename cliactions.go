@@ -1,4 +1,4 @@
-package main
+package daisy
 
 import (
 	"encoding/hex"
@@ -9,7 +9,6 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"reflect"
 	"strings"
 	"time"
 )
@@ -23,6 +22,9 @@ func processActions() bool {
 		return false
 	}
 	cmd := flag.Arg(0)
+	if cfg.relay && cmd != "help" && cmd != "mykeys" {
+		log.Fatalln("The", cmd, "command needs the full blockchain and cannot be used in relay mode")
+	}
 	switch cmd {
 	case "help":
 		actionHelp()
@@ -33,12 +35,89 @@ func processActions() bool {
 	case "query":
 		actionQuery(flag.Arg(1))
 		return true
+	case "verify-anchors":
+		actionVerifyAnchors()
+		return true
 	case "signimportblock":
+		if cfg.readOnly {
+			log.Fatalln("Cannot import blocks in read-only mode")
+		}
 		if flag.NArg() < 2 {
 			log.Fatalln("Not enough arguments: expecting <sqlite db filename>")
 		}
 		actionSignImportBlock(flag.Arg(1))
 		return true
+	case "attach":
+		if cfg.readOnly {
+			log.Fatalln("Cannot add attachments in read-only mode")
+		}
+		if flag.NArg() < 3 {
+			log.Fatalln("Not enough arguments: expecting <sqlite db filename> <file>...")
+		}
+		actionAttach(flag.Arg(1), flag.Args()[2:])
+		return true
+	case "bundle":
+		if cfg.readOnly {
+			log.Fatalln("Cannot add attachments in read-only mode")
+		}
+		if flag.NArg() < 4 {
+			log.Fatalln("Not enough arguments: expecting <sqlite db filename> <file> <file>...")
+		}
+		actionBundle(flag.Arg(1), flag.Args()[2:])
+		return true
+	case "encryptattach":
+		if cfg.readOnly {
+			log.Fatalln("Cannot add attachments in read-only mode")
+		}
+		if flag.NArg() < 3 {
+			log.Fatalln("Not enough arguments: expecting <sqlite db filename> <file> [recipient public key hash]...")
+		}
+		actionEncryptAttach(flag.Arg(1), flag.Arg(2), flag.Args()[3:])
+		return true
+	case "decryptattachment":
+		if flag.NArg() < 3 {
+			log.Fatalln("Not enough arguments: expecting <attachment hash> <output filename>")
+		}
+		if err := decryptAttachment(flag.Arg(1), flag.Arg(2)); err != nil {
+			log.Fatalln(err)
+		}
+		return true
+	case "getattachment":
+		if flag.NArg() < 3 {
+			log.Fatalln("Not enough arguments: expecting <attachment hash> <output filename>")
+		}
+		actionGetAttachment(flag.Arg(1), flag.Arg(2))
+		return true
+	case "receipt":
+		if flag.NArg() < 3 {
+			log.Fatalln("Not enough arguments: expecting <document hash> <output filename>")
+		}
+		actionReceipt(flag.Arg(1), flag.Arg(2))
+		return true
+	case "export":
+		actionExport(flag.Args()[1:])
+		return true
+	case "stats":
+		actionStats(flag.Args()[1:])
+		return true
+	case "compare":
+		actionCompare(flag.Args()[1:])
+		return true
+	case "movestorage":
+		if cfg.readOnly {
+			log.Fatalln("The movestorage command cannot be used in read-only mode")
+		}
+		actionMoveStorage()
+		return true
+	case "governance":
+		actionGovernance(flag.Args()[1:])
+		return true
+	case "maintenance":
+		if cfg.readOnly {
+			log.Fatalln("The maintenance command cannot be used in read-only mode")
+		}
+		actionMaintenance()
+		return true
 	}
 	return false
 }
@@ -50,6 +129,12 @@ func processPreBlockchainActions() bool {
 		return false
 	}
 	cmd := flag.Arg(0)
+	if cfg.readOnly && (cmd == "newchain" || cmd == "pull" || cmd == "import") {
+		log.Fatalln("The", cmd, "command cannot be used in read-only mode")
+	}
+	if cfg.relay && (cmd == "pull" || cmd == "import" || cmd == "backup") {
+		log.Fatalln("The", cmd, "command cannot be used in relay mode")
+	}
 	switch cmd {
 	case "newchain":
 		if flag.NArg() < 2 {
@@ -63,6 +148,33 @@ func processPreBlockchainActions() bool {
 		}
 		actionPull(flag.Arg(1))
 		return true
+	case "import":
+		if flag.NArg() < 2 {
+			log.Fatalln("Not enough arguments: expecting export filename")
+		}
+		actionImport(flag.Arg(1))
+		return true
+	case "verify-receipt":
+		if flag.NArg() < 2 {
+			log.Fatalln("Not enough arguments: expecting receipt filename")
+		}
+		actionVerifyReceipt(flag.Arg(1))
+		return true
+	case "service":
+		actionService(flag.Args()[1:])
+		return true
+	case "devnet":
+		actionDevnet(flag.Args()[1:])
+		return true
+	case "upgrade":
+		actionUpgrade()
+		return true
+	case "backup":
+		actionBackup(flag.Args()[1:])
+		return true
+	case "tip-check-override":
+		actionTipCheckOverride(flag.Args()[1:])
+		return true
 	}
 	return false
 }
@@ -70,129 +182,137 @@ func processPreBlockchainActions() bool {
 // Opens the given block file (SQLite database), creates metadata tables in it, signes the
 // block with one of the private keys, and accepts the resulting block into the blockchain.
 func actionSignImportBlock(fn string) {
-	db, err := dbOpen(fn, false)
-	if err != nil {
+	if _, err := blockchainSignImportBlock(fn); err != nil {
 		log.Fatalln(err)
 	}
-	dbEnsureBlockchainTables(db)
-	keypair, publicKeyHash, err := cryptoGetAPrivateKey()
+}
+
+// Splits the given files into chunks, stores them in the chunk store and records them
+// as attachments in the given block file (SQLite database), which can then be imported
+// with signimportblock.
+func actionAttach(fn string, files []string) {
+	db, err := dbOpen(fn, false)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	lastBlockHeight := dbGetBlockchainHeight()
-	dbb, err := dbGetBlockByHeight(lastBlockHeight)
-	if err != nil {
-		log.Fatalln(err)
+	dbEnsureAttachmentTables(db)
+	for _, file := range files {
+		att, err := attachmentChunkFile(file)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err = dbInsertAttachment(db, att); err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println(att.hash, att.name, att.size)
 	}
-	if err = dbSetMetaInt(db, "Version", CurrentBlockVersion); err != nil {
+	if err = db.Close(); err != nil {
 		log.Panic(err)
 	}
-	err = dbSetMetaString(db, "PreviousBlockHash", dbb.Hash)
+}
+
+// Attaches the given files to the given block file (SQLite database) as a bundle
+func actionBundle(fn string, files []string) {
+	db, err := dbOpen(fn, false)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	signature, err := cryptoSignHex(keypair, dbb.Hash)
-	if err != nil {
+	if err = dbAttachBundle(db, files); err != nil {
 		log.Fatalln(err)
 	}
-	err = dbSetMetaString(db, "PreviousBlockHashSignature", signature)
+	if err = db.Close(); err != nil {
+		log.Panic(err)
+	}
+	fmt.Println("Attached", len(files), "files as a bundle")
+}
+
+// Encrypts the given file to the recipients and to all of our own keys, and attaches the
+// ciphertext to the given block file (SQLite database).
+func actionEncryptAttach(fn string, file string, recipients []string) {
+	for _, k := range dbGetMyPublicKeyHashes() {
+		if !inStrings(k, recipients) {
+			recipients = append(recipients, k)
+		}
+	}
+	db, err := dbOpen(fn, false)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	err = dbSetMetaString(db, "Timestamp", time.Now().Format(time.RFC3339))
+	att, err := encryptAttachFile(db, file, recipients)
 	if err != nil {
 		log.Fatalln(err)
 	}
-
-	pkdb, err := dbGetPublicKey(publicKeyHash)
-	if err != nil {
+	fmt.Println(att.hash, att.name, att.size)
+	if err = db.Close(); err != nil {
 		log.Panic(err)
 	}
-	previousBlockHashSignature, err := hex.DecodeString(signature)
+}
+
+// Writes a receipt for the given document into a file
+func actionReceipt(documentHash string, outputFilename string) {
+	receipt, err := blockchainMakeReceipt(documentHash, receiptDefaultConfirmations)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	if creatorString, ok := pkdb.metadata["BlockCreator"]; ok {
-		err = dbSetMetaString(db, "Creator", creatorString)
-		if err != nil {
-			log.Fatalln(err)
-		}
-	}
-	err = dbSetMetaString(db, "CreatorPublicKey", pkdb.publicKeyHash)
+	data, err := json.MarshalIndent(receipt, "", "  ")
 	if err != nil {
 		log.Fatalln(err)
 	}
-	if err = db.Close(); err != nil {
-		log.Panic(err)
+	if err = ioutil.WriteFile(outputFilename, data, 0644); err != nil {
+		log.Fatalln(err)
 	}
-	blockHashHex, err := hashFileToHexString(fn)
+	log.Println("Wrote receipt for", documentHash, "in block", receipt.Block.Height, "with", len(receipt.Confirmations), "confirmations")
+}
+
+// Verifies a receipt file, without needing the blockchain. Exits with a non-zero exit code
+// if the receipt is invalid.
+func actionVerifyReceipt(fileName string) {
+	data, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		log.Panic(err)
+		log.Fatalln(err)
 	}
-	signature, err = cryptoSignHex(keypair, blockHashHex)
-	if err != nil {
-		log.Panic(err)
+	var receipt TimestampReceipt
+	if err = json.Unmarshal(data, &receipt); err != nil {
+		log.Fatalln("Error decoding receipt:", err)
 	}
-	blockHashSignature, _ := hex.DecodeString(signature)
-
-	newBlockHeight := lastBlockHeight + 1
-	newBlock := DbBlockchainBlock{Hash: blockHashHex, HashSignature: blockHashSignature, PreviousBlockHash: dbb.Hash, PreviousBlockHashSignature: previousBlockHashSignature,
-		Version: CurrentBlockVersion, SignaturePublicKeyHash: pkdb.publicKeyHash, Height: newBlockHeight, TimeAccepted: time.Now()}
-
-	err = blockchainCopyFile(fn, newBlockHeight)
+	signers, err := receipt.Verify()
 	if err != nil {
-		log.Panic(err)
+		log.Fatalln("Receipt is INVALID:", err)
 	}
+	fmt.Println("Receipt is valid")
+	fmt.Println("Document:", receipt.DocumentHash, receipt.DocumentName)
+	fmt.Println("Chain:", receipt.ChainRoot)
+	fmt.Println("Block:", receipt.Block.Height, receipt.Block.Hash)
+	fmt.Println("Timestamp:", receipt.Block.Timestamp)
+	fmt.Println("Confirmations:", len(receipt.Confirmations))
+	fmt.Println("Signed by:", strings.Join(signers, ", "))
+}
 
-	err = dbInsertBlock(&newBlock)
+// Reassembles the attachment with the given hash from the chunk store into a file.
+func actionGetAttachment(hash string, outputFilename string) {
+	att, height, err := blockchainFindAttachment(hash)
 	if err != nil {
-		log.Panic(err)
+		log.Fatalln(err)
+	}
+	log.Println("Found attachment", att.name, "in block", height)
+	if err = attachmentWriteFile(att, outputFilename); err != nil {
+		log.Fatalln(err)
 	}
 }
 
 // Runs a SQL query over all the blocks.
 func actionQuery(q string) {
 	log.Println("Running query:", q)
-	errCount := 0
-	for h := dbGetBlockchainHeight(); h > 0; h-- {
-		fn := blockchainGetFilename(h)
-		db, err := dbOpen(fn, true)
+	errCount, err := blockchainQuery(q, func(height int, row map[string]interface{}) error {
+		buf, err := json.Marshal(row)
 		if err != nil {
-			log.Panic(err)
-		}
-		rows, err := db.Query(q)
-		if err != nil {
-			errCount++
-			continue
-		}
-		cols, err := rows.Columns()
-		if err != nil {
-			log.Panic(err)
-		}
-		for rows.Next() {
-			columns := make([]interface{}, len(cols))
-			columnPointers := make([]interface{}, len(cols))
-			for i := range columns {
-				columnPointers[i] = &columns[i]
-			}
-			if err := rows.Scan(columnPointers...); err != nil {
-				log.Panic(err)
-			}
-			row := make(map[string]interface{})
-			for i, colName := range cols {
-				val := columnPointers[i].(*interface{})
-				if reflect.TypeOf(*val).String() == "[]uint8" {
-					row[colName] = string((*val).([]byte))
-				} else {
-					row[colName] = *val
-				}
-			}
-			buf, err := json.Marshal(row)
-			if err != nil {
-				log.Panic(err)
-			}
-			fmt.Println(string(buf))
+			return err
 		}
+		fmt.Println(string(buf))
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
 	}
 	if errCount != 0 {
 		log.Println("There have been", errCount, "errors.")
@@ -208,8 +328,29 @@ func actionHelp() {
 	fmt.Println("\tmykeys\t\tShows a list of my public keys")
 	fmt.Println("\tquery\t\tExecutes a SQL query on the blockchain (expects 1 argument: SQL query)")
 	fmt.Println("\tsignimportblock\tSigns a block (creates metadata tables in it first) and imports it into the blockchain (expects 1 argument: a sqlite db filename)")
+	fmt.Println("\tattach\t\tAttaches files to a block before it's imported (expects 2 or more arguments: a sqlite db filename and the files)")
+	fmt.Println("\tbundle\t\tAttaches files to a block as a bundle, which can only be included in a block as a whole (expects 3 or more arguments: a sqlite db filename and the files)")
+	fmt.Println("\tencryptattach\tEncrypts a file to the given public keys and attaches it to a block (expects 2 or more arguments: a sqlite db filename, the file and the recipients' public key hashes)")
+	fmt.Println("\tdecryptattachment\tDecrypts an encrypted attachment with one of my keys (expects 2 arguments: attachment hash, output filename)")
+	fmt.Println("\tgetattachment\tReassembles an attachment into a file (expects 2 arguments: attachment hash, output filename)")
+	fmt.Println("\treceipt\t\tWrites a timestamp receipt for a document (expects 2 arguments: document hash, output filename)")
+	fmt.Println("\texport\t\tExports blocks to json, ndjson or csv (flags: -from height, -to height, -format, -payloads, -o filename)")
+	fmt.Println("\tstats\t\tShows block interval, size, document and signer statistics (flags: -from height, -to height, -window duration e.g. 30d, -json)")
+	fmt.Println("\tcompare\t\tFinds the first height at which the blockchain differs from a remote node's and shows both blocks (flags: -peer host:port or URL of its HTTP API, -token, -json)")
+	fmt.Println("\tmovestorage\tMoves the block files to the directories given by the block_storage setting")
+	fmt.Println("\tbackup\t\tTakes a consistent snapshot of the blockchain and the databases while the node runs (flags: -output dir)")
+	fmt.Println("\tgovernance\tSigns a governance order with an admin key and submits it to a node, or prints it (flags: -key hash, -expires, -node host:port, -token; expects a command: ban-peer peer=host duration=24h, set-parameter name=flag value=v, or schedule-maintenance at=RFC 3339 time)")
+	fmt.Println("\tupgrade\t\tHands the running node over to a new process of its binary, e.g. after replacing the binary, keeping its listeners and peer connections (Unix only)")
+	fmt.Println("\ttip-check-override\tReleases the startup tip check's hold on a running node's block production (flags: -node host:port or URL of its HTTP API, -token)")
+	fmt.Println("\tmaintenance\tVacuums the databases and repacks the block storage right away")
+	fmt.Println("\tverify-anchors\tChecks the blockchain against the block hashes recorded by the configured anchors, and verifies their proofs")
+	fmt.Println("\tverify-receipt\tVerifies a timestamp receipt without needing the blockchain (expects 1 argument: receipt filename)")
+	fmt.Println("\tdevnet\t\tRuns a local network of devnet nodes with a fresh chain, sealing blocks every second (flags: -nodes, -base-port, -dir, -reset)")
 	fmt.Println("\tnewchain\tStarts a new chain with the given parameters (expects 1 argument: chainparams.json)")
 	fmt.Println("\tpull\t\tPulls a blockchain from a HTTP URL (expects 1 argument: URL, e.g. http://example.com:2018/)")
+	fmt.Println("\tservice install\tInstalls this node as a service: writes a systemd unit file (flags: -o filename, -user name), or on Windows creates a Windows service (flags: -manual)")
+	fmt.Println("\tservice uninstall\tRemoves the Windows service")
+	fmt.Println("\timport\t\tInitialises a new data directory from an export with payloads (expects 1 argument: export filename)")
 }
 
 // Shows the public keys which correspond to private keys in the system database.
@@ -252,10 +393,27 @@ func actionNewChain(jsonFilename string) {
 		log.Fatalln("Data directory must not be empty:", cfg.DataDir)
 	}
 
+	newChainCreate(ncp)
+
+	// Reopen the database to verify
+	log.Println("Reloading to verify...")
+	blockchainInit(false)
+
+	// If we make it to here, everything's ok.
+	log.Println("All done.")
+}
+
+// Creates the genesis block of a new blockchain with the given parameters, and the system
+// databases with the genesis keypair, in the empty data directory
+func newChainCreate(ncp NewChainParams) {
+	var err error
+	if err = chainHashInit(&ncp.ChainParams); err != nil {
+		log.Fatalln(err)
+	}
 	ensureBlockchainSubdirectoryExists()
 	freshDb := true
 	if ncp.GenesisDb != "" && fileExists(ncp.GenesisDb) {
-		err = blockchainCopyFile(ncp.GenesisDb, 0)
+		err = blockchainCopyFile(ncp.GenesisDb, 0, "")
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -300,6 +458,12 @@ func actionNewChain(jsonFilename string) {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if err = blockLimitsWriteGenesis(db, &ncp.ChainParams); err != nil {
+		log.Fatalln(err)
+	}
+	if err = keyOpQuorumWriteGenesis(db, &ncp.ChainParams); err != nil {
+		log.Fatalln(err)
+	}
 
 	if len(ncp.BootstrapPeers) > 0 {
 		// bootstrapPeers is required to be filled in before dbInit()
@@ -397,13 +561,6 @@ func actionNewChain(jsonFilename string) {
 	if err != nil {
 		log.Panic(err)
 	}
-
-	// Reopen the database to verify
-	log.Println("Reloading to verify...")
-	blockchainInit(false)
-
-	// If we make it to here, everything's ok.
-	log.Println("All done.")
 }
 
 func actionPull(baseURL string) {
@@ -429,6 +586,9 @@ func actionPull(baseURL string) {
 	if chainParams.GenesisBlockHash == "" || chainParams.GenesisBlockHashSignature == "" {
 		log.Fatalln("Incomplete chainparams data", cpURL)
 	}
+	if err = chainHashInit(&chainParams); err != nil {
+		log.Fatalln("Error in chainparams", cpURL, err)
+	}
 
 	// Step 2: Fetch the genesis block
 	gbURL := fmt.Sprintf("%s/block/0", baseURL)
@@ -442,13 +602,26 @@ func actionPull(baseURL string) {
 		log.Fatalln("Error reading genesis block", gbURL, err)
 	}
 
+	initChainFromGenesis(body)
+
+	// Reopen the database to verify
+	log.Println("Reloading to verify...")
+	blockchainInit(false)
+
+	// If we make it to here, everything's ok.
+	log.Println("All done.")
+}
+
+// Initialises an empty data directory with the given genesis block, which is verified
+// against the chainParams.
+func initChainFromGenesis(body []byte) {
 	// Step 3: initialise data directories
 	if fileExists(cfg.DataDir) {
 		if empty, err := isDirEmpty(cfg.DataDir); err != nil || !empty {
 			log.Fatalln("Blockchain directory must be empty", cfg.DataDir)
 		}
 	}
-	if _, err = os.Stat(cfg.DataDir); err != nil {
+	if _, err := os.Stat(cfg.DataDir); err != nil {
 		log.Println("Data directory", cfg.DataDir, "doesn't exist, creating.")
 		err = os.Mkdir(cfg.DataDir, 0700)
 		if err != nil {
@@ -458,7 +631,7 @@ func actionPull(baseURL string) {
 	ensureBlockchainSubdirectoryExists()
 
 	blockFilename := blockchainGetFilename(0)
-	err = ioutil.WriteFile(blockFilename, body, 0664)
+	err := ioutil.WriteFile(blockFilename, body, 0664)
 	if err != nil {
 		log.Fatalln("Cannot write genesis block", blockFilename, err)
 	}
@@ -532,11 +705,4 @@ func actionPull(baseURL string) {
 	if err != nil {
 		log.Fatalln(err)
 	}
-
-	// Reopen the database to verify
-	log.Println("Reloading to verify...")
-	blockchainInit(false)
-
-	// If we make it to here, everything's ok.
-	log.Println("All done.")
 }
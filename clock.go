@@ -0,0 +1,20 @@
+package daisy
+
+import "time"
+
+// Expiry timers, like peer bans and the recently requested blocks, are based on a
+// monotonic clock instead of the wall clock, so NTP corrections and manual changes of the
+// system time don't expire or extend them. On Linux the clock also advances while the
+// system is suspended, so a ban lasts the same real time across a suspend and resume.
+
+// The time the process started, the origin of the monotonic clock where there's no
+// system clock usable for it
+var processStartTime = time.Now()
+
+// The clock used for the expiry timers, replaceable where a controlled clock is needed
+var monoClock = monotonicNow
+
+// Returns the time elapsed since the process started, measured with Go's monotonic clock
+func processMonotonicNow() time.Duration {
+	return time.Since(processStartTime)
+}
@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+package daisy
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var bootTimeClock struct {
+	once   sync.Once
+	usable bool
+}
+
+// Returns the current reading of CLOCK_BOOTTIME, which is monotonic and, unlike Go's
+// monotonic clock, includes the time spent suspended. Falls back to Go's monotonic clock
+// on kernels without it.
+func monotonicNow() time.Duration {
+	var ts unix.Timespec
+	bootTimeClock.once.Do(func() {
+		bootTimeClock.usable = unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts) == nil
+	})
+	if !bootTimeClock.usable {
+		return processMonotonicNow()
+	}
+	unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts)
+	return time.Duration(ts.Nano())
+}
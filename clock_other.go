@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package daisy
+
+import "time"
+
+// Returns the reading of Go's monotonic clock
+func monotonicNow() time.Duration {
+	return processMonotonicNow()
+}
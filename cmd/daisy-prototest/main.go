@@ -0,0 +1,25 @@
+// Command daisy-prototest checks that a node conforms to the Daisy p2p protocol
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ivoras/daisy/prototest"
+)
+
+func main() {
+	var cfg prototest.Config
+	flag.StringVar(&cfg.Address, "peer", "localhost:2017", "The p2p address of the node to test, as host:port")
+	flag.StringVar(&cfg.Root, "root", "", "The genesis block hash of the chain the node must be on (default: the one the node announces)")
+	flag.DurationVar(&cfg.Timeout, "timeout", 15*time.Second, "How long to wait for each answer from the node")
+	flag.Int64Var(&cfg.OversizeBytes, "oversize", 300*1024*1024, "The size in bytes of the oversized message, which must be larger than the node accepts")
+	asJSON := flag.Bool("json", false, "Output the report as JSON")
+	flag.Parse()
+	if err := prototest.RunAndPrint(cfg, os.Stdout, *asJSON); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
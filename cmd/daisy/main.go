@@ -0,0 +1,8 @@
+// Command daisy runs a Daisy blockchain node
+package main
+
+import "github.com/ivoras/daisy"
+
+func main() {
+	daisy.Main()
+}
@@ -0,0 +1,217 @@
+package daisy
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The compare command finds where this node's blockchain and a remote node's diverge,
+// using the remote node's HTTP API: it compares the heights, then the block hashes, with a
+// binary search for the first height at which they differ, since the blocks below a
+// common block are always common. It reports the headers of the first divergent blocks on
+// both sides.
+
+// CompareReport is the result of comparing this node's blockchain with a peer's
+type CompareReport struct {
+	Peer        string `json:"peer"`
+	LocalHeight int    `json:"local_height"`
+	PeerHeight  int    `json:"peer_height"`
+	// -1 if the blockchains agree up to the lower of the two heights
+	DivergentHeight int          `json:"divergent_height"`
+	LocalBlock      *BlockHeader `json:"local_block,omitempty"`
+	PeerBlock       *BlockHeader `json:"peer_block,omitempty"`
+}
+
+// A client of a remote node's HTTP API
+type compareClient struct {
+	baseURL string
+	token   string
+	client  http.Client
+}
+
+// Fetches the JSON document at the path of the remote node's API
+func (c *compareClient) getJSON(path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", c.baseURL+path, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// Returns the remote node's header of the block at the height
+func (c *compareClient) header(height int) (*BlockHeader, error) {
+	var headers []BlockHeader
+	if err := c.getJSON(fmt.Sprintf("/headers?from=%d&to=%d", height, height), &headers); err != nil {
+		return nil, err
+	}
+	if len(headers) != 1 || headers[0].Height != height {
+		return nil, fmt.Errorf("The peer has no block at height %d", height)
+	}
+	return &headers[0], nil
+}
+
+// Returns the local header of the block at the height
+func compareLocalHeader(height int) (*BlockHeader, error) {
+	headers, err := blockchainGetHeaders(height, height)
+	if err != nil {
+		return nil, err
+	}
+	if len(headers) != 1 {
+		return nil, fmt.Errorf("No block at height %d", height)
+	}
+	return &headers[0], nil
+}
+
+// Compares this node's blockchain with the blockchain of the remote node
+func blockchainCompare(c *compareClient) (*CompareReport, error) {
+	var cp ChainParams
+	if err := c.getJSON("/chainparams.json", &cp); err != nil {
+		return nil, err
+	}
+	var status struct {
+		ChainHeight int `json:"chain_height"`
+	}
+	if err := c.getJSON("/status", &status); err != nil {
+		return nil, err
+	}
+	report := CompareReport{
+		Peer:            c.baseURL,
+		LocalHeight:     dbGetBlockchainHeight(),
+		PeerHeight:      status.ChainHeight,
+		DivergentHeight: -1,
+	}
+	differsAt := func(height int) (bool, *BlockHeader, *BlockHeader, error) {
+		local, err := compareLocalHeader(height)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		remote, err := c.header(height)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		return local.Hash != remote.Hash, local, remote, nil
+	}
+	if cp.GenesisBlockHash != chainParams.GenesisBlockHash {
+		// Different chains altogether
+		report.DivergentHeight = 0
+		var err error
+		if report.LocalBlock, err = compareLocalHeader(0); err != nil {
+			return nil, err
+		}
+		report.PeerBlock, _ = c.header(0)
+		return &report, nil
+	}
+	high := report.LocalHeight
+	if report.PeerHeight < high {
+		high = report.PeerHeight
+	}
+	differs, local, remote, err := differsAt(high)
+	if err != nil {
+		return nil, err
+	}
+	if !differs {
+		return &report, nil
+	}
+	// The block at low is common, the block at high differs
+	low := 0
+	for high-low > 1 {
+		mid := low + (high-low)/2
+		d, l, r, err := differsAt(mid)
+		if err != nil {
+			return nil, err
+		}
+		if d {
+			high, local, remote = mid, l, r
+		} else {
+			low = mid
+		}
+	}
+	report.DivergentHeight = high
+	report.LocalBlock = local
+	report.PeerBlock = remote
+	return &report, nil
+}
+
+// Compares this node's blockchain with a remote node's, run as: compare -peer host:port
+func actionCompare(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	peer := fs.String("peer", "", "The HTTP address of the remote node, as host:port or a URL")
+	token := fs.String("token", "", "Bearer token for the remote node's HTTP API")
+	asJSON := fs.Bool("json", false, "Output the comparison as JSON")
+	fs.Parse(args)
+	if *peer == "" {
+		log.Fatalln("The compare command needs -peer host:port")
+	}
+	baseURL := strings.TrimSuffix(*peer, "/")
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		baseURL = "http://" + baseURL
+	}
+	c := compareClient{baseURL: baseURL, token: *token, client: http.Client{Timeout: 30 * time.Second}}
+	report, err := blockchainCompare(&c)
+	if err != nil {
+		log.Fatalln("Cannot compare with", baseURL, err)
+	}
+	if *asJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	fmt.Printf("Local height:        %d\n", report.LocalHeight)
+	fmt.Printf("Peer height:         %d\n", report.PeerHeight)
+	if report.DivergentHeight == -1 {
+		lower := report.LocalHeight
+		if report.PeerHeight < lower {
+			lower = report.PeerHeight
+		}
+		fmt.Printf("The blockchains agree up to height %d\n", lower)
+		return
+	}
+	if report.DivergentHeight == 0 {
+		fmt.Println("The peer is on a different blockchain (the genesis blocks differ)")
+	} else {
+		fmt.Printf("The blockchains diverge at height %d, after the common block %s\n", report.DivergentHeight, report.LocalBlock.PreviousBlockHash)
+	}
+	peerBlock := report.PeerBlock
+	if peerBlock == nil {
+		peerBlock = &BlockHeader{}
+	}
+	fmt.Println()
+	fmt.Printf("  %-24s %-66s %s\n", "", "local", "peer")
+	row := func(name, local, remote string) {
+		mark := " "
+		if local != remote {
+			mark = "*"
+		}
+		fmt.Printf("%s %-24s %-66s %s\n", mark, name, local, remote)
+	}
+	row("hash", report.LocalBlock.Hash, peerBlock.Hash)
+	row("previous_block_hash", report.LocalBlock.PreviousBlockHash, peerBlock.PreviousBlockHash)
+	row("timestamp", report.LocalBlock.Timestamp, peerBlock.Timestamp)
+	row("creator_public_key_hash", report.LocalBlock.CreatorPublicKeyHash, peerBlock.CreatorPublicKeyHash)
+	row("documents_root", report.LocalBlock.DocumentsRoot, peerBlock.DocumentsRoot)
+	row("header_hash", report.LocalBlock.HeaderHash, peerBlock.HeaderHash)
+}
@@ -1,4 +1,4 @@
-package main
+package daisy
 
 import (
 	"encoding/json"
@@ -7,7 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"os/user"
+	"strings"
 )
 
 // DefaultP2PPort is the default TCP port for p2p connections
@@ -23,28 +23,93 @@ const DefaultConfigFile = "/etc/daisy/config.json"
 const DefaultDataDir = ".daisy"
 
 var cfg struct {
-	configFile     string
-	P2pPort        int    `json:"p2p_port"`
-	DataDir        string `json:"data_dir"`
-	httpPort       int    `json:"http_port"`
-	showHelp       bool
-	faster         bool
-	p2pBlockInline bool
+	configFile                 string
+	profile                    string
+	P2pPort                    int    `json:"p2p_port"`
+	DataDir                    string `json:"data_dir"`
+	httpPort                   int    `json:"http_port"`
+	showHelp                   bool
+	faster                     bool
+	p2pBlockInline             bool
+	readOnly                   bool
+	relay                      bool
+	httpDisabled               bool
+	DiskWarningMB              int                   `json:"disk_warning_mb"`
+	DiskCriticalMB             int                   `json:"disk_critical_mb"`
+	RecordTypesFile            string                `json:"record_types_file"`
+	Webhooks                   []WebhookConfig       `json:"webhooks"`
+	P2pTransports              string                `json:"p2p_transports"`
+	P2pOutboundPeers           int                   `json:"p2p_outbound_peers"`
+	P2pAdvertiseHost           string                `json:"p2p_advertise_host"`
+	HTTPTLSCert                string                `json:"http_tls_cert"`
+	HTTPTLSKey                 string                `json:"http_tls_key"`
+	HTTPClientCA               string                `json:"http_client_ca"`
+	HTTPClientRoles            map[string]string     `json:"http_client_roles"`
+	HTTPTokens                 []HTTPToken           `json:"http_tokens"`
+	HTTPQueryRole              string                `json:"http_query_role"`
+	HTTPRateLimit              float64               `json:"http_rate_limit"`
+	HTTPRateBurst              int                   `json:"http_rate_burst"`
+	HTTPMaxConcurrent          int                   `json:"http_max_concurrent"`
+	HTTPMaxConcurrentPerClient int                   `json:"http_max_concurrent_per_client"`
+	HTTPMaxResponseBytes       int64                 `json:"http_max_response_bytes"`
+	BlockSchedule              string                `json:"block_schedule"`
+	Plugins                    string                `json:"plugins"`
+	StallAlertMinutes          int                   `json:"stall_alert_minutes"`
+	OtlpEndpoint               string                `json:"otlp_endpoint"`
+	BlockStorage               []BlockStorageConfig  `json:"block_storage"`
+	MaintenanceHours           string                `json:"maintenance_hours"`
+	IntegritySamplesPerHour    int                   `json:"integrity_samples_per_hour"`
+	MaintenanceMaxLoad         float64               `json:"maintenance_max_load"`
+	P2pTickInterval            string                `json:"p2p_tick_interval"`
+	P2pReconnectInterval       string                `json:"p2p_reconnect_interval"`
+	P2pRequestExpiry           string                `json:"p2p_request_expiry"`
+	P2pBadPeerTTL              string                `json:"p2p_bad_peer_ttl"`
+	Anchors                    []AnchorConfig        `json:"anchors"`
+	AnchorInterval             string                `json:"anchor_interval"`
+	Replication                []ReplicationConfig   `json:"replication"`
+	PeerTags                   map[string][]string   `json:"peer_tags"`
+	PeerPolicies               map[string]PeerPolicy `json:"peer_policies"`
+	TipCheckPeers              int                   `json:"tip_check_peers"`
+	TipCheckTimeout            string                `json:"tip_check_timeout"`
+	TipCheckMaxLag             int                   `json:"tip_check_max_lag"`
+	AdminKeys                  []string              `json:"admin_keys"`
+	MemoryBudgetMB             int                   `json:"memory_budget_mb"`
+	Failover                   bool                  `json:"failover"`
+	FailoverHeartbeat          string                `json:"failover_heartbeat"`
+	FailoverTimeout            string                `json:"failover_timeout"`
+	FailoverPriority           int                   `json:"failover_priority"`
 }
 
-// Initialises defaults, parses command line
-func configInit() {
-	u, err := user.Current()
-	if err != nil {
-		log.Panicln(err)
-	}
-	cfg.DataDir = fmt.Sprintf("%s/%s", u.HomeDir, DefaultDataDir)
-
-	// Init defaults
+// Initialises the configuration defaults
+func configDefaults() {
+	cfg.DataDir = defaultDataDir()
 	cfg.P2pPort = DefaultP2PPort
 	cfg.httpPort = DefaultBlockWebServerPort
+	cfg.DiskWarningMB = DefaultDiskWarningMB
+	cfg.DiskCriticalMB = DefaultDiskCriticalMB
+	cfg.P2pTransports = DefaultP2PTransports
+	cfg.P2pOutboundPeers = DefaultP2POutboundPeers
+	cfg.P2pTickInterval = DefaultP2PTickInterval
+	cfg.P2pReconnectInterval = DefaultP2PReconnectInterval
+	cfg.P2pRequestExpiry = DefaultP2PRequestExpiry
+	cfg.P2pBadPeerTTL = DefaultP2PBadPeerTTL
+	cfg.AnchorInterval = DefaultAnchorInterval
+	cfg.TipCheckPeers = DefaultTipCheckPeers
+	cfg.TipCheckTimeout = DefaultTipCheckTimeout
+	cfg.TipCheckMaxLag = DefaultTipCheckMaxLag
+	cfg.FailoverHeartbeat = DefaultFailoverHeartbeat
+	cfg.FailoverTimeout = DefaultFailoverTimeout
+	cfg.HTTPRateBurst = DefaultHTTPRateBurst
+	cfg.HTTPQueryRole = DefaultHTTPQueryRole
+	cfg.IntegritySamplesPerHour = DefaultIntegritySamplesPerHour
+}
 
-	// Config file is parsed first
+// Initialises defaults, parses command line
+func configInit() {
+	configDefaults()
+
+	// The profile and the config file are parsed first
+	profile := DefaultProfile
 	for i, arg := range os.Args {
 		if arg == "-conf" || arg == "--conf" {
 			if i+1 >= len(os.Args) {
@@ -52,45 +117,210 @@ func configInit() {
 			}
 			cfg.configFile = os.Args[i+1]
 		}
+		if arg == "-profile" || arg == "--profile" {
+			if i+1 >= len(os.Args) {
+				log.Fatal("-profile requires a profile name argument")
+			}
+			profile = os.Args[i+1]
+		} else if strings.HasPrefix(arg, "-profile=") || strings.HasPrefix(arg, "--profile=") {
+			profile = arg[strings.Index(arg, "=")+1:]
+		}
+	}
+	if err := profileApply(profile); err != nil {
+		log.Fatal(err)
 	}
 	if cfg.configFile != "" {
-		loadConfigFile()
+		if err := loadConfigFile(); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	// Then override the configuration with command-line flags
+	flag.StringVar(&cfg.profile, "profile", cfg.profile, "Chain profile: mainnet, testnet or devnet, selecting the default ports, data directory and genesis")
 	flag.IntVar(&cfg.P2pPort, "port", cfg.P2pPort, "P2P port")
 	flag.IntVar(&cfg.httpPort, "http-port", cfg.httpPort, "HTTP port")
 	flag.StringVar(&cfg.DataDir, "dir", cfg.DataDir, "Data directory")
 	flag.BoolVar(&cfg.showHelp, "help", false, "Shows CLI usage information")
 	flag.BoolVar(&cfg.faster, "faster", false, "Be faster when starting up")
+	flag.StringVar(&cfg.P2pTransports, "p2p-transports", cfg.P2pTransports, "Comma-separated list of p2p transports (tcp, quic, tls), in order of preference")
+	flag.IntVar(&cfg.P2pOutboundPeers, "p2p-outbound-peers", cfg.P2pOutboundPeers, "Target number of outbound p2p connections, a fraction of which is rotated every 10 minutes")
+	flag.StringVar(&cfg.P2pAdvertiseHost, "p2p-advertise", cfg.P2pAdvertiseHost, "The public host name or IP address of this node, advertised to peers (default: as seen by the peers)")
+	flag.StringVar(&cfg.P2pTickInterval, "p2p-tick", cfg.P2pTickInterval, "Interval of the p2p coordinator's periodic tasks, such as announcing new blocks and requesting chunks (1s to 1m)")
+	flag.StringVar(&cfg.P2pReconnectInterval, "p2p-reconnect-interval", cfg.P2pReconnectInterval, "Interval of connecting to more peers, up to the target number of outbound connections (10s to 1h)")
+	flag.StringVar(&cfg.P2pRequestExpiry, "p2p-request-expiry", cfg.P2pRequestExpiry, "Time after which a block which hasn't arrived can be requested again (1s to 5m)")
+	flag.StringVar(&cfg.P2pBadPeerTTL, "p2p-bad-peer-ttl", cfg.P2pBadPeerTTL, "Time for which a peer which couldn't be connected to isn't dialed again (1m to 24h)")
+	flag.IntVar(&cfg.TipCheckPeers, "tip-check-peers", cfg.TipCheckPeers, "Number of peers which must confirm the chain tip on startup before blocks are produced (0 to disable)")
+	flag.StringVar(&cfg.TipCheckTimeout, "tip-check-timeout", cfg.TipCheckTimeout, "Time after which blocks are produced even if not enough peers have confirmed the chain tip")
+	flag.IntVar(&cfg.TipCheckMaxLag, "tip-check-max-lag", cfg.TipCheckMaxLag, "Number of blocks the peers may be ahead before block production is held until the node catches up")
+	flag.BoolVar(&cfg.Failover, "failover", cfg.Failover, "Produce blocks only while active in a group of nodes sharing the signing key, taking over when the active node stops")
+	flag.StringVar(&cfg.FailoverHeartbeat, "failover-heartbeat", cfg.FailoverHeartbeat, "Interval of the heartbeats sent to the other nodes of the failover group (1s to 1m)")
+	flag.StringVar(&cfg.FailoverTimeout, "failover-timeout", cfg.FailoverTimeout, "Time without heartbeats from the active node after which a standby takes over")
+	flag.IntVar(&cfg.FailoverPriority, "failover-priority", cfg.FailoverPriority, "Priority of the node when two nodes of the failover group are active in the same term")
+	flag.StringVar(&cfg.AnchorInterval, "anchor-interval", cfg.AnchorInterval, "Interval of publishing the latest block's hash to the configured anchors (1m to 168h)")
 	flag.BoolVar(&cfg.p2pBlockInline, "p2pblockinline", false, "Send blocks to peers inline instead of over HTTP")
+	flag.StringVar(&cfg.RecordTypesFile, "record-types", cfg.RecordTypesFile, "JSON file with record type schemas to validate blocks against")
+	flag.BoolVar(&cfg.relay, "relay", false, "Run as a relay node which stores only block headers and forwards requests to full nodes")
+	flag.BoolVar(&cfg.readOnly, "readonly", false, "Open the databases read-only and only serve queries over HTTP")
+	flag.IntVar(&cfg.DiskWarningMB, "disk-warning-mb", cfg.DiskWarningMB, "Free disk space (MiB) below which warnings are logged")
+	flag.IntVar(&cfg.DiskCriticalMB, "disk-critical-mb", cfg.DiskCriticalMB, "Free disk space (MiB) below which new blocks are not accepted")
+	flag.IntVar(&cfg.MemoryBudgetMB, "memory-budget-mb", cfg.MemoryBudgetMB, "Memory (MiB) the sync buffers and caches are sized to fit, syncing more slowly instead of running out of memory (0 for unlimited)")
+	flag.StringVar(&cfg.HTTPTLSCert, "http-tls-cert", cfg.HTTPTLSCert, "TLS certificate file (PEM) for the HTTP server")
+	flag.StringVar(&cfg.HTTPTLSKey, "http-tls-key", cfg.HTTPTLSKey, "TLS private key file (PEM) for the HTTP server")
+	flag.StringVar(&cfg.HTTPClientCA, "http-client-ca", cfg.HTTPClientCA, "CA certificate file (PEM) for authenticating HTTP clients with TLS client certificates")
+	flag.StringVar(&cfg.HTTPQueryRole, "http-query-role", cfg.HTTPQueryRole, "Role needed to run SQL queries with /query: read-only, submitter, admin, or off to disable it")
+	flag.Float64Var(&cfg.HTTPRateLimit, "http-rate-limit", cfg.HTTPRateLimit, "Maximum number of query API requests per second per client (0 for unlimited)")
+	flag.IntVar(&cfg.HTTPRateBurst, "http-rate-burst", cfg.HTTPRateBurst, "Number of query API requests a client can make in a burst above the rate limit")
+	flag.IntVar(&cfg.HTTPMaxConcurrent, "http-max-concurrent", cfg.HTTPMaxConcurrent, "Maximum number of concurrent query API requests (0 for unlimited)")
+	flag.IntVar(&cfg.HTTPMaxConcurrentPerClient, "http-max-concurrent-per-client", cfg.HTTPMaxConcurrentPerClient, "Maximum number of concurrent query API requests per client (0 for unlimited)")
+	flag.Int64Var(&cfg.HTTPMaxResponseBytes, "http-max-response-bytes", cfg.HTTPMaxResponseBytes, "Maximum size of query API responses in bytes (0 for unlimited)")
+	flag.StringVar(&cfg.BlockSchedule, "block-schedule", cfg.BlockSchedule, "Seal the documents in the pending directory into blocks on this schedule: an interval (10m) or a cron expression (\"0 0 * * *\")")
+	flag.IntVar(&cfg.StallAlertMinutes, "stall-alert-minutes", cfg.StallAlertMinutes, "Alert when no block has been accepted for this many minutes while the peers are ahead or while producing blocks (0 to disable)")
+	flag.StringVar(&cfg.OtlpEndpoint, "otlp-endpoint", cfg.OtlpEndpoint, "OpenTelemetry collector URL (OTLP/HTTP, e.g. http://localhost:4318) to export the sync traces to")
+	flag.IntVar(&cfg.IntegritySamplesPerHour, "integrity-samples-per-hour", cfg.IntegritySamplesPerHour, "Number of randomly chosen blocks verified every hour to detect disk corruption (0 to disable)")
+	flag.StringVar(&cfg.MaintenanceHours, "maintenance-hours", cfg.MaintenanceHours, "Daily quiet hours (e.g. 01:00-05:00, local time) in which the databases are vacuumed and the block storage is repacked")
+	flag.Float64Var(&cfg.MaintenanceMaxLoad, "maintenance-max-load", cfg.MaintenanceMaxLoad, "System load average above which the maintenance pauses (default: the number of CPUs)")
+	flag.StringVar(&cfg.Plugins, "plugins", cfg.Plugins, "Comma-separated list of Go plugins (.so files) with node hooks")
+	webhookURL := flag.String("webhook", "", "URL to POST new block notifications to")
+	webhookSecret := flag.String("webhook-secret", "", "Secret used to sign the notifications sent to the -webhook URL")
 	flag.Parse()
 
 	if cfg.showHelp {
 		actionHelp()
 		os.Exit(0)
 	}
+	if *webhookURL != "" {
+		cfg.Webhooks = append(cfg.Webhooks, WebhookConfig{URL: *webhookURL, Secret: *webhookSecret})
+	}
+	if err := configCheck(); err != nil {
+		log.Fatal(err)
+	}
+}
 
+// Validates the configuration and prepares the data directory
+func configCheck() error {
+	if cfg.relay && cfg.readOnly {
+		return fmt.Errorf("The -relay and -readonly modes cannot be used together")
+	}
 	if _, err := os.Stat(cfg.DataDir); err != nil {
+		if cfg.readOnly {
+			return fmt.Errorf("Data directory %s doesn't exist", cfg.DataDir)
+		}
 		log.Println("Data directory", cfg.DataDir, "doesn't exist, creating.")
-		err = os.Mkdir(cfg.DataDir, 0700)
-		if err != nil {
-			log.Panicln(err)
+		if err = os.MkdirAll(cfg.DataDir, 0700); err != nil {
+			return err
 		}
 	}
 	if cfg.P2pPort < 1 || cfg.P2pPort > 65535 {
-		log.Fatal("Invalid TCP port", cfg.P2pPort)
+		return fmt.Errorf("Invalid TCP port %d", cfg.P2pPort)
+	}
+	if cfg.P2pOutboundPeers < 1 {
+		return fmt.Errorf("The target number of outbound peers must be at least 1")
+	}
+	var err error
+	if p2pEnabledTransports, err = p2pParseTransports(cfg.P2pTransports); err != nil {
+		return err
+	}
+	if err = p2pCoordinatorConfigure(); err != nil {
+		return err
+	}
+	if err = peerTagsConfigure(); err != nil {
+		return err
+	}
+	if err = tipCheckConfigure(); err != nil {
+		return err
+	}
+	if err = failoverConfigure(); err != nil {
+		return err
+	}
+	if cfg.DiskCriticalMB < 0 || cfg.DiskWarningMB < cfg.DiskCriticalMB {
+		return fmt.Errorf("Invalid disk space thresholds: the critical threshold must not be negative, and the warning threshold must be at least the critical threshold")
+	}
+	if err = memoryBudgetConfigure(); err != nil {
+		return err
+	}
+	for _, wh := range cfg.Webhooks {
+		if !strings.HasPrefix(wh.URL, "http://") && !strings.HasPrefix(wh.URL, "https://") {
+			return fmt.Errorf("Invalid webhook URL: %s", wh.URL)
+		}
+	}
+	if cfg.HTTPRateLimit < 0 || cfg.HTTPRateBurst < 1 || cfg.HTTPMaxConcurrent < 0 || cfg.HTTPMaxConcurrentPerClient < 0 || cfg.HTTPMaxResponseBytes < 0 {
+		return fmt.Errorf("Invalid HTTP limits: the limits cannot be negative and the burst must be at least 1")
+	}
+	if err = httpAuthConfigCheck(); err != nil {
+		return err
+	}
+	if p2pTLSEnabled() {
+		if cfg.HTTPTLSCert == "" || cfg.httpDisabled {
+			return fmt.Errorf("The tls p2p transport runs on the HTTPS server, which needs -http-tls-cert")
+		}
+		if cfg.P2pPort != cfg.httpPort {
+			return fmt.Errorf("With the tls p2p transport, the p2p port must be the HTTP port (%d)", cfg.httpPort)
+		}
+		for _, t := range p2pEnabledTransports {
+			if t.Name() == "tcp" {
+				return fmt.Errorf("The tcp and tls p2p transports cannot be used together, as they need the same port")
+			}
+		}
+	}
+	if cfg.BlockSchedule != "" {
+		if cfg.readOnly || cfg.relay {
+			return fmt.Errorf("Blocks cannot be produced in the read-only or relay mode")
+		}
+		if blockProductionSchedule, err = parseBlockSchedule(cfg.BlockSchedule); err != nil {
+			return err
+		}
+	}
+	if cfg.MaintenanceHours != "" {
+		if cfg.readOnly {
+			return fmt.Errorf("The maintenance cannot run in the read-only mode")
+		}
+		if maintenanceHours, err = parseMaintenanceWindow(cfg.MaintenanceHours); err != nil {
+			return err
+		}
+	}
+	if cfg.IntegritySamplesPerHour < 0 || cfg.IntegritySamplesPerHour > 3600 {
+		return fmt.Errorf("Invalid -integrity-samples-per-hour: %d (expecting 0 to 3600)", cfg.IntegritySamplesPerHour)
 	}
+	if cfg.MaintenanceMaxLoad < 0 {
+		return fmt.Errorf("Invalid -maintenance-max-load: %v", cfg.MaintenanceMaxLoad)
+	}
+	if cfg.StallAlertMinutes < 0 {
+		return fmt.Errorf("Invalid -stall-alert-minutes: %d", cfg.StallAlertMinutes)
+	}
+	if err = governanceConfigure(); err != nil {
+		return err
+	}
+	if err = blockStorageParse(); err != nil {
+		return err
+	}
+	if cfg.OtlpEndpoint != "" && !strings.HasPrefix(cfg.OtlpEndpoint, "http://") && !strings.HasPrefix(cfg.OtlpEndpoint, "https://") {
+		return fmt.Errorf("Invalid OTLP endpoint URL: %s", cfg.OtlpEndpoint)
+	}
+	if cfg.Plugins != "" {
+		if err = hooksLoadPlugins(cfg.Plugins); err != nil {
+			return err
+		}
+	}
+	// After the plugins, which can register anchor publishers
+	if err = anchorConfigure(); err != nil {
+		return err
+	}
+	if err = replicationConfigure(); err != nil {
+		return err
+	}
+	if cfg.RecordTypesFile != "" {
+		if err = loadRecordTypesFile(cfg.RecordTypesFile); err != nil {
+			return fmt.Errorf("Error loading record types: %v", err)
+		}
+	}
+	return nil
 }
 
 // Loads the JSON config file.
-func loadConfigFile() {
+func loadConfigFile() error {
 	data, err := ioutil.ReadFile(cfg.configFile)
 	if err != nil {
-		log.Fatal(err)
-	}
-	err = json.Unmarshal(data, &cfg)
-	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return json.Unmarshal(data, &cfg)
 }
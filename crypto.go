@@ -1,4 +1,4 @@
-package main
+package daisy
 
 import (
 	"crypto/ecdsa"
@@ -96,10 +96,33 @@ func cryptoGetAPrivateKey() (*ecdsa.PrivateKey, string, error) {
 	return keys, publicKeyHash, nil
 }
 
+// Returns the keypair for the given public key hash, read from the database
+func cryptoGetPrivateKey(publicKeyHash string) (*ecdsa.PrivateKey, error) {
+	privateKeyBytes, err := dbGetPrivateKey(publicKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := x509.ParseECPrivateKey(privateKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if cryptoMustGetPublicKeyHash(&keys.PublicKey) != publicKeyHash {
+		return nil, fmt.Errorf("Private key doesn't match the public key hash %s", publicKeyHash)
+	}
+	return keys, nil
+}
+
 // Decodes the given bytes into a public key
 func cryptoDecodePublicKeyBytes(key []byte) (*ecdsa.PublicKey, error) {
 	ikey, err := x509.ParsePKIXPublicKey(key)
-	return ikey.(*ecdsa.PublicKey), err
+	if err != nil {
+		return nil, err
+	}
+	pkey, ok := ikey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Not an ECDSA public key")
+	}
+	return pkey, nil
 }
 
 // Returns a hash of the given public key
@@ -135,9 +158,9 @@ func cryptoVerifyPublicKeyHashSignature(publicKey *ecdsa.PublicKey, publicKeyHas
 	return cryptoVerifyBytes(publicKey, publicKeyHashBytes, signature)
 }
 
-// Signs a hex-encoded byte blob. and returns a hex-encoded signature byte blob
+// Signs a hash, and returns a hex-encoded signature byte blob
 func cryptoSignHex(myPrivateKey *ecdsa.PrivateKey, hash string) (string, error) {
-	hashBytes, err := hex.DecodeString(hash)
+	hashBytes, err := hashDigest(hash)
 	if err != nil {
 		return "", err
 	}
@@ -148,9 +171,9 @@ func cryptoSignHex(myPrivateKey *ecdsa.PrivateKey, hash string) (string, error)
 	return hex.EncodeToString(signatureBytes), nil
 }
 
-// Verifies the given signature of a hash, both hex-encoded. Returns nil if everything's ok.
+// Verifies the given hex-encoded signature of a hash. Returns nil if everything's ok.
 func cryptoVerifyHex(publicKey *ecdsa.PublicKey, hash string, signature string) error {
-	hashBytes, err := hex.DecodeString(hash)
+	hashBytes, err := hashDigest(hash)
 	if err != nil {
 		return err
 	}
@@ -161,9 +184,9 @@ func cryptoVerifyHex(publicKey *ecdsa.PublicKey, hash string, signature string)
 	return cryptoVerifyBytes(publicKey, hashBytes, signatureBytes)
 }
 
-// Signs a hex-encoded byte blob. and returns a signature byte blob
+// Signs a hash, and returns a signature byte blob
 func cryptoSignHexBytes(myPrivateKey *ecdsa.PrivateKey, hash string) ([]byte, error) {
-	hashBytes, err := hex.DecodeString(hash)
+	hashBytes, err := hashDigest(hash)
 	if err != nil {
 		return nil, err
 	}
@@ -176,7 +199,7 @@ func cryptoSignHexBytes(myPrivateKey *ecdsa.PrivateKey, hash string) ([]byte, er
 
 // Verifies the given signature of a hash. Returns nil if everything's ok.
 func cryptoVerifyHexBytes(publicKey *ecdsa.PublicKey, hash string, signatureBytes []byte) error {
-	hashBytes, err := hex.DecodeString(hash)
+	hashBytes, err := hashDigest(hash)
 	if err != nil {
 		return err
 	}
@@ -1,4 +1,4 @@
-package main
+package daisy
 
 import (
 	"database/sql"
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -70,6 +72,14 @@ CREATE TABLE pubkeys (
 	metadata		VARCHAR -- JSON
 );`
 
+// The heights of the blocks which revoked the public keys, so that the revocations are
+// undone when the blocks are rolled back
+const pubKeyRevocationsTableCreate = `
+CREATE TABLE pubkey_revocations (
+	pubkey_hash		VARCHAR NOT NULL PRIMARY KEY,
+	block_height	INTEGER NOT NULL
+);`
+
 const privateTableCreate = `
 CREATE TABLE privkeys (
 	pubkey_hash		VARCHAR NOT NULL PRIMARY KEY,
@@ -93,6 +103,95 @@ CREATE TABLE peers (
 );
 `
 
+// Chunks of attachments referenced from accepted blocks which haven't been fetched yet
+const missingChunksTableCreate = `
+CREATE TABLE missing_chunks (
+	chunk_hash		VARCHAR NOT NULL PRIMARY KEY,
+	block_height	INTEGER NOT NULL,
+	time_added		INTEGER NOT NULL
+);
+`
+
+const outboxTableCreate = `
+CREATE TABLE outbox (
+	ack_id			INTEGER NOT NULL PRIMARY KEY,
+	address			VARCHAR NOT NULL,
+	priority		INTEGER NOT NULL,
+	block_height	INTEGER NOT NULL,
+	msg				TEXT NOT NULL,
+	time_added		INTEGER NOT NULL
+);
+CREATE INDEX outbox_address ON outbox(address);
+`
+
+// Peer addresses from the peer exchange, signed by the nodes at those addresses and
+// confirmed by connecting to them. The hops column is no longer used.
+const peerRecordsTableCreate = `
+CREATE TABLE peer_records (
+	address			VARCHAR NOT NULL PRIMARY KEY,
+	node_key		VARCHAR NOT NULL,
+	timestamp		INTEGER NOT NULL,
+	hops			INTEGER NOT NULL DEFAULT 0,
+	signature		VARCHAR NOT NULL
+);
+`
+
+// The block hashes published to external systems, with the proofs that they've been recorded
+const anchorsTableCreate = `
+CREATE TABLE anchors (
+	publisher		VARCHAR NOT NULL,
+	block_height	INTEGER NOT NULL,
+	hash			VARCHAR NOT NULL,
+	chain			VARCHAR NOT NULL,
+	proof			BLOB NOT NULL,
+	time_added		INTEGER NOT NULL,
+	PRIMARY KEY (publisher, block_height)
+);
+`
+
+// The audit log of the governance orders signed by the admin keys
+const governanceLogTableCreate = `
+CREATE TABLE governance_log (
+	id				VARCHAR NOT NULL PRIMARY KEY,
+	command			VARCHAR NOT NULL,
+	params			VARCHAR NOT NULL,
+	issuer			VARCHAR NOT NULL,
+	issued			INTEGER NOT NULL,
+	expires			INTEGER NOT NULL,
+	public_key		VARCHAR NOT NULL,
+	signature		VARCHAR NOT NULL,
+	source			VARCHAR NOT NULL,
+	result			VARCHAR NOT NULL,
+	time_added		INTEGER NOT NULL
+);
+`
+
+// The delays with which the blocks announced by the peers have been accepted
+const blockPropagationTableCreate = `
+CREATE TABLE block_propagation (
+	block_height		INTEGER NOT NULL PRIMARY KEY,
+	hash				VARCHAR NOT NULL,
+	delay_ms			INTEGER NOT NULL,
+	announce_delay_ms	INTEGER NOT NULL,
+	first_peer			VARCHAR NOT NULL,
+	time_added			INTEGER NOT NULL
+);
+`
+
+// The heights of the blocks which contain the documents, so they're found without
+// opening the blocks
+const documentsTableCreate = `
+CREATE TABLE documents (
+	hash			VARCHAR NOT NULL,
+	block_height	INTEGER NOT NULL,
+	PRIMARY KEY (hash, block_height)
+);
+`
+
+// The config table key which is set once the documents table has been filled with the
+// documents of all the blocks
+const documentsIndexedKey = "documents_indexed"
+
 /*********************************************************************************************************************
  * Structures and SQL schema for the individual blockchain block tables.
  */
@@ -103,6 +202,42 @@ CREATE TABLE _meta (
 );
 `
 
+const attachmentsTableCreate = `
+CREATE TABLE _attachments (
+    hash            VARCHAR NOT NULL PRIMARY KEY,
+    name            VARCHAR NOT NULL,
+    size            INTEGER NOT NULL,
+    chunk_count     INTEGER NOT NULL
+);
+`
+
+const attachmentChunksTableCreate = `
+CREATE TABLE _attachment_chunks (
+    attachment_hash VARCHAR NOT NULL,
+    idx             INTEGER NOT NULL,
+    chunk_hash      VARCHAR NOT NULL,
+    PRIMARY KEY (attachment_hash, idx)
+);
+`
+
+const encryptedTableCreate = `
+CREATE TABLE _encrypted (
+    attachment_hash VARCHAR NOT NULL PRIMARY KEY,
+    cipher          VARCHAR NOT NULL,
+    plaintext_size  INTEGER NOT NULL
+);
+`
+
+const keyEnvelopesTableCreate = `
+CREATE TABLE _key_envelopes (
+    attachment_hash  VARCHAR NOT NULL,
+    recipient        VARCHAR NOT NULL,
+    ephemeral_pubkey VARCHAR NOT NULL,
+    wrapped_key      VARCHAR NOT NULL,
+    PRIMARY KEY (attachment_hash, recipient)
+);
+`
+
 const keysTableCreate = `
 CREATE TABLE _keys (
     op              CHAR NOT NULL,
@@ -120,6 +255,10 @@ var privateDb *sql.DB
 
 // Initialises the system databases
 func dbInit() {
+	if cfg.readOnly {
+		dbInitReadOnly()
+		return
+	}
 	dbFileName := fmt.Sprintf("%s/%s", cfg.DataDir, mainDbFileName)
 	_, err := os.Stat(dbFileName)
 	mainDbFileExists := err == nil
@@ -127,6 +266,7 @@ func dbInit() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	memoryLimitSQLite(mainDb)
 	if !mainDbFileExists || !dbTableExists(mainDb, "blockchain") {
 		// Create system tables
 		_, err = mainDb.Exec(blockchainTableCreate)
@@ -140,6 +280,12 @@ func dbInit() {
 			log.Panic(err)
 		}
 	}
+	if !dbTableExists(mainDb, "pubkey_revocations") {
+		_, err = mainDb.Exec(pubKeyRevocationsTableCreate)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
 	if !dbTableExists(mainDb, "config") {
 		_, err = mainDb.Exec(configTableCreate)
 		if err != nil {
@@ -158,6 +304,48 @@ func dbInit() {
 			}
 		}
 	}
+	if !dbTableExists(mainDb, "missing_chunks") {
+		_, err = mainDb.Exec(missingChunksTableCreate)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	if !dbTableExists(mainDb, "outbox") {
+		_, err = mainDb.Exec(outboxTableCreate)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	if !dbTableExists(mainDb, "peer_records") {
+		_, err = mainDb.Exec(peerRecordsTableCreate)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	if !dbTableExists(mainDb, "anchors") {
+		_, err = mainDb.Exec(anchorsTableCreate)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	if !dbTableExists(mainDb, "governance_log") {
+		_, err = mainDb.Exec(governanceLogTableCreate)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	if !dbTableExists(mainDb, "block_propagation") {
+		_, err = mainDb.Exec(blockPropagationTableCreate)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	if !dbTableExists(mainDb, "documents") {
+		_, err = mainDb.Exec(documentsTableCreate)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
 
 	dbFileName = fmt.Sprintf("%s/%s", cfg.DataDir, privateDbFilename)
 	_, err = os.Stat(dbFileName)
@@ -179,17 +367,56 @@ func dbInit() {
 	}
 }
 
+// Opens the existing system databases without write access. The private database is
+// optional in this mode, so data directories can be copied without private keys.
+func dbInitReadOnly() {
+	dbFileName := fmt.Sprintf("%s/%s", cfg.DataDir, mainDbFileName)
+	if !fileExists(dbFileName) {
+		log.Fatalln("Main database doesn't exist:", dbFileName)
+	}
+	var err error
+	mainDb, err = dbOpen(dbFileName, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	memoryLimitSQLite(mainDb)
+	if !dbTableExists(mainDb, "blockchain") || !dbTableExists(mainDb, "pubkeys") || !dbTableExists(mainDb, "peers") {
+		log.Fatalln("Main database is not initialised:", dbFileName)
+	}
+	dbFileName = fmt.Sprintf("%s/%s", cfg.DataDir, privateDbFilename)
+	if fileExists(dbFileName) {
+		privateDb, err = dbOpen(dbFileName, true)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
 // Just opens the given file as a SQLite database
 func dbOpen(fileName string, readOnly bool) (*sql.DB, error) {
 	if !readOnly {
 		return sql.Open("sqlite3", fileName)
 	}
-	return sql.Open("sqlite3", "file:"+fileName+"?mode=ro")
+	return sql.Open("sqlite3", sqliteFileURI(fileName)+"?mode=ro")
+}
+
+// Returns the SQLite URI for the file name. Windows paths need forward slashes and a
+// leading slash before the drive letter, and all paths need ? and # escaped.
+func sqliteFileURI(fileName string) string {
+	p := filepath.ToSlash(fileName)
+	if filepath.VolumeName(fileName) != "" && !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	p = strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(p)
+	return "file:" + p
 }
 
 // Counts the number of private keys in the system databases
 func dbNumPrivateKeys() int {
 	assertSysDbOpen()
+	if privateDb == nil {
+		return 0
+	}
 	var count int
 	err := privateDb.QueryRow("SELECT COUNT(*) FROM privkeys").Scan(&count)
 	if err != nil {
@@ -198,10 +425,10 @@ func dbNumPrivateKeys() int {
 	return count
 }
 
-// Checks to see if a table exists in the given database
+// Checks to see if a table exists in the given database. Like in SQLite, the name is case-insensitive.
 func dbTableExists(db *sql.DB, name string) bool {
 	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=?", name).Scan(&count)
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=? COLLATE NOCASE", name).Scan(&count)
 	if err != nil {
 		log.Panicln(err)
 	}
@@ -210,7 +437,7 @@ func dbTableExists(db *sql.DB, name string) bool {
 
 // Panics if the system databases are not open
 func assertSysDbOpen() {
-	if mainDb == nil || privateDb == nil {
+	if mainDb == nil || (privateDb == nil && !cfg.readOnly) {
 		log.Panic("Databases are not open")
 	}
 }
@@ -233,12 +460,16 @@ func dbWritePublicKey(pubkey []byte, hash string, blockHeight int) {
 	}
 }
 
-// Marks a public key as revoked.
-func dbRevokePublicKey(hash string) {
+// Marks a public key as revoked by the block at the given height.
+func dbRevokePublicKey(hash string, height int) {
 	_, err := mainDb.Exec("UPDATE pubkeys SET time_revoked=? WHERE pubkey_hash=?", getNowUTC(), hash)
 	if err != nil {
 		log.Panic(err)
 	}
+	_, err = mainDb.Exec("INSERT OR REPLACE INTO pubkey_revocations(pubkey_hash, block_height) VALUES (?, ?)", hash, height)
+	if err != nil {
+		log.Panic(err)
+	}
 }
 
 // Writes the given private key byte blob to the system databases
@@ -249,9 +480,54 @@ func dbWritePrivateKey(privkey []byte, hash string) {
 	}
 }
 
+// Returns the blocks in the listing's height and time ranges, after the given height in
+// the listing's order unless it's -1, at most limit of them
+func dbListBlocks(lp *listParams, afterHeight, limit int) ([]DbBlockchainBlock, error) {
+	from, to := lp.heightRange()
+	since, until := lp.timeRange()
+	order := "ASC"
+	if lp.desc {
+		order = "DESC"
+		if afterHeight >= 0 && afterHeight-1 < to {
+			to = afterHeight - 1
+		}
+	} else if afterHeight >= 0 && afterHeight+1 > from {
+		from = afterHeight + 1
+	}
+	rows, err := mainDb.Query("SELECT hash, height, prev_hash, sigkey_hash, time_accepted, version FROM blockchain WHERE height BETWEEN ? AND ? AND time_accepted BETWEEN ? AND ? ORDER BY height "+order+" LIMIT ?", from, to, since, until, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []DbBlockchainBlock
+	for rows.Next() {
+		var dbb DbBlockchainBlock
+		var timeAccepted int
+		if err = rows.Scan(&dbb.Hash, &dbb.Height, &dbb.PreviousBlockHash, &dbb.SignaturePublicKeyHash, &timeAccepted, &dbb.Version); err != nil {
+			return nil, err
+		}
+		dbb.TimeAccepted = unixTimeStampToUTCTime(timeAccepted)
+		result = append(result, dbb)
+	}
+	return result, rows.Err()
+}
+
+// Returns true if the key has signed a block in the blockchain
+func dbPublicKeyHasSigned(publicKeyHash string) bool {
+	var count int
+	err := mainDb.QueryRow("SELECT COUNT(*) FROM (SELECT 1 FROM blockchain WHERE sigkey_hash=? LIMIT 1)", publicKeyHash).Scan(&count)
+	if err != nil {
+		log.Panic(err)
+	}
+	return count > 0
+}
+
 // Returns a list of public keys hashes corresponding to private keys in the system databases
 func dbGetMyPublicKeyHashes() []string {
 	var result []string
+	if privateDb == nil {
+		return result
+	}
 	rows, err := privateDb.Query("SELECT pubkey_hash FROM privkeys")
 	if err != nil {
 		log.Panic(err)
@@ -321,6 +597,16 @@ func dbGetAPrivateKey() ([]byte, string, error) {
 	return privateKeyBytes, publicKeyHash, nil
 }
 
+// Returns the private key corresponding to the given public key hash from the system databases
+func dbGetPrivateKey(publicKeyHash string) ([]byte, error) {
+	var privateKey string
+	err := privateDb.QueryRow("SELECT privkey FROM privkeys WHERE pubkey_hash=?", publicKeyHash).Scan(&privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(privateKey)
+}
+
 // Returns the public key corresponding to the given public key hash, by reading it from the system databases.
 func dbGetPublicKey(publicKeyHash string) (*DbPubKey, error) {
 	var dbpk DbPubKey
@@ -454,6 +740,32 @@ func dbBlockHeightExists(h int) bool {
 	return count > 0
 }
 
+// Records the hashes of the documents in the block at the given height
+func dbInsertDocuments(height int, hashes []string) error {
+	tx, err := mainDb.Begin()
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err = tx.Exec("INSERT OR IGNORE INTO documents(hash, block_height) VALUES (?, ?)", strings.ToLower(hash), height); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Returns the height of the newest block which contains the document, and false if no
+// block does
+func dbGetDocumentHeight(hash string) (int, bool) {
+	var height sql.NullInt64
+	err := mainDb.QueryRow("SELECT MAX(block_height) FROM documents WHERE hash=?", strings.ToLower(hash)).Scan(&height)
+	if err != nil {
+		log.Panic(err)
+	}
+	return int(height.Int64), height.Valid
+}
+
 // Inserts a block record into the main database, without validation
 func dbInsertBlock(dbb *DbBlockchainBlock) error {
 	_, err := mainDb.Exec("INSERT INTO blockchain (hash, height, prev_hash, sigkey_hash, hash_signature, prev_hash_signature, time_accepted, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
@@ -462,6 +774,37 @@ func dbInsertBlock(dbb *DbBlockchainBlock) error {
 	return err
 }
 
+// Removes the blocks above the given height from the blockchain index, together with
+// the public keys which were added by those blocks, and undoes the key revocations done
+// by them.
+func dbRollbackToHeight(height int) error {
+	tx, err := mainDb.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM blockchain WHERE height > ?", height); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("UPDATE pubkeys SET time_revoked=NULL WHERE pubkey_hash IN (SELECT pubkey_hash FROM pubkey_revocations WHERE block_height > ?)", height); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM pubkey_revocations WHERE block_height > ?", height); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM documents WHERE block_height > ?", height); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM pubkeys WHERE block_height > ?", height); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
 func dbClearSavedPeers() error {
 	_, err := mainDb.Exec("DELETE FROM peers")
 	return err
@@ -499,3 +842,345 @@ func dbSavePeer(address string) {
 		log.Panic(err)
 	}
 }
+
+// Records a chunk which needs to be fetched from peers
+func dbAddMissingChunk(hash string, blockHeight int) {
+	_, err := mainDb.Exec("INSERT OR IGNORE INTO missing_chunks(chunk_hash, block_height, time_added) VALUES (?, ?, ?)", hash, blockHeight, getNowUTC())
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Checks if the chunk is in the list of chunks which need to be fetched
+func dbMissingChunkExists(hash string) bool {
+	var count int
+	err := mainDb.QueryRow("SELECT COUNT(*) FROM missing_chunks WHERE chunk_hash=?", hash).Scan(&count)
+	if err != nil {
+		log.Panic(err)
+	}
+	return count > 0
+}
+
+// Removes a chunk from the list of chunks which need to be fetched
+func dbRemoveMissingChunk(hash string) {
+	_, err := mainDb.Exec("DELETE FROM missing_chunks WHERE chunk_hash=?", hash)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Returns a map of at most limit missing chunk hashes, and the heights of the blocks which reference them
+func dbGetMissingChunks(limit int) map[string]int {
+	result := map[string]int{}
+	rows, err := mainDb.Query("SELECT chunk_hash, block_height FROM missing_chunks ORDER BY block_height LIMIT ?", limit)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func() {
+		err = rows.Close()
+		if err != nil {
+			log.Fatalf("dbGetMissingChunks rows.Close: %v", err)
+		}
+	}()
+	for rows.Next() {
+		var hash string
+		var height int
+		if err = rows.Scan(&hash, &height); err != nil {
+			log.Panic(err)
+		}
+		result[hash] = height
+	}
+	return result
+}
+
+// Records a message which needs to be acknowledged by the peer at the given address
+func dbOutboxAdd(ackID int64, address string, priority int, blockHeight int, msg []byte) {
+	_, err := mainDb.Exec("INSERT INTO outbox(ack_id, address, priority, block_height, msg, time_added) VALUES (?, ?, ?, ?, ?, ?)",
+		ackID, address, priority, blockHeight, string(msg), getNowUTC())
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Removes an acknowledged message from the outbox
+func dbOutboxDelete(ackID int64, address string) {
+	_, err := mainDb.Exec("DELETE FROM outbox WHERE ack_id=? AND address=?", ackID, address)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Removes the messages about blocks the peer at the given address already has
+func dbOutboxDeleteUpToHeight(address string, blockHeight int) {
+	_, err := mainDb.Exec("DELETE FROM outbox WHERE address=? AND block_height<=?", address, blockHeight)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Removes the messages older than the given Unix timestamp
+func dbOutboxExpire(before int64) {
+	_, err := mainDb.Exec("DELETE FROM outbox WHERE time_added<?", before)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Returns at most limit messages waiting for the peer at the given address, in order of
+// priority and age
+func dbOutboxGet(address string, limit int) [][]byte {
+	var result [][]byte
+	rows, err := mainDb.Query("SELECT msg FROM outbox WHERE address=? ORDER BY priority, time_added LIMIT ?", address, limit)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func() {
+		err = rows.Close()
+		if err != nil {
+			log.Fatalf("dbOutboxGet rows.Close: %v", err)
+		}
+	}()
+	for rows.Next() {
+		var msg string
+		if err = rows.Scan(&msg); err != nil {
+			log.Panic(err)
+		}
+		result = append(result, []byte(msg))
+	}
+	return result
+}
+
+// Returns the value of a setting stored in the config table, and whether it exists
+func dbGetConfig(key string) (string, bool) {
+	var value string
+	err := mainDb.QueryRow("SELECT value FROM config WHERE key=?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+	return value, true
+}
+
+// Stores a setting in the config table
+func dbSetConfig(key string, value string) {
+	_, err := mainDb.Exec("INSERT OR REPLACE INTO config(key, value) VALUES (?, ?)", key, value)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Returns the stored peer record for the address, or nil
+func dbGetPeerRecord(address string) *p2pPeerRecord {
+	var r p2pPeerRecord
+	err := mainDb.QueryRow("SELECT address, node_key, timestamp, signature FROM peer_records WHERE address=?", address).Scan(
+		&r.Address, &r.NodeKey, &r.Timestamp, &r.Signature)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+	return &r
+}
+
+// Returns at most limit peer records, the newest first
+func dbGetPeerRecords(limit int) []p2pPeerRecord {
+	var result []p2pPeerRecord
+	rows, err := mainDb.Query("SELECT address, node_key, timestamp, signature FROM peer_records ORDER BY timestamp DESC LIMIT ?", limit)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func() {
+		err = rows.Close()
+		if err != nil {
+			log.Fatalf("dbGetPeerRecords rows.Close: %v", err)
+		}
+	}()
+	for rows.Next() {
+		var r p2pPeerRecord
+		if err = rows.Scan(&r.Address, &r.NodeKey, &r.Timestamp, &r.Signature); err != nil {
+			log.Panic(err)
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// Stores the peer record, replacing the one for the same address
+func dbSavePeerRecord(r *p2pPeerRecord) {
+	_, err := mainDb.Exec("INSERT OR REPLACE INTO peer_records(address, node_key, timestamp, hops, signature) VALUES (?, ?, ?, 0, ?)",
+		r.Address, r.NodeKey, r.Timestamp, r.Signature)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Removes the peer record for the address
+func dbDeletePeerRecord(address string) {
+	_, err := mainDb.Exec("DELETE FROM peer_records WHERE address=?", address)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Removes the peer records signed before the given Unix timestamp
+func dbPeerRecordsExpire(before int64) {
+	_, err := mainDb.Exec("DELETE FROM peer_records WHERE timestamp<?", before)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// A recorded anchor
+type dbAnchor struct {
+	publisher string
+	statement *AnchorStatement
+	proof     []byte
+}
+
+// Records the anchor of the block by the publisher
+func dbInsertAnchor(publisher string, statement *AnchorStatement, proof []byte) error {
+	_, err := mainDb.Exec("INSERT OR REPLACE INTO anchors(publisher, block_height, hash, chain, proof, time_added) VALUES (?, ?, ?, ?, ?, ?)",
+		publisher, statement.Height, statement.Hash, statement.Chain, proof, getNowUTC())
+	return err
+}
+
+// Returns the highest block anchored by the publisher, and false if there is none
+func dbGetLastAnchorHeight(publisher string) (int, bool) {
+	var height sql.NullInt64
+	err := mainDb.QueryRow("SELECT MAX(block_height) FROM anchors WHERE publisher=?", publisher).Scan(&height)
+	if err != nil {
+		log.Panic(err)
+	}
+	return int(height.Int64), height.Valid
+}
+
+// Returns all the recorded anchors, by height
+func dbGetAnchors() ([]dbAnchor, error) {
+	if !dbTableExists(mainDb, "anchors") {
+		// A read-only database of an older version
+		return nil, nil
+	}
+	rows, err := mainDb.Query("SELECT publisher, block_height, hash, chain, proof FROM anchors ORDER BY block_height, publisher")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []dbAnchor
+	for rows.Next() {
+		a := dbAnchor{statement: &AnchorStatement{}}
+		if err = rows.Scan(&a.publisher, &a.statement.Height, &a.statement.Hash, &a.statement.Chain, &a.proof); err != nil {
+			return nil, err
+		}
+		result = append(result, a)
+	}
+	return result, rows.Err()
+}
+
+// A governance order in the audit log
+type dbGovernanceLogEntry struct {
+	GovernanceOrder
+	Issuer    string `json:"issuer"`
+	Source    string `json:"source"`
+	Result    string `json:"result"`
+	TimeAdded string `json:"time_added"`
+}
+
+// Records the governance order received from the source, with the result of applying it
+func dbInsertGovernanceOrder(o *GovernanceOrder, source, result string) error {
+	_, err := mainDb.Exec("INSERT OR IGNORE INTO governance_log(id, command, params, issuer, issued, expires, public_key, signature, source, result, time_added) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		o.ID, o.Command, jsonifyWhatever(o.Params), o.issuer(), o.Issued, o.Expires, o.PublicKey, o.Signature, source, result, getNowUTC())
+	return err
+}
+
+// Returns true if the governance order has been recorded
+func dbGovernanceOrderExists(id string) bool {
+	var count int
+	err := mainDb.QueryRow("SELECT COUNT(*) FROM governance_log WHERE id=?", id).Scan(&count)
+	if err != nil {
+		log.Panic(err)
+	}
+	return count > 0
+}
+
+// Returns the governance orders in the listing's time range, after the order at the
+// given time and rowid in the listing's order if the cursor isn't nil, at most limit of
+// them. Also returns the time and rowid of each, for the cursors.
+func dbListGovernanceLog(lp *listParams, cursor []int64, limit int) ([]dbGovernanceLogEntry, [][2]int64, error) {
+	since, until := lp.timeRange()
+	order, cmp := "ASC", ">"
+	if lp.desc {
+		order, cmp = "DESC", "<"
+	}
+	query := "SELECT id, command, params, issuer, issued, expires, public_key, signature, source, result, time_added, rowid FROM governance_log WHERE time_added BETWEEN ? AND ?"
+	args := []interface{}{since, until}
+	if cursor != nil {
+		query += " AND (time_added " + cmp + " ? OR (time_added = ? AND rowid " + cmp + " ?))"
+		args = append(args, cursor[0], cursor[0], cursor[1])
+	}
+	query += " ORDER BY time_added " + order + ", rowid " + order + " LIMIT ?"
+	rows, err := mainDb.Query(query, append(args, limit)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	result := []dbGovernanceLogEntry{}
+	var keys [][2]int64
+	for rows.Next() {
+		var e dbGovernanceLogEntry
+		var params string
+		var timeAdded, rowid int64
+		if err = rows.Scan(&e.ID, &e.Command, &params, &e.Issuer, &e.Issued, &e.Expires, &e.PublicKey, &e.Signature, &e.Source, &e.Result, &timeAdded, &rowid); err != nil {
+			return nil, nil, err
+		}
+		if err = json.Unmarshal([]byte(params), &e.Params); err != nil {
+			return nil, nil, err
+		}
+		e.TimeAdded = time.Unix(timeAdded, 0).UTC().Format(time.RFC3339)
+		result = append(result, e)
+		keys = append(keys, [2]int64{timeAdded, rowid})
+	}
+	return result, keys, rows.Err()
+}
+
+// The recorded propagation of a block
+type dbPropagation struct {
+	delay         time.Duration // from the block's timestamp to its acceptance
+	announceDelay time.Duration // from its first announcement to its acceptance
+	firstPeer     string
+}
+
+// Records the propagation delays of the block
+func dbInsertPropagation(height int, hash string, delay, announceDelay time.Duration, firstPeer string) error {
+	_, err := mainDb.Exec("INSERT OR REPLACE INTO block_propagation(block_height, hash, delay_ms, announce_delay_ms, first_peer, time_added) VALUES (?, ?, ?, ?, ?, ?)",
+		height, hash, delay.Milliseconds(), announceDelay.Milliseconds(), firstPeer, getNowUTC())
+	return err
+}
+
+// Returns the recorded propagation of the blocks in the range of heights, by height
+func dbGetPropagation(minHeight, maxHeight int) (map[int]dbPropagation, error) {
+	result := map[int]dbPropagation{}
+	if !dbTableExists(mainDb, "block_propagation") {
+		// A read-only database of an older version
+		return result, nil
+	}
+	rows, err := mainDb.Query("SELECT block_height, delay_ms, announce_delay_ms, first_peer FROM block_propagation WHERE block_height BETWEEN ? AND ?", minHeight, maxHeight)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var height int
+		var delay, announceDelay int64
+		var p dbPropagation
+		if err = rows.Scan(&height, &delay, &announceDelay, &p.firstPeer); err != nil {
+			return nil, err
+		}
+		p.delay = time.Duration(delay) * time.Millisecond
+		p.announceDelay = time.Duration(announceDelay) * time.Millisecond
+		result[height] = p
+	}
+	return result, rows.Err()
+}
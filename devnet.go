@@ -0,0 +1,214 @@
+package daisy
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The devnet command runs a local network of devnet profile nodes for integration testing:
+// it creates a fresh chain in the data directory of the first node, with all the nodes as
+// its bootstrap peers, seeds the other nodes' data directories with its genesis block, and
+// runs every node as a child process of the same binary, since a node keeps its state in
+// globals and there can only be one per process. The nodes' logs are prefixed with their
+// names. The first node holds the genesis key and seals the documents written to its
+// pending directory into blocks every second, and the others sync them. Node i listens
+// for p2p connections on the port -base-port + 2i and serves the HTTP API on the port
+// after it. The nodes' data directories are kept, so the network can be restarted where it
+// stopped, unless -reset is given.
+
+// The subdirectory of the devnet data directory with the local network's nodes
+const devnetClusterSubdirectory = "cluster"
+
+// A node of the local devnet
+type devnetNode struct {
+	name     string
+	dir      string
+	p2pPort  int
+	httpPort int
+	cmd      *exec.Cmd
+}
+
+// Closes the system databases opened while seeding a node's data directory
+func devnetCloseDbs() {
+	mainDb.Close()
+	privateDb.Close()
+}
+
+// Creates a fresh chain in the first node's data directory, and seeds the other nodes'
+// data directories with it. Nodes which already have data directories are left alone.
+func devnetSeed(nodes []*devnetNode) error {
+	first := nodes[0]
+	// The data directories are seeded from this process, which mustn't add the mainnet's
+	// peers to them
+	bootstrapPeers = peerStringMap{}
+	if !fileExists(first.dir) {
+		if err := os.MkdirAll(first.dir, 0700); err != nil {
+			return err
+		}
+		ncp := NewChainParams{ChainParams: ChainParams{
+			Creator:     "devnet@localhost",
+			Description: "Daisy local devnet",
+			KeyOpQuorum: 1,
+		}}
+		for _, n := range nodes {
+			ncp.BootstrapPeers = append(ncp.BootstrapPeers, fmt.Sprintf("127.0.0.1:%d", n.p2pPort))
+		}
+		ncp.GenesisBlockTimestamp = time.Now().Format(time.RFC3339)
+		cfg.DataDir = first.dir
+		log.Println("Creating a fresh devnet chain in", first.dir)
+		newChainCreate(ncp)
+		devnetCloseDbs()
+	}
+
+	cfg.DataDir = first.dir
+	cpJSON, err := ioutil.ReadFile(filepath.Join(first.dir, chainParamsBaseName))
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(cpJSON, &chainParams); err != nil {
+		return err
+	}
+	if err = chainHashInit(&chainParams); err != nil {
+		return err
+	}
+	genesis, err := ioutil.ReadFile(blockchainGetFilename(genesisBlockHeight))
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes[1:] {
+		if fileExists(n.dir) {
+			continue
+		}
+		log.Println("Seeding", n.name, "in", n.dir, "with the devnet's genesis block")
+		cfg.DataDir = n.dir
+		initChainFromGenesis(genesis)
+		devnetCloseDbs()
+	}
+	return nil
+}
+
+// Starts the node as a child process, passing its log on with its name
+func (n *devnetNode) start(executable string, produce bool) error {
+	args := []string{"-profile", ProfileDevnet, "-dir", n.dir, "-port", fmt.Sprint(n.p2pPort), "-http-port", fmt.Sprint(n.httpPort)}
+	if !produce {
+		args = append(args, "-block-schedule=")
+	}
+	n.cmd = exec.Command(executable, args...)
+	n.cmd.Stdout = os.Stdout
+	stderr, err := n.cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err = n.cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			fmt.Fprintf(os.Stderr, "[%s] %s\n", n.name, scanner.Text())
+		}
+	}()
+	return nil
+}
+
+// Asks the node to stop
+func (n *devnetNode) stop() {
+	if n.cmd == nil || n.cmd.Process == nil {
+		return
+	}
+	if err := n.cmd.Process.Signal(os.Interrupt); err != nil {
+		// Windows cannot interrupt other processes
+		n.cmd.Process.Kill()
+	}
+}
+
+// Runs a local network of devnet nodes, run as: devnet -nodes 5
+func actionDevnet(args []string) {
+	fs := flag.NewFlagSet("devnet", flag.ExitOnError)
+	numNodes := fs.Int("nodes", 3, "The number of nodes")
+	basePort := fs.Int("base-port", chainProfiles[ProfileDevnet].p2pPort, "The p2p port of the first node; the HTTP port of each node is the one after its p2p port")
+	dir := fs.String("dir", filepath.Join(defaultDataDir(), chainProfiles[ProfileDevnet].dataSubdir, devnetClusterSubdirectory), "The directory with the nodes' data directories")
+	reset := fs.Bool("reset", false, "Delete the nodes' data directories and start with a fresh chain")
+	fs.Parse(args)
+	if *numNodes < 1 {
+		log.Fatalln("The devnet needs at least 1 node")
+	}
+	if *basePort < 1 || *basePort+2**numNodes-1 > 65535 {
+		log.Fatalln("Invalid -base-port:", *basePort)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatalln("Cannot find the daisy executable:", err)
+	}
+	if *reset {
+		log.Println("Deleting the devnet in", *dir)
+		if err = os.RemoveAll(*dir); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	nodes := make([]*devnetNode, *numNodes)
+	for i := range nodes {
+		nodes[i] = &devnetNode{
+			name:     fmt.Sprintf("node%d", i),
+			dir:      filepath.Join(*dir, fmt.Sprintf("node%d", i)),
+			p2pPort:  *basePort + 2*i,
+			httpPort: *basePort + 2*i + 1,
+		}
+	}
+	if err = devnetSeed(nodes); err != nil {
+		log.Fatalln("Cannot create the devnet:", err)
+	}
+
+	sigChannel := make(chan os.Signal, 1)
+	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGTERM)
+	exited := make(chan *devnetNode, len(nodes))
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		if err = n.start(executable, i == 0); err != nil {
+			log.Println("Cannot start", n.name, err)
+			for _, started := range nodes[:i] {
+				started.stop()
+			}
+			wg.Wait()
+			os.Exit(1)
+		}
+		wg.Add(1)
+		go func(n *devnetNode) {
+			defer wg.Done()
+			if err := n.cmd.Wait(); err != nil {
+				log.Println(n.name, "exited:", err)
+			}
+			exited <- n
+		}(n)
+	}
+
+	fmt.Printf("%-8s %-10s %-36s %s\n", "node", "p2p", "api", "data")
+	for _, n := range nodes {
+		fmt.Printf("%-8s %-10d %-36s %s\n", n.name, n.p2pPort, fmt.Sprintf("http://127.0.0.1:%d/", n.httpPort), n.dir)
+	}
+	fmt.Println("Documents written to", filepath.Join(nodes[0].dir, pendingSubdirectoryBaseName), "are sealed into blocks every second. Press ^C to stop.")
+
+	// The devnet runs until it's stopped or one of its nodes exits
+	select {
+	case <-sigChannel:
+		log.Println("Stopping the devnet")
+	case n := <-exited:
+		log.Println(n.name, "has stopped, stopping the devnet")
+	}
+	for _, n := range nodes {
+		n.stop()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,102 @@
+package daisy
+
+import (
+	"log"
+)
+
+// DefaultDiskWarningMB is the default free space (in MiB) below which warnings are logged
+const DefaultDiskWarningMB = 1024
+
+// DefaultDiskCriticalMB is the default free space (in MiB) below which new blocks are refused
+const DefaultDiskCriticalMB = 256
+
+const (
+	diskSpaceOk = iota
+	diskSpaceWarning
+	diskSpaceCritical
+)
+
+var diskSpaceStateNames = map[int]string{
+	diskSpaceOk:       "ok",
+	diskSpaceWarning:  "warning",
+	diskSpaceCritical: "critical",
+}
+
+// The last observed state of the free space in the data directory
+type diskSpaceStatus struct {
+	state     int
+	freeBytes uint64
+	lock      WithMutex
+}
+
+var diskSpace diskSpaceStatus
+
+// Checks the free space in the data directory and in the block storage directories which
+// receive new blocks, and logs a warning if a threshold has been crossed since the last
+// check. Returns the new state, for the directory with the least free space.
+func checkDiskSpace() int {
+	height := -1
+	if mainDb != nil {
+		height = dbGetBlockchainHeight()
+	}
+	dir := cfg.DataDir
+	free, err := getFreeDiskSpace(dir)
+	if err != nil {
+		log.Println("Cannot get free disk space for", dir, err)
+		return diskSpaceOk
+	}
+	for _, storageDir := range blockStorageWritableDirs(height)[1:] {
+		storageFree, err := getFreeDiskSpace(storageDir)
+		if err != nil {
+			log.Println("Cannot get free disk space for", storageDir, err)
+			continue
+		}
+		if storageFree < free {
+			dir, free = storageDir, storageFree
+		}
+	}
+	state := diskSpaceOk
+	if free < uint64(cfg.DiskCriticalMB)*1024*1024 {
+		state = diskSpaceCritical
+	} else if free < uint64(cfg.DiskWarningMB)*1024*1024 {
+		state = diskSpaceWarning
+	}
+	var oldState int
+	diskSpace.lock.With(func() {
+		oldState = diskSpace.state
+		diskSpace.state = state
+		diskSpace.freeBytes = free
+	})
+	if state != oldState {
+		switch state {
+		case diskSpaceOk:
+			log.Printf("Free disk space in %s is back to normal (%d MiB)", dir, free/(1024*1024))
+		case diskSpaceWarning:
+			log.Printf("WARNING: Low disk space in %s: %d MiB free", dir, free/(1024*1024))
+		case diskSpaceCritical:
+			log.Printf("CRITICAL: Disk space in %s is critically low: %d MiB free. Not accepting new blocks until space is freed.",
+				dir, free/(1024*1024))
+		}
+	}
+	return state
+}
+
+// Returns true if there's not enough free disk space to safely write new blocks.
+func diskSpaceIsCritical() bool {
+	var critical bool
+	diskSpace.lock.With(func() {
+		critical = diskSpace.state == diskSpaceCritical
+	})
+	return critical
+}
+
+// Returns the last observed disk space state name and the free space in bytes
+func getDiskSpaceStatus() (string, uint64) {
+	var state int
+	var free uint64
+	diskSpace.lock.With(func() {
+		state = diskSpace.state
+		free = diskSpace.freeBytes
+	})
+	return diskSpaceStateNames[state], free
+}
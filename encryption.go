@@ -0,0 +1,338 @@
+package daisy
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// Encrypted documents are attachments whose content is encrypted with a random per-document
+// AES-256 key. The document key is wrapped for each recipient public key (ECDH with an
+// ephemeral P-256 key) and stored in the _key_envelopes table of the block, alongside the
+// attachment. Only the holders of the recipients' private keys can decrypt the document.
+
+// The cipher used for the encrypted documents: AES-256-GCM over 64 KiB segments
+const encryptionCipherName = "aes-256-gcm-stream64k"
+
+const encryptionSegmentSize = 64 * 1024
+
+// Returns an AEAD nonce for the given segment number, marking the final segment so that
+// truncated ciphertexts are detected.
+func encryptionSegmentNonce(n uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, n)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Encrypts the input stream with the given key, segment by segment
+func encryptStream(key []byte, in io.Reader, out io.Writer) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(in, encryptionSegmentSize)
+	buf := make([]byte, encryptionSegmentSize)
+	for n := uint64(0); ; n++ {
+		size, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := err != nil
+		if !final {
+			if _, err := r.Peek(1); err == io.EOF {
+				final = true
+			}
+		}
+		if _, err := out.Write(aead.Seal(nil, encryptionSegmentNonce(n, final), buf[0:size], nil)); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// Decrypts the input stream encrypted with encryptStream
+func decryptStream(key []byte, in io.Reader, out io.Writer) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(in, encryptionSegmentSize+aead.Overhead())
+	buf := make([]byte, encryptionSegmentSize+aead.Overhead())
+	for n := uint64(0); ; n++ {
+		size, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := err != nil
+		if !final {
+			if _, err := r.Peek(1); err == io.EOF {
+				final = true
+			}
+		}
+		plaintext, err := aead.Open(nil, encryptionSegmentNonce(n, final), buf[0:size], nil)
+		if err != nil {
+			return fmt.Errorf("Cannot decrypt segment %d: %v", n, err)
+		}
+		if _, err = out.Write(plaintext); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// Derives the key wrapping key from an ECDH shared secret
+func encryptionKDF(sharedX []byte, ephemeralPublicKey []byte, recipient string) []byte {
+	h := sha256.New()
+	h.Write(sharedX)
+	h.Write(ephemeralPublicKey)
+	h.Write([]byte(recipient))
+	return h.Sum(nil)
+}
+
+// Wraps the document key for the given recipient public key. Returns the ephemeral public key
+// and the wrapped key.
+func encryptionWrapKey(documentKey []byte, recipientKey *ecdsa.PublicKey, recipient string) ([]byte, []byte, error) {
+	ephemeral, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	ephemeralPublicKey, err := x509.MarshalPKIXPublicKey(&ephemeral.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedX, _ := elliptic.P256().ScalarMult(recipientKey.X, recipientKey.Y, ephemeral.D.Bytes())
+	block, err := aes.NewCipher(encryptionKDF(sharedX.Bytes(), ephemeralPublicKey, recipient))
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ephemeralPublicKey, aead.Seal(nil, make([]byte, aead.NonceSize()), documentKey, nil), nil
+}
+
+// Unwraps a document key wrapped with encryptionWrapKey, using the recipient's private key
+func encryptionUnwrapKey(wrappedKey []byte, ephemeralPublicKey []byte, recipientKey *ecdsa.PrivateKey, recipient string) ([]byte, error) {
+	ephemeral, err := cryptoDecodePublicKeyBytes(ephemeralPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if !elliptic.P256().IsOnCurve(ephemeral.X, ephemeral.Y) {
+		return nil, fmt.Errorf("Ephemeral key is not on the curve")
+	}
+	sharedX, _ := elliptic.P256().ScalarMult(ephemeral.X, ephemeral.Y, recipientKey.D.Bytes())
+	block, err := aes.NewCipher(encryptionKDF(sharedX.Bytes(), ephemeralPublicKey, recipient))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, aead.NonceSize()), wrappedKey, nil)
+}
+
+// Encrypts the given file to the given recipients (public key hashes from the pubkeys table),
+// attaches the ciphertext to the block database and records the key envelopes.
+// Returns the attachment record.
+func encryptAttachFile(db *sql.DB, fileName string, recipients []string) (*BlockAttachment, error) {
+	documentKey := make([]byte, 32)
+	if _, err := rand.Read(documentKey); err != nil {
+		return nil, err
+	}
+	in, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile("", "daisy")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if err = encryptStream(documentKey, in, tmp); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+	att, err := attachmentChunkFile(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	att.name = st.Name() + ".enc"
+
+	dbEnsureAttachmentTables(db)
+	dbEnsureEncryptionTables(db)
+	if err = dbInsertAttachment(db, att); err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec("INSERT INTO _encrypted (attachment_hash, cipher, plaintext_size) VALUES (?, ?, ?)",
+		att.hash, encryptionCipherName, st.Size()); err != nil {
+		return nil, err
+	}
+	for _, recipient := range recipients {
+		dbpk, err := dbGetPublicKey(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown recipient public key %s", recipient)
+		}
+		recipientKey, err := cryptoDecodePublicKeyBytes(dbpk.publicKeyBytes)
+		if err != nil {
+			return nil, err
+		}
+		ephemeralPublicKey, wrappedKey, err := encryptionWrapKey(documentKey, recipientKey, recipient)
+		if err != nil {
+			return nil, err
+		}
+		_, err = db.Exec("INSERT INTO _key_envelopes (attachment_hash, recipient, ephemeral_pubkey, wrapped_key) VALUES (?, ?, ?, ?)",
+			att.hash, recipient, hex.EncodeToString(ephemeralPublicKey), hex.EncodeToString(wrappedKey))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return att, nil
+}
+
+// Ensures the encrypted document tables exist in a SQLite database
+func dbEnsureEncryptionTables(db *sql.DB) {
+	if !dbTableExists(db, "_encrypted") {
+		if _, err := db.Exec(encryptedTableCreate); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if !dbTableExists(db, "_key_envelopes") {
+		if _, err := db.Exec(keyEnvelopesTableCreate); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Checks that the key envelopes in the block refer to its encrypted attachments
+func (b *Block) dbCheckKeyEnvelopes() error {
+	if !dbTableExists(b.db, "_key_envelopes") {
+		return nil
+	}
+	if !dbTableExists(b.db, "_encrypted") || !dbTableExists(b.db, "_attachments") {
+		return fmt.Errorf("Block has key envelopes but no encrypted attachments")
+	}
+	var count int
+	err := b.db.QueryRow(`SELECT COUNT(*) FROM _key_envelopes WHERE attachment_hash NOT IN
+		(SELECT attachment_hash FROM _encrypted WHERE attachment_hash IN (SELECT hash FROM _attachments))`).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count != 0 {
+		return fmt.Errorf("Block has %d key envelopes for unknown encrypted attachments", count)
+	}
+	return nil
+}
+
+// Decrypts the encrypted attachment with the given hash into a file, using one of our
+// private keys which is among the attachment's recipients.
+func decryptAttachment(hash string, outputFilename string) error {
+	att, height, err := blockchainFindAttachment(hash)
+	if err != nil {
+		return err
+	}
+	b, err := OpenBlockByHeight(height)
+	if err != nil {
+		return err
+	}
+	var documentKey []byte
+	var cipherName string
+	err = b.db.QueryRow("SELECT cipher FROM _encrypted WHERE attachment_hash=?", hash).Scan(&cipherName)
+	if err == nil && cipherName != encryptionCipherName {
+		err = fmt.Errorf("Unsupported cipher %s", cipherName)
+	}
+	if err == nil {
+		for _, myKeyHash := range dbGetMyPublicKeyHashes() {
+			var ephemeralHex, wrappedHex string
+			if b.db.QueryRow("SELECT ephemeral_pubkey, wrapped_key FROM _key_envelopes WHERE attachment_hash=? AND recipient=?",
+				hash, myKeyHash).Scan(&ephemeralHex, &wrappedHex) != nil {
+				continue
+			}
+			var myKey *ecdsa.PrivateKey
+			if myKey, err = cryptoGetPrivateKey(myKeyHash); err != nil {
+				break
+			}
+			// The envelope comes from a peer's block, so it mustn't be trusted to be valid hex
+			var wrappedKey, ephemeralPublicKey []byte
+			if wrappedKey, err = hex.DecodeString(wrappedHex); err != nil {
+				err = fmt.Errorf("Invalid key envelope of %s: %v", hash, err)
+				break
+			}
+			if ephemeralPublicKey, err = hex.DecodeString(ephemeralHex); err != nil {
+				err = fmt.Errorf("Invalid key envelope of %s: %v", hash, err)
+				break
+			}
+			documentKey, err = encryptionUnwrapKey(wrappedKey, ephemeralPublicKey, myKey, myKeyHash)
+			break
+		}
+	}
+	b.Close()
+	if err != nil {
+		return err
+	}
+	if documentKey == nil {
+		return fmt.Errorf("None of my keys is a recipient of %s", hash)
+	}
+
+	tmp, err := ioutil.TempFile("", "daisy")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err = attachmentWriteFile(att, tmp.Name()); err != nil {
+		return err
+	}
+	in, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(outputFilename)
+	if err != nil {
+		return err
+	}
+	if err = decryptStream(documentKey, in, out); err != nil {
+		out.Close()
+		os.Remove(outputFilename)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,295 @@
+package daisy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Exports contain the headers of a range of blocks together with their documents, and
+// optionally the block files themselves (the payloads). The json and ndjson formats also
+// contain the chain params, and exports with payloads starting at the genesis block can be
+// imported into a fresh node. The csv format contains only the headers and is meant for
+// spreadsheets and analytics tools.
+
+// The supported export formats
+const (
+	exportFormatJSON   = "json"
+	exportFormatNDJSON = "ndjson"
+	exportFormatCSV    = "csv"
+)
+
+// ExportDocument describes a document (an attachment) in an exported block
+type ExportDocument struct {
+	Hash   string `json:"hash"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Bundle string `json:"bundle,omitempty"`
+}
+
+// ExportBlock is an exported block
+type ExportBlock struct {
+	BlockHeader
+	Documents    []ExportDocument `json:"documents"`
+	ManifestHash string           `json:"manifest_hash"`
+	Payload      string           `json:"payload,omitempty"`
+}
+
+// ExportFile is the structure of a json export. An ndjson export has the same data: an
+// object with the chain_params on the first line, followed by one ExportBlock per line.
+type ExportFile struct {
+	ChainParams *ChainParams  `json:"chain_params"`
+	Blocks      []ExportBlock `json:"blocks"`
+}
+
+// Returns the exported data of the block at the given height
+func blockchainExportBlock(height int, withPayload bool) (*ExportBlock, error) {
+	hdr, err := blockchainGetHeader(height)
+	if err != nil {
+		return nil, err
+	}
+	eb := ExportBlock{BlockHeader: *hdr, Documents: []ExportDocument{}}
+	b, err := OpenBlockByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	atts, err := b.dbGetAttachments()
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	bundles, err := b.dbGetBundles()
+	b.Close()
+	if err != nil {
+		return nil, err
+	}
+	for _, att := range atts {
+		eb.Documents = append(eb.Documents, ExportDocument{Hash: att.hash, Name: att.name, Size: att.size, Bundle: bundles[strings.ToLower(att.hash)]})
+	}
+	eb.ManifestHash = canonicalManifestHash(eb.Documents)
+	if withPayload {
+		data, err := ioutil.ReadFile(blockchainGetFilename(height))
+		if err != nil {
+			return nil, err
+		}
+		eb.Payload = base64.StdEncoding.EncodeToString(data)
+	}
+	return &eb, nil
+}
+
+// Exports blocks, run as: export [-from height] [-to height] [-format json|ndjson|csv] [-payloads] [-o file]
+func actionExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	from := fs.Int("from", 0, "The first block height to export")
+	to := fs.Int("to", -1, "The last block height to export (default: the last block)")
+	format := fs.String("format", exportFormatJSON, "The export format: json, ndjson or csv")
+	payloads := fs.Bool("payloads", false, "Include the block files (not supported in csv)")
+	output := fs.String("o", "", "The output file (default: standard output)")
+	fs.Parse(args)
+
+	height := dbGetBlockchainHeight()
+	if *to < 0 || *to > height {
+		*to = height
+	}
+	if *from < 0 || *from > *to {
+		log.Fatalln("Invalid range of heights:", *from, "to", *to)
+	}
+	if *format == exportFormatCSV && *payloads {
+		log.Fatalln("Payloads cannot be exported in the csv format")
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+
+	var err error
+	switch *format {
+	case exportFormatJSON:
+		err = exportJSON(w, *from, *to, *payloads)
+	case exportFormatNDJSON:
+		err = exportNDJSON(w, *from, *to, *payloads)
+	case exportFormatCSV:
+		err = exportCSV(w, *from, *to)
+	default:
+		log.Fatalln("Unknown export format:", *format)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Fatalln("Export failed:", err)
+	}
+	log.Println("Exported blocks", *from, "to", *to)
+}
+
+func exportJSON(w io.Writer, from, to int, withPayloads bool) error {
+	ef := ExportFile{ChainParams: &chainParams, Blocks: []ExportBlock{}}
+	for h := from; h <= to; h++ {
+		eb, err := blockchainExportBlock(h, withPayloads)
+		if err != nil {
+			return fmt.Errorf("Block %d: %v", h, err)
+		}
+		ef.Blocks = append(ef.Blocks, *eb)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ef)
+}
+
+func exportNDJSON(w io.Writer, from, to int, withPayloads bool) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(ExportFile{ChainParams: &chainParams}); err != nil {
+		return err
+	}
+	for h := from; h <= to; h++ {
+		eb, err := blockchainExportBlock(h, withPayloads)
+		if err != nil {
+			return fmt.Errorf("Block %d: %v", h, err)
+		}
+		if err = enc.Encode(eb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportCSV(w io.Writer, from, to int) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"height", "hash", "previous_block_hash", "creator_public_key_hash", "timestamp", "documents_root", "document_hashes"})
+	if err != nil {
+		return err
+	}
+	for h := from; h <= to; h++ {
+		eb, err := blockchainExportBlock(h, false)
+		if err != nil {
+			return fmt.Errorf("Block %d: %v", h, err)
+		}
+		var docHashes []string
+		for _, doc := range eb.Documents {
+			docHashes = append(docHashes, doc.Hash)
+		}
+		err = cw.Write([]string{strconv.Itoa(eb.Height), eb.Hash, eb.PreviousBlockHash, eb.CreatorPublicKeyHash,
+			eb.Timestamp, eb.DocumentsRoot, strings.Join(docHashes, ";")})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Reads a json or ndjson export
+func exportRead(fileName string) (*ExportFile, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ef ExportFile
+	dec := json.NewDecoder(bufio.NewReader(f))
+	if err = dec.Decode(&ef); err != nil {
+		return nil, err
+	}
+	// In ndjson, the blocks follow the first object
+	for dec.More() {
+		var eb ExportBlock
+		if err = dec.Decode(&eb); err != nil {
+			return nil, err
+		}
+		ef.Blocks = append(ef.Blocks, eb)
+	}
+	if ef.ChainParams == nil {
+		return nil, fmt.Errorf("The export doesn't contain the chain params")
+	}
+	return &ef, nil
+}
+
+// Imports an export with payloads into a fresh data directory. All the blocks are verified
+// as if they were received from peers.
+func actionImport(fileName string) {
+	ef, err := exportRead(fileName)
+	if err != nil {
+		log.Fatalln("Error reading export", fileName, err)
+	}
+	if len(ef.Blocks) == 0 || ef.Blocks[0].Height != 0 {
+		log.Fatalln("The export must start with the genesis block")
+	}
+	chainParams = *ef.ChainParams
+	if chainParams.GenesisBlockHash == "" || chainParams.GenesisBlockHashSignature == "" {
+		log.Fatalln("Incomplete chain params in the export")
+	}
+	if err = chainHashInit(&chainParams); err != nil {
+		log.Fatalln("Error in the chain params of the export:", err)
+	}
+	for i := range ef.Blocks {
+		if ef.Blocks[i].Payload == "" {
+			log.Fatalln("Block", ef.Blocks[i].Height, "has no payload; export with -payloads")
+		}
+	}
+	genesis, err := base64.StdEncoding.DecodeString(ef.Blocks[0].Payload)
+	if err != nil {
+		log.Fatalln("Error decoding the genesis block", err)
+	}
+	initChainFromGenesis(genesis)
+
+	for _, eb := range ef.Blocks[1:] {
+		if err = importExportedBlock(&eb); err != nil {
+			log.Fatalln("Cannot import block", eb.Height, err)
+		}
+	}
+	log.Println("Imported", len(ef.Blocks), "blocks. Reloading to verify...")
+	blockchainInit(false)
+	log.Println("All done.")
+}
+
+func importExportedBlock(eb *ExportBlock) error {
+	data, err := base64.StdEncoding.DecodeString(eb.Payload)
+	if err != nil {
+		return err
+	}
+	if hashBytesToHexString(data) != eb.Hash {
+		return fmt.Errorf("The payload doesn't match the block hash %s", eb.Hash)
+	}
+	hashSignature, err := hex.DecodeString(eb.HashSignature)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile("", "daisy")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	blk, err := blockchainImportBlockFile(f.Name(), hashSignature, "")
+	if err != nil {
+		return err
+	}
+	blk.Close()
+	if blk.Height != eb.Height {
+		return fmt.Errorf("Imported at height %d instead of %d", blk.Height, eb.Height)
+	}
+	return nil
+}
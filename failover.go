@@ -0,0 +1,510 @@
+package daisy
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// With -failover, two or more nodes which have the same signing key run as one block
+// producer: only the active node produces blocks, while the others stand by, following
+// the chain. Every node of the group floods a heartbeat through the p2p network every
+// -failover-heartbeat, signed with the shared key and saying if it's active, in which
+// term, and at which height its chain is. The other nodes relay the heartbeats of the
+// keys which sign blocks in the chain, so they reach the group over any path. A node
+// starts as a standby, and takes over when it hasn't seen the heartbeat of an active node
+// for -failover-timeout, once it has synced up to the height the active node last
+// reported, in a term one higher than any it has seen. If it can't get that block, e.g.
+// because the active node failed before sending it, it takes over at its own tip after
+// another -failover-timeout, and logs and reports the possible fork. When two active
+// nodes see each other, e.g. after a network partition, the one with the lower term (or
+// priority, set by -failover-priority, if the terms are equal) steps down to standby. A
+// node which has just taken over waits two heartbeats before producing, so simultaneous
+// takeovers are resolved before either produces. If the two nodes can't reach each other
+// through the network, but both can reach other peers, both may produce; the network
+// should connect them over more than one path. The state is shown in /status, and the
+// changes are logged and sent to the webhooks as "failover" events.
+
+// Defaults of the failover
+const (
+	DefaultFailoverHeartbeat = "5s"
+	DefaultFailoverTimeout   = "30s"
+)
+
+// The states of a node in a failover group
+const (
+	failoverStandby = "standby"
+	failoverActive  = "active"
+)
+
+// The config table key under which the highest term is kept
+const failoverTermKey = "failover_term"
+
+// How far a heartbeat's issue time may be ahead, for clock differences
+const failoverMaxSkew = time.Minute
+
+// The message carrying a heartbeat
+const p2pMsgHeartbeat = "heartbeat"
+
+type p2pMsgHeartbeatStruct struct {
+	p2pMsgHeader
+	Heartbeat ProducerHeartbeat `json:"heartbeat"`
+}
+
+const canonicalHeartbeatMagic = "DAISYHBT"
+
+// ProducerHeartbeat is the signed announcement of a block producer's state to the other
+// nodes which have the same signing key
+type ProducerHeartbeat struct {
+	Instance  int64  `json:"instance"` // the node's ephemeral ID
+	Active    bool   `json:"active"`
+	Term      int64  `json:"term"`
+	Priority  int    `json:"priority"`
+	Height    int    `json:"height"`
+	Hash      string `json:"hash"`
+	Issued    int64  `json:"issued"` // in nanoseconds, increasing for every heartbeat
+	PublicKey string `json:"public_key"`
+	Signature string `json:"signature"`
+}
+
+// The last heartbeat seen from a node
+type failoverInstance struct {
+	heartbeat ProducerHeartbeat
+	received  time.Time
+	mine      bool // signed with one of this node's keys
+}
+
+var failover = struct {
+	lock       WithMutex
+	state      string
+	term       int64 // of this node if it's active, else the highest one seen
+	since      time.Time
+	key        *ecdsa.PrivateKey
+	publicKey  string
+	keys       map[string]bool // this node's public key hashes
+	instances  map[int64]*failoverInstance
+	lastActive *failoverInstance // the last heartbeat of another active node of the group
+	heardFrom  time.Time         // when an active node of the group was last heard from
+	waiting    bool              // for the chain to sync before taking over
+	takeovers  int
+	fork       string // set when the node has taken over without the active node's last block
+}{
+	instances: map[int64]*failoverInstance{},
+}
+
+// The parsed -failover-heartbeat and -failover-timeout
+var failoverHeartbeat, failoverTimeout time.Duration
+
+// Checks the failover settings
+func failoverConfigure() error {
+	var err error
+	if failoverHeartbeat, err = parseDurationSetting("failover-heartbeat", cfg.FailoverHeartbeat, time.Second, time.Minute); err != nil {
+		return err
+	}
+	if failoverTimeout, err = parseDurationSetting("failover-timeout", cfg.FailoverTimeout, time.Second, time.Hour); err != nil {
+		return err
+	}
+	if failoverTimeout < 3*failoverHeartbeat {
+		return fmt.Errorf("The -failover-timeout must be at least three times the -failover-heartbeat")
+	}
+	if cfg.Failover && (cfg.readOnly || cfg.relay) {
+		return fmt.Errorf("Blocks cannot be produced in the read-only or relay mode")
+	}
+	return nil
+}
+
+// Returns true if the node is in a failover group
+func failoverEnabled() bool {
+	return cfg.Failover && !cfg.readOnly && !cfg.relay
+}
+
+// Returns true if the node is in a failover group and standing by
+func failoverStandingBy() bool {
+	if !failoverEnabled() {
+		return false
+	}
+	standby := false
+	failover.lock.With(func() {
+		standby = failover.state != failoverActive
+	})
+	return standby
+}
+
+// Returns an error if block production is held because another node of the group is
+// active, or this one has just taken over
+func failoverError() error {
+	if !failoverEnabled() {
+		return nil
+	}
+	var err error
+	failover.lock.With(func() {
+		if failover.state != failoverActive {
+			err = fmt.Errorf("Block production is held: this node is a failover standby")
+		} else if time.Since(failover.since) < 2*failoverHeartbeat {
+			err = fmt.Errorf("Block production is held: this node has just taken over")
+		}
+	})
+	return err
+}
+
+// Returns an error if the node mustn't produce blocks now
+func blockProductionError() error {
+	if err := tipCheckError(); err != nil {
+		return err
+	}
+	return failoverError()
+}
+
+// Returns the hash of the signed part of the heartbeat
+func (hb *ProducerHeartbeat) signedHash() string {
+	var w canonicalWriter
+	w.WriteString(canonicalHeartbeatMagic)
+	w.WriteByte(CanonicalVersion)
+	w.writeString(chainParams.GenesisBlockHash)
+	w.writeUint(uint64(hb.Instance))
+	if hb.Active {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+	w.writeUint(uint64(hb.Term))
+	w.writeUint(uint64(int64(hb.Priority)))
+	w.writeUint(uint64(int64(hb.Height)))
+	w.writeString(hb.Hash)
+	w.writeUint(uint64(hb.Issued))
+	w.writeString(hb.PublicKey)
+	return hashBytesToHexString(w.Bytes())
+}
+
+// Returns the hash of the key which signed the heartbeat
+func (hb *ProducerHeartbeat) signer() string {
+	keyBytes, err := hex.DecodeString(hb.PublicKey)
+	if err != nil {
+		return ""
+	}
+	return getPubKeyHash(keyBytes)
+}
+
+// Returns true if the heartbeat's node wins over the given one, when both are active
+func (hb *ProducerHeartbeat) outranks(term int64, priority int, instance int64) bool {
+	if hb.Term != term {
+		return hb.Term > term
+	}
+	if hb.Priority != priority {
+		return hb.Priority > priority
+	}
+	return hb.Instance > instance
+}
+
+// Checks the heartbeat's time and that it's signed by a block signing key of the chain
+func (hb *ProducerHeartbeat) verify(now time.Time) error {
+	issued := time.Unix(0, hb.Issued)
+	if issued.After(now.Add(failoverMaxSkew)) {
+		return fmt.Errorf("The heartbeat is from the future")
+	}
+	if issued.Before(now.Add(-failoverTimeout - failoverMaxSkew)) {
+		return fmt.Errorf("The heartbeat is too old")
+	}
+	if hb.Term < 0 || hb.Height < 0 {
+		return fmt.Errorf("Invalid heartbeat")
+	}
+	signer := hb.signer()
+	if dbpk, err := dbGetPublicKey(signer); err == nil {
+		if dbpk.isRevoked {
+			return fmt.Errorf("The heartbeat is signed with the revoked key %s", signer)
+		}
+	} else if !dbPublicKeyHasSigned(signer) {
+		return fmt.Errorf("The heartbeat is signed with %s, which doesn't sign blocks", signer)
+	}
+	keyBytes, err := hex.DecodeString(hb.PublicKey)
+	if err != nil {
+		return err
+	}
+	publicKey, err := cryptoDecodePublicKeyBytes(keyBytes)
+	if err != nil {
+		return err
+	}
+	return cryptoVerifyHex(publicKey, hb.signedHash(), hb.Signature)
+}
+
+// Sends the heartbeat to all the peers except the one it came from
+func failoverFlood(hb *ProducerHeartbeat, except *p2pConnection) {
+	msg := p2pMsgHeartbeatStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgHeartbeat,
+		},
+		Heartbeat: *hb,
+	}
+	p2pPeers.lock.With(func() {
+		for p2pc := range p2pPeers.peers {
+			if p2pc != except {
+				go p2pc.queueMsg(msg)
+			}
+		}
+	})
+}
+
+// Logs the change of the node's state and notifies the webhooks. Called with the lock held.
+func failoverChangeState(state, reason string) {
+	failover.state = state
+	failover.since = time.Now()
+	failover.waiting = false
+	if state == failoverStandby {
+		failover.fork = ""
+	}
+	log.Println("Failover: this node is now", state, "in term", failover.term, "("+reason+")")
+	report := map[string]interface{}{
+		"event":    "failover",
+		"chain":    chainParams.GenesisBlockHash,
+		"state":    state,
+		"term":     failover.term,
+		"instance": fmt.Sprintf("%x", p2pEphemeralID),
+		"reason":   reason,
+		"height":   dbGetBlockchainHeight(),
+	}
+	if state == failoverActive && failover.fork != "" {
+		report["possible_fork"] = failover.fork
+	}
+	go webhooksNotify(jsonifyWhateverToBytes(report), "the failover event")
+}
+
+// Forgets the nodes which haven't been heard from. Called with the lock held.
+func failoverPrune(now time.Time) {
+	for instance, fi := range failover.instances {
+		if now.Sub(fi.received) > 2*failoverTimeout {
+			delete(failover.instances, instance)
+		}
+	}
+}
+
+// heartbeat: the state of a block producer, relayed by the peer
+func (p2pc *p2pConnection) handleHeartbeat(msg StrIfMap) {
+	if cfg.readOnly {
+		return
+	}
+	var hb ProducerHeartbeat
+	data, err := json.Marshal(msg["heartbeat"])
+	if err == nil {
+		err = json.Unmarshal(data, &hb)
+	}
+	if err != nil {
+		log.Println(p2pc.address, "sent an invalid heartbeat:", err)
+		return
+	}
+	if hb.Instance == p2pEphemeralID {
+		// Flooded back to us
+		return
+	}
+	now := time.Now()
+	seen := false
+	failover.lock.With(func() {
+		if fi := failover.instances[hb.Instance]; fi != nil && hb.Issued <= fi.heartbeat.Issued {
+			seen = true
+		}
+	})
+	if seen {
+		return
+	}
+	if err = hb.verify(now); err != nil {
+		log.Println("Rejected the heartbeat from", p2pc.address+":", err)
+		return
+	}
+	mine := false
+	failover.lock.With(func() {
+		if fi := failover.instances[hb.Instance]; fi != nil && hb.Issued <= fi.heartbeat.Issued {
+			seen = true
+			return
+		}
+		failoverPrune(now)
+		mine = failover.keys[hb.signer()]
+		fi := &failoverInstance{heartbeat: hb, received: now, mine: mine}
+		failover.instances[hb.Instance] = fi
+		if !mine || !failoverEnabled() || !hb.Active {
+			return
+		}
+		if failover.state != failoverActive && hb.Term > failover.term {
+			failover.term = hb.Term
+		}
+		if failover.state == failoverActive && !hb.outranks(failover.term, cfg.FailoverPriority, p2pEphemeralID) {
+			// It will step down when it sees our heartbeat
+			return
+		}
+		failover.lastActive = fi
+		failover.heardFrom = now
+		if failover.state == failoverActive {
+			failover.term = hb.Term
+			failoverChangeState(failoverStandby, fmt.Sprintf("the node %x is active in term %d", hb.Instance, hb.Term))
+		}
+	})
+	if !seen {
+		failoverFlood(&hb, p2pc)
+	}
+}
+
+// Sends this node's heartbeat to the peers, signed with the shared key
+func failoverSendHeartbeat() {
+	var hb ProducerHeartbeat
+	var key *ecdsa.PrivateKey
+	height := dbGetBlockchainHeight()
+	failover.lock.With(func() {
+		hb = ProducerHeartbeat{
+			Instance:  p2pEphemeralID,
+			Active:    failover.state == failoverActive,
+			Term:      failover.term,
+			Priority:  cfg.FailoverPriority,
+			Height:    height,
+			Hash:      dbGetBlockHashByHeight(height),
+			Issued:    time.Now().UnixNano(),
+			PublicKey: failover.publicKey,
+		}
+		key = failover.key
+	})
+	var err error
+	if hb.Signature, err = cryptoSignHex(key, hb.signedHash()); err != nil {
+		log.Println("Cannot sign the heartbeat:", err)
+		return
+	}
+	failoverFlood(&hb, nil)
+}
+
+// Takes over as the active node if no active node has been heard from for the timeout,
+// once the chain has caught up with it
+func failoverCheck() {
+	now := time.Now()
+	height := dbGetBlockchainHeight()
+	failover.lock.With(func() {
+		failoverPrune(now)
+		if failover.state == failoverActive || now.Sub(failover.heardFrom) < failoverTimeout {
+			return
+		}
+		if la := failover.lastActive; la != nil {
+			hb := la.heartbeat
+			if height < hb.Height || dbGetBlockHashByHeight(hb.Height) != hb.Hash {
+				if now.Sub(failover.heardFrom) < 2*failoverTimeout {
+					if !failover.waiting {
+						log.Printf("Failover: the node %x hasn't been heard from for %v, taking over once the blockchain has caught up with its block %d", hb.Instance, now.Sub(failover.heardFrom).Round(time.Second), hb.Height)
+						failover.waiting = true
+					}
+					return
+				}
+				// The block may never arrive, so production resumes from the local tip,
+				// which may fork the chain if the block was sent to other nodes
+				failover.fork = fmt.Sprintf("taken over at height %d without the block %d %s of the node %x, the chain may fork", height, hb.Height, hb.Hash, hb.Instance)
+				log.Println("WARNING: Failover:", failover.fork)
+			}
+		}
+		failover.term++
+		failover.takeovers++
+		dbSetConfig(failoverTermKey, strconv.FormatInt(failover.term, 10))
+		reason := fmt.Sprintf("no active node for %v", now.Sub(failover.heardFrom).Round(time.Second))
+		if failover.fork != "" {
+			reason += "; " + failover.fork
+		}
+		failoverChangeState(failoverActive, reason)
+	})
+}
+
+// Runs the node's part of the failover group: sends the heartbeats and takes over when the
+// active node has gone
+func failoverRun() {
+	key, publicKeyHash, err := cryptoGetAPrivateKey()
+	if err != nil {
+		log.Println("Failover is disabled, there's no signing key:", err)
+		return
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		log.Println("Failover is disabled:", err)
+		return
+	}
+	failover.lock.With(func() {
+		failover.key, failover.publicKey = key, hex.EncodeToString(publicKey)
+		failover.keys = map[string]bool{}
+		for _, hash := range dbGetMyPublicKeyHashes() {
+			failover.keys[hash] = true
+		}
+		if value, ok := dbGetConfig(failoverTermKey); ok {
+			if term, err := strconv.ParseInt(value, 10, 64); err == nil && term > failover.term {
+				failover.term = term
+			}
+		}
+		failover.since = time.Now()
+		if handoverInherited.failoverActive {
+			// The old process of a handover was active
+			failover.state = failoverActive
+			failover.since = failover.since.Add(-2 * failoverHeartbeat)
+			if handoverInherited.failoverTerm > failover.term {
+				failover.term = handoverInherited.failoverTerm
+			}
+			return
+		}
+		failover.state = failoverStandby
+		failover.heardFrom = failover.since
+	})
+	log.Println("Failover: standing by with the key", publicKeyHash+", taking over if no active node is heard from for", failoverTimeout)
+	ticker := time.NewTicker(failoverHeartbeat)
+	defer ticker.Stop()
+	for {
+		failoverCheck()
+		failoverSendHeartbeat()
+		select {
+		case <-nodeQuit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns true and the term if the node is the active one, for the handover
+func failoverHandoverState() (bool, int64) {
+	if !failoverEnabled() {
+		return false, 0
+	}
+	active, term := false, int64(0)
+	failover.lock.With(func() {
+		active, term = failover.state == failoverActive, failover.term
+	})
+	return active, term
+}
+
+// Returns the failover state for /status
+func failoverStatus() map[string]interface{} {
+	status := map[string]interface{}{}
+	now := time.Now()
+	failover.lock.With(func() {
+		status["state"] = failover.state
+		status["term"] = failover.term
+		status["since"] = failover.since.UTC().Format(time.RFC3339)
+		status["takeovers"] = failover.takeovers
+		var members []map[string]interface{}
+		for _, fi := range failover.instances {
+			if !fi.mine {
+				continue
+			}
+			members = append(members, map[string]interface{}{
+				"instance":    fmt.Sprintf("%x", fi.heartbeat.Instance),
+				"active":      fi.heartbeat.Active,
+				"term":        fi.heartbeat.Term,
+				"height":      fi.heartbeat.Height,
+				"seconds_ago": int64(now.Sub(fi.received).Seconds()),
+			})
+		}
+		status["members"] = members
+		if failover.state != failoverActive {
+			status["seconds_without_active"] = int64(now.Sub(failover.heardFrom).Seconds())
+		} else if failover.fork != "" {
+			status["possible_fork"] = failover.fork
+		}
+	})
+	if err := failoverError(); err != nil {
+		status["held"] = err.Error()
+	}
+	return status
+}
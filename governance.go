@@ -0,0 +1,625 @@
+package daisy
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Governance orders let the operators of a private network administer its nodes remotely:
+// an order, signed with one of the keys listed in admin_keys, can ban a peer, change one
+// of a few runtime parameters, or schedule the maintenance. Orders are submitted to any
+// node with POST /governance (the governance command creates and signs them), and flooded
+// from node to node with the governance p2p message. Each node checks the signature
+// against its own admin_keys, the expiry, and that it hasn't seen the order before, then
+// applies it and floods it on. The admin role of the HTTP API isn't enough to give an
+// order, only the signature counts. Every order signed by an admin key is recorded in the
+// governance_log table with its signature, where it came from and its result, so the log
+// can be audited and re-verified, and is shown by GET /governance. Nodes without
+// admin_keys, and read-only nodes, ignore the orders and don't flood them.
+
+// The governance commands
+const (
+	governanceBanPeer             = "ban-peer"
+	governanceSetParameter        = "set-parameter"
+	governanceScheduleMaintenance = "schedule-maintenance"
+)
+
+// The message carrying a governance order
+const p2pMsgGovernance = "governance"
+
+type p2pMsgGovernanceStruct struct {
+	p2pMsgHeader
+	Order GovernanceOrder `json:"order"`
+}
+
+const canonicalGovernanceMagic = "DAISYGOV"
+
+// The longest time an order can be valid for, which is also how long the IDs of the
+// orders seen are remembered
+const governanceMaxLifetime = 7 * 24 * time.Hour
+
+// How far in the future an order's issue time can be, for clock differences
+const governanceMaxSkew = 5 * time.Minute
+
+// The longest ban and the farthest maintenance which can be ordered
+const governanceMaxDelay = 30 * 24 * time.Hour
+
+// How many orders GET /governance returns per page by default
+const governanceLogLimit = 100
+
+// GovernanceOrder is a signed instruction to the nodes from an operator
+type GovernanceOrder struct {
+	ID        string            `json:"id"`
+	Command   string            `json:"command"`
+	Params    map[string]string `json:"params"`
+	Issued    int64             `json:"issued"`
+	Expires   int64             `json:"expires"`
+	PublicKey string            `json:"public_key"`
+	Signature string            `json:"signature"`
+}
+
+// The runtime parameters which can be changed by set-parameter, by their flag names. Each
+// function checks and sets the new value, returning the old one.
+var governanceParameters = map[string]func(value string) (string, error){
+	"p2p-outbound-peers": func(value string) (string, error) {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return "", fmt.Errorf("The target number of outbound peers must be at least 1")
+		}
+		var old int
+		tunables.lock.With(func() {
+			old, tunables.p2pOutboundPeers = tunables.p2pOutboundPeers, n
+		})
+		return strconv.Itoa(old), nil
+	},
+	"stall-alert-minutes": func(value string) (string, error) {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("Invalid -stall-alert-minutes: %s", value)
+		}
+		var old int
+		tunables.lock.With(func() {
+			old, tunables.stallAlertMinutes = tunables.stallAlertMinutes, n
+		})
+		return strconv.Itoa(old), nil
+	},
+	"maintenance-max-load": func(value string) (string, error) {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 {
+			return "", fmt.Errorf("Invalid -maintenance-max-load: %s", value)
+		}
+		var old float64
+		tunables.lock.With(func() {
+			old, tunables.maintenanceMaxLoad = tunables.maintenanceMaxLoad, f
+		})
+		return strconv.FormatFloat(old, 'g', -1, 64), nil
+	},
+	"http-rate-limit": func(value string) (string, error) {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 {
+			return "", fmt.Errorf("Invalid -http-rate-limit: %s", value)
+		}
+		var old float64
+		tunables.lock.With(func() {
+			old, tunables.httpRateLimit = tunables.httpRateLimit, f
+		})
+		return strconv.FormatFloat(old, 'g', -1, 64), nil
+	},
+	"http-max-response-bytes": func(value string) (string, error) {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("Invalid -http-max-response-bytes: %s", value)
+		}
+		var old int64
+		tunables.lock.With(func() {
+			old, tunables.httpMaxResponseBytes = tunables.httpMaxResponseBytes, n
+		})
+		return strconv.FormatInt(old, 10), nil
+	},
+}
+
+// The current values of the runtime parameters. Since governance orders change them
+// while other goroutines use them, they're kept here, starting with the configured
+// values, and read with the accessors below rather than from cfg.
+var tunables = struct {
+	lock                 WithMutex
+	p2pOutboundPeers     int
+	stallAlertMinutes    int
+	maintenanceMaxLoad   float64
+	httpRateLimit        float64
+	httpMaxResponseBytes int64
+}{}
+
+func tunableP2pOutboundPeers() int {
+	var v int
+	tunables.lock.With(func() {
+		v = tunables.p2pOutboundPeers
+	})
+	return v
+}
+
+func tunableStallAlertMinutes() int {
+	var v int
+	tunables.lock.With(func() {
+		v = tunables.stallAlertMinutes
+	})
+	return v
+}
+
+func tunableMaintenanceMaxLoad() float64 {
+	var v float64
+	tunables.lock.With(func() {
+		v = tunables.maintenanceMaxLoad
+	})
+	return v
+}
+
+func tunableHTTPRateLimit() float64 {
+	var v float64
+	tunables.lock.With(func() {
+		v = tunables.httpRateLimit
+	})
+	return v
+}
+
+func tunableHTTPMaxResponseBytes() int64 {
+	var v int64
+	tunables.lock.With(func() {
+		v = tunables.httpMaxResponseBytes
+	})
+	return v
+}
+
+var governance = struct {
+	lock          WithMutex
+	adminKeys     map[string]bool // public key hashes
+	seen          *StringSetWithExpiry
+	bans          *StringSetWithExpiry // hosts
+	maintenanceAt time.Time
+	maintenance   *time.Timer
+	applied       int
+	rejected      int
+}{
+	seen: NewStringSetWithExpiry(governanceMaxLifetime + governanceMaxSkew),
+	bans: NewStringSetWithExpiry(governanceMaxDelay),
+}
+
+// Checks the admin keys
+func governanceConfigure() error {
+	tunables.lock.With(func() {
+		tunables.p2pOutboundPeers = cfg.P2pOutboundPeers
+		tunables.stallAlertMinutes = cfg.StallAlertMinutes
+		tunables.maintenanceMaxLoad = cfg.MaintenanceMaxLoad
+		tunables.httpRateLimit = cfg.HTTPRateLimit
+		tunables.httpMaxResponseBytes = cfg.HTTPMaxResponseBytes
+	})
+	governance.adminKeys = map[string]bool{}
+	for _, key := range cfg.AdminKeys {
+		if !strings.HasPrefix(key, "1:") || !isValidHashHex(key[2:]) {
+			return fmt.Errorf("Invalid admin key %q: expecting a public key hash like the ones shown by mykeys", key)
+		}
+		governance.adminKeys[strings.ToLower(key)] = true
+	}
+	return nil
+}
+
+// Returns true if the node accepts governance orders
+func governanceEnabled() bool {
+	return len(governance.adminKeys) > 0 && !cfg.readOnly
+}
+
+// Returns true if the peer at the address has been banned by a governance order
+func governanceBanned(address string) bool {
+	return governance.bans.Has(p2pPanicHost(address))
+}
+
+// Returns the hash of the signed part of the order
+func (o *GovernanceOrder) signedHash() string {
+	var w canonicalWriter
+	w.WriteString(canonicalGovernanceMagic)
+	w.WriteByte(CanonicalVersion)
+	w.writeString(chainParams.GenesisBlockHash)
+	w.writeString(o.ID)
+	w.writeString(o.Command)
+	names := make([]string, 0, len(o.Params))
+	for name := range o.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.writeUint(uint64(len(names)))
+	for _, name := range names {
+		w.writeString(name)
+		w.writeString(o.Params[name])
+	}
+	w.writeUint(uint64(o.Issued))
+	w.writeUint(uint64(o.Expires))
+	w.writeString(o.PublicKey)
+	return hashBytesToHexString(w.Bytes())
+}
+
+// Returns the hash of the key which signed the order
+func (o *GovernanceOrder) issuer() string {
+	keyBytes, err := hex.DecodeString(o.PublicKey)
+	if err != nil {
+		return ""
+	}
+	return getPubKeyHash(keyBytes)
+}
+
+// Checks the order's ID and validity period, and that it's signed by an admin key
+func (o *GovernanceOrder) verify(now time.Time) error {
+	if len(o.ID) < 16 || len(o.ID) > 64 {
+		return fmt.Errorf("Invalid governance order ID %q", o.ID)
+	}
+	if _, err := hex.DecodeString(o.ID); err != nil {
+		return fmt.Errorf("Invalid governance order ID %q", o.ID)
+	}
+	issued, expires := time.Unix(o.Issued, 0), time.Unix(o.Expires, 0)
+	if issued.After(now.Add(governanceMaxSkew)) {
+		return fmt.Errorf("Governance order %s is from the future", o.ID)
+	}
+	if !expires.After(now) {
+		return fmt.Errorf("Governance order %s has expired", o.ID)
+	}
+	if expires.Sub(issued) > governanceMaxLifetime {
+		return fmt.Errorf("Governance order %s is valid for longer than %v", o.ID, governanceMaxLifetime)
+	}
+	if !governance.adminKeys[o.issuer()] {
+		return fmt.Errorf("Governance order %s is not signed by an admin key", o.ID)
+	}
+	return o.verifySignature()
+}
+
+// Checks the order's signature
+func (o *GovernanceOrder) verifySignature() error {
+	keyBytes, err := hex.DecodeString(o.PublicKey)
+	if err != nil {
+		return err
+	}
+	publicKey, err := cryptoDecodePublicKeyBytes(keyBytes)
+	if err != nil {
+		return err
+	}
+	return cryptoVerifyHex(publicKey, o.signedHash(), o.Signature)
+}
+
+// Carries out the order
+func (o *GovernanceOrder) apply() error {
+	switch o.Command {
+	case governanceBanPeer:
+		return governanceApplyBan(o.Params["peer"], o.Params["duration"])
+	case governanceSetParameter:
+		return governanceApplyParameter(o.Params["name"], o.Params["value"])
+	case governanceScheduleMaintenance:
+		return governanceApplyMaintenance(o.Params["at"])
+	}
+	return fmt.Errorf("Unknown governance command %q", o.Command)
+}
+
+// Bans the peer's host for the duration, or lifts its ban if the duration is 0, and
+// disconnects it
+func governanceApplyBan(peer, duration string) error {
+	if peer == "" {
+		return fmt.Errorf("The ban-peer order needs a peer")
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil || d < 0 || d > governanceMaxDelay {
+		return fmt.Errorf("Invalid ban duration %q: expecting 0 to %v", duration, governanceMaxDelay)
+	}
+	host := p2pPanicHost(peer)
+	if d == 0 {
+		governance.bans.Remove(host)
+		log.Println("Governance: lifted the ban of", host)
+		return nil
+	}
+	governance.bans.AddWithTTL(host, d)
+	log.Println("Governance: banned", host, "for", d)
+	var banned []*p2pConnection
+	p2pPeers.lock.With(func() {
+		for p2pc := range p2pPeers.peers {
+			if p2pPanicHost(p2pc.address) == host {
+				banned = append(banned, p2pc)
+			}
+		}
+	})
+	for _, p2pc := range banned {
+		p2pc.conn.Close()
+	}
+	return nil
+}
+
+// Sets the runtime parameter, restoring its old value if the new one isn't valid
+func governanceApplyParameter(name, value string) error {
+	set, ok := governanceParameters[name]
+	if !ok {
+		return fmt.Errorf("The parameter %q cannot be changed at runtime", name)
+	}
+	old, err := set(value)
+	if err != nil {
+		return err
+	}
+	log.Println("Governance: changed", name, "from", old, "to", value)
+	return nil
+}
+
+// Schedules the maintenance to run at the given time, replacing the one scheduled before
+func governanceApplyMaintenance(at string) error {
+	t, err := time.Parse(time.RFC3339, at)
+	if err != nil {
+		return fmt.Errorf("Invalid maintenance time %q: expecting RFC 3339", at)
+	}
+	delay := time.Until(t)
+	if delay < 0 || delay > governanceMaxDelay {
+		return fmt.Errorf("The maintenance must be scheduled within the next %v", governanceMaxDelay)
+	}
+	governance.lock.With(func() {
+		if governance.maintenance != nil {
+			governance.maintenance.Stop()
+		}
+		governance.maintenanceAt = t
+		governance.maintenance = time.AfterFunc(delay, governanceRunMaintenance)
+	})
+	log.Println("Governance: scheduled the maintenance at", t.Format(time.RFC3339))
+	return nil
+}
+
+// Runs the scheduled maintenance, unless it's already running
+func governanceRunMaintenance() {
+	governance.lock.With(func() {
+		governance.maintenanceAt = time.Time{}
+		governance.maintenance = nil
+	})
+	if nodeStopping() {
+		return
+	}
+	running := false
+	maintenanceState.lock.With(func() {
+		running = maintenanceState.running
+	})
+	if running {
+		log.Println("Governance: the maintenance is already running")
+		return
+	}
+	maintenanceRun(true)
+}
+
+// Verifies, records and applies the order, which came from the source (a peer's address
+// or the HTTP API), and floods it to the peers other than the one it came from. Returns
+// the result recorded in the log.
+func governanceReceive(o *GovernanceOrder, source string, from *p2pConnection) (string, error) {
+	if !governanceEnabled() {
+		return "", fmt.Errorf("This node doesn't accept governance orders")
+	}
+	if governance.seen.Has(o.ID) || dbGovernanceOrderExists(o.ID) {
+		return "", fmt.Errorf("Governance order %s has already been received", o.ID)
+	}
+	if err := o.verify(time.Now()); err != nil {
+		governance.lock.With(func() {
+			governance.rejected++
+		})
+		if governance.adminKeys[o.issuer()] && o.verifySignature() == nil {
+			// Signed by an admin key but invalid, e.g. expired
+			governance.seen.Add(o.ID)
+			if derr := dbInsertGovernanceOrder(o, source, "rejected: "+err.Error()); derr != nil {
+				log.Println(derr)
+			}
+		}
+		return "", err
+	}
+	if governance.seen.TestAndSet(o.ID) {
+		return "", fmt.Errorf("Governance order %s has already been received", o.ID)
+	}
+	log.Println("Governance order", o.ID, "from", source, "signed by", o.issuer()+":", o.Command, o.Params)
+	result := "applied"
+	if err := o.apply(); err != nil {
+		log.Println("Governance order", o.ID, "failed:", err)
+		result = "failed: " + err.Error()
+	}
+	governance.lock.With(func() {
+		governance.applied++
+	})
+	if err := dbInsertGovernanceOrder(o, source, result); err != nil {
+		log.Println("Cannot record governance order", o.ID, err)
+	}
+	governanceFlood(o, from)
+	return result, nil
+}
+
+// Sends the order to all the peers except the one it came from
+func governanceFlood(o *GovernanceOrder, except *p2pConnection) {
+	msg := p2pMsgGovernanceStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgGovernance,
+		},
+		Order: *o,
+	}
+	p2pPeers.lock.With(func() {
+		for p2pc := range p2pPeers.peers {
+			if p2pc != except {
+				go p2pc.queueMsg(msg)
+			}
+		}
+	})
+}
+
+// governance: an order from an operator, relayed by the peer
+func (p2pc *p2pConnection) handleGovernance(msg StrIfMap) {
+	if !governanceEnabled() {
+		return
+	}
+	var o GovernanceOrder
+	data, err := json.Marshal(msg["order"])
+	if err == nil {
+		err = json.Unmarshal(data, &o)
+	}
+	if err != nil {
+		log.Println(p2pc.address, "sent an invalid governance order:", err)
+		return
+	}
+	if governance.seen.Has(o.ID) {
+		// Flooded back to us
+		return
+	}
+	if _, err = governanceReceive(&o, p2pc.address, p2pc); err != nil {
+		log.Println("Rejected the governance order from", p2pc.address+":", err)
+	}
+}
+
+// Returns the governance state for /status
+func governanceStatus() map[string]interface{} {
+	status := map[string]interface{}{}
+	governance.lock.With(func() {
+		status["admin_keys"] = len(governance.adminKeys)
+		status["applied"] = governance.applied
+		status["rejected"] = governance.rejected
+		if !governance.maintenanceAt.IsZero() {
+			status["maintenance_at"] = governance.maintenanceAt.UTC().Format(time.RFC3339)
+		}
+	})
+	status["banned_peers"] = ttlsToSeconds(governance.bans.TTLs())
+	return status
+}
+
+// /governance accepts a signed order on POST, and returns the log of the orders
+func blockWebGovernance(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var o GovernanceOrder
+		if err = json.Unmarshal(body, &o); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := governanceReceive(&o, "http:"+r.RemoteAddr, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err = w.Write(jsonifyWhateverToBytes(map[string]string{"id": o.ID, "result": result})); err != nil {
+			log.Println(err)
+		}
+		return
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "Expecting GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	lp, err := parseListParams(r, governanceLogLimit, listMaxLimit, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cursor, err := lp.cursorInts(2)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, keys, err := dbListGovernanceLog(lp, cursor, lp.limit+1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(entries) > lp.limit {
+		entries = entries[:lp.limit]
+		last := keys[lp.limit-1]
+		listSetNextCursor(w, fmt.Sprintf("%d/%d", last[0], last[1]))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(jsonifyWhateverToBytes(entries)); err != nil {
+		log.Println(err)
+	}
+}
+
+// Creates and signs a governance order, and submits it to a node or prints it, run as:
+// governance [-key hash] [-expires 1h] [-node host:port] command name=value...
+func actionGovernance(args []string) {
+	fs := flag.NewFlagSet("governance", flag.ExitOnError)
+	keyHash := fs.String("key", "", "The public key hash of the admin key to sign the order with (default: any of my keys)")
+	expires := fs.String("expires", "1h", "How long the order is valid for")
+	node := fs.String("node", "", "The HTTP address of the node to submit the order to, as host:port or a URL (default: print the order)")
+	token := fs.String("token", "", "Bearer token for the node's HTTP API")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		log.Fatalln("The governance command needs a command:", governanceBanPeer, "peer=host duration=24h,", governanceSetParameter, "name=flag value=v, or", governanceScheduleMaintenance, "at=time")
+	}
+	lifetime, err := time.ParseDuration(*expires)
+	if err != nil || lifetime <= 0 || lifetime > governanceMaxLifetime {
+		log.Fatalln("Invalid -expires:", *expires)
+	}
+	now := time.Now()
+	o := GovernanceOrder{
+		ID:      fmt.Sprintf("%016x%016x", randInt63(), randInt63()),
+		Command: fs.Arg(0),
+		Params:  map[string]string{},
+		Issued:  now.Unix(),
+		Expires: now.Add(lifetime).Unix(),
+	}
+	for _, arg := range fs.Args()[1:] {
+		i := strings.Index(arg, "=")
+		if i < 1 {
+			log.Fatalln("Invalid order parameter, expecting name=value:", arg)
+		}
+		o.Params[arg[:i]] = arg[i+1:]
+	}
+	var key *ecdsa.PrivateKey
+	if *keyHash == "" {
+		key, _, err = cryptoGetAPrivateKey()
+	} else {
+		key, err = cryptoGetPrivateKey(*keyHash)
+	}
+	if err != nil {
+		log.Fatalln("Cannot load the admin key:", err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	o.PublicKey = hex.EncodeToString(publicKey)
+	if o.Signature, err = cryptoSignHex(key, o.signedHash()); err != nil {
+		log.Fatalln(err)
+	}
+	data := jsonifyWhateverToBytes(o)
+	if *node == "" {
+		fmt.Println(string(data))
+		return
+	}
+	baseURL := strings.TrimSuffix(*node, "/")
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		baseURL = "http://" + baseURL
+	}
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/governance", strings.NewReader(string(data)))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalln("The node rejected the order:", resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Println(strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,376 @@
+package daisy
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// A node can be upgraded without dropping its peers: on SIGUSR2 (or with the upgrade
+// command), the running node starts its binary again, normally just replaced by the new
+// version, passing it the listening sockets and the data directory lock. The new process
+// parses its configuration and reports that it's ready; if it fails, the old process
+// carries on. The old process then stops its services, waiting until the ones which write
+// to the databases and the block files have returned, and handles the messages the peers
+// have already sent, and its TCP peer connections are detached between two messages and
+// passed to the new process together with what their hello messages said, so the new
+// process continues the conversations without new handshakes. The peers connected over
+// QUIC or TLS, whose connection state can't be passed on, are disconnected and reconnect.
+// The new process then opens the databases and takes over, and the old process exits.
+// Incoming connections wait in the listening sockets' backlog meanwhile. Once the old
+// process has stopped its services, it can't carry on: if its services don't stop in
+// time, or the new process fails after that (e.g. while opening the databases), both
+// processes exit, and the node has to be restarted by the service manager. Handing over
+// is only supported on Unix.
+
+// The name of the data directory lock file, which contains the PID of the node
+const dataDirLockBaseName = "daisy.lock"
+
+// The environment variable naming the files inherited by the new process
+const handoverEnv = "DAISY_HANDOVER"
+
+// How long the new process has to parse its configuration
+const handoverReadyTimeout = time.Minute
+
+// How long the peers have to finish the messages they're sending
+const handoverDrainTimeout = 10 * time.Second
+
+// How long the new process has to open the databases and start its services
+const handoverStartTimeout = 10 * time.Minute
+
+// How long the services of the old process have to stop, e.g. to finish vacuuming a
+// database
+const handoverStopTimeout = 5 * time.Minute
+
+// How often a peer which is in the middle of a message is checked while draining
+const handoverPollInterval = 100 * time.Millisecond
+
+// The most peer connections passed in one control message
+const handoverPeersPerMessage = 64
+
+// A peer connection passed to the new process, with what the peer said in its hello
+// message
+type handoverPeer struct {
+	Address           string   `json:"address"`
+	Outbound          bool     `json:"outbound,omitempty"`
+	PeerID            int64    `json:"peer_id"`
+	Features          []string `json:"features,omitempty"`
+	UserAgent         string   `json:"user_agent"`
+	NodeKey           string   `json:"node_key,omitempty"`
+	ChainHeight       int      `json:"chain_height"`
+	IsRelay           bool     `json:"is_relay,omitempty"`
+	IsConnectable     bool     `json:"is_connectable,omitempty"`
+	TestedConnectable bool     `json:"tested_connectable,omitempty"`
+	BlocksReceived    int      `json:"blocks_received,omitempty"`
+}
+
+// A control message from the old process to the new one. The files of the peer
+// connections are passed with it, in the same order.
+type handoverMessage struct {
+	Peers []handoverPeer `json:"peers,omitempty"`
+	// In the last message
+	Done           bool   `json:"done,omitempty"`
+	EphemeralID    int64  `json:"ephemeral_id,omitempty"`
+	TipCheck       string `json:"tip_check,omitempty"`
+	FailoverActive bool   `json:"failover_active,omitempty"`
+	FailoverTerm   int64  `json:"failover_term,omitempty"`
+}
+
+// The state of a handover in the old process
+var handover = struct {
+	lock      WithMutex
+	running   bool
+	draining  chan struct{} // closed when the peers start draining
+	deadline  time.Time     // for the peers to finish their messages
+	detaching map[*p2pConnection]bool
+	wg        sync.WaitGroup // the connections being detached
+	collected bool
+	peers     []handoverPeer
+	files     []*os.File
+}{
+	draining:  make(chan struct{}),
+	detaching: map[*p2pConnection]bool{},
+}
+
+// What the new process has inherited from the old one
+var handoverInherited struct {
+	listeners      map[string]*os.File // by name
+	peers          []handoverPeer
+	files          []*os.File // of the peers
+	tipCheck       string
+	failoverActive bool
+	failoverTerm   int64
+}
+
+// Returns true if the peers are being drained for a handover
+func handoverDraining() bool {
+	select {
+	case <-handover.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Marks the handover as running. Returns false if one already is.
+func handoverBegin() bool {
+	ok := false
+	handover.lock.With(func() {
+		if !handover.running {
+			handover.running, ok = true, true
+		}
+	})
+	return ok
+}
+
+// Marks the handover as finished, after it has failed
+func handoverEnd() {
+	handover.lock.With(func() {
+		handover.running = false
+	})
+}
+
+// Returns the listener the new process has inherited under the name, or a new one. TCP
+// listeners can be passed on to the next process.
+func handoverListen(name, address string, listen func(string) (net.Listener, error)) (net.Listener, error) {
+	var l net.Listener
+	var err error
+	if f := handoverInherited.listeners[name]; f != nil {
+		l, err = net.FileListener(f)
+		f.Close()
+		delete(handoverInherited.listeners, name)
+		if err == nil {
+			log.Println("Inherited the", name, "listener from the old process")
+		}
+	} else {
+		l, err = listen(address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tl, ok := l.(*net.TCPListener); ok {
+		nodeServers.lock.With(func() {
+			if nodeServers.inheritable == nil {
+				nodeServers.inheritable = map[string]*net.TCPListener{}
+			}
+			nodeServers.inheritable[name] = tl
+		})
+	}
+	return l, nil
+}
+
+// Returns the files of the listeners to pass to the new process, by name
+func handoverListenerFiles() (map[string]*os.File, error) {
+	files := map[string]*os.File{}
+	var err error
+	nodeServers.lock.With(func() {
+		for name, l := range nodeServers.inheritable {
+			var f *os.File
+			if f, err = l.File(); err != nil {
+				return
+			}
+			files[name] = f
+		}
+	})
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, err
+	}
+	return files, nil
+}
+
+// Called by a reader which has failed to read a message while the peers are draining.
+// Returns true if the reader should go on reading the rest of the message, after its
+// read deadline has been extended.
+func (p2pc *p2pConnection) handoverReadMore(partial []byte, err error) bool {
+	ne, ok := err.(net.Error)
+	if !ok || !ne.Timeout() || len(partial) == 0 || !handoverDraining() {
+		return false
+	}
+	var deadline time.Time
+	handover.lock.With(func() {
+		deadline = handover.deadline
+	})
+	if time.Now().After(deadline) {
+		log.Println("Disconnecting", p2pc.address, "which hasn't finished its message in time for the handover")
+		return false
+	}
+	p2pc.conn.SetReadDeadline(time.Now().Add(handoverPollInterval))
+	return true
+}
+
+// Returns true if the reader has stopped between two messages for the handover
+func handoverReadStopped(partial []byte, err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout() && len(partial) == 0 && handoverDraining()
+}
+
+// Returns true if the connection can be passed to the new process
+func (p2pc *p2pConnection) handoverDetachable() bool {
+	if !handoverDraining() || !p2pc.helloReceived || p2pc.bulk != nil {
+		return false
+	}
+	_, ok := p2pc.conn.(*net.TCPConn)
+	return ok
+}
+
+// Detaches the connection, whose messages have all been handled and sent, for the new
+// process
+func (p2pc *p2pConnection) handoverDetach() {
+	f, err := p2pc.conn.(*net.TCPConn).File()
+	if err != nil {
+		log.Println("Cannot detach the connection to", p2pc.address, err)
+		return
+	}
+	hp := handoverPeer{
+		Address:           p2pc.address,
+		Outbound:          p2pc.outbound,
+		PeerID:            p2pc.peerID,
+		Features:          p2pc.features,
+		UserAgent:         p2pc.userAgent,
+		NodeKey:           p2pc.nodeKey,
+		ChainHeight:       p2pc.chainHeight,
+		IsRelay:           p2pc.isRelay,
+		IsConnectable:     p2pc.isConnectable,
+		TestedConnectable: p2pc.testedConnectable,
+		BlocksReceived:    p2pc.blocksReceived,
+	}
+	handover.lock.With(func() {
+		if handover.collected {
+			// Too late, the connection closes with this process
+			return
+		}
+		handover.peers = append(handover.peers, hp)
+		handover.files = append(handover.files, f)
+		f = nil
+	})
+	if f != nil {
+		f.Close()
+	}
+}
+
+// Called when the connection handler has finished, detached or not
+func (p2pc *p2pConnection) handoverDone() {
+	handover.lock.With(func() {
+		if handover.detaching[p2pc] {
+			delete(handover.detaching, p2pc)
+			handover.wg.Done()
+		}
+	})
+}
+
+// Stops the node for the new process to take over: the services which write to the
+// databases are stopped, and the peer connections are drained and detached. Returns the
+// detached connections and their files. Exits if the services don't stop in time, since
+// the node can't carry on without them.
+func handoverStop() ([]handoverPeer, []*os.File) {
+	close(nodeQuit)
+	nodeServers.lock.With(func() {
+		for _, l := range nodeServers.listeners {
+			l.Close()
+		}
+	})
+	if nodeServers.httpServer != nil {
+		// Waits for the requests being served, the new process serves the next ones
+		ctx, cancel := context.WithTimeout(context.Background(), handoverDrainTimeout)
+		nodeServers.httpServer.Shutdown(ctx)
+		cancel()
+	}
+	// The new process mustn't open the databases while e.g. the maintenance is still
+	// vacuuming them, or remove a block file which is still being written
+	if !nodeWaitServices(handoverStopTimeout) {
+		log.Fatalln("Some services haven't stopped in", handoverStopTimeout, "- exiting without handing over")
+	}
+	var peers []*p2pConnection
+	p2pPeers.lock.With(func() {
+		for p2pc := range p2pPeers.peers {
+			peers = append(peers, p2pc)
+		}
+	})
+	now := time.Now()
+	handover.lock.With(func() {
+		handover.deadline = now.Add(handoverDrainTimeout)
+		for _, p2pc := range peers {
+			if _, ok := p2pc.conn.(*net.TCPConn); ok && p2pc.bulk == nil {
+				handover.detaching[p2pc] = true
+				handover.wg.Add(1)
+			}
+		}
+	})
+	close(handover.draining)
+	for _, p2pc := range peers {
+		if _, ok := p2pc.conn.(*net.TCPConn); ok && p2pc.bulk == nil {
+			// The readers stop at the end of the message they're reading
+			p2pc.conn.SetReadDeadline(now)
+		} else {
+			p2pc.conn.Close()
+		}
+	}
+	drained := make(chan struct{})
+	go func() {
+		handover.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(2 * handoverDrainTimeout):
+		log.Println("Not all the peer connections have drained in time for the handover")
+	}
+	var hps []handoverPeer
+	var files []*os.File
+	handover.lock.With(func() {
+		handover.collected = true
+		hps, files = handover.peers, handover.files
+	})
+	return hps, files
+}
+
+// Adopts the peer connections passed by the old process. Called when the p2p services
+// are started.
+func handoverAdoptPeers() {
+	for i, hp := range handoverInherited.peers {
+		f := handoverInherited.files[i]
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			log.Println("Cannot adopt the connection to", hp.Address, err)
+			continue
+		}
+		p2pc, err := p2pSetupPeer(hp.Address, conn)
+		if err != nil {
+			log.Println("Cannot adopt the connection to", hp.Address, err)
+			continue
+		}
+		p2pc.outbound = hp.Outbound
+		p2pc.peerID = hp.PeerID
+		p2pc.features = hp.Features
+		p2pc.userAgent = hp.UserAgent
+		p2pc.nodeKey = hp.NodeKey
+		p2pc.chainHeight = hp.ChainHeight
+		p2pc.isRelay = hp.IsRelay
+		p2pc.isConnectable = hp.IsConnectable
+		p2pc.testedConnectable = hp.TestedConnectable
+		p2pc.blocksReceived = hp.BlocksReceived
+		p2pc.helloReceived = true
+		p2pc.adopted = true
+		go p2pc.handleConnection()
+	}
+	if n := len(handoverInherited.peers); n > 0 {
+		log.Println("Adopted", n, "peer connections from the old process")
+	}
+	handoverInherited.peers, handoverInherited.files = nil, nil
+}
+
+// Catches up with an adopted peer, whose hello message was received by the old process
+func (p2pc *p2pConnection) handoverResume() {
+	hooksPeerConnected(p2pc)
+	p2pc.tipCheckAsk()
+	if p2pc.chainHeight > dbGetBlockchainHeight() {
+		p2pCtrlChannel <- p2pCtrlMessage{msgType: p2pCtrlSearchForBlocks, payload: p2pc}
+	}
+}
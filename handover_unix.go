@@ -0,0 +1,365 @@
+//go:build !windows
+// +build !windows
+
+package daisy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The lock on the data directory, held while the node runs
+var dataDirLockFile *os.File
+
+// The control connection to the old process, in the new process
+var handoverControl *net.UnixConn
+
+// Asks for the signal which starts a handover
+func handoverNotify(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// Returns true for the signal which starts a handover
+func isHandoverSignal(sig os.Signal) bool {
+	return sig == syscall.SIGUSR2
+}
+
+// Locks the data directory, so that only one node uses it, and writes the node's PID to
+// the lock file. The new process of a handover already has the lock.
+func dataDirLock() error {
+	f := dataDirLockFile
+	if f == nil {
+		var err error
+		if f, err = os.OpenFile(filepath.Join(cfg.DataDir, dataDirLockBaseName), os.O_RDWR|os.O_CREATE, 0600); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return fmt.Errorf("The data directory %s is in use by another node", cfg.DataDir)
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		return err
+	}
+	dataDirLockFile = f
+	return nil
+}
+
+// Returns the PID of the node running in the data directory
+func dataDirLockPID() (int, error) {
+	fileName := filepath.Join(cfg.DataDir, dataDirLockBaseName)
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, fmt.Errorf("No node is running in %s", cfg.DataDir)
+	}
+	defer f.Close()
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+		return 0, fmt.Errorf("No node is running in %s", cfg.DataDir)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid PID in %s", fileName)
+	}
+	return pid, nil
+}
+
+// Asks the node running in the data directory to hand over to a new process of its
+// binary, run as: upgrade
+func actionUpgrade() {
+	pid, err := dataDirLockPID()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = syscall.Kill(pid, syscall.SIGUSR2); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Asked the node", pid, "to hand over to a new process, see its log for the outcome")
+}
+
+// Reads a line from the control connection, which has to arrive before the timeout
+func handoverReadLine(conn *net.UnixConn, r *bufio.Reader, timeout time.Duration) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// Hands the node over to a new process of its binary. Called on SIGUSR2.
+func handoverRun() {
+	if cfg.readOnly || cfg.relay || dataDirLockFile == nil {
+		log.Println("Handing over is only supported by full nodes")
+		return
+	}
+	if !handoverBegin() {
+		log.Println("A handover is already running")
+		return
+	}
+	cmd, conn, err := handoverStartProcess()
+	if err != nil {
+		log.Println("Cannot start the new process, the node keeps running:", err)
+		handoverEnd()
+		return
+	}
+	r := bufio.NewReader(conn)
+	if line, err := handoverReadLine(conn, r, handoverReadyTimeout); line != "ready" {
+		log.Println("The new process has failed to start, the node keeps running:", err)
+		cmd.Process.Kill()
+		conn.Close()
+		handoverEnd()
+		return
+	}
+	log.Println("The new process", cmd.Process.Pid, "is ready, handing over")
+	// Stopping the services and the new process loading the blockchain take a while,
+	// during which the watchdog is still expecting this process
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Second):
+				sdNotifyWatchdog()
+			}
+		}
+	}()
+	peers, files := handoverStop()
+	if err = handoverSendPeers(conn, peers, files); err != nil {
+		log.Fatalln("Cannot hand over to the new process:", err)
+	}
+	line, err := handoverReadLine(conn, r, handoverStartTimeout)
+	close(done)
+	if line != "running" {
+		log.Fatalln("The new process has failed to take over:", err)
+	}
+	if err = sdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid)); err != nil {
+		log.Println("sd_notify:", err)
+	}
+	log.Println("Handed over to the new process", cmd.Process.Pid)
+	os.Exit(0)
+}
+
+// Starts the node's binary again with the same arguments, passing it the listeners, the
+// data directory lock and one end of the control connection
+func handoverStartProcess() (*exec.Cmd, *net.UnixConn, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	listeners, err := handoverListenerFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	mine := os.NewFile(uintptr(fds[0]), "handover")
+	theirs := os.NewFile(uintptr(fds[1]), "handover")
+	defer theirs.Close()
+	names := []string{"control", "lock"}
+	files := []*os.File{theirs, dataDirLockFile}
+	for name, f := range listeners {
+		defer f.Close()
+		names = append(names, name)
+		files = append(files, f)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), handoverEnv+"="+strings.Join(names, ","))
+	cmd.ExtraFiles = files
+	if err = cmd.Start(); err != nil {
+		mine.Close()
+		return nil, nil, err
+	}
+	go cmd.Wait()
+	c, err := net.FileConn(mine)
+	mine.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, nil, err
+	}
+	return cmd, c.(*net.UnixConn), nil
+}
+
+// Sends the detached peer connections to the new process, and the rest of the state in
+// the last message
+func handoverSendPeers(conn *net.UnixConn, peers []handoverPeer, files []*os.File) error {
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	conn.SetWriteDeadline(time.Now().Add(handoverDrainTimeout))
+	for start := 0; ; start += handoverPeersPerMessage {
+		end := start + handoverPeersPerMessage
+		if end > len(peers) {
+			end = len(peers)
+		}
+		msg := handoverMessage{Peers: peers[start:end]}
+		if end == len(peers) {
+			msg.Done = true
+			msg.EphemeralID = p2pEphemeralID
+			tipCheck.lock.With(func() {
+				msg.TipCheck = tipCheck.state
+			})
+			msg.FailoverActive, msg.FailoverTerm = failoverHandoverState()
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		var fds []int
+		for _, f := range files[start:end] {
+			fds = append(fds, int(f.Fd()))
+		}
+		var rights []byte
+		if len(fds) > 0 {
+			rights = syscall.UnixRights(fds...)
+		}
+		if _, _, err = conn.WriteMsgUnix(append(data, '\n'), rights, nil); err != nil {
+			return err
+		}
+		if msg.Done {
+			log.Println("Handed over", len(peers), "peer connections")
+			return nil
+		}
+	}
+}
+
+// Receives the peer connections and the state from the old process
+func handoverReceivePeers(conn *net.UnixConn) error {
+	var pending []byte
+	var fds []int
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, syscall.CmsgSpace(4*handoverPeersPerMessage))
+	conn.SetReadDeadline(time.Now().Add(handoverReadyTimeout + handoverStopTimeout + 3*handoverDrainTimeout))
+	for {
+		n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			return err
+		}
+		if oobn > 0 {
+			cmsgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+			if err != nil {
+				return err
+			}
+			for _, cmsg := range cmsgs {
+				rights, err := syscall.ParseUnixRights(&cmsg)
+				if err != nil {
+					return err
+				}
+				fds = append(fds, rights...)
+			}
+		}
+		pending = append(pending, buf[:n]...)
+		for {
+			i := bytes.IndexByte(pending, '\n')
+			if i < 0 {
+				break
+			}
+			var msg handoverMessage
+			if err = json.Unmarshal(pending[:i], &msg); err != nil {
+				return err
+			}
+			pending = pending[i+1:]
+			if len(fds) < len(msg.Peers) {
+				return fmt.Errorf("Missing the files of %d peer connections", len(msg.Peers)-len(fds))
+			}
+			for j, hp := range msg.Peers {
+				handoverInherited.peers = append(handoverInherited.peers, hp)
+				handoverInherited.files = append(handoverInherited.files, os.NewFile(uintptr(fds[j]), hp.Address))
+			}
+			fds = fds[len(msg.Peers):]
+			if msg.Done {
+				p2pEphemeralID = msg.EphemeralID
+				handoverInherited.tipCheck = msg.TipCheck
+				handoverInherited.failoverActive, handoverInherited.failoverTerm = msg.FailoverActive, msg.FailoverTerm
+				return nil
+			}
+		}
+	}
+}
+
+// In a new process started by a handover, picks up the inherited files and waits until
+// the old process has stopped. Does nothing in a process started normally.
+func handoverReceive() {
+	names := os.Getenv(handoverEnv)
+	if names == "" {
+		return
+	}
+	os.Unsetenv(handoverEnv)
+	if os.Getenv("WATCHDOG_PID") != "" {
+		// This process becomes the service's main process
+		os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	}
+	handoverInherited.listeners = map[string]*os.File{}
+	var control *os.File
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(3+i), name)
+		switch name {
+		case "control":
+			control = f
+		case "lock":
+			dataDirLockFile = f
+		default:
+			handoverInherited.listeners[name] = f
+		}
+	}
+	if control == nil {
+		log.Fatalln("Started for a handover without a control connection")
+	}
+	c, err := net.FileConn(control)
+	control.Close()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	handoverControl = c.(*net.UnixConn)
+	if _, err = handoverControl.Write([]byte("ready\n")); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Waiting for the old process to hand over")
+	if err = handoverReceivePeers(handoverControl); err != nil {
+		log.Fatalln("The handover has failed:", err)
+	}
+	log.Println("Taking over from the old process with", len(handoverInherited.peers), "peer connections")
+}
+
+// Tells the old process that this one has taken over, so it can exit
+func handoverTakenOver() {
+	if handoverControl == nil {
+		return
+	}
+	if _, err := handoverControl.Write([]byte("running\n")); err != nil {
+		log.Println("Cannot notify the old process:", err)
+	}
+	handoverControl.Close()
+	handoverControl = nil
+	for name, f := range handoverInherited.listeners {
+		// Listeners of transports which aren't enabled anymore
+		log.Println("Closing the inherited", name, "listener")
+		f.Close()
+	}
+	handoverInherited.listeners = nil
+}
@@ -0,0 +1,40 @@
+//go:build windows
+// +build windows
+
+package daisy
+
+import (
+	"log"
+	"os"
+)
+
+// Handing over to a new process is not supported on Windows: there is no signal for it,
+// and the data directory is not locked
+
+func handoverNotify(c chan<- os.Signal) {
+}
+
+func isHandoverSignal(sig os.Signal) bool {
+	return false
+}
+
+func dataDirLock() error {
+	return nil
+}
+
+func handoverRun() {
+	log.Println("Handing over is only supported on Unix")
+}
+
+func handoverReceive() {
+	if os.Getenv(handoverEnv) != "" {
+		log.Fatalln("Handing over is only supported on Unix")
+	}
+}
+
+func handoverTakenOver() {
+}
+
+func actionUpgrade() {
+	log.Fatalln("The upgrade command is only supported on Unix, restart the Windows service instead")
+}
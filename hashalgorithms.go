@@ -0,0 +1,179 @@
+package daisy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// The hash algorithm of the blocks and documents is a chain parameter (hash_algorithm in
+// chainparams.json), so a new chain can use a stronger or faster digest than SHA256. The
+// hashes are hex strings prefixed with the algorithm's type and ":", like the public key
+// hashes, e.g. "2:5f3a..." for SHA3-256. SHA256 hashes are unprefixed, as they have always
+// been, so the existing chains are unchanged. The type prefix tells which algorithm
+// verifies a hash found outside of the chain, e.g. in a receipt. Other algorithms, such as
+// BLAKE3, are added with RegisterHashAlgorithm.
+
+// The hash algorithms built into the node
+const (
+	HashAlgorithmSHA256  = "sha256"
+	HashAlgorithmSHA3256 = "sha3-256"
+)
+
+// The length in bytes of the digests: the same for all the algorithms, as the block hashes
+// are also used as fixed-size keys
+const hashDigestSize = 32
+
+// A hash algorithm which blocks and documents can be hashed with
+type hashAlgorithm struct {
+	name    string
+	hashID  int
+	newHash func() hash.Hash
+}
+
+var hashSHA256 = &hashAlgorithm{name: HashAlgorithmSHA256, hashID: 1, newHash: sha256.New}
+
+var hashAlgorithms = struct {
+	lock   WithMutex
+	byName map[string]*hashAlgorithm
+	byID   map[int]*hashAlgorithm
+}{
+	byName: map[string]*hashAlgorithm{HashAlgorithmSHA256: hashSHA256, HashAlgorithmSHA3256: {name: HashAlgorithmSHA3256, hashID: 2, newHash: sha3.New256}},
+	byID:   map[int]*hashAlgorithm{},
+}
+
+// The hash algorithm of this node's blockchain
+var chainHash = hashSHA256
+
+func init() {
+	for _, a := range hashAlgorithms.byName {
+		hashAlgorithms.byID[a.hashID] = a
+	}
+}
+
+// RegisterHashAlgorithm adds a hash algorithm which chains can choose with hash_algorithm.
+// The type is the prefix of its hashes and must be unique. The algorithm must produce
+// 32-byte digests. It should be called before the node is started.
+func RegisterHashAlgorithm(name string, hashType int, newHash func() hash.Hash) error {
+	if name == "" || hashType < 1 {
+		return fmt.Errorf("Invalid hash algorithm %q type %d", name, hashType)
+	}
+	if size := newHash().Size(); size != hashDigestSize {
+		return fmt.Errorf("Hash algorithm %s produces %d-byte digests, expecting %d", name, size, hashDigestSize)
+	}
+	var err error
+	hashAlgorithms.lock.With(func() {
+		if _, ok := hashAlgorithms.byName[name]; ok {
+			err = fmt.Errorf("Hash algorithm %s is already registered", name)
+			return
+		}
+		if a, ok := hashAlgorithms.byID[hashType]; ok {
+			err = fmt.Errorf("Hash type %d is already used by %s", hashType, a.name)
+			return
+		}
+		a := &hashAlgorithm{name: name, hashID: hashType, newHash: newHash}
+		hashAlgorithms.byName[name] = a
+		hashAlgorithms.byID[hashType] = a
+	})
+	return err
+}
+
+// Returns the hash algorithm with the given name. An empty name is SHA256.
+func hashAlgorithmByName(name string) (*hashAlgorithm, error) {
+	if name == "" {
+		return hashSHA256, nil
+	}
+	var a *hashAlgorithm
+	hashAlgorithms.lock.With(func() {
+		a = hashAlgorithms.byName[strings.ToLower(name)]
+	})
+	if a == nil {
+		return nil, fmt.Errorf("Unknown hash algorithm %q", name)
+	}
+	return a, nil
+}
+
+// Sets the hash algorithm of the blockchain from its parameters
+func chainHashInit(cp *ChainParams) error {
+	a, err := hashAlgorithmByName(cp.HashAlgorithm)
+	if err != nil {
+		return err
+	}
+	chainHash = a
+	return nil
+}
+
+// Returns the hash of the digest, with the algorithm's type prefix
+func (a *hashAlgorithm) format(digest []byte) string {
+	if a == hashSHA256 {
+		return hex.EncodeToString(digest)
+	}
+	return strconv.Itoa(a.hashID) + ":" + hex.EncodeToString(digest)
+}
+
+// Returns the hash of the given bytes
+func (a *hashAlgorithm) hashBytes(b []byte) string {
+	h := a.newHash()
+	h.Write(b)
+	return a.format(h.Sum(nil))
+}
+
+// Parses a hash into its algorithm and digest. Hashes without a type prefix are SHA256.
+func hashParse(hash string) (*hashAlgorithm, []byte, error) {
+	a := hashSHA256
+	if i := strings.IndexByte(hash, ':'); i >= 0 {
+		hashType, err := strconv.Atoi(hash[:i])
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid hash %q", hash)
+		}
+		hashAlgorithms.lock.With(func() {
+			a = hashAlgorithms.byID[hashType]
+		})
+		if a == nil || a == hashSHA256 {
+			return nil, nil, fmt.Errorf("Unknown hash type in %q", hash)
+		}
+		hash = hash[i+1:]
+	}
+	digest, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(digest) != hashDigestSize {
+		return nil, nil, fmt.Errorf("Invalid hash length: %q", hash)
+	}
+	return a, digest, nil
+}
+
+// Returns the hex digest of the hash, without the type prefix, e.g. for file names
+func hashHex(hash string) string {
+	if i := strings.IndexByte(hash, ':'); i >= 0 {
+		return hash[i+1:]
+	}
+	return hash
+}
+
+// Returns the digest of a hash made with any of the algorithms
+func hashDigest(hash string) ([]byte, error) {
+	_, digest, err := hashParse(hash)
+	return digest, err
+}
+
+// Checks if the string is a hash made with the chain's algorithm
+func isValidChainHash(hash string) bool {
+	a, _, err := hashParse(hash)
+	return err == nil && a == chainHash
+}
+
+// Checks if the string is a hex-encoded 32-byte digest, without a type prefix
+func isValidHashHex(s string) bool {
+	if len(s) != 2*hashDigestSize {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,183 @@
+package daisy
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"plugin"
+	"strings"
+)
+
+// Hooks let integrators extend the node's policy without changing it: they are called
+// when blocks are received and accepted, for the documents of the received blocks, and
+// when peers connect and disconnect, and they can reject blocks. Hooks are registered with
+// RegisterHooks by programs embedding the node, or loaded from Go plugins given with
+// -plugins, which must export a variable named DaisyHooks of the type daisy.Hooks. Plugins
+// can also export an anchor publisher as DaisyAnchorPublisher (see anchor.go).
+
+// Hooks is the interface implemented by node plugins. The hooks are called synchronously,
+// so they should be quick, and hand slow work (like mirroring) to their own goroutines.
+type Hooks interface {
+	// BlockReceived is called before a block is accepted, either from a peer or created
+	// by this node, and for the dry runs of blocks. Returning an error rejects the block.
+	BlockReceived(blk *HookBlock) error
+	// DocumentSeen is called for every document of a received block, before the block is
+	// accepted. The document's chunks may not have been fetched yet. Returning an error
+	// rejects the block.
+	DocumentSeen(blk *HookBlock, doc ExportDocument) error
+	// BlockAccepted is called after a block has been added to the blockchain
+	BlockAccepted(evt *BlockEvent)
+	// PeerConnected is called after a peer has sent its hello message
+	PeerConnected(peer *HookPeer)
+	// PeerDisconnected is called when the connection to a peer is closed
+	PeerDisconnected(peer *HookPeer)
+}
+
+// NoHooks implements all the hooks by doing nothing. Embed it to implement only some of them.
+type NoHooks struct{}
+
+// BlockReceived accepts the block
+func (NoHooks) BlockReceived(blk *HookBlock) error { return nil }
+
+// DocumentSeen accepts the document
+func (NoHooks) DocumentSeen(blk *HookBlock, doc ExportDocument) error { return nil }
+
+// BlockAccepted does nothing
+func (NoHooks) BlockAccepted(evt *BlockEvent) {}
+
+// PeerConnected does nothing
+func (NoHooks) PeerConnected(peer *HookPeer) {}
+
+// PeerDisconnected does nothing
+func (NoHooks) PeerDisconnected(peer *HookPeer) {}
+
+// HookBlock describes a block which is about to be accepted
+type HookBlock struct {
+	Height               int
+	Hash                 string // empty for the blocks created by this node, which are not yet hashed
+	PreviousBlockHash    string
+	CreatorPublicKeyHash string
+	// The block's SQLite database, which must not be modified
+	DB *sql.DB
+}
+
+// HookPeer describes a peer connection
+type HookPeer struct {
+	Address   string
+	UserAgent string
+	NodeKey   string
+	Outbound  bool
+	Relay     bool
+}
+
+var nodeHooks struct {
+	lock  WithMutex
+	hooks []Hooks
+}
+
+// RegisterHooks adds hooks to the node. It should be called before the node is started.
+func RegisterHooks(h Hooks) {
+	nodeHooks.lock.With(func() {
+		nodeHooks.hooks = append(nodeHooks.hooks, h)
+	})
+}
+
+// Loads the Go plugins with the given comma-separated file names
+func hooksLoadPlugins(fileNames string) error {
+	for _, fileName := range strings.Split(fileNames, ",") {
+		fileName = strings.TrimSpace(fileName)
+		if fileName == "" {
+			continue
+		}
+		p, err := plugin.Open(fileName)
+		if err != nil {
+			return fmt.Errorf("Cannot load plugin %s: %v", fileName, err)
+		}
+		hooksSym, hooksErr := p.Lookup("DaisyHooks")
+		anchorSym, anchorErr := p.Lookup("DaisyAnchorPublisher")
+		if hooksErr != nil && anchorErr != nil {
+			return fmt.Errorf("Plugin %s exports neither DaisyHooks nor DaisyAnchorPublisher", fileName)
+		}
+		if hooksErr == nil {
+			h, ok := hooksSym.(*Hooks)
+			if !ok || *h == nil {
+				return fmt.Errorf("Plugin %s: DaisyHooks must be a non-nil variable of the type daisy.Hooks", fileName)
+			}
+			RegisterHooks(*h)
+		}
+		if anchorErr == nil {
+			ap, ok := anchorSym.(*AnchorPublisher)
+			if !ok || *ap == nil {
+				return fmt.Errorf("Plugin %s: DaisyAnchorPublisher must be a non-nil variable of the type daisy.AnchorPublisher", fileName)
+			}
+			RegisterAnchorPublisher(*ap)
+		}
+		log.Println("Loaded plugin", fileName)
+	}
+	return nil
+}
+
+// Returns the registered hooks
+func hooksGet() []Hooks {
+	var result []Hooks
+	nodeHooks.lock.With(func() {
+		result = nodeHooks.hooks
+	})
+	return result
+}
+
+// Runs the BlockReceived and DocumentSeen hooks for the block
+func hooksCheckBlock(blk *Block) error {
+	hooks := hooksGet()
+	if len(hooks) == 0 {
+		return nil
+	}
+	hb := HookBlock{Height: blk.Height, Hash: blk.Hash, PreviousBlockHash: blk.PreviousBlockHash,
+		CreatorPublicKeyHash: blk.SignaturePublicKeyHash, DB: blk.db}
+	atts, err := blk.dbGetAttachments()
+	if err != nil {
+		return err
+	}
+	bundles, err := blk.dbGetBundles()
+	if err != nil {
+		return err
+	}
+	for _, h := range hooks {
+		if err = h.BlockReceived(&hb); err != nil {
+			return fmt.Errorf("Block rejected by a plugin: %v", err)
+		}
+		for _, att := range atts {
+			doc := ExportDocument{Hash: att.hash, Name: att.name, Size: att.size, Bundle: bundles[strings.ToLower(att.hash)]}
+			if err = h.DocumentSeen(&hb, doc); err != nil {
+				return fmt.Errorf("Document %s rejected by a plugin: %v", att.hash, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Runs the BlockAccepted hooks
+func hooksBlockAccepted(evt *BlockEvent) {
+	for _, h := range hooksGet() {
+		h.BlockAccepted(evt)
+	}
+}
+
+// Returns the description of the peer for the hooks
+func (p2pc *p2pConnection) hookPeer() *HookPeer {
+	return &HookPeer{Address: p2pc.address, UserAgent: p2pc.userAgent, NodeKey: p2pc.nodeKey, Outbound: p2pc.outbound, Relay: p2pc.isRelay}
+}
+
+// Runs the PeerConnected hooks
+func hooksPeerConnected(p2pc *p2pConnection) {
+	for _, h := range hooksGet() {
+		h.PeerConnected(p2pc.hookPeer())
+	}
+}
+
+// Runs the PeerDisconnected hooks
+func hooksPeerDisconnected(p2pc *p2pConnection) {
+	for _, h := range hooksGet() {
+		h.PeerDisconnected(p2pc.hookPeer())
+	}
+}
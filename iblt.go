@@ -0,0 +1,206 @@
+package daisy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+// An invertible Bloom lookup table (IBLT) is used for set reconciliation: a node sends a
+// small IBLT of the blocks it has, the peer subtracts it from the IBLT of its own blocks,
+// and the result (which only contains the symmetric difference of the two sets) can be
+// decoded if the difference is small enough, regardless of the size of the sets.
+// Items are (height, hash) pairs of blocks.
+
+// The number of cells each item is stored in
+const ibltHashCount = 3
+
+// The size of an item: 8 bytes of height and 32 bytes of hash
+const ibltKeySize = 8 + 32
+
+// The size of a serialised cell: count, key sum, check sum
+const ibltCellSize = 4 + ibltKeySize + 8
+
+// The maximum number of cells accepted from peers
+const ibltMaxCells = 3 * 4096
+
+type ibltKey [ibltKeySize]byte
+
+type ibltCell struct {
+	count    int32
+	keySum   ibltKey
+	checkSum uint64
+}
+
+type iblt struct {
+	cells []ibltCell
+}
+
+// Returns the number of cells for an IBLT able to decode a difference of about the given
+// number of items
+func ibltCellsForDifference(d int) int {
+	n := (d*3/2 + 16 + ibltHashCount - 1) / ibltHashCount * ibltHashCount
+	if n > ibltMaxCells {
+		n = ibltMaxCells
+	}
+	return n
+}
+
+func ibltMakeKey(height int, hash string) (ibltKey, error) {
+	var k ibltKey
+	b, err := hashDigest(hash)
+	if err != nil {
+		return k, err
+	}
+	binary.BigEndian.PutUint64(k[0:8], uint64(height))
+	copy(k[8:], b)
+	return k, nil
+}
+
+func (k ibltKey) height() int {
+	return int(binary.BigEndian.Uint64(k[0:8]))
+}
+
+func (k ibltKey) hash() string {
+	return chainHash.format(k[8:])
+}
+
+// Returns the cell indexes and the check sum for the key. Each hash function maps the key
+// into its own part of the table, so the indexes are always distinct.
+func (t *iblt) keyHashes(k ibltKey) ([ibltHashCount]int, uint64) {
+	h := sha256.Sum256(k[:])
+	var idx [ibltHashCount]int
+	partSize := uint32(len(t.cells) / ibltHashCount)
+	for i := 0; i < ibltHashCount; i++ {
+		idx[i] = int(binary.BigEndian.Uint32(h[4*i:])%partSize) + i*int(partSize)
+	}
+	return idx, binary.BigEndian.Uint64(h[24:])
+}
+
+func (t *iblt) update(k ibltKey, delta int32) {
+	idx, checkSum := t.keyHashes(k)
+	for _, i := range idx {
+		c := &t.cells[i]
+		c.count += delta
+		for j := range c.keySum {
+			c.keySum[j] ^= k[j]
+		}
+		c.checkSum ^= checkSum
+	}
+}
+
+// Inserts a block into the table
+func (t *iblt) Insert(height int, hash string) error {
+	k, err := ibltMakeKey(height, hash)
+	if err != nil {
+		return err
+	}
+	t.update(k, 1)
+	return nil
+}
+
+// Subtracts the other table (which must be of the same size) from this one
+func (t *iblt) Subtract(o *iblt) error {
+	if len(o.cells) != len(t.cells) {
+		return fmt.Errorf("IBLT size mismatch: %d vs %d", len(t.cells), len(o.cells))
+	}
+	for i := range t.cells {
+		c := &t.cells[i]
+		c.count -= o.cells[i].count
+		for j := range c.keySum {
+			c.keySum[j] ^= o.cells[i].keySum[j]
+		}
+		c.checkSum ^= o.cells[i].checkSum
+	}
+	return nil
+}
+
+// Checks if the cell contains exactly one item
+func (t *iblt) isPure(c *ibltCell) bool {
+	if c.count != 1 && c.count != -1 {
+		return false
+	}
+	_, checkSum := t.keyHashes(c.keySum)
+	return checkSum == c.checkSum
+}
+
+// Decodes a table resulting from Subtract(), returning the items which were only in this
+// table (positive) and those only in the subtracted table (negative), as maps of heights
+// to hashes. Returns an error if the difference was too large to decode.
+// The table is destroyed in the process.
+func (t *iblt) Decode() (map[int]string, map[int]string, error) {
+	positive := map[int]string{}
+	negative := map[int]string{}
+	for {
+		found := false
+		for i := range t.cells {
+			c := &t.cells[i]
+			if !t.isPure(c) {
+				continue
+			}
+			k := c.keySum
+			if c.count == 1 {
+				positive[k.height()] = k.hash()
+			} else {
+				negative[k.height()] = k.hash()
+			}
+			t.update(k, -c.count)
+			found = true
+		}
+		if !found {
+			break
+		}
+	}
+	for i := range t.cells {
+		c := &t.cells[i]
+		if c.count != 0 || c.checkSum != 0 || c.keySum != (ibltKey{}) {
+			return nil, nil, fmt.Errorf("The set difference is too large to decode")
+		}
+	}
+	return positive, negative, nil
+}
+
+// Serialises the table into a base64 string
+func (t *iblt) Encode() string {
+	buf := make([]byte, len(t.cells)*ibltCellSize)
+	for i, c := range t.cells {
+		b := buf[i*ibltCellSize:]
+		binary.BigEndian.PutUint32(b[0:4], uint32(c.count))
+		copy(b[4:4+ibltKeySize], c.keySum[:])
+		binary.BigEndian.PutUint64(b[4+ibltKeySize:], c.checkSum)
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// Deserialises a table encoded with Encode()
+func ibltDecode(s string) (*iblt, error) {
+	buf, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	n := len(buf) / ibltCellSize
+	if len(buf)%ibltCellSize != 0 || n == 0 || n%ibltHashCount != 0 || n > ibltMaxCells {
+		return nil, fmt.Errorf("Invalid IBLT size: %d bytes", len(buf))
+	}
+	t := iblt{cells: make([]ibltCell, n)}
+	for i := range t.cells {
+		b := buf[i*ibltCellSize:]
+		c := &t.cells[i]
+		c.count = int32(binary.BigEndian.Uint32(b[0:4]))
+		copy(c.keySum[:], b[4:4+ibltKeySize])
+		c.checkSum = binary.BigEndian.Uint64(b[4+ibltKeySize:])
+	}
+	return &t, nil
+}
+
+// Returns an IBLT of the blocks in the given range of heights
+func blockchainMakeIBLT(minHeight, maxHeight int, cells int) (*iblt, error) {
+	t := iblt{cells: make([]ibltCell, cells)}
+	for height, hash := range dbGetHeightHashes(minHeight, maxHeight) {
+		if err := t.Insert(height, hash); err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
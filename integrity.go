@@ -0,0 +1,199 @@
+package daisy
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// The integrity sampler verifies -integrity-samples-per-hour randomly chosen blocks every
+// hour, so silent disk corruption is caught on nodes which run for a long time without a
+// restart (which verifies all the blocks). A sampled block has its hash and signatures
+// checked, its database checked with SQLite's quick_check, and the chunks of its documents
+// read back and hashed. A block is only taken to be damaged if its file's hash doesn't
+// match, or if SQLite finds its database damaged although the hash matches; other errors,
+// e.g. a file which can't be opened for now, are counted and the block is checked again
+// in the next sample. A damaged block is repaired with a copy from the peers, or if it
+// cannot be, it and the blocks above it are quarantined and fetched again from the peers.
+// A damaged chunk is deleted and fetched again. The checks and the failures are counted in
+// the metrics.
+
+// DefaultIntegritySamplesPerHour is the default number of blocks verified every hour
+const DefaultIntegritySamplesPerHour = 6
+
+var integrityStats = struct {
+	lock          WithMutex
+	checked       int64
+	blockFailures int64
+	chunkFailures int64
+	errors        int64
+	lastFailure   string
+	retryHeight   int // the block to check in the next sample, or -1
+}{
+	retryHeight: -1,
+}
+
+// An error which confirms that a block file is damaged, as opposed to one which only
+// means that it couldn't be checked
+type blockDamagedError struct {
+	error
+}
+
+// Checks that the block's database and the chunks of its documents are readable and
+// intact. Returns the hashes of the damaged chunks.
+func blockchainVerifyPayload(height int) ([]string, error) {
+	b, err := OpenBlockByHeight(height)
+	if err != nil {
+		return nil, fmt.Errorf("block %d: cannot open block db file: %v", height, err)
+	}
+	defer b.Close()
+	var result string
+	if err = b.db.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+		return nil, fmt.Errorf("block %d: cannot check the block db file: %v", height, err)
+	}
+	if result != "ok" {
+		return nil, blockDamagedError{fmt.Errorf("block %d: the block db file is damaged: %s", height, result)}
+	}
+	atts, err := b.dbGetAttachments()
+	if err != nil {
+		return nil, fmt.Errorf("block %d: cannot read the attachments: %v", height, err)
+	}
+	var damaged []string
+	for _, att := range atts {
+		for _, chunkHash := range att.chunks {
+			if !chunkExists(chunkHash) {
+				// Already waiting to be fetched
+				continue
+			}
+			data, err := chunkRead(chunkHash)
+			if err != nil || hashBytesToHexString(data) != chunkHash {
+				damaged = append(damaged, chunkHash)
+			}
+		}
+	}
+	return damaged, nil
+}
+
+// Records a failure found by the sampler
+func integrityRecordFailure(desc string, chunk bool) {
+	log.Println("WARNING: integrity check failed:", desc)
+	integrityStats.lock.With(func() {
+		if chunk {
+			integrityStats.chunkFailures++
+		} else {
+			integrityStats.blockFailures++
+		}
+		integrityStats.lastFailure = desc
+	})
+}
+
+// Asks the peer with the highest chain for the blocks we don't have
+func integritySearchForBlocks() {
+	var best *p2pConnection
+	p2pPeers.lock.With(func() {
+		for p2pc := range p2pPeers.peers {
+			if best == nil || p2pc.chainHeight > best.chainHeight {
+				best = p2pc
+			}
+		}
+	})
+	if best != nil && best.chainHeight > dbGetBlockchainHeight() {
+		p2pCtrlChannel <- p2pCtrlMessage{msgType: p2pCtrlSearchForBlocks, payload: best}
+	}
+}
+
+// Verifies the block at the given height, and sends the damaged block or chunks to be
+// fetched again
+func integrityCheckBlock(height int) {
+	integrityStats.lock.With(func() {
+		integrityStats.checked++
+	})
+	err := blockchainVerifyBlock(height)
+	var damaged []string
+	if err == nil {
+		damaged, err = blockchainVerifyPayload(height)
+	}
+	if _, ok := err.(blockDamagedError); err != nil && !ok {
+		log.Println("Cannot check block", height, "- it will be checked again:", err)
+		integrityStats.lock.With(func() {
+			integrityStats.errors++
+			integrityStats.retryHeight = height
+		})
+		return
+	}
+	if err != nil {
+		integrityRecordFailure(err.Error(), false)
+		if height <= genesisBlockHeight {
+			log.Println("The genesis block is damaged, cannot recover automatically")
+			return
+		}
+		if err = blockRepairStart(height); err == nil {
+			return
+		}
+		log.Println(err)
+		// The imports hold maintenanceLock, and the blocks created by this node also
+		// blockCreateLock, which is taken first
+		blockCreateLock.With(func() {
+			maintenanceLock.With(func() {
+				err = blockchainQuarantineFrom(height)
+			})
+		})
+		if err != nil {
+			log.Println("Cannot quarantine the damaged blocks:", err)
+			return
+		}
+		log.Println("Rolled back the blockchain to height", dbGetBlockchainHeight(), "- missing blocks will be fetched from peers")
+		integritySearchForBlocks()
+		return
+	}
+	for _, chunkHash := range damaged {
+		integrityRecordFailure(fmt.Sprintf("block %d: chunk %s is damaged", height, chunkHash), true)
+		if err = os.Remove(chunkGetFilename(chunkHash)); err != nil {
+			log.Println(err)
+		}
+		dbAddMissingChunk(chunkHash, height)
+	}
+}
+
+// Verifies randomly chosen blocks at the configured rate, until the node stops
+func integritySampleRun() {
+	interval := time.Hour / time.Duration(cfg.IntegritySamplesPerHour)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-nodeQuit:
+			return
+		case <-ticker.C:
+		}
+		height := dbGetBlockchainHeight()
+		if height <= 0 {
+			continue
+		}
+		sample := rand.Intn(height + 1)
+		integrityStats.lock.With(func() {
+			if integrityStats.retryHeight >= 0 && integrityStats.retryHeight <= height {
+				sample = integrityStats.retryHeight
+			}
+			integrityStats.retryHeight = -1
+		})
+		integrityCheckBlock(sample)
+	}
+}
+
+// Returns the sampler's counters for the metrics
+func integrityMetrics() map[string]interface{} {
+	var m map[string]interface{}
+	integrityStats.lock.With(func() {
+		m = map[string]interface{}{
+			"checked":        integrityStats.checked,
+			"block_failures": integrityStats.blockFailures,
+			"chunk_failures": integrityStats.chunkFailures,
+			"errors":         integrityStats.errors,
+			"last_failure":   integrityStats.lastFailure,
+		}
+	})
+	return m
+}
@@ -0,0 +1,422 @@
+// Package lightclient is a small client for verifying Daisy documents without running a node.
+//
+// A light client starts from a trusted checkpoint (a block height and hash, and the chain's
+// root, obtained out of band) and a list of trusted signers, fetches the chain of block
+// headers from a node's HTTP API and verifies that they link together and are signed by
+// the trusted signers. It can then fetch the Merkle proof of a document and verify it
+// against the sealed documents root of a verified header. The whole chain is never
+// downloaded, so this is suitable for mobile and embedded devices.
+//
+// The package only depends on the standard library, so it can be used outside of the daisy
+// binary.
+package lightclient
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/sha3"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The maximum number of headers returned by a single request to a node
+const maxHeadersPerRequest = 500
+
+// A hash algorithm of the chains. Block and document hashes are hex strings prefixed with
+// the algorithm's type and ":", except for SHA256 hashes, which are unprefixed.
+type hashAlgorithm struct {
+	name     string
+	hashType int
+	newHash  func() hash.Hash
+}
+
+var hashSHA256 = &hashAlgorithm{name: "sha256", hashType: 1, newHash: sha256.New}
+
+var hashAlgorithms = struct {
+	lock   sync.Mutex
+	byType map[int]*hashAlgorithm
+}{byType: map[int]*hashAlgorithm{
+	1: hashSHA256,
+	2: {name: "sha3-256", hashType: 2, newHash: func() hash.Hash { return sha3.New256() }},
+}}
+
+// RegisterHashAlgorithm adds a hash algorithm for the chains which use one the package
+// doesn't know, with the same name and type as daisy.RegisterHashAlgorithm
+func RegisterHashAlgorithm(name string, hashType int, newHash func() hash.Hash) error {
+	hashAlgorithms.lock.Lock()
+	defer hashAlgorithms.lock.Unlock()
+	if _, ok := hashAlgorithms.byType[hashType]; ok || hashType < 1 {
+		return fmt.Errorf("Invalid or duplicate hash type %d", hashType)
+	}
+	hashAlgorithms.byType[hashType] = &hashAlgorithm{name: name, hashType: hashType, newHash: newHash}
+	return nil
+}
+
+// Parses a hash into its algorithm and digest
+func parseHash(s string) (*hashAlgorithm, []byte, error) {
+	a := hashSHA256
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		hashType, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid hash %q", s)
+		}
+		hashAlgorithms.lock.Lock()
+		a = hashAlgorithms.byType[hashType]
+		hashAlgorithms.lock.Unlock()
+		if a == nil || a == hashSHA256 {
+			return nil, nil, fmt.Errorf("Unknown hash type in %q", s)
+		}
+		s = s[i+1:]
+	}
+	digest, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a, digest, nil
+}
+
+// Returns the digest of the concatenated data
+func (a *hashAlgorithm) digest(data ...[]byte) []byte {
+	h := a.newHash()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func (a *hashAlgorithm) format(digest []byte) string {
+	if a == hashSHA256 {
+		return hex.EncodeToString(digest)
+	}
+	return strconv.Itoa(a.hashType) + ":" + hex.EncodeToString(digest)
+}
+
+// Header is a block header, as returned by the node's /headers endpoint
+type Header struct {
+	Height                     int    `json:"height"`
+	Hash                       string `json:"hash"`
+	HashSignature              string `json:"hash_signature"`
+	PreviousBlockHash          string `json:"previous_block_hash"`
+	PreviousBlockHashSignature string `json:"previous_block_hash_signature"`
+	CreatorPublicKeyHash       string `json:"creator_public_key_hash"`
+	CreatorPublicKey           string `json:"creator_public_key"`
+	Timestamp                  string `json:"timestamp"`
+	DocumentsRoot              string `json:"documents_root,omitempty"`
+	DocumentsRootSignature     string `json:"documents_root_signature,omitempty"`
+	SealSignature              string `json:"seal_signature,omitempty"`
+}
+
+// ProofStep is one step of a Merkle inclusion proof
+type ProofStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// Proof is the Merkle proof of a document, as returned by the node's /proof endpoint
+type Proof struct {
+	Version       int         `json:"version"`
+	HashAlgorithm string      `json:"hash_algorithm"`
+	ChainRoot     string      `json:"chain_root"`
+	DocumentHash  string      `json:"document_hash"`
+	DocumentName  string      `json:"document_name"`
+	DocumentSize  int64       `json:"document_size"`
+	MerkleProof   []ProofStep `json:"merkle_proof"`
+	Block         Header      `json:"block"`
+}
+
+// Checkpoint is a trusted block, from which the header chain is verified
+type Checkpoint struct {
+	Height int
+	Hash   string
+	// The genesis block hash of the chain, to which the block seals are bound
+	ChainRoot string
+}
+
+// ErrNotPinned is returned when syncing without trusted signers or a chain root. Without
+// them, headers would only be checked against the keys they carry themselves, which
+// anyone can make.
+var ErrNotPinned = errors.New("The light client needs trusted signers and the chain root")
+
+// Client verifies headers and documents fetched from a Daisy node
+type Client struct {
+	// The base URL of the node's HTTP API, e.g. http://example.com:2018/
+	BaseURL string
+	// The HTTP client used for the requests
+	HTTPClient *http.Client
+	// Only headers signed by these public key hashes are accepted. It must not be empty.
+	TrustedSigners []string
+
+	chainRoot string
+	headers   map[int]*Header
+	tip       int
+}
+
+// New creates a client which trusts the given checkpoint
+func New(baseURL string, checkpoint Checkpoint) *Client {
+	c := Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 60 * time.Second},
+		chainRoot:  checkpoint.ChainRoot,
+		headers:    map[int]*Header{},
+		tip:        checkpoint.Height,
+	}
+	c.headers[checkpoint.Height] = &Header{Height: checkpoint.Height, Hash: checkpoint.Hash}
+	return &c
+}
+
+// Height returns the height of the latest verified header
+func (c *Client) Height() int {
+	return c.tip
+}
+
+// Header returns the verified header at the given height, or nil
+func (c *Client) Header(height int) *Header {
+	return c.headers[height]
+}
+
+func (c *Client) getJSON(path string, v interface{}) error {
+	resp, err := c.HTTPClient.Get(c.BaseURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: HTTP status %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Sync fetches and verifies the headers following the latest verified header, up to the
+// node's chain height. Returns the number of new headers.
+func (c *Client) Sync() (int, error) {
+	if len(c.TrustedSigners) == 0 || c.chainRoot == "" {
+		return 0, ErrNotPinned
+	}
+	n := 0
+	for {
+		var headers []Header
+		path := fmt.Sprintf("/headers?from=%d&to=%d", c.tip+1, c.tip+maxHeadersPerRequest)
+		if err := c.getJSON(path, &headers); err != nil {
+			return n, err
+		}
+		if len(headers) == 0 {
+			return n, nil
+		}
+		for i := range headers {
+			hdr := &headers[i]
+			prev := c.headers[c.tip]
+			if hdr.Height != prev.Height+1 || hdr.PreviousBlockHash != prev.Hash {
+				return n, fmt.Errorf("Header %d doesn't follow the verified header %d", hdr.Height, prev.Height)
+			}
+			if err := c.VerifyHeader(hdr); err != nil {
+				return n, err
+			}
+			c.headers[hdr.Height] = hdr
+			c.tip = hdr.Height
+			n++
+		}
+	}
+}
+
+// VerifyHeader checks the signatures in the header, including its seal, and that it's
+// signed by one of the trusted signers.
+func (c *Client) VerifyHeader(hdr *Header) error {
+	if len(c.TrustedSigners) == 0 || c.chainRoot == "" {
+		return ErrNotPinned
+	}
+	trusted := false
+	for _, s := range c.TrustedSigners {
+		if s == hdr.CreatorPublicKeyHash {
+			trusted = true
+		}
+	}
+	if !trusted {
+		return fmt.Errorf("Header %d is signed by an untrusted key %s", hdr.Height, hdr.CreatorPublicKeyHash)
+	}
+	if err := VerifyHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.SealSignature != "" {
+		publicKey, err := headerPublicKey(hdr)
+		if err != nil {
+			return err
+		}
+		seal, err := sealHash(c.chainRoot, hdr)
+		if err != nil {
+			return fmt.Errorf("Header %d: %v", hdr.Height, err)
+		}
+		if err = verifyHex(publicKey, seal, hdr.SealSignature); err != nil {
+			return fmt.Errorf("Header %d: invalid seal signature: %v", hdr.Height, err)
+		}
+	}
+	return nil
+}
+
+// Returns the public key in the header, checked against its hash
+func headerPublicKey(hdr *Header) (*ecdsa.PublicKey, error) {
+	publicKeyBytes, err := hex.DecodeString(hdr.CreatorPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Header %d: invalid public key: %v", hdr.Height, err)
+	}
+	keyHash := sha256.Sum256(publicKeyBytes)
+	if "1:"+hex.EncodeToString(keyHash[:]) != hdr.CreatorPublicKeyHash {
+		return nil, fmt.Errorf("Header %d: public key doesn't match its hash %s", hdr.Height, hdr.CreatorPublicKeyHash)
+	}
+	ikey, err := x509.ParsePKIXPublicKey(publicKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Header %d: invalid public key: %v", hdr.Height, err)
+	}
+	publicKey, ok := ikey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Header %d: not an ECDSA public key", hdr.Height)
+	}
+	return publicKey, nil
+}
+
+// VerifyHeader checks the signatures in the header against the public key it carries. This
+// only shows the header is consistent: anyone can make a key and sign a header with it, so
+// the header must also be signed by a trusted signer, as Client.VerifyHeader checks.
+func VerifyHeader(hdr *Header) error {
+	publicKey, err := headerPublicKey(hdr)
+	if err != nil {
+		return err
+	}
+	if err = verifyHex(publicKey, hdr.Hash, hdr.HashSignature); err != nil {
+		return fmt.Errorf("Header %d: invalid block hash signature: %v", hdr.Height, err)
+	}
+	if err = verifyHex(publicKey, hdr.PreviousBlockHash, hdr.PreviousBlockHashSignature); err != nil {
+		return fmt.Errorf("Header %d: invalid previous block hash signature: %v", hdr.Height, err)
+	}
+	if hdr.DocumentsRoot != "" {
+		if err = verifyHex(publicKey, hdr.DocumentsRoot, hdr.DocumentsRootSignature); err != nil {
+			return fmt.Errorf("Header %d: invalid documents root signature: %v", hdr.Height, err)
+		}
+	}
+	return nil
+}
+
+// Returns the hash of the canonical encoding of the header's seal, which binds its timestamp
+// and documents root to the block, as the daisy nodes encode it. It is hashed with the
+// algorithm of the block's hash.
+func sealHash(chainRoot string, hdr *Header) (string, error) {
+	a, _, err := parseHash(hdr.Hash)
+	if err != nil {
+		return "", err
+	}
+	var w bytes.Buffer
+	writeString := func(s string) {
+		binary.Write(&w, binary.BigEndian, uint32(len(s)))
+		w.WriteString(s)
+	}
+	w.WriteString("DAISYSEL")
+	w.WriteByte(1)
+	writeString(strings.ToLower(chainRoot))
+	binary.Write(&w, binary.BigEndian, uint64(hdr.Height))
+	writeString(strings.ToLower(hdr.PreviousBlockHash))
+	writeString(hdr.Timestamp)
+	writeString(strings.ToLower(hdr.DocumentsRoot))
+	return a.format(a.digest(w.Bytes())), nil
+}
+
+func verifyHex(publicKey *ecdsa.PublicKey, hash string, signature string) error {
+	_, hashBytes, err := parseHash(hash)
+	if err != nil {
+		return err
+	}
+	signatureBytes, err := hex.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	if !ecdsa.VerifyASN1(publicKey, hashBytes, signatureBytes) {
+		return fmt.Errorf("Signature verification failed")
+	}
+	return nil
+}
+
+// GetProof fetches the proof of the document with the given hash and verifies it against
+// the verified header chain. The header chain must have been synced past the document's block.
+func (c *Client) GetProof(documentHash string) (*Proof, error) {
+	var proof Proof
+	if err := c.getJSON("/proof/"+url.PathEscape(documentHash), &proof); err != nil {
+		return nil, err
+	}
+	if proof.DocumentHash != documentHash {
+		return nil, fmt.Errorf("Received the proof for a different document")
+	}
+	if err := c.VerifyProof(&proof); err != nil {
+		return nil, err
+	}
+	return &proof, nil
+}
+
+// VerifyProof checks that the document is included in a block whose header is in the
+// verified header chain.
+func (c *Client) VerifyProof(proof *Proof) error {
+	hdr := c.headers[proof.Block.Height]
+	if hdr == nil {
+		return fmt.Errorf("Block %d is not in the verified header chain", proof.Block.Height)
+	}
+	if hdr.Hash != proof.Block.Hash {
+		return fmt.Errorf("Block %d in the proof doesn't match the verified header", proof.Block.Height)
+	}
+	if proof.ChainRoot != c.chainRoot {
+		return fmt.Errorf("The proof is for another chain: %s", proof.ChainRoot)
+	}
+	if hdr.SealSignature == "" {
+		// Without the seal, the documents root isn't bound to the block
+		return fmt.Errorf("Block %d is not sealed", hdr.Height)
+	}
+	a, _, err := parseHash(hdr.Hash)
+	if err != nil {
+		return err
+	}
+	if proof.HashAlgorithm != "" && !strings.EqualFold(proof.HashAlgorithm, a.name) {
+		return fmt.Errorf("The proof's hash algorithm %s isn't the chain's %s", proof.HashAlgorithm, a.name)
+	}
+	root, err := MerkleRoot(proof.DocumentHash, proof.MerkleProof)
+	if err != nil {
+		return err
+	}
+	// The verified header is used, since the documents root in the proof is not trusted
+	if hdr.DocumentsRoot == "" || root != hdr.DocumentsRoot {
+		return fmt.Errorf("The Merkle proof doesn't lead to the documents root of block %d", hdr.Height)
+	}
+	return nil
+}
+
+// MerkleRoot computes the Merkle root from a document hash and its inclusion proof, in the
+// same way as the daisy nodes, with the hash algorithm of the document hash.
+func MerkleRoot(leaf string, proof []ProofStep) (string, error) {
+	a, b, err := parseHash(leaf)
+	if err != nil {
+		return "", err
+	}
+	h := a.digest([]byte{0}, b)
+	for _, step := range proof {
+		sa, sibling, err := parseHash(step.Hash)
+		if err != nil {
+			return "", err
+		}
+		if sa != a {
+			return "", fmt.Errorf("Proof step %s is not a %s hash", step.Hash, a.name)
+		}
+		if step.Left {
+			h = a.digest([]byte{1}, sibling, h)
+		} else {
+			h = a.digest([]byte{1}, h, sibling)
+		}
+	}
+	return a.format(h), nil
+}
@@ -0,0 +1,296 @@
+package daisy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The listings of the HTTP API (/blocks, /headers, /documents, /peers and /governance)
+// are paginated, filtered and sorted with the same query parameters: limit (the number of
+// items per page), order (asc or desc), from and to (the range of block heights), since
+// and until (the range of times, as RFC 3339 or Unix seconds), and cursor. The response
+// is the JSON array of the page's items; if there are more, the X-Next-Cursor header
+// carries an opaque cursor, which is passed as the cursor parameter together with the
+// same filters to get the next page. The cursors point after the last item of a page, so
+// pages don't overlap or skip items when new blocks arrive meanwhile.
+
+// The header with the cursor of the next page
+const listNextCursorHeader = "X-Next-Cursor"
+
+// The number of items per page, if it isn't given, and the most which can be asked for
+const (
+	listDefaultLimit = 100
+	listMaxLimit     = 1000
+)
+
+// The most blocks /documents opens for a page, so a range of blocks without documents
+// doesn't make a request arbitrarily long
+const listMaxScanBlocks = 1000
+
+// The parameters of a listing request
+type listParams struct {
+	limit        int
+	desc         bool
+	cursor       string // decoded, empty on the first page
+	from, to     int    // block heights, -1 if not given
+	since, until time.Time
+}
+
+// Parses a time given as RFC 3339 or Unix seconds
+func parseListTime(s string) (time.Time, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Parses the listing parameters of the request, with the default and the largest page
+// size and the default order of the listing
+func parseListParams(r *http.Request, defaultLimit, maxLimit int, defaultDesc bool) (*listParams, error) {
+	lp := listParams{limit: defaultLimit, desc: defaultDesc, from: -1, to: -1}
+	var err error
+	if s := r.FormValue("limit"); s != "" {
+		if lp.limit, err = strconv.Atoi(s); err != nil || lp.limit < 1 || lp.limit > maxLimit {
+			return nil, fmt.Errorf("Invalid limit %q: expecting 1 to %d", s, maxLimit)
+		}
+	}
+	switch s := r.FormValue("order"); s {
+	case "":
+	case "asc":
+		lp.desc = false
+	case "desc":
+		lp.desc = true
+	default:
+		return nil, fmt.Errorf("Invalid order %q: expecting asc or desc", s)
+	}
+	for _, p := range []struct {
+		name  string
+		value *int
+	}{{"from", &lp.from}, {"to", &lp.to}} {
+		if s := r.FormValue(p.name); s != "" {
+			if *p.value, err = strconv.Atoi(s); err != nil || *p.value < 0 {
+				return nil, fmt.Errorf("Invalid %s height %q", p.name, s)
+			}
+		}
+	}
+	for _, p := range []struct {
+		name  string
+		value *time.Time
+	}{{"since", &lp.since}, {"until", &lp.until}} {
+		if s := r.FormValue(p.name); s != "" {
+			if *p.value, err = parseListTime(s); err != nil {
+				return nil, fmt.Errorf("Invalid %s time %q: expecting RFC 3339 or Unix seconds", p.name, s)
+			}
+		}
+	}
+	if s := r.FormValue("cursor"); s != "" {
+		cursor, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(cursor) == 0 {
+			return nil, fmt.Errorf("Invalid cursor %q", s)
+		}
+		lp.cursor = string(cursor)
+	}
+	return &lp, nil
+}
+
+// Returns the height range of the listing, within the blockchain
+func (lp *listParams) heightRange() (int, int) {
+	from, to := lp.from, dbGetBlockchainHeight()
+	if from < 0 {
+		from = 0
+	}
+	if lp.to >= 0 && lp.to < to {
+		to = lp.to
+	}
+	return from, to
+}
+
+// Returns the time range of the listing in Unix seconds
+func (lp *listParams) timeRange() (int64, int64) {
+	since, until := int64(0), int64(1<<62)
+	if !lp.since.IsZero() {
+		since = lp.since.Unix()
+	}
+	if !lp.until.IsZero() {
+		until = lp.until.Unix()
+	}
+	return since, until
+}
+
+// Returns true if the time is in the listing's time range
+func (lp *listParams) timeMatches(t time.Time) bool {
+	return (lp.since.IsZero() || !t.Before(lp.since)) && (lp.until.IsZero() || !t.After(lp.until))
+}
+
+// Returns the cursor as integers separated by slashes, or nil on the first page
+func (lp *listParams) cursorInts(n int) ([]int64, error) {
+	if lp.cursor == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(lp.cursor, "/", n)
+	if len(parts) != n {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	values := make([]int64, n)
+	for i, part := range parts {
+		v, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid cursor")
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// Sets the cursor of the next page in the response
+func listSetNextCursor(w http.ResponseWriter, cursor string) {
+	w.Header().Set(listNextCursorHeader, base64.RawURLEncoding.EncodeToString([]byte(cursor)))
+}
+
+// A block in the /blocks listing
+type listBlock struct {
+	Height                 int    `json:"height"`
+	Hash                   string `json:"hash"`
+	PreviousBlockHash      string `json:"previous_block_hash"`
+	SignaturePublicKeyHash string `json:"signature_public_key_hash"`
+	TimeAccepted           string `json:"time_accepted"`
+	Version                int    `json:"version"`
+}
+
+// A document in the /documents listing
+type listDocument struct {
+	Height int `json:"height"`
+	ExportDocument
+}
+
+// Returns the blocks of the listing's page from the blockchain table, and the cursor of
+// the next page, if there is one
+func listBlocks(lp *listParams) ([]DbBlockchainBlock, string, error) {
+	after, err := lp.cursorInts(1)
+	if err != nil {
+		return nil, "", err
+	}
+	afterHeight := -1
+	if after != nil {
+		afterHeight = int(after[0])
+	}
+	blocks, err := dbListBlocks(lp, afterHeight, lp.limit+1)
+	if err != nil || len(blocks) <= lp.limit {
+		return blocks, "", err
+	}
+	blocks = blocks[:lp.limit]
+	return blocks, strconv.Itoa(blocks[len(blocks)-1].Height), nil
+}
+
+// /blocks lists the blocks in the blockchain by height, filtered by their heights and the
+// times they were accepted by this node
+func blockWebListBlocks(w http.ResponseWriter, r *http.Request) {
+	lp, err := parseListParams(r, listDefaultLimit, listMaxLimit, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	blocks, next, err := listBlocks(lp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result := []listBlock{}
+	for _, dbb := range blocks {
+		result = append(result, listBlock{
+			Height:                 dbb.Height,
+			Hash:                   dbb.Hash,
+			PreviousBlockHash:      dbb.PreviousBlockHash,
+			SignaturePublicKeyHash: dbb.SignaturePublicKeyHash,
+			TimeAccepted:           dbb.TimeAccepted.UTC().Format(time.RFC3339),
+			Version:                dbb.Version,
+		})
+	}
+	if next != "" {
+		listSetNextCursor(w, next)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(jsonifyWhateverToBytes(result)); err != nil {
+		log.Println(err)
+	}
+}
+
+// /documents lists the documents in the blocks, in the order of the blocks and of the
+// documents in them. A page is cut short after opening listMaxScanBlocks blocks.
+func blockWebListDocuments(w http.ResponseWriter, r *http.Request) {
+	if cfg.relay {
+		http.Error(w, "Relay nodes don't have the documents", http.StatusNotFound)
+		return
+	}
+	lp, err := parseListParams(r, listDefaultLimit, listMaxLimit, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The cursor is the height of a block and the index of the last document listed from
+	// it, or -1 if all its documents have been listed
+	after, err := lp.cursorInts(2)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cursorHeight, cursorIndex, afterHeight := -1, -1, -1
+	if after != nil {
+		cursorHeight, cursorIndex, afterHeight = int(after[0]), int(after[1]), int(after[0])
+		if cursorIndex >= 0 {
+			// The block the cursor is in has more documents
+			if lp.desc {
+				afterHeight++
+			} else {
+				afterHeight--
+			}
+		}
+	}
+	blocks, err := dbListBlocks(lp, afterHeight, listMaxScanBlocks)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := []listDocument{}
+	next := ""
+	lastIndex := -1
+scan:
+	for _, dbb := range blocks {
+		eb, err := blockchainExportBlock(dbb.Height, false)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Cannot read block %d: %v", dbb.Height, err), http.StatusInternalServerError)
+			return
+		}
+		for j := range eb.Documents {
+			i := j
+			if lp.desc {
+				i = len(eb.Documents) - 1 - j
+			}
+			if dbb.Height == cursorHeight && cursorIndex >= 0 && (lp.desc && i >= cursorIndex || !lp.desc && i <= cursorIndex) {
+				continue
+			}
+			if len(result) == lp.limit {
+				next = fmt.Sprintf("%d/%d", result[len(result)-1].Height, lastIndex)
+				break scan
+			}
+			result = append(result, listDocument{Height: dbb.Height, ExportDocument: eb.Documents[i]})
+			lastIndex = i
+		}
+	}
+	if next == "" && len(blocks) == listMaxScanBlocks {
+		// The next page goes on after the last block opened
+		next = fmt.Sprintf("%d/-1", blocks[len(blocks)-1].Height)
+	}
+	if next != "" {
+		listSetNextCursor(w, next)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(jsonifyWhateverToBytes(result)); err != nil {
+		log.Println(err)
+	}
+}
@@ -1,6 +1,7 @@
-package main
+package daisy
 
 import (
+	"flag"
 	"log"
 	"math/rand"
 	"os"
@@ -20,27 +21,35 @@ type sysEventMessage struct {
 // Passes messages such as eventQuit
 var sysEventChannel = make(chan sysEventMessage, 5)
 
-func main() {
+// Main runs the daisy command: it parses the command line, runs the requested action or
+// starts the node, and exits when the node is stopped.
+func Main() {
 	rand.Seed(p2pEphemeralID + getNowUTC()) // Initialise weak RNG with strong RNG
 	log.Println("Starting up", p2pClientVersionString, "...")
 	sigChannel := make(chan os.Signal, 1)
 	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGTERM)
+	handoverNotify(sigChannel)
 
 	configInit()
+	osServiceRun()
 	if processPreBlockchainActions() {
 		return
 	}
-	dbInit()
-	cryptoInit()
-	blockchainInit(true)
+	if flag.NArg() == 0 {
+		// Running the node
+		handoverReceive()
+		if !cfg.readOnly {
+			if err := dataDirLock(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+	nodeInit()
 	if processActions() {
 		return
 	}
-	log.Printf("Ephemeral ID: %x\n", p2pEphemeralID)
-	go p2pCoordinator.Run()
-	go p2pServer()
-	go p2pClient()
-	go blockWebServer()
+	nodeStartServices()
+	handoverTakenOver()
 
 	for {
 		select {
@@ -48,6 +57,7 @@ func main() {
 			switch msg.event {
 			case eventQuit:
 				log.Println("Exiting")
+				sdNotifyStopping()
 				os.Exit(msg.idata)
 			}
 		case sig := <-sigChannel:
@@ -58,8 +68,78 @@ func main() {
 			case syscall.SIGTERM:
 				sysEventChannel <- sysEventMessage{event: eventQuit, idata: 0}
 				log.Println("Quit signal detected")
+			default:
+				if isHandoverSignal(sig) {
+					log.Println("Upgrade signal detected, handing over to a new process")
+					go handoverRun()
+				}
 			}
 		}
 	}
 
 }
+
+// Opens the databases and loads the blockchain
+func nodeInit() {
+	if err := canonicalSelfCheck(); err != nil {
+		log.Fatalln(err)
+	}
+	checkDiskSpace()
+	profileInitChain()
+	dbInit()
+	if !cfg.readOnly {
+		cryptoInit()
+	}
+	blockchainInit(true)
+}
+
+// Starts the p2p, notification and HTTP services in the background
+func nodeStartServices() {
+	if cfg.readOnly {
+		log.Println("Running in read-only mode, p2p is disabled")
+	} else {
+		log.Printf("Ephemeral ID: %x\n", p2pEphemeralID)
+		if err := nodeKeyInit(); err != nil {
+			log.Fatalln("Cannot load the node identity key:", err)
+		}
+		if cfg.relay {
+			log.Println("Running in relay mode, only block headers are stored")
+		}
+		if cfg.OtlpEndpoint != "" {
+			traceSpans = make(chan traceSpan, traceMaxQueuedSpans)
+			nodeGo(traceExportRun)
+		}
+		if !cfg.relay && handoverInherited.tipCheck != tipCheckOK {
+			tipCheckStart()
+		}
+		nodeGo(p2pCoordinator.Run)
+		handoverAdoptPeers()
+		nodeGo(p2pServer)
+		nodeGo(p2pClient)
+		if failoverEnabled() {
+			nodeGo(failoverRun)
+		}
+		if blockProductionSchedule != nil {
+			nodeGo(blockScheduleRun)
+		}
+		if maintenanceHours != nil {
+			nodeGo(maintenanceScheduleRun)
+		}
+		if cfg.IntegritySamplesPerHour > 0 && !cfg.relay {
+			nodeGo(integritySampleRun)
+		}
+		if len(anchorGetPublishers()) > 0 && !cfg.relay {
+			nodeGo(anchorRun)
+		}
+	}
+	if !cfg.relay {
+		nodeGo(blockEventsRun)
+		replicationStart()
+	}
+	if !cfg.httpDisabled {
+		nodeGo(blockWebServer)
+	}
+	if cfg.readOnly {
+		sdNotifyReady()
+	}
+}
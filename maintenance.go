@@ -0,0 +1,412 @@
+package daisy
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With -maintenance-hours, the node does its housekeeping during the given quiet hours,
+// once a day: it runs ANALYZE and VACUUM on the main and the private databases, and
+// repacks the block storage, moving the block files which aren't where the block_storage
+// setting puts them and removing the temporary files left by interrupted copies. The
+// block files themselves are never vacuumed, since their hashes are the hashes of their
+// contents. While a database is vacuumed or a block file is moved, the node doesn't
+// import blocks, and the p2p coordinator skips its periodic work on the databases.
+// The maintenance pauses while the node is syncing or while the system load
+// average is above -maintenance-max-load, and resumes where it stopped when the load
+// drops, or in the next quiet hours. Its progress is logged and reported in /status. The
+// maintenance command runs it right away.
+
+// The config table key under which the time of the last completed maintenance is kept
+const maintenanceLastRunKey = "maintenance_last_run"
+
+// Temporary files older than this in the block directories are left over by interrupted copies
+const maintenanceStaleTmpAge = time.Hour
+
+// The maintenance steps
+const (
+	maintenanceStepAnalyze = "analyze"
+	maintenanceStepVacuum  = "vacuum"
+	maintenanceStepRepack  = "repack"
+)
+
+var maintenanceSteps = []string{maintenanceStepAnalyze, maintenanceStepVacuum, maintenanceStepRepack}
+
+// Held by the maintenance while it vacuums a database or moves a block file, and by the
+// block imports, so that blocks aren't written while the files are rewritten
+var maintenanceLock WithMutex
+
+// The daily quiet hours, in minutes since midnight in the local time zone. The window
+// wraps around midnight if the end is before the start.
+type maintenanceWindow struct {
+	start, end int
+}
+
+// The parsed -maintenance-hours, or nil
+var maintenanceHours *maintenanceWindow
+
+// The state of the maintenance, reported in /status
+var maintenanceState = struct {
+	lock        WithMutex
+	running     bool
+	step        string
+	progress    string
+	pauseReason string
+	lastRun     time.Time
+	// Set while the maintenance holds maintenanceLock
+	exclusive bool
+	// The height up to which the block storage has been repacked by this process
+	repackedHeight int
+}{
+	repackedHeight: -1,
+}
+
+// Parses quiet hours like "01:00-05:00"
+func parseMaintenanceWindow(s string) (*maintenanceWindow, error) {
+	bounds := strings.Split(strings.TrimSpace(s), "-")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("Invalid maintenance hours %q: expecting a range like 01:00-05:00", s)
+	}
+	var w maintenanceWindow
+	for i, b := range bounds {
+		t, err := time.Parse("15:04", strings.TrimSpace(b))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid maintenance hours %q: expecting a range like 01:00-05:00", s)
+		}
+		if i == 0 {
+			w.start = t.Hour()*60 + t.Minute()
+		} else {
+			w.end = t.Hour()*60 + t.Minute()
+		}
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("Invalid maintenance hours %q: the window is empty", s)
+	}
+	return &w, nil
+}
+
+// Returns the start of the quiet hours which contain t, or the zero time if t is outside
+// of them
+func (w *maintenanceWindow) startOf(t time.Time) time.Time {
+	minute := t.Hour()*60 + t.Minute()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if w.start < w.end {
+		if minute >= w.start && minute < w.end {
+			return midnight.Add(time.Duration(w.start) * time.Minute)
+		}
+		return time.Time{}
+	}
+	if minute >= w.start {
+		return midnight.Add(time.Duration(w.start) * time.Minute)
+	}
+	if minute < w.end {
+		return midnight.AddDate(0, 0, -1).Add(time.Duration(w.start) * time.Minute)
+	}
+	return time.Time{}
+}
+
+// Returns the 1-minute system load average, or -1 if it's not known on this system
+func maintenanceLoadAverage() float64 {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return -1
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return -1
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return -1
+	}
+	return load
+}
+
+// Returns why the maintenance should pause now, or an empty string
+func maintenanceBusyReason() string {
+	if height := dbGetBlockchainHeight(); p2pPeers.maxChainHeight() > height {
+		return "syncing"
+	}
+	maxLoad := tunableMaintenanceMaxLoad()
+	if maxLoad == 0 {
+		maxLoad = float64(runtime.NumCPU())
+	}
+	if load := maintenanceLoadAverage(); load > maxLoad {
+		return fmt.Sprintf("load average %.2f", load)
+	}
+	return ""
+}
+
+// Runs f with maintenanceLock held, pausing the block imports and the coordinator
+func maintenanceExclusive(f func()) {
+	maintenanceLock.With(func() {
+		maintenanceState.lock.With(func() {
+			maintenanceState.exclusive = true
+		})
+		defer maintenanceState.lock.With(func() {
+			maintenanceState.exclusive = false
+		})
+		f()
+	})
+}
+
+// Returns true while the maintenance vacuums a database or moves a block file
+func maintenanceIsExclusive() bool {
+	exclusive := false
+	maintenanceState.lock.With(func() {
+		exclusive = maintenanceState.exclusive
+	})
+	return exclusive
+}
+
+// Records the current step and its progress
+func maintenanceSetStep(step, progress string) {
+	maintenanceState.lock.With(func() {
+		maintenanceState.step = step
+		maintenanceState.progress = progress
+	})
+}
+
+// Waits until the node isn't busy any more. Returns false if the maintenance must stop
+// because the quiet hours are over or the node is stopping. The check is skipped if
+// force is true.
+func maintenanceWaitQuiet(force bool) bool {
+	if force {
+		return true
+	}
+	for {
+		if maintenanceHours.startOf(time.Now()).IsZero() {
+			return false
+		}
+		reason := maintenanceBusyReason()
+		maintenanceState.lock.With(func() {
+			if reason != "" && maintenanceState.pauseReason == "" {
+				log.Println("Pausing the maintenance:", reason)
+			} else if reason == "" && maintenanceState.pauseReason != "" {
+				log.Println("Resuming the maintenance")
+			}
+			maintenanceState.pauseReason = reason
+		})
+		if reason == "" {
+			return true
+		}
+		select {
+		case <-nodeQuit:
+			return false
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+// Runs ANALYZE on the databases
+func maintenanceAnalyze() error {
+	for _, db := range []*sql.DB{mainDb, privateDb} {
+		if db == nil {
+			continue
+		}
+		if _, err := db.Exec("ANALYZE"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs VACUUM on the databases which have free pages, returning the bytes reclaimed
+func maintenanceVacuum() (int64, error) {
+	var reclaimed int64
+	for _, db := range []*sql.DB{mainDb, privateDb} {
+		if db == nil {
+			continue
+		}
+		var freePages, pageSize int64
+		if err := db.QueryRow("PRAGMA freelist_count").Scan(&freePages); err != nil {
+			return reclaimed, err
+		}
+		if freePages == 0 {
+			continue
+		}
+		if err := db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+			return reclaimed, err
+		}
+		var err error
+		maintenanceExclusive(func() {
+			_, err = db.Exec("VACUUM")
+		})
+		if err != nil {
+			return reclaimed, err
+		}
+		reclaimed += freePages * pageSize
+	}
+	return reclaimed, nil
+}
+
+// Moves the block files which aren't where the block_storage setting puts them, starting
+// after the height repacked last. Returns false if the maintenance must stop before all
+// the blocks are done.
+func maintenanceRepack(force bool) (bool, error) {
+	var from int
+	maintenanceState.lock.With(func() {
+		from = maintenanceState.repackedHeight + 1
+	})
+	if from == 0 {
+		if removed := blockStorageRemoveTmpFiles(maintenanceStaleTmpAge); removed > 0 {
+			log.Println("Removed", removed, "stale temporary files from the block storage")
+		}
+	}
+	height := dbGetBlockchainHeight()
+	moved := 0
+	defer func() {
+		if moved > 0 {
+			log.Println("Moved", moved, "block files")
+		}
+	}()
+	for h := from; h <= height; h++ {
+		if h%1000 == 0 {
+			maintenanceSetStep(maintenanceStepRepack, fmt.Sprintf("%d/%d", h, height))
+			if !maintenanceWaitQuiet(force) {
+				return false, nil
+			}
+		}
+		var ok bool
+		var err error
+		maintenanceExclusive(func() {
+			ok, err = blockStorageRepackBlock(h)
+		})
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			moved++
+		}
+		maintenanceState.lock.With(func() {
+			maintenanceState.repackedHeight = h
+		})
+	}
+	return true, nil
+}
+
+// Runs the maintenance steps. Returns false if it stopped before completing all of them.
+// With force, it runs regardless of the quiet hours and the load.
+func maintenanceRun(force bool) bool {
+	start := time.Now()
+	maintenanceState.lock.With(func() {
+		maintenanceState.running = true
+	})
+	defer maintenanceState.lock.With(func() {
+		maintenanceState.running = false
+		maintenanceState.step = ""
+		maintenanceState.progress = ""
+		maintenanceState.pauseReason = ""
+	})
+	log.Println("Starting the maintenance")
+	for i, step := range maintenanceSteps {
+		maintenanceSetStep(step, fmt.Sprintf("%d/%d", i+1, len(maintenanceSteps)))
+		if !maintenanceWaitQuiet(force) {
+			log.Println("The maintenance stopped before the", step, "step, it will be resumed in the next quiet hours")
+			return false
+		}
+		stepStart := time.Now()
+		var err error
+		switch step {
+		case maintenanceStepAnalyze:
+			err = maintenanceAnalyze()
+		case maintenanceStepVacuum:
+			var reclaimed int64
+			if reclaimed, err = maintenanceVacuum(); err == nil && reclaimed > 0 {
+				log.Println("Vacuuming reclaimed", reclaimed/1024, "KiB")
+			}
+		case maintenanceStepRepack:
+			if cfg.relay {
+				continue
+			}
+			var done bool
+			if done, err = maintenanceRepack(force); err == nil && !done {
+				log.Println("The block storage repacking stopped, it will be resumed in the next quiet hours")
+				return false
+			}
+		}
+		if err != nil {
+			// Retried in the next quiet hours, e.g. if the databases were busy
+			log.Println("Maintenance step", step, "failed:", err)
+			return false
+		}
+		log.Println("Maintenance step", step, "done in", time.Since(stepStart).Round(time.Millisecond))
+	}
+	now := time.Now()
+	maintenanceState.lock.With(func() {
+		maintenanceState.lastRun = now
+	})
+	dbSetConfig(maintenanceLastRunKey, strconv.FormatInt(now.Unix(), 10))
+	log.Println("Maintenance completed in", time.Since(start).Round(time.Second))
+	return true
+}
+
+// Runs the maintenance in the quiet hours, once in each, until the node stops
+func maintenanceScheduleRun() {
+	if value, ok := dbGetConfig(maintenanceLastRunKey); ok {
+		if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+			maintenanceState.lock.With(func() {
+				maintenanceState.lastRun = time.Unix(ts, 0)
+			})
+		}
+	}
+	log.Println("Running the maintenance in the quiet hours", cfg.MaintenanceHours)
+	var lastAttempt time.Time
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-nodeQuit:
+			return
+		case <-ticker.C:
+		}
+		// The maintenance pauses by itself while the node is busy, so it's started only once
+		// in each quiet hours, unless it has already been completed in them
+		windowStart := maintenanceHours.startOf(time.Now())
+		if windowStart.IsZero() || !lastAttempt.Before(windowStart) {
+			continue
+		}
+		var lastRun time.Time
+		maintenanceState.lock.With(func() {
+			lastRun = maintenanceState.lastRun
+		})
+		if !lastRun.Before(windowStart) {
+			continue
+		}
+		lastAttempt = time.Now()
+		maintenanceRun(false)
+	}
+}
+
+// Returns the maintenance state for /status
+func maintenanceStatus() map[string]interface{} {
+	status := map[string]interface{}{"hours": cfg.MaintenanceHours, "state": "idle"}
+	maintenanceState.lock.With(func() {
+		if maintenanceState.running {
+			status["state"] = "running"
+			status["step"] = maintenanceState.step
+			status["progress"] = maintenanceState.progress
+			if maintenanceState.pauseReason != "" {
+				status["state"] = "paused"
+				status["pause_reason"] = maintenanceState.pauseReason
+			}
+		}
+		if !maintenanceState.lastRun.IsZero() {
+			status["last_run"] = maintenanceState.lastRun.UTC().Format(time.RFC3339)
+		}
+	})
+	return status
+}
+
+// Runs the maintenance right away, run as: maintenance
+func actionMaintenance() {
+	if !maintenanceRun(true) {
+		log.Fatalln("The maintenance failed")
+	}
+}
@@ -0,0 +1,246 @@
+package daisy
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// With -memory-budget-mb, the node's sync buffers and caches are sized to fit the given
+// amount of memory, so a node on a small VM degrades to a slower initial sync instead of
+// being killed for running out of memory. The budget is shared out between: the messages
+// received from the peers and not handled yet, mostly inline blocks, whose readers wait
+// while the total is over their share; the block hashes asked for at a time while
+// syncing, which limits the range of each getblockhashes request; the blocks downloaded
+// from the sync peer at the same time; the caches of announced and requested block
+// hashes; and SQLite's page caches, through its soft heap limit. The node keeps no pool
+// of orphan blocks: a block whose parent hasn't been accepted yet is dropped, and
+// requested again with the next batch. The rest of the budget is left for the Go runtime
+// and the other allocations. If the Go heap still grows over the budget, the batches and
+// the downloads are halved, down to an eighth, until it has shrunk again.
+
+// The smallest memory budget
+const memoryMinBudgetMB = 64
+
+// The shares of the budget
+const (
+	memoryShareInFlight = 0.4 // the received messages not handled yet
+	memoryShareHashes   = 0.1 // the block hashes of a sync batch
+	memoryShareCaches   = 0.1 // the tracked block announcements and traces
+	memoryShareSQLite   = 0.2 // the page caches of the databases
+)
+
+// The estimated memory used by a block hash in a blockhashes message: its JSON, its
+// entry in the decoded map, and its place in the sync queue
+const memoryHashBytes = 512
+
+// The estimated memory used by an entry of a cache of block hashes
+const memoryCacheEntryBytes = 256
+
+// A block received inline takes about twice its size while it's being decoded
+const memoryBlockFactor = 2
+
+// The most blocks downloaded from the sync peer at the same time
+const memoryMaxDownloads = 64
+
+// The smallest sync batch
+const memoryMinSyncBatch = 100
+
+// The highest pressure level, at which the batches and the downloads are an eighth of
+// their size
+const memoryMaxPressure = 3
+
+// The heap usage, as a fraction of the budget, below which the pressure level is lowered
+const memoryRelief = 0.6
+
+var memoryInFlight = struct {
+	lock     WithMutex // also guards the connections' memoryHeld and memoryClosed
+	bytes    int64
+	waits    int64
+	pressure int
+	heap     uint64
+}{}
+
+// Signalled when memory is released
+var memoryInFlightCond = sync.NewCond(&memoryInFlight.lock.Mutex)
+
+// Checks the memory budget
+func memoryBudgetConfigure() error {
+	if cfg.MemoryBudgetMB < 0 || (cfg.MemoryBudgetMB > 0 && cfg.MemoryBudgetMB < memoryMinBudgetMB) {
+		return fmt.Errorf("Invalid -memory-budget-mb: %d (expecting 0 or at least %d)", cfg.MemoryBudgetMB, memoryMinBudgetMB)
+	}
+	return nil
+}
+
+// Returns true if the memory use is limited
+func memoryBudgetEnabled() bool {
+	return cfg.MemoryBudgetMB > 0
+}
+
+// Returns the given share of the budget in bytes, reduced at the current pressure level
+// if reduce is true
+func memoryShare(share float64, reduce bool) int64 {
+	n := int64(float64(cfg.MemoryBudgetMB) * 1024 * 1024 * share)
+	if reduce {
+		memoryInFlight.lock.With(func() {
+			n >>= uint(memoryInFlight.pressure)
+		})
+	}
+	return n
+}
+
+// Limits the memory SQLite uses for its page caches, across all the databases
+func memoryLimitSQLite(db *sql.DB) {
+	if !memoryBudgetEnabled() {
+		return
+	}
+	// The soft heap limit applies to the whole process, whichever connection sets it
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA soft_heap_limit=%d", memoryShare(memoryShareSQLite, false))); err != nil {
+		log.Println("Cannot limit the SQLite memory:", err)
+	}
+}
+
+// Reserves the memory for a message of n bytes received from the peer, waiting while
+// the messages not handled yet are over their share of the budget. A message is always
+// let through when no others are waiting to be handled, however long it is. Returns false
+// if the connection has been closed meanwhile.
+func (p2pc *p2pConnection) memoryReserve(n int64) bool {
+	if !memoryBudgetEnabled() {
+		return true
+	}
+	limit := memoryShare(memoryShareInFlight, true)
+	ok := true
+	memoryInFlight.lock.With(func() {
+		waited := false
+		for memoryInFlight.bytes > 0 && memoryInFlight.bytes+n > limit && !p2pc.memoryClosed {
+			if !waited {
+				memoryInFlight.waits++
+				waited = true
+			}
+			memoryInFlightCond.Wait()
+		}
+		if p2pc.memoryClosed {
+			ok = false
+			return
+		}
+		memoryInFlight.bytes += n
+		p2pc.memoryHeld += n
+	})
+	return ok
+}
+
+// Releases the memory reserved for a handled message
+func (p2pc *p2pConnection) memoryRelease(n int64) {
+	if !memoryBudgetEnabled() || n == 0 {
+		return
+	}
+	memoryInFlight.lock.With(func() {
+		memoryInFlight.bytes -= n
+		p2pc.memoryHeld -= n
+	})
+	memoryInFlightCond.Broadcast()
+}
+
+// Releases the memory reserved for the messages of the closed connection which haven't
+// been handled, and stops its readers from reserving more
+func (p2pc *p2pConnection) memoryReleaseAll() {
+	if !memoryBudgetEnabled() {
+		return
+	}
+	memoryInFlight.lock.With(func() {
+		memoryInFlight.bytes -= p2pc.memoryHeld
+		p2pc.memoryHeld = 0
+		p2pc.memoryClosed = true
+	})
+	memoryInFlightCond.Broadcast()
+}
+
+// Returns the number of block heights whose hashes are asked for at a time while
+// syncing, or 0 if it's not limited
+func memorySyncBatch() int {
+	if !memoryBudgetEnabled() {
+		return 0
+	}
+	n := int(memoryShare(memoryShareHashes, true) / memoryHashBytes)
+	if n < memoryMinSyncBatch {
+		n = memoryMinSyncBatch
+	}
+	return n
+}
+
+// Returns the number of blocks downloaded from the sync peer at the same time, or 0 if
+// it's not limited
+func memorySyncDownloads() int {
+	if !memoryBudgetEnabled() {
+		return 0
+	}
+	blockSize := int64(p2pSyncTypicalBlockSize)
+	if chainParams.MaxBlockSize > 0 {
+		blockSize = chainParams.MaxBlockSize
+	}
+	n := int(memoryShare(memoryShareInFlight, true) / (memoryBlockFactor * blockSize))
+	if n < 1 {
+		n = 1
+	}
+	if n > memoryMaxDownloads {
+		n = memoryMaxDownloads
+	}
+	return n
+}
+
+// Returns true if a cache of block hashes with n entries is full
+func memoryCacheFull(n int) bool {
+	return memoryBudgetEnabled() && int64(n) >= memoryShare(memoryShareCaches, true)/memoryCacheEntryBytes
+}
+
+// Compares the Go heap to the budget, raising the pressure level when it's over it and
+// lowering it when it has shrunk. Called periodically by the coordinator.
+func memoryCheck() {
+	if !memoryBudgetEnabled() {
+		return
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	budget := uint64(cfg.MemoryBudgetMB) * 1024 * 1024
+	heap := ms.HeapInuse
+	pressure := 0
+	changed := false
+	memoryInFlight.lock.With(func() {
+		memoryInFlight.heap = heap
+		if heap > budget && memoryInFlight.pressure < memoryMaxPressure {
+			memoryInFlight.pressure++
+			changed = true
+		} else if heap < uint64(memoryRelief*float64(budget)) && memoryInFlight.pressure > 0 {
+			memoryInFlight.pressure--
+			changed = true
+		}
+		pressure = memoryInFlight.pressure
+	})
+	if heap > budget {
+		// Return the freed memory to the system right away
+		debug.FreeOSMemory()
+	}
+	if changed {
+		log.Printf("The heap is %d MiB of the %d MiB memory budget, the sync batches and downloads are now 1/%d of their size", heap/1024/1024, cfg.MemoryBudgetMB, 1<<uint(pressure))
+	}
+}
+
+// Returns the memory budget's state for the metrics
+func memoryMetrics() map[string]interface{} {
+	var m map[string]interface{}
+	memoryInFlight.lock.With(func() {
+		m = map[string]interface{}{
+			"budget_bytes":    int64(cfg.MemoryBudgetMB) * 1024 * 1024,
+			"heap_bytes":      memoryInFlight.heap,
+			"in_flight_bytes": memoryInFlight.bytes,
+			"reader_waits":    memoryInFlight.waits,
+			"pressure":        memoryInFlight.pressure,
+		}
+	})
+	m["sync_batch"] = memorySyncBatch()
+	m["sync_downloads"] = memorySyncDownloads()
+	return m
+}
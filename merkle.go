@@ -0,0 +1,99 @@
+package daisy
+
+import (
+	"fmt"
+)
+
+// Merkle trees are built over the (sorted) hashes of the documents in a block. Leaves and
+// interior nodes are hashed with different prefixes so a leaf can't be passed off as a node.
+// A node without a sibling is promoted to the next level unchanged. The tree is hashed with
+// the algorithm of the leaves.
+
+// MerkleProofStep is one step of a Merkle inclusion proof: the sibling hash and whether it's
+// on the left side of the concatenation.
+type MerkleProofStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+func merkleLeafHash(a *hashAlgorithm, b []byte) []byte {
+	h := a.newHash()
+	h.Write([]byte{0})
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func merkleNodeHash(a *hashAlgorithm, left, right []byte) []byte {
+	h := a.newHash()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// Returns the Merkle root of the given leaves, made with the chain's hash algorithm, and if
+// proofIndex is a valid leaf index, the inclusion proof for that leaf.
+func merkleRootAndProof(leaves []string, proofIndex int) (string, []MerkleProofStep, error) {
+	if len(leaves) == 0 {
+		return "", nil, fmt.Errorf("Cannot build a Merkle tree without leaves")
+	}
+	a := chainHash
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		la, b, err := hashParse(leaf)
+		if err != nil {
+			return "", nil, err
+		}
+		if la != a {
+			return "", nil, fmt.Errorf("Leaf %s is not a %s hash", leaf, a.name)
+		}
+		level[i] = merkleLeafHash(a, b)
+	}
+	proof := []MerkleProofStep{}
+	idx := proofIndex
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			if idx == i {
+				proof = append(proof, MerkleProofStep{Hash: a.format(level[i+1]), Left: false})
+			} else if idx == i+1 {
+				proof = append(proof, MerkleProofStep{Hash: a.format(level[i]), Left: true})
+			}
+			next = append(next, merkleNodeHash(a, level[i], level[i+1]))
+		}
+		idx /= 2
+		level = next
+	}
+	return a.format(level[0]), proof, nil
+}
+
+// Computes the Merkle root from a leaf and its inclusion proof, with the given hash algorithm
+func merkleRootFromProof(a *hashAlgorithm, leaf string, proof []MerkleProofStep) (string, error) {
+	la, b, err := hashParse(leaf)
+	if err != nil {
+		return "", err
+	}
+	if la != a {
+		return "", fmt.Errorf("Leaf %s is not a %s hash", leaf, a.name)
+	}
+	h := merkleLeafHash(a, b)
+	for _, step := range proof {
+		sa, sibling, err := hashParse(step.Hash)
+		if err != nil {
+			return "", err
+		}
+		if sa != a {
+			return "", fmt.Errorf("Proof step %s is not a %s hash", step.Hash, a.name)
+		}
+		if step.Left {
+			h = merkleNodeHash(a, sibling, h)
+		} else {
+			h = merkleNodeHash(a, h, sibling)
+		}
+	}
+	return a.format(h), nil
+}
@@ -0,0 +1,44 @@
+package daisy
+
+import (
+	"expvar"
+	"sync"
+)
+
+// Metrics are published with expvar at /debug/vars of the HTTP server, for the admin role
+
+var metricsOnce sync.Once
+
+// Publishes the node's metrics
+func metricsInit() {
+	metricsOnce.Do(func() {
+		expvar.Publish("daisy_version", expvar.Func(func() interface{} {
+			return p2pClientVersionString
+		}))
+		expvar.Publish("daisy_chain_height", expvar.Func(func() interface{} {
+			return dbGetBlockchainHeight()
+		}))
+		expvar.Publish("daisy_peers", expvar.Func(func() interface{} {
+			return len(p2pPeers.GetAddresses(false))
+		}))
+		expvar.Publish("daisy_stall", expvar.Func(func() interface{} {
+			reason, since := stallStatus()
+			return map[string]interface{}{"reason": reason, "seconds_since_last_block": int64(since.Seconds())}
+		}))
+		expvar.Publish("daisy_integrity", expvar.Func(func() interface{} {
+			return integrityMetrics()
+		}))
+		expvar.Publish("daisy_peer_user_agents", expvar.Func(func() interface{} {
+			return p2pPeers.userAgents()
+		}))
+		expvar.Publish("daisy_peer_panics", expvar.Func(func() interface{} {
+			return p2pPanicMetrics()
+		}))
+		expvar.Publish("daisy_block_propagation", expvar.Func(func() interface{} {
+			return propagationMetrics()
+		}))
+		expvar.Publish("daisy_memory", expvar.Func(func() interface{} {
+			return memoryMetrics()
+		}))
+	})
+}
@@ -1,14 +1,13 @@
-package main
+package daisy
 
 import (
 	"encoding/binary"
-	"encoding/hex"
 	"os"
 	"time"
 )
 
 // mineSqlite3Database mines a SQLite3 database file, by adjusting the user_version field
-// in the database header as a "nonce", and using SHA256 for the actual hashing. The file
+// in the database header as a "nonce", and using the chain's hash algorithm. The file
 // must exist and must be closed.
 func mineSqlite3Database(fileName string, difficultyBits int) (string, error) {
 	startNonce := uint32(time.Now().Unix())
@@ -31,7 +30,7 @@ func mineSqlite3Database(fileName string, difficultyBits int) (string, error) {
 		}
 		nZeroes := countStartZeroBits(hash)
 		if nZeroes == difficultyBits {
-			return hex.EncodeToString(hash), nil
+			return chainHash.format(hash), nil
 		}
 	}
 	return "", nil
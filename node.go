@@ -0,0 +1,298 @@
+package daisy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A daisy node can be embedded into another Go program instead of running the daisy
+// binary. Since the node keeps its state in package-level variables, there can be only
+// one Node per process. Database errors are still fatal, as they are in the binary.
+
+// Config is the configuration of an embedded node. The zero values select the defaults,
+// and all the other settings can be given in a JSON config file.
+type Config struct {
+	DataDir     string
+	ConfigFile  string
+	P2PPort     int
+	HTTPPort    int
+	DisableHTTP bool
+	ReadOnly    bool
+	Relay       bool
+}
+
+// Node is an embedded daisy node
+type Node struct {
+	lock    WithMutex
+	started bool
+	stopped bool
+}
+
+// How long Stop waits for the services and the peer connections to finish
+const nodeStopTimeout = 5 * time.Second
+
+// Closed when the node is stopping
+var nodeQuit = make(chan struct{})
+
+// The background services started by nodeGo(), which Stop waits for before closing the
+// databases
+var nodeServices sync.WaitGroup
+
+// Waits for the services started with nodeGo to return, after nodeQuit has been closed.
+// Returns false if they haven't returned within the timeout.
+func nodeWaitServices(timeout time.Duration) bool {
+	servicesDone := make(chan struct{})
+	go func() {
+		nodeServices.Wait()
+		close(servicesDone)
+	}()
+	select {
+	case <-servicesDone:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Runs a background service of the node in a new goroutine. The service must return
+// when nodeQuit is closed.
+func nodeGo(f func()) {
+	nodeServices.Add(1)
+	go func() {
+		defer nodeServices.Done()
+		f()
+	}()
+}
+
+// The servers which need to be closed when the node is stopped
+var nodeServers struct {
+	lock        WithMutex
+	listeners   []net.Listener
+	httpServer  *http.Server
+	inheritable map[string]*net.TCPListener // the listeners passed on in a handover, by name
+}
+
+var nodeCreated bool
+
+// Returns true if the node is stopping
+func nodeStopping() bool {
+	select {
+	case <-nodeQuit:
+		return true
+	default:
+		return false
+	}
+}
+
+// NewNode configures a node. It must be started with Start.
+func NewNode(c Config) (*Node, error) {
+	if nodeCreated {
+		return nil, fmt.Errorf("Only one node can be created per process")
+	}
+	configDefaults()
+	if c.ConfigFile != "" {
+		cfg.configFile = c.ConfigFile
+		if err := loadConfigFile(); err != nil {
+			return nil, err
+		}
+	}
+	if c.DataDir != "" {
+		cfg.DataDir = c.DataDir
+	}
+	if c.P2PPort != 0 {
+		cfg.P2pPort = c.P2PPort
+	}
+	if c.HTTPPort != 0 {
+		cfg.httpPort = c.HTTPPort
+	}
+	cfg.httpDisabled = c.DisableHTTP
+	cfg.readOnly = c.ReadOnly
+	cfg.relay = c.Relay
+	if err := configCheck(); err != nil {
+		return nil, err
+	}
+	nodeCreated = true
+	return &Node{}, nil
+}
+
+// Start opens the databases, loads the blockchain and starts the p2p, notification and
+// HTTP services in the background
+func (n *Node) Start() error {
+	var err error
+	n.lock.With(func() {
+		if n.started {
+			err = fmt.Errorf("The node has already been started")
+			return
+		}
+		n.started = true
+	})
+	if err != nil {
+		return err
+	}
+	nodeInit()
+	nodeStartServices()
+	return nil
+}
+
+// Stop stops the services, disconnects the peers and closes the databases. A stopped
+// node cannot be started again.
+func (n *Node) Stop() error {
+	var err error
+	n.lock.With(func() {
+		if !n.started || n.stopped {
+			err = fmt.Errorf("The node is not running")
+			return
+		}
+		n.stopped = true
+	})
+	if err != nil {
+		return err
+	}
+	close(nodeQuit)
+	nodeServers.lock.With(func() {
+		for _, l := range nodeServers.listeners {
+			l.Close()
+		}
+		if nodeServers.httpServer != nil {
+			nodeServers.httpServer.Close()
+		}
+	})
+	var peers []*p2pConnection
+	p2pPeers.lock.With(func() {
+		for peer := range p2pPeers.peers {
+			peers = append(peers, peer)
+		}
+	})
+	for _, peer := range peers {
+		peer.conn.Close()
+	}
+	deadline := time.Now().Add(nodeStopTimeout)
+	if !nodeWaitServices(nodeStopTimeout) {
+		log.Println("Some services haven't stopped in", nodeStopTimeout)
+	}
+	for len(p2pPeers.GetAddresses(false)) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	sdNotifyStopping()
+	if privateDb != nil {
+		if err = privateDb.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	return mainDb.Close()
+}
+
+// Height returns the height of the last block in the blockchain
+func (n *Node) Height() int {
+	return dbGetBlockchainHeight()
+}
+
+// SubmitDocument creates a new block with the given files as documents, signs it with
+// one of the node's keys and adds it to the blockchain, from where it's announced to the
+// peers. Returns the height of the new block.
+func (n *Node) SubmitDocument(fileNames ...string) (int, error) {
+	if cfg.readOnly || cfg.relay {
+		return 0, fmt.Errorf("Documents cannot be submitted in the read-only or relay mode")
+	}
+	if err := blockProductionError(); err != nil {
+		return 0, err
+	}
+	return blockchainCreateBlock(fileNames, nil)
+}
+
+// SubmitBundle is like SubmitDocument, but records the files as a bundle, which is
+// guaranteed to be included in a block together or not at all
+func (n *Node) SubmitBundle(fileNames ...string) (int, error) {
+	if cfg.readOnly || cfg.relay {
+		return 0, fmt.Errorf("Documents cannot be submitted in the read-only or relay mode")
+	}
+	if err := blockProductionError(); err != nil {
+		return 0, err
+	}
+	return blockchainCreateBlock(nil, [][]string{fileNames})
+}
+
+// QueryBlock returns the header and the list of documents of the block at the given height
+func (n *Node) QueryBlock(height int) (*ExportBlock, error) {
+	if height < 0 || height > dbGetBlockchainHeight() {
+		return nil, fmt.Errorf("No block at height %d", height)
+	}
+	return blockchainExportBlock(height, false)
+}
+
+// BlockTemplate returns the block the node would seal from the pending documents right
+// now, with the result of validating it, or nil if there are no pending documents
+func (n *Node) BlockTemplate() (*BlockDryRun, error) {
+	if cfg.readOnly || cfg.relay {
+		return nil, fmt.Errorf("Blocks cannot be produced in the read-only or relay mode")
+	}
+	return blockchainBlockTemplate()
+}
+
+// DryRunBlock validates the block in the given file as the next block of the blockchain,
+// without adding it. If hashSignature is nil, the block is treated as unsigned and a copy
+// of it is signed by the node first.
+func (n *Node) DryRunBlock(fileName string, hashSignature []byte) (*BlockDryRun, error) {
+	if hashSignature != nil {
+		return blockchainDryRunBlockFile(fileName, hashSignature)
+	}
+	if cfg.readOnly || cfg.relay {
+		return nil, fmt.Errorf("Blocks cannot be signed in the read-only or relay mode")
+	}
+	return blockchainDryRunUnsignedBlockFile(fileName)
+}
+
+// Query runs the SQL query on every block, as the /query endpoint does, and calls rowFunc
+// for every resulting row. Returns the number of blocks queried.
+func (n *Node) Query(q string, rowFunc func(height int, row map[string]interface{}) error) (int, error) {
+	return blockchainQuery(q, rowFunc)
+}
+
+// Subscribe returns a channel which receives the events of the new blocks, and a function
+// which cancels the subscription. The channel is closed after the subscription is cancelled
+// or the node is stopped. Block events are not available in the relay mode.
+func (n *Node) Subscribe() (<-chan *BlockEvent, func()) {
+	events := make(chan *BlockEvent, 16)
+	cancel := make(chan struct{})
+	var once sync.Once
+	go func() {
+		defer close(events)
+		height := dbGetBlockchainHeight()
+		for {
+			newHeight := blockEventsWaitHeight(height, time.Minute, cancel)
+			for h := height + 1; h <= newHeight; h++ {
+				evt, err := blockchainGetBlockEvent(h)
+				if err != nil {
+					log.Println("Cannot read block", h, "for a subscription:", err)
+					continue
+				}
+				select {
+				case events <- evt:
+				case <-cancel:
+					return
+				case <-nodeQuit:
+					return
+				}
+			}
+			if newHeight > height {
+				height = newHeight
+			}
+			select {
+			case <-cancel:
+				return
+			case <-nodeQuit:
+				return
+			default:
+			}
+		}
+	}()
+	return events, func() {
+		once.Do(func() {
+			close(cancel)
+		})
+	}
+}
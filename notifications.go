@@ -0,0 +1,233 @@
+package daisy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// External systems can be notified of new blocks in two ways: the node POSTs a JSON
+// payload to the configured webhook URLs, or clients can wait for new blocks by
+// long-polling the /wait HTTP endpoint.
+
+// The maximum number of delivery attempts for a webhook notification
+const webhookMaxAttempts = 6
+
+// The delay before the first retry of a failed webhook delivery, doubled on each retry
+const webhookRetryDelay = 2 * time.Second
+
+// The maximum number of notifications waiting to be delivered to a single webhook
+const webhookQueueLength = 256
+
+// The maximum number of blocks returned by a single long-polling request
+const longPollMaxBlocks = 100
+
+// WebhookConfig is the configuration of a webhook which receives block notifications.
+// If the secret is set, the payloads are signed with HMAC-SHA256 in the X-Daisy-Signature header.
+type WebhookConfig struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// BlockEvent is the notification payload sent when a new block is accepted
+type BlockEvent struct {
+	Event             string   `json:"event"`
+	Chain             string   `json:"chain"`
+	Height            int      `json:"height"`
+	Hash              string   `json:"hash"`
+	PreviousBlockHash string   `json:"previous_block_hash"`
+	TimeAccepted      string   `json:"time_accepted"`
+	DocumentHashes    []string `json:"document_hashes"`
+}
+
+type webhook struct {
+	WebhookConfig
+	queue chan []byte
+}
+
+// State shared with the long-polling HTTP handlers. The newBlock channel is closed
+// (and replaced) whenever new blocks are detected.
+var blockEvents = struct {
+	lock     WithMutex
+	height   int
+	newBlock chan struct{}
+	webhooks []*webhook
+}{
+	newBlock: make(chan struct{}),
+}
+
+// Returns the notification payload for the block at the given height
+func blockchainGetBlockEvent(height int) (*BlockEvent, error) {
+	dbb, err := dbGetBlockByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	b, err := OpenBlockByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	documentHashes, err := b.dbGetDocumentHashes()
+	b.Close()
+	if err != nil {
+		return nil, err
+	}
+	if documentHashes == nil {
+		documentHashes = []string{}
+	}
+	return &BlockEvent{
+		Event:             "block",
+		Chain:             chainParams.GenesisBlockHash,
+		Height:            dbb.Height,
+		Hash:              dbb.Hash,
+		PreviousBlockHash: dbb.PreviousBlockHash,
+		TimeAccepted:      dbb.TimeAccepted.UTC().Format(time.RFC3339),
+		DocumentHashes:    documentHashes,
+	}, nil
+}
+
+// Returns the HMAC-SHA256 signature of the payload, in the form used in the X-Daisy-Signature header
+func webhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Delivers the queued notifications to the webhook, in order, retrying failed deliveries
+func (wh *webhook) run() {
+	client := http.Client{Timeout: 30 * time.Second}
+	for payload := range wh.queue {
+		delay := webhookRetryDelay
+		for attempt := 1; ; attempt++ {
+			retry, err := wh.deliver(&client, payload)
+			if err == nil {
+				break
+			}
+			if !retry || attempt >= webhookMaxAttempts {
+				log.Println("Giving up delivering notification to webhook", wh.URL, "after", attempt, "attempts:", err)
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// Sends a single notification to the webhook. Returns if the delivery should be retried
+// in case of an error.
+func (wh *webhook) deliver(client *http.Client, payload []byte) (bool, error) {
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", p2pClientVersionString)
+	req.Header.Set("X-Daisy-Event", "block")
+	if wh.Secret != "" {
+		req.Header.Set("X-Daisy-Signature", webhookSignature(wh.Secret, payload))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	// Client errors other than timeouts and rate limiting won't go away by retrying
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("Webhook returned HTTP status %d", resp.StatusCode)
+}
+
+// Queues the notification payload for all the webhooks. The description is for the log.
+func webhooksNotify(payload []byte, description string) {
+	var webhooks []*webhook
+	blockEvents.lock.With(func() {
+		webhooks = blockEvents.webhooks
+	})
+	for _, wh := range webhooks {
+		select {
+		case wh.queue <- payload:
+		default:
+			log.Println("Webhook queue for", wh.URL, "is full, dropping the notification for", description)
+		}
+	}
+}
+
+// Watches the blockchain height and notifies the webhooks and the long-polling
+// clients of new blocks, whether they were received from peers or imported locally.
+func blockEventsRun() {
+	var webhooks []*webhook
+	for _, whc := range cfg.Webhooks {
+		wh := webhook{WebhookConfig: whc, queue: make(chan []byte, webhookQueueLength)}
+		webhooks = append(webhooks, &wh)
+		go wh.run()
+	}
+	if len(webhooks) > 0 {
+		log.Println("Sending block notifications to", len(webhooks), "webhooks")
+	}
+	lastHeight := dbGetBlockchainHeight()
+	blockEvents.lock.With(func() {
+		blockEvents.height = lastHeight
+		blockEvents.webhooks = webhooks
+	})
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-nodeQuit:
+			return
+		case <-ticker.C:
+		}
+		newHeight := dbGetBlockchainHeight()
+		if newHeight == lastHeight {
+			continue
+		}
+		if newHeight > lastHeight {
+			for h := lastHeight + 1; h <= newHeight; h++ {
+				evt, err := blockchainGetBlockEvent(h)
+				if err != nil {
+					log.Println("Cannot read block", h, "for notifications:", err)
+					continue
+				}
+				hooksBlockAccepted(evt)
+				webhooksNotify(jsonifyWhateverToBytes(evt), fmt.Sprintf("block %d", h))
+			}
+		}
+		lastHeight = newHeight
+		blockEvents.lock.With(func() {
+			blockEvents.height = newHeight
+			close(blockEvents.newBlock)
+			blockEvents.newBlock = make(chan struct{})
+		})
+	}
+}
+
+// Waits until the blockchain height is larger than the given height, or the timeout
+// expires. Returns the current blockchain height.
+func blockEventsWaitHeight(height int, timeout time.Duration, cancel <-chan struct{}) int {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		var currentHeight int
+		var newBlock chan struct{}
+		blockEvents.lock.With(func() {
+			currentHeight = blockEvents.height
+			newBlock = blockEvents.newBlock
+		})
+		if currentHeight > height {
+			return currentHeight
+		}
+		select {
+		case <-newBlock:
+		case <-timer.C:
+			return currentHeight
+		case <-cancel:
+			return currentHeight
+		}
+	}
+}
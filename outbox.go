@@ -0,0 +1,100 @@
+package daisy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Block announcements are persisted in the outbox table until the peer acknowledges them,
+// so that the announcements lost when a connection breaks are sent again when the peer
+// reconnects, even after a restart. Peers are identified by their canonical address, since
+// the port of incoming connections changes every time.
+
+// The priorities of the messages in the outbox, lower is sent first
+const (
+	outboxPriorityAnnouncement = iota
+)
+
+// How long the unacknowledged messages are kept
+const outboxMaxAge = 24 * time.Hour
+
+// The maximum number of messages resent to a peer when it connects
+const outboxMaxResend = 64
+
+// The maximum number of blocks following its height announced to a peer when it connects
+const p2pReannounceMaxBlocks = 100
+
+// Returns the address under which the messages for this peer are stored
+func (p2pc *p2pConnection) outboxAddress() string {
+	host, _, err := splitAddress(p2pc.address)
+	if err != nil {
+		return p2pc.address
+	}
+	return fmt.Sprintf("%s:%d", host, DefaultP2PPort)
+}
+
+// Sends the block hashes to the peer, keeping them in the outbox until the peer acknowledges
+// them. Peers which don't support acknowledgements just get the message.
+func (p2pc *p2pConnection) announceBlocks(hashes map[int]string, maxHeight int) {
+	msg := p2pMsgBlockHashesStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgBlockHashes,
+		},
+		Hashes: hashes,
+	}
+	if inStrings(p2pFeatureAck, p2pc.features) {
+		// JSON numbers are decoded as float64, so the ID must fit in its mantissa
+		msg.AckID = randInt63() & (1<<53 - 1)
+		dbOutboxAdd(msg.AckID, p2pc.outboxAddress(), outboxPriorityAnnouncement, maxHeight, jsonifyWhateverToBytes(msg))
+	}
+	p2pc.chanToPeer <- msg
+}
+
+// Resends the unacknowledged messages to a peer which has just said hello, except those
+// about the blocks it already has. Called from the connection's goroutine. Returns the
+// number of messages resent.
+func (p2pc *p2pConnection) resendOutbox() int {
+	address := p2pc.outboxAddress()
+	dbOutboxDeleteUpToHeight(address, p2pc.chainHeight)
+	msgs := dbOutboxGet(address, outboxMaxResend)
+	if len(msgs) > 0 {
+		log.Println("Resending", len(msgs), "unacknowledged messages to", p2pc.address)
+	}
+	for i, msg := range msgs {
+		if !p2pc.queueMsg(json.RawMessage(msg)) {
+			return i
+		}
+	}
+	return len(msgs)
+}
+
+// Sends the hashes of the blocks which follow the peer's last block to a peer which has
+// just connected, so it can start fetching them right away instead of waiting for the
+// next block to be announced. The blocks start right after the peer's height, so it can
+// accept them without a gap, and a peer which is further behind asks for the rest when
+// it sees our height. The announcement isn't kept in the outbox, since the peer gets it
+// again whenever it connects.
+func (p2pc *p2pConnection) reannounceBlocks() {
+	myHeight := dbGetBlockchainHeight()
+	if p2pc.chainHeight >= myHeight {
+		return
+	}
+	minHeight := p2pc.chainHeight + 1
+	maxHeight := myHeight
+	if maxHeight > minHeight+p2pReannounceMaxBlocks-1 {
+		maxHeight = minHeight + p2pReannounceMaxBlocks - 1
+	}
+	log.Println("Announcing blocks", minHeight, "to", maxHeight, "to", p2pc.address)
+	p2pc.queueMsg(p2pMsgBlockHashesStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgBlockHashes,
+		},
+		Hashes: dbGetHeightHashes(minHeight, maxHeight),
+	})
+}
@@ -1,4 +1,4 @@
-package main
+package daisy
 
 import (
 	"bufio"
@@ -17,6 +17,7 @@ import (
 	"os"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -24,9 +25,10 @@ const p2pClientVersionString = "godaisy/0.2"
 
 // Header for JSON messages we're sending
 type p2pMsgHeader struct {
-	Root  string `json:"root"`
-	Msg   string `json:"msg"`
-	P2pID int64  `json:"p2p_id"`
+	Root    string `json:"root"`
+	Msg     string `json:"msg"`
+	P2pID   int64  `json:"p2p_id"`
+	TraceID string `json:"trace_id,omitempty"` // the correlation ID of a sync, echoed in the responses
 }
 
 // The hello message
@@ -34,9 +36,39 @@ const p2pMsgHello = "hello"
 
 type p2pMsgHelloStruct struct {
 	p2pMsgHeader
-	Version     string   `json:"version"`
-	ChainHeight int      `json:"chain_height"`
-	MyPeers     []string `json:"my_peers"`
+	Version     string          `json:"version"`
+	ChainHeight int             `json:"chain_height"`
+	MyPeers     []string        `json:"my_peers"`
+	Relay       bool            `json:"relay,omitempty"`
+	Features    []string        `json:"features,omitempty"`
+	NodeKey     string          `json:"node_key,omitempty"`
+	Challenge   string          `json:"challenge,omitempty"` // for the nodeproof message
+	YourAddress string          `json:"your_address,omitempty"`
+	PeerRecords []p2pPeerRecord `json:"peer_records,omitempty"`
+	// The chain's block limits, with the block_limits feature
+	MaxBlockSize      int64 `json:"max_block_size,omitempty"`
+	MaxBlockDocuments int   `json:"max_block_documents,omitempty"`
+}
+
+// The optional protocol features this node supports, announced in the hello message
+var p2pFeatures = []string{p2pFeatureReconcile, p2pFeatureAck, p2pFeatureBlockLimits, p2pFeaturePing, p2pFeatureNodeProof}
+
+// The feature of set reconciliation with the reconcile message
+const p2pFeatureReconcile = "reconcile"
+
+// The feature of acknowledging block announcements with the ack message
+const p2pFeatureAck = "ack"
+
+// The feature of proving the identity key with the nodeproof message
+const p2pFeatureNodeProof = "node_proof"
+
+// The message with the signature of the challenge from the peer's hello message
+const p2pMsgNodeProof = "nodeproof"
+
+type p2pMsgNodeProofStruct struct {
+	p2pMsgHeader
+	NodeKey   string `json:"node_key"`
+	Signature string `json:"signature"`
 }
 
 // The message asking for block hashes
@@ -54,6 +86,15 @@ const p2pMsgBlockHashes = "blockhashes"
 type p2pMsgBlockHashesStruct struct {
 	p2pMsgHeader
 	Hashes map[int]string `json:"hashes"`
+	AckID  int64          `json:"ack_id,omitempty"`
+}
+
+// The message acknowledging a message which had an ack_id
+const p2pMsgAck = "ack"
+
+type p2pMsgAckStruct struct {
+	p2pMsgHeader
+	AckID int64 `json:"ack_id"`
 }
 
 // The message asking for block data
@@ -76,6 +117,71 @@ type p2pMsgBlockStruct struct {
 	Data          string `json:"data"`
 }
 
+// The message with an IBLT of the sender's blocks in the given range of heights. The
+// receiver replies with a blockhashes message containing the blocks the sender doesn't have.
+const p2pMsgReconcile = "reconcile"
+
+type p2pMsgReconcileStruct struct {
+	p2pMsgHeader
+	MinBlockHeight int    `json:"min_block_height"`
+	MaxBlockHeight int    `json:"max_block_height"`
+	Cells          string `json:"cells"`
+}
+
+// The message asking for block headers, used by relay nodes
+const p2pMsgGetHeaders = "getheaders"
+
+type p2pMsgGetHeadersStruct struct {
+	p2pMsgHeader
+	MinBlockHeight int `json:"min_block_height"`
+	MaxBlockHeight int `json:"max_block_height"`
+}
+
+// The message containing block headers
+const p2pMsgHeaders = "headers"
+
+type p2pMsgHeadersStruct struct {
+	p2pMsgHeader
+	Headers []BlockHeader `json:"headers"`
+}
+
+// The message asking for the Merkle proof of a document, used by light clients
+const p2pMsgGetProof = "getproof"
+
+type p2pMsgGetProofStruct struct {
+	p2pMsgHeader
+	DocumentHash string `json:"document_hash"`
+}
+
+// The message containing the proof of a document, as a receipt without confirmations
+const p2pMsgProof = "proof"
+
+type p2pMsgProofStruct struct {
+	p2pMsgHeader
+	DocumentHash string            `json:"document_hash"`
+	Receipt      *TimestampReceipt `json:"receipt,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// The message asking for an attachment chunk
+const p2pMsgGetChunk = "getchunk"
+
+type p2pMsgGetChunkStruct struct {
+	p2pMsgHeader
+	Hash string `json:"hash"`
+}
+
+// The message containing one attachment chunk
+const p2pMsgChunk = "chunk"
+
+type p2pMsgChunkStruct struct {
+	p2pMsgHeader
+	Hash     string `json:"hash"`
+	Size     int64  `json:"size"`
+	Encoding string `json:"encoding"`
+	Data     string `json:"data"`
+}
+
 // Map of peer addresses, for easy set-like behaviour
 type peerStringMap map[string]time.Time
 
@@ -95,10 +201,35 @@ type p2pConnection struct {
 	peerID            int64
 	isConnectable     bool // using the default port
 	testedConnectable bool // using the default port
+	isRelay           bool // the peer only has block headers
+	outbound          bool // we have connected to the peer
+	blocksReceived    int  // the number of blocks accepted from the peer
+	features          []string
+	userAgent         string // the software and version of the peer, from the hello message
+	nodeKey           string // the identity key of the peer, once it has proven to have it
+	claimedNodeKey    string // the identity key of the peer, from the hello message
+	challenge         string // sent to the peer in the hello message, to sign with its key
+	dialAddress       string // the address we have connected to, for outbound connections
+	helloReceived     bool
 	chainHeight       int
 	refreshTime       time.Time
-	chanToPeer        chan interface{} // structs go out
-	chanFromPeer      chan StrIfMap    // StrIfMaps go in
+	chanToPeer        chan interface{}  // structs go out
+	chanFromPeer      chan StrIfMap     // StrIfMaps go in
+	bulk              *bufio.ReadWriter // the bulk stream, if the transport has one
+	chanToPeerControl chan interface{}  // control messages, written with priority
+	chanToPeerBulk    chan interface{}  // blocks and chunks
+	writersDone       chan struct{}     // closed when a writer goroutine fails
+	writersDoneOnce   sync.Once
+	syncStats         p2pSyncStats         // the measured ping latency and block download performance
+	bandwidth         peerBandwidth        // the bytes sent, for the bandwidth cap of the peer's tags
+	memoryHeld        int64                // the memory reserved for the received messages not handled yet
+	memoryClosed      bool                 // set when the connection is closed, to stop reserving memory
+	adopted           bool                 // passed on by the old process in a handover, after the hello
+	requestedChunks   *StringSetWithExpiry // the chunks asked from the peer, the only ones accepted from it
+	policyLock        WithMutex
+	cachedPolicy      PeerPolicy // the policy of the peer's tags, see policy()
+	policyComputed    bool
+	writers           sync.WaitGroup
 }
 
 // A set of p2p connections
@@ -124,6 +255,15 @@ func (p *p2pPeersSet) Remove(c *p2pConnection) {
 	})
 }
 
+// Checks if the p2p connection is still in the set of p2p connections
+func (p *p2pPeersSet) Has(c *p2pConnection) bool {
+	found := false
+	p.lock.With(func() {
+		_, found = p.peers[c]
+	})
+	return found
+}
+
 func (p *p2pPeersSet) HasAddress(address string) bool {
 	found := false
 	p.lock.With(func() {
@@ -137,6 +277,17 @@ func (p *p2pPeersSet) HasAddress(address string) bool {
 	return found
 }
 
+// Returns the number of peers running each user agent
+func (p *p2pPeersSet) userAgents() map[string]int {
+	result := map[string]int{}
+	p.lock.With(func() {
+		for peer := range p.peers {
+			result[peer.userAgent]++
+		}
+	})
+	return result
+}
+
 func (p *p2pPeersSet) GetAddresses(onlyConnectable bool) []string {
 	var addresses []string
 	p.lock.With(func() {
@@ -175,7 +326,7 @@ func (p *p2pPeersSet) tryPeersConnectable() {
 	})
 
 	for paddress, address := range addressesToTry {
-		conn, err := net.Dial("tcp", address)
+		conn, err := p2pDial(address)
 		if err != nil {
 			continue
 		}
@@ -227,29 +378,43 @@ func (p *p2pPeersSet) saveConnectablePeers() {
 
 }
 
+// Listens for p2p connections on all the configured transports
 func p2pServer() {
 	serverAddress := ":" + strconv.Itoa(cfg.P2pPort)
-	l, err := net.Listen("tcp", serverAddress)
-	if err != nil {
-		log.Println("Cannot listen on", serverAddress)
-		log.Fatal(err)
+	for _, t := range p2pEnabledTransports {
+		l, err := handoverListen("p2p-"+t.Name(), serverAddress, t.Listen)
+		if err != nil {
+			log.Println("Cannot listen on", serverAddress, "over", t.Name())
+			log.Fatal(err)
+		}
+		log.Println("P2P listening on", serverAddress, "over", t.Name())
+		nodeServers.lock.With(func() {
+			nodeServers.listeners = append(nodeServers.listeners, l)
+		})
+		go p2pAccept(l)
 	}
+}
+
+func p2pAccept(l net.Listener) {
 	defer func() {
-		err = l.Close()
-		if err != nil {
+		err := l.Close()
+		if err != nil && !nodeStopping() {
 			log.Fatalf("p2pServer l.Close: %v", err)
 		}
 	}()
-	log.Println("P2P listening on", serverAddress)
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if nodeStopping() {
+				return
+			}
 			log.Println("Error accepting socket:", err)
 			sysEventChannel <- sysEventMessage{event: eventQuit}
 			return
 		}
-		if p2pCoordinator.badPeers.Has(conn.RemoteAddr().String()) {
+		if p2pCoordinator.badPeers.Has(conn.RemoteAddr().String()) || p2pPanicBanned(conn.RemoteAddr().String()) || governanceBanned(conn.RemoteAddr().String()) {
 			log.Println("Ignoring bad peer", conn.RemoteAddr().String())
+			conn.Close()
 			continue
 		}
 		p2pc, err := p2pSetupPeer(conn.RemoteAddr().String(), conn)
@@ -266,38 +431,253 @@ func p2pClient() {
 }
 
 func (p2pc *p2pConnection) sendMsg(msg interface{}) error {
+	return p2pWriteMsg(p2pc.peer.Writer, msg)
+}
+
+// Writes a JSON message followed by a newline
+func p2pWriteMsg(w *bufio.Writer, msg interface{}) error {
+	_, err := p2pWriteMsgCounted(w, msg)
+	return err
+}
+
+// Writes the message like p2pWriteMsg, and returns the number of bytes written
+func p2pWriteMsgCounted(w *bufio.Writer, msg interface{}) (int, error) {
 	bmsg, err := json.Marshal(msg)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	n, err := p2pc.peer.Write(bmsg)
+	n, err := w.Write(bmsg)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if n != len(bmsg) {
-		return fmt.Errorf("didn't write entire message: %v vs %v", n, len(bmsg))
+		return 0, fmt.Errorf("didn't write entire message: %v vs %v", n, len(bmsg))
 	}
-	n, err = p2pc.peer.Write([]byte("\n"))
+	n, err = w.Write([]byte("\n"))
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if n != 1 {
-		return errors.New("didn't write newline")
+		return 0, errors.New("didn't write newline")
 	}
 	//log.Println("... successfully wrote", string(bmsg))
-	return p2pc.peer.Flush()
+	return len(bmsg) + 1, w.Flush()
+}
+
+// Returns true for the messages which should be sent over the bulk stream
+func p2pIsBulkMsg(msg interface{}) bool {
+	switch m := msg.(type) {
+	case p2pMsgBlockStruct, p2pMsgChunkStruct:
+		return true
+	case StrIfMap:
+		// Replies forwarded by relays
+		return m["msg"] == p2pMsgBlock || m["msg"] == p2pMsgChunk
+	}
+	return false
+}
+
+// Passes the message to the writer goroutines. Returns false if the connection is broken.
+func (p2pc *p2pConnection) queueMsg(msg interface{}) bool {
+	ch := p2pc.chanToPeerControl
+	if p2pIsBulkMsg(msg) {
+		ch = p2pc.chanToPeerBulk
+	}
+	select {
+	case ch <- msg:
+		return true
+	case <-p2pc.writersDone:
+		return false
+	}
+}
+
+// The longest time writing one message to a peer can take. A peer which stops reading
+// would otherwise block the writer, and with full channels the connection handler too.
+const p2pWriteTimeout = 2 * time.Minute
+
+// Sets the write deadline of a stream, if it supports deadlines
+type p2pWriteDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// Writes the messages from the channels to the peer, always preferring the messages from
+// the high priority channel, until both are closed. The low priority channel can be nil.
+// Each write must finish within p2pWriteTimeout, or the connection is closed.
+func (p2pc *p2pConnection) writeMessages(w *bufio.Writer, stream p2pWriteDeadliner, high, low chan interface{}) {
+	defer p2pc.writers.Done()
+	defer p2pc.recoverPanic("the writer")
+	// Until both channels are closed, so the queued messages are all sent
+	for high != nil || low != nil {
+		var msg interface{}
+		var ok bool
+		select {
+		case msg, ok = <-high:
+			if !ok {
+				high = nil
+				continue
+			}
+		default:
+			select {
+			case msg, ok = <-high:
+				if !ok {
+					high = nil
+					continue
+				}
+			case msg, ok = <-low:
+				if !ok {
+					low = nil
+					continue
+				}
+			}
+		}
+		if stream != nil {
+			stream.SetWriteDeadline(time.Now().Add(p2pWriteTimeout))
+		}
+		n, err := p2pWriteMsgCounted(w, msg)
+		if stream != nil {
+			stream.SetWriteDeadline(time.Time{})
+		}
+		if err != nil {
+			log.Println("Error sending to peer:", err)
+			p2pc.writersDoneOnce.Do(func() {
+				close(p2pc.writersDone)
+			})
+			p2pc.conn.Close()
+			return
+		}
+		p2pc.bandwidth.wait(n, p2pc.policy().MaxBytesPerSecond)
+	}
+}
+
+// Returns true if blocks and chunks should be sent to the peer inline, instead of
+// instructing the peer to fetch them over HTTP. With TLS, peers usually cannot verify the
+// HTTP server's certificate, so they don't use HTTP.
+func (p2pc *p2pConnection) sendInline() bool {
+	return cfg.p2pBlockInline || p2pc.bulk != nil || cfg.HTTPTLSCert != ""
+}
+
+// The longest message accepted from a peer when the chain has no block size limit. It
+// leaves room for inline blocks of a few hundred megabytes.
+const p2pDefaultMaxMessageSize = 256 * 1024 * 1024
+
+// The longest message accepted from a peer when the chain limits the block size to less
+// than this: the control messages, such as lists of hashes and headers, don't depend on
+// the block size
+const p2pMaxControlMessageSize = 16 * 1024 * 1024
+
+// The most block hashes sent or asked for in one message
+const p2pMaxHashesPerMsg = 5000
+
+var errP2pMessageTooLarge = errors.New("message too large")
+
+// Returns the longest message accepted from a peer: the longest inline block (which is
+// zlib-compressed and base64-encoded) if the chain limits the block size, but no less than
+// the longest control message
+func p2pMaxMessageSize() int {
+	if chainParams.MaxBlockSize > 0 {
+		if size := int(chainParams.MaxBlockSize/3*4) + 1024*1024; size > p2pMaxControlMessageSize {
+			return size
+		}
+		return p2pMaxControlMessageSize
+	}
+	return p2pDefaultMaxMessageSize
+}
+
+// Reads a line like ReadBytes, but fails as soon as it's longer than max, without
+// buffering the rest of it. On other errors, returns what has been read of the line.
+func p2pReadLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		if len(line)+len(frag) > max {
+			return nil, errP2pMessageTooLarge
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// Reads JSON messages from the reader and passes them to chanFromPeer, until an error occurs
+func (p2pc *p2pConnection) readMessages(r *bufio.Reader) {
+	defer p2pc.recoverPanic("the reader")
+	maxSize := p2pMaxMessageSize()
+	var partial []byte // of a message being finished for a handover
+	for {
+		line, err := p2pReadLine(r, maxSize-len(partial))
+		if partial != nil {
+			line, partial = append(partial, line...), nil
+		}
+		if err != nil && p2pc.handoverReadMore(line, err) {
+			partial = line
+			continue
+		}
+		if err != nil && handoverReadStopped(line, err) {
+			p2pc.chanFromPeer <- StrIfMap{"_handover": true}
+			break
+		}
+		if err != nil {
+			log.Println("Error reading data from", p2pc.address, err)
+			p2pc.chanFromPeer <- StrIfMap{"_error": "Error reading data"}
+			break
+		}
+		// The decoded message takes about as much memory as the line
+		reserved := int64(2 * len(line))
+		if !p2pc.memoryReserve(reserved) {
+			break
+		}
+		var msg StrIfMap
+		err = json.Unmarshal(line, &msg)
+		if err != nil {
+			log.Println("Cannot parse JSON", strconv.QuoteToASCII(string(line)), "from", p2pc.address)
+			p2pc.chanFromPeer <- StrIfMap{"_error": "Cannot parse JSON"}
+			break
+		}
+
+		var root string
+		if root, err = msg.GetString("root"); err != nil {
+			log.Printf("Problem with chain root from  %v: %v", p2pc.address, err)
+			p2pc.chanFromPeer <- StrIfMap{"_error": "Problem with chain root"}
+			break
+		}
+		if root != chainParams.GenesisBlockHash {
+			log.Printf("Received message from %v for a different chain than mine (%s vs %s). Ignoring.", p2pc.conn, root, chainParams.GenesisBlockHash)
+			p2pc.memoryRelease(reserved)
+			continue
+		}
+		msg["_reserved"] = reserved
+		p2pc.chanFromPeer <- msg
+	}
 }
 
 func (p2pc *p2pConnection) handleConnection() {
+	detach := false
 	defer func() {
 		log.Println("Cleaning up connection", p2pc.address)
 		p2pPeers.Remove(p2pc)
+		if p2pc.helloReceived && !detach {
+			hooksPeerDisconnected(p2pc)
+		}
+		if detach {
+			p2pc.queuePending()
+		}
+		close(p2pc.chanToPeerControl)
+		close(p2pc.chanToPeerBulk)
+		p2pc.memoryReleaseAll()
+		if detach {
+			// The new process continues after the queued messages
+			p2pc.writers.Wait()
+			p2pc.handoverDetach()
+		}
 		err := p2pc.conn.Close()
 		if err != nil {
 			log.Printf("p2pc.conn.Close: %v", err)
 		}
+		p2pc.handoverDone()
 		log.Println("Finished cleaning up connection", p2pc.address)
 	}()
+	// Runs before the cleanup above
+	defer p2pc.recoverPanic("the connection handler")
 
 	// Only store the IP address as the address.
 	// This must be done in the goroutine because resolving can block for a long time.
@@ -307,6 +687,16 @@ func (p2pc *p2pConnection) handleConnection() {
 	}
 
 	p2pc.peer = bufio.NewReadWriter(bufio.NewReader(p2pc.conn), bufio.NewWriter(p2pc.conn))
+	if bc, ok := p2pc.conn.(p2pBulkConn); ok {
+		bulk := bc.BulkStream()
+		p2pc.bulk = bufio.NewReadWriter(bufio.NewReader(bulk), bufio.NewWriter(bulk))
+	}
+	p2pc.chanToPeerControl = make(chan interface{}, 16)
+	p2pc.chanToPeerBulk = make(chan interface{}, 5)
+	p2pc.writersDone = make(chan struct{})
+	if !p2pc.adopted {
+		p2pc.challenge = nodeProofChallenge()
+	}
 
 	// XXX: the state machine shouldn't start by the listener sending something
 	// (security best practices)
@@ -316,50 +706,51 @@ func (p2pc *p2pConnection) handleConnection() {
 			Root:  chainParams.GenesisBlockHash,
 			Msg:   p2pMsgHello,
 		},
-		Version:     p2pClientVersionString,
-		ChainHeight: dbGetBlockchainHeight(),
-		MyPeers:     p2pPeers.GetAddresses(true),
+		Version:           p2pClientVersionString,
+		ChainHeight:       dbGetBlockchainHeight(),
+		MyPeers:           p2pPeers.GetAddresses(true),
+		Relay:             cfg.relay,
+		Features:          p2pFeatures,
+		NodeKey:           nodeKeyPublicHex,
+		Challenge:         p2pc.challenge,
+		PeerRecords:       p2pPeerRecordsToSend(),
+		MaxBlockSize:      chainParams.MaxBlockSize,
+		MaxBlockDocuments: chainParams.MaxBlockDocuments,
 	}
-	err = p2pc.sendMsg(helloMsg)
-	if err != nil {
-		log.Println(err)
-		return
+	if host, _, err := splitAddress(p2pc.address); err == nil {
+		helloMsg.YourAddress = host
+	}
+	if !p2pc.adopted {
+		err = p2pc.sendMsg(helloMsg)
+		if err != nil {
+			log.Println(err)
+			return
+		}
 	}
 	log.Println("Handling connection", p2pc.address)
 	exit := false
 
 	go func() {
-		var line []byte
-		for {
-			line, err = p2pc.peer.ReadBytes('\n')
-			if err != nil {
-				log.Println("Error reading data from", p2pc.address, err)
-				p2pc.chanFromPeer <- StrIfMap{"_error": "Error reading data"}
-				break
-			}
-			var msg StrIfMap
-			err = json.Unmarshal(line, &msg)
-			if err != nil {
-				log.Println("Cannot parse JSON", strconv.QuoteToASCII(string(line)), "from", p2pc.address)
-				p2pc.chanFromPeer <- StrIfMap{"_error": "Cannot parse JSON"}
-				break
-			}
-
-			var root string
-			if root, err = msg.GetString("root"); err != nil {
-				log.Printf("Problem with chain root from  %v: %v", p2pc.address, err)
-				p2pc.chanFromPeer <- StrIfMap{"_error": "Problem with chain root"}
-				break
-			}
-			if root != chainParams.GenesisBlockHash {
-				log.Printf("Received message from %v for a different chain than mine (%s vs %s). Ignoring.", p2pc.conn, root, chainParams.GenesisBlockHash)
-				continue
-			}
-			p2pc.chanFromPeer <- msg
-		}
+		p2pc.readMessages(p2pc.peer.Reader)
 		log.Println("Shutting down receiver for", p2pc.address)
-		exit = true // In any case, if this goroutine exits, we want to shut down everything
+		if !handoverDraining() {
+			// While draining, the handler stops after the messages already received
+			exit = true // In any case, if this goroutine exits, we want to shut down everything
+		}
 	}()
+	if p2pc.bulk != nil {
+		go p2pc.readMessages(p2pc.bulk.Reader)
+		p2pc.writers.Add(2)
+		bulkStream, _ := p2pc.conn.(p2pBulkConn).BulkStream().(p2pWriteDeadliner)
+		go p2pc.writeMessages(p2pc.peer.Writer, p2pc.conn, p2pc.chanToPeerControl, nil)
+		go p2pc.writeMessages(p2pc.bulk.Writer, bulkStream, p2pc.chanToPeerBulk, nil)
+	} else {
+		p2pc.writers.Add(1)
+		go p2pc.writeMessages(p2pc.peer.Writer, p2pc.conn, p2pc.chanToPeerControl, p2pc.chanToPeerBulk)
+	}
+	if p2pc.adopted {
+		p2pc.handoverResume()
+	}
 
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
@@ -368,6 +759,12 @@ func (p2pc *p2pConnection) handleConnection() {
 		select {
 		case msg := <-p2pc.chanFromPeer:
 			// log.Printf("... chainFromPeer: %s: %s", p2pc.address, jsonifyWhatever(msg))
+			if _, ok := msg["_handover"]; ok {
+				// The reader has stopped between two messages
+				detach = p2pc.handoverDetachable()
+				exit = true
+				break
+			}
 			var _error string
 			if _error, err = msg.GetString("_error"); err == nil {
 				log.Printf("Fatal error from %v: %v", p2pc.address, _error)
@@ -380,32 +777,104 @@ func (p2pc *p2pConnection) handleConnection() {
 				exit = true
 				break
 			}
-			switch cmd {
-			case p2pMsgHello:
-				p2pc.handleMsgHello(msg)
-			case p2pMsgGetBlockHashes:
-				p2pc.handleGetBlockHashes(msg)
-			case p2pMsgBlockHashes:
-				p2pc.handleBlockHashes(msg)
-			case p2pMsgGetBlock:
-				p2pc.handleGetBlock(msg)
-			case p2pMsgBlock:
-				p2pc.handleBlock(msg)
+			// Not passed on, as relays forward the messages
+			reserved, _ := msg["_reserved"].(int64)
+			delete(msg, "_reserved")
+			if p2pc.handleMsg(cmd, msg) {
+				exit = true
 			}
+			p2pc.memoryRelease(reserved)
 		case msg := <-p2pc.chanToPeer:
-			err := p2pc.sendMsg(msg)
-			if err != nil {
-				log.Println("Error sending to peer:", err)
+			if !p2pc.queueMsg(msg) {
 				exit = true
 			}
 		case <-ticker.C:
 			// so the exit variable gets tested
-			continue
+			p2pc.pingIfDue()
+			p2pc.syncExpire()
 		}
 	}
 	// The connection has been dismissed
 }
 
+// Passes the messages queued by the coordinator to the writers, before the connection is
+// detached
+func (p2pc *p2pConnection) queuePending() {
+	for {
+		select {
+		case msg := <-p2pc.chanToPeer:
+			p2pc.queueMsg(msg)
+		default:
+			return
+		}
+	}
+}
+
+// Dispatches the message to its handler. Returns true if the handler panicked, in which
+// case the connection is closed.
+func (p2pc *p2pConnection) handleMsg(cmd string, msg StrIfMap) (crashed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			p2pc.panicked("the "+cmd+" handler", r, true)
+			crashed = true
+		}
+	}()
+	switch cmd {
+	case p2pMsgHello:
+		p2pc.handleMsgHello(msg)
+	case p2pMsgGetBlockHashes:
+		p2pc.handleGetBlockHashes(msg)
+	case p2pMsgBlockHashes:
+		p2pc.handleBlockHashes(msg)
+	case p2pMsgGetBlock:
+		p2pc.handleGetBlock(msg)
+	case p2pMsgBlock:
+		p2pc.handleBlock(msg)
+	case p2pMsgGetChunk:
+		p2pc.handleGetChunk(msg)
+	case p2pMsgChunk:
+		p2pc.handleChunk(msg)
+	case p2pMsgGetHeaders:
+		p2pc.handleGetHeaders(msg)
+	case p2pMsgHeaders:
+		p2pc.handleHeaders(msg)
+	case p2pMsgGetProof:
+		p2pc.handleGetProof(msg)
+	case p2pMsgAck:
+		p2pc.handleAck(msg)
+	case p2pMsgNodeProof:
+		p2pc.handleNodeProof(msg)
+	case p2pMsgReconcile:
+		p2pc.handleReconcile(msg)
+	case p2pMsgPing:
+		p2pc.handlePing(msg)
+	case p2pMsgPong:
+		p2pc.handlePong(msg)
+	case p2pMsgGovernance:
+		p2pc.handleGovernance(msg)
+	case p2pMsgHeartbeat:
+		p2pc.handleHeartbeat(msg)
+	}
+	return false
+}
+
+// The longest user agent string kept for a peer
+const p2pMaxUserAgentLength = 100
+
+// Makes the user agent reported by a peer safe to log and show: printable ASCII only
+func p2pSanitizeUserAgent(ua string) string {
+	b := make([]byte, 0, len(ua))
+	for i := 0; i < len(ua) && len(b) < p2pMaxUserAgentLength; i++ {
+		if ua[i] >= 0x20 && ua[i] < 0x7f {
+			b = append(b, ua[i])
+		}
+	}
+	if len(b) == 0 {
+		return "unknown"
+	}
+	return string(b)
+}
+
 func (p2pc *p2pConnection) handleMsgHello(msg StrIfMap) {
 	var ver string
 	var err error
@@ -423,11 +892,18 @@ func (p2pc *p2pConnection) handleMsgHello(msg StrIfMap) {
 			return
 		}
 	}
-	var remotePeers []string
-	if remotePeers, err = msg.GetStringList("my_peers"); err == nil {
+	p2pc.userAgent = p2pSanitizeUserAgent(ver)
+	p2pc.isRelay, _ = msg["relay"].(bool)
+	p2pc.features, _ = msg.GetStringList("features")
+	p2pc.claimedNodeKey, _ = msg["node_key"].(string)
+	if yourAddress, ok := msg["your_address"].(string); ok && p2pc.outbound {
+		p2pSetMyHost(p2pc.address, yourAddress)
+	}
+	// The plain my_peers list is not trusted, only signed peer records are
+	if remotePeers := p2pc.handlePeerRecords(msg); len(remotePeers) > 0 {
 		p2pCtrlChannel <- p2pCtrlMessage{msgType: p2pCtrlConnectPeers, payload: remotePeers}
 	}
-	log.Printf("Hello from %v %s (%x) %d blocks", p2pc.address, ver, p2pc.peerID, p2pc.chainHeight)
+	log.Printf("Hello from %v %s (%x) %d blocks", p2pc.address, p2pc.userAgent, p2pc.peerID, p2pc.chainHeight)
 	// Check for duplicates
 	dup := false
 	p2pPeers.lock.With(func() {
@@ -443,6 +919,10 @@ func (p2pc *p2pConnection) handleMsgHello(msg StrIfMap) {
 		log.Printf("%v is apparently myself (%x). Dropping it.", p2pc.conn, p2pc.peerID)
 		dup = true
 	}
+	if err = p2pc.checkBlockLimits(msg); err != nil {
+		log.Printf("%v: %v. Dropping it.", p2pc.address, err)
+		dup = true
+	}
 	if dup {
 		p2pCoordinator.badPeers.Add(p2pc.address)
 		err = p2pc.conn.Close()
@@ -452,6 +932,20 @@ func (p2pc *p2pConnection) handleMsgHello(msg StrIfMap) {
 		return
 	}
 	p2pc.refreshTime = time.Now()
+	firstHello := !p2pc.helloReceived
+	if firstHello {
+		p2pc.helloReceived = true
+		if challenge, ok := msg["challenge"].(string); ok {
+			p2pc.sendNodeProof(challenge)
+		}
+		hooksPeerConnected(p2pc)
+	}
+	if p2pc.resendOutbox() == 0 && firstHello {
+		p2pc.reannounceBlocks()
+	}
+	if firstHello {
+		p2pc.tipCheckAsk()
+	}
 	if p2pc.chainHeight > dbGetBlockchainHeight() {
 		p2pCtrlChannel <- p2pCtrlMessage{msgType: p2pCtrlSearchForBlocks, payload: p2pc}
 	}
@@ -470,16 +964,24 @@ func (p2pc *p2pConnection) handleGetBlockHashes(msg StrIfMap) {
 		log.Println(p2pc.conn, err)
 		return
 	}
+	if maxBlockHeight-minBlockHeight > p2pMaxHashesPerMsg {
+		// The peer asks for the rest after these
+		maxBlockHeight = minBlockHeight + p2pMaxHashesPerMsg
+	}
 	log.Printf("*** Sending block hashes from %d to %d to %s", minBlockHeight, maxBlockHeight, p2pc.address)
+	start := time.Now()
+	traceID := traceIDFromMsg(msg)
 	respMsg := p2pMsgBlockHashesStruct{
 		p2pMsgHeader: p2pMsgHeader{
-			P2pID: p2pEphemeralID,
-			Root:  chainParams.GenesisBlockHash,
-			Msg:   p2pMsgBlockHashes,
+			P2pID:   p2pEphemeralID,
+			Root:    chainParams.GenesisBlockHash,
+			Msg:     p2pMsgBlockHashes,
+			TraceID: traceID,
 		},
 		Hashes: dbGetHeightHashes(minBlockHeight, maxBlockHeight),
 	}
 	p2pc.chanToPeer <- respMsg
+	traceStage(traceID, traceStageServeBlockHashes, start, nil, "peer", p2pc.address, "hashes", strconv.Itoa(len(respMsg.Hashes)))
 }
 
 // Handle receiving blockhashes
@@ -498,6 +1000,33 @@ func (p2pc *p2pConnection) handleBlockHashes(msg StrIfMap) {
 	}
 	sort.Ints(heights)
 	log.Println("handleBlockHashes: got", jsonifyWhatever(heights))
+	start := time.Now()
+	traceID := traceIDFromMsg(msg)
+	stage := traceStageBlockHashes
+	if traceID == "" {
+		// Blocks announced by the peer
+		traceID = traceNewID()
+		stage = traceStageAnnouncement
+	}
+	traceStage(traceID, stage, start, nil, "peer", p2pc.address, "hashes", strconv.Itoa(len(hashes)))
+	if stage == traceStageAnnouncement {
+		p2pc.propagationAnnounced(hashes)
+	}
+	if ackID, err := msg.GetInt64("ack_id"); err == nil {
+		p2pc.chanToPeer <- p2pMsgAckStruct{
+			p2pMsgHeader: p2pMsgHeader{
+				P2pID: p2pEphemeralID,
+				Root:  chainParams.GenesisBlockHash,
+				Msg:   p2pMsgAck,
+			},
+			AckID: ackID,
+		}
+	}
+	if cfg.relay {
+		p2pc.requestHeaders(heights, hashes)
+		return
+	}
+	var missing []p2pSyncQueued
 	for _, h := range heights {
 		if dbBlockHeightExists(h) {
 			log.Println("handleBlockHashes: already have block:", h)
@@ -507,19 +1036,172 @@ func (p2pc *p2pConnection) handleBlockHashes(msg StrIfMap) {
 			}
 			continue
 		}
-		if p2pCoordinator.recentlyRequestedBlocks.TestAndSet(hashes[h]) {
+		missing = append(missing, p2pSyncQueued{height: h, hash: hashes[h], traceID: traceID})
+	}
+	p2pc.syncQueue(missing)
+	p2pc.syncRequestMore()
+}
+
+// ack: the peer has received a message from the outbox
+func (p2pc *p2pConnection) handleAck(msg StrIfMap) {
+	ackID, err := msg.GetInt64("ack_id")
+	if err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	dbOutboxDelete(ackID, p2pc.outboxAddress())
+}
+
+// reconcile: the peer sent an IBLT of its blocks, reply with the blocks it doesn't have
+func (p2pc *p2pConnection) handleReconcile(msg StrIfMap) {
+	var minBlockHeight int
+	var maxBlockHeight int
+	var err error
+	if minBlockHeight, err = msg.GetInt("min_block_height"); err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	if maxBlockHeight, err = msg.GetInt("max_block_height"); err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	cells, err := msg.GetString("cells")
+	if err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	theirs, err := ibltDecode(cells)
+	if err != nil {
+		log.Println("Invalid IBLT from", p2pc.address, err)
+		return
+	}
+	mine, err := blockchainMakeIBLT(minBlockHeight, maxBlockHeight, len(theirs.cells))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	start := time.Now()
+	traceID := traceIDFromMsg(msg)
+	respMsg := p2pMsgBlockHashesStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID:   p2pEphemeralID,
+			Root:    chainParams.GenesisBlockHash,
+			Msg:     p2pMsgBlockHashes,
+			TraceID: traceID,
+		},
+	}
+	if err = mine.Subtract(theirs); err != nil {
+		log.Println(err)
+		return
+	}
+	onlyMine, onlyTheirs, err := mine.Decode()
+	if err != nil {
+		// Fall back to sending all the hashes in the range
+		log.Println("Reconciliation with", p2pc.address, "failed:", err)
+		respMsg.Hashes = dbGetHeightHashes(minBlockHeight, maxBlockHeight)
+	} else {
+		log.Printf("Reconciled blocks %d to %d with %s: %d missing there, %d missing here", minBlockHeight, maxBlockHeight, p2pc.address, len(onlyMine), len(onlyTheirs))
+		respMsg.Hashes = onlyMine
+	}
+	p2pc.chanToPeer <- respMsg
+	traceStage(traceID, traceStageServeBlockHashes, start, nil, "peer", p2pc.address, "hashes", strconv.Itoa(len(respMsg.Hashes)))
+}
+
+// Relay nodes ask for the headers of the blocks they don't have yet, instead of the blocks
+func (p2pc *p2pConnection) requestHeaders(heights []int, hashes map[int]string) {
+	minHeight, maxHeight := -1, -1
+	for _, h := range heights {
+		if dbBlockHeightExists(h) || p2pCoordinator.recentlyRequestedBlocks.TestAndSet(hashes[h]) {
 			continue
 		}
-		log.Println("Requesting block", hashes[h])
-		msg := p2pMsgGetBlockStruct{
-			p2pMsgHeader: p2pMsgHeader{
-				P2pID: p2pEphemeralID,
-				Root:  chainParams.GenesisBlockHash,
-				Msg:   p2pMsgGetBlock,
-			},
-			Hash: hashes[h],
+		if minHeight == -1 {
+			minHeight = h
 		}
-		p2pc.chanToPeer <- msg
+		maxHeight = h
+	}
+	if minHeight == -1 {
+		return
+	}
+	log.Println("Requesting headers from", minHeight, "to", maxHeight)
+	p2pc.chanToPeer <- p2pMsgGetHeadersStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgGetHeaders,
+		},
+		MinBlockHeight: minHeight,
+		MaxBlockHeight: maxHeight,
+	}
+}
+
+// getheaders: a request for block headers
+func (p2pc *p2pConnection) handleGetHeaders(msg StrIfMap) {
+	var minBlockHeight int
+	var maxBlockHeight int
+	var err error
+	if minBlockHeight, err = msg.GetInt("min_block_height"); err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	if maxBlockHeight, err = msg.GetInt("max_block_height"); err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	headers, err := blockchainGetHeaders(minBlockHeight, maxBlockHeight)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	respMsg := p2pMsgHeadersStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgHeaders,
+		},
+		Headers: headers,
+	}
+	p2pc.chanToPeer <- respMsg
+}
+
+// getproof: a request for the Merkle proof of a document
+func (p2pc *p2pConnection) handleGetProof(msg StrIfMap) {
+	hash, err := msg.GetString("document_hash")
+	if err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	if !isValidChunkHash(hash) {
+		log.Println("Invalid document hash in getproof from", p2pc.address)
+		return
+	}
+	respMsg := p2pMsgProofStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgProof,
+		},
+		DocumentHash: hash,
+	}
+	if respMsg.Receipt, err = blockchainMakeReceipt(hash, 0); err != nil {
+		respMsg.Error = err.Error()
+	}
+	p2pc.chanToPeer <- respMsg
+}
+
+// headers: block headers are received. Relay nodes store them, and the other nodes only
+// use them for the startup tip check.
+func (p2pc *p2pConnection) handleHeaders(msg StrIfMap) {
+	headers, err := p2pGetHeaders(msg)
+	if err != nil {
+		log.Println("Cannot decode headers from", p2pc.address, err)
+		return
+	}
+	if !cfg.relay {
+		p2pc.tipCheckRecord(headers)
+		return
+	}
+	if n := relayStoreHeaders(headers); n > 0 {
+		log.Println("Stored", n, "block headers from", p2pc.address, "- new height:", dbGetBlockchainHeight())
 	}
 }
 
@@ -530,12 +1212,28 @@ func (p2pc *p2pConnection) handleGetBlock(msg StrIfMap) {
 		log.Println(p2pc.conn, err)
 		return
 	}
+	start := time.Now()
+	traceID := traceIDFromMsg(msg)
 	dbb, err := dbGetBlock(hash)
 	if err != nil {
 		log.Println(p2pc.conn, err)
+		traceStage(traceID, traceStageServeBlock, start, err, "peer", p2pc.address, "hash", hash)
 		return
 	}
 	fileName := blockchainGetFilename(dbb.Height)
+	if cfg.relay && !fileExists(fileName) {
+		relayForwardRequest(p2pc, "block:"+hash, dbb.Height, p2pMsgGetBlockStruct{
+			p2pMsgHeader: p2pMsgHeader{
+				P2pID:   p2pEphemeralID,
+				Root:    chainParams.GenesisBlockHash,
+				Msg:     p2pMsgGetBlock,
+				TraceID: traceID,
+			},
+			Hash: hash,
+		})
+		traceStage(traceID, traceStageServeBlock, start, nil, "peer", p2pc.address, "hash", hash, "forwarded", "true")
+		return
+	}
 	st, err := os.Stat(fileName)
 	if err != nil {
 		log.Println(err)
@@ -545,7 +1243,7 @@ func (p2pc *p2pConnection) handleGetBlock(msg StrIfMap) {
 
 	var msgBlockEncoding, msgBlockData string
 
-	if cfg.p2pBlockInline {
+	if p2pc.sendInline() {
 		f, err := os.Open(fileName)
 		if err != nil {
 			log.Println(err)
@@ -582,9 +1280,10 @@ func (p2pc *p2pConnection) handleGetBlock(msg StrIfMap) {
 
 	respMsg := p2pMsgBlockStruct{
 		p2pMsgHeader: p2pMsgHeader{
-			P2pID: p2pEphemeralID,
-			Root:  chainParams.GenesisBlockHash,
-			Msg:   p2pMsgBlock,
+			P2pID:   p2pEphemeralID,
+			Root:    chainParams.GenesisBlockHash,
+			Msg:     p2pMsgBlock,
+			TraceID: traceID,
 		},
 		Hash:          hash,
 		HashSignature: hex.EncodeToString(dbb.HashSignature),
@@ -594,6 +1293,7 @@ func (p2pc *p2pConnection) handleGetBlock(msg StrIfMap) {
 	}
 	p2pc.chanToPeer <- respMsg
 	log.Println("*** Sent block", hash, "to", p2pc.address)
+	traceStage(traceID, traceStageServeBlock, start, nil, "peer", p2pc.address, "hash", hash, "encoding", msgBlockEncoding)
 }
 
 // block: A block is received
@@ -603,6 +1303,11 @@ func (p2pc *p2pConnection) handleBlock(msg StrIfMap) {
 		log.Println(err)
 		return
 	}
+	if cfg.relay {
+		relayDeliver("block:"+hash, msg)
+		return
+	}
+	defer p2pc.syncContinue()
 	hashSignature, err := msg.GetString("hash_signature")
 	if err != nil {
 		log.Println(err)
@@ -613,131 +1318,281 @@ func (p2pc *p2pConnection) handleBlock(msg StrIfMap) {
 		log.Println(err)
 		return
 	}
-	if dbBlockHashExists(hash) {
+	// A block we already have is only accepted as the copy of a damaged block
+	repair := blockRepairPending(hash)
+	if !repair && dbBlockHashExists(hash) {
 		log.Println("Replacing blocks not yet implemented")
 		return
 	}
+	if !repair && diskSpaceIsCritical() {
+		log.Println("Not accepting block", hash, "because disk space is critically low")
+		return
+	}
 	fileSize, err := msg.GetInt64("size")
 	if err != nil {
 		log.Println(err)
 	}
-	var blockFile *os.File
 	encoding, err := msg.GetString("encoding")
 	if err != nil {
 		log.Printf("encoding: %v", err)
 		return
 	}
-	if encoding == "zlib-base64" {
-		zlibData, err := base64.StdEncoding.DecodeString(dataString)
+	traceID := traceForBlock(hash)
+	if traceID == "" {
+		traceID = traceIDFromMsg(msg)
+	}
+	if traceID == "" {
+		traceID = traceNewID()
+	}
+	start := time.Now()
+	blockFileName, err := p2pReceiveBlockFile(hash, encoding, dataString, fileSize)
+	traceStage(traceID, traceStageDownload, start, err, "peer", p2pc.address, "hash", hash, "encoding", encoding)
+	if err != nil {
+		p2pc.syncReceived(hash, 0, err)
+		return
+	}
+	defer func() {
+		err = os.Remove(blockFileName)
 		if err != nil {
-			log.Println(err)
-			return
+			log.Printf("remove: %v", err)
 		}
-		blockFile, err = ioutil.TempFile("", "daisy")
+	}()
+
+	if repair {
+		if err = blockRepairReplace(hash, blockFileName); err != nil {
+			log.Println("Cannot repair block:", err)
+		}
+		p2pc.syncReceived(hash, fileSize, err)
+		return
+	}
+	hashSignatureBytes, err := hex.DecodeString(hashSignature)
+	if err != nil {
+		log.Println("Error decoding hash signature", p2pc.conn, err)
+		return
+	}
+	blk, err := blockchainImportBlockFile(blockFileName, hashSignatureBytes, traceID)
+	p2pc.syncReceived(hash, fileSize, err)
+	if err != nil {
+		log.Println("Cannot import block:", err)
+		return
+	}
+	log.Println("Accepted block", blk.Hash, "at height", blk.Height)
+	p2pc.blocksReceived++
+	propagationAccepted(blk)
+	blk.Close()
+}
+
+// Receives the data of a block in the given encoding into a temporary file, which the
+// caller must remove. Returns its name.
+func p2pReceiveBlockFile(hash, encoding, dataString string, fileSize int64) (string, error) {
+	var body io.Reader
+	if encoding == "zlib-base64" {
+		zlibData, err := base64.StdEncoding.DecodeString(dataString)
 		if err != nil {
-			log.Println(err)
-			return
+			return "", err
 		}
-		defer func() {
-			err = blockFile.Close()
-			if err != nil {
-				log.Printf("handleBlock blockFile.Close: %v", err)
-			}
-			err = os.Remove(blockFile.Name())
-			if err != nil {
-				log.Printf("remove: %v", err)
-			}
-		}()
 		r, err := zlib.NewReader(bytes.NewReader(zlibData))
 		if err != nil {
-			log.Println(err)
-			return
+			return "", err
 		}
 		defer func() {
 			err = r.Close()
 			if err != nil {
-				log.Printf("handleBlock r.Close: %v", err)
+				log.Printf("p2pReceiveBlockFile r.Close: %v", err)
 			}
 		}()
-		written, err := io.Copy(blockFile, r)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-		if written != fileSize {
-			log.Println("Error decoding block: sizes don't match:", written, "vs", fileSize)
-			return
-		}
+		body = r
 	} else if encoding == "http" {
 		log.Println("Getting block", hash, "from", dataString)
 		resp, err := http.Get(dataString)
 		if err != nil {
-			log.Println("Error receiving block at", dataString, err)
-			return
+			return "", fmt.Errorf("Error receiving block at %s: %v", dataString, err)
 		}
 		defer resp.Body.Close()
-		blockFile, err = ioutil.TempFile("", "daisy")
-		if err != nil {
-			log.Println("Error creating temp file", err)
-			return
-		}
-		written, err := io.Copy(blockFile, resp.Body)
-		if err != nil {
-			log.Println("Error saving block:", err)
-			blockFile.Close()
-			os.Remove(blockFile.Name())
-			return
+		body = resp.Body
+	} else {
+		return "", fmt.Errorf("Unknown block encoding: %s", encoding)
+	}
+	blockFile, err := ioutil.TempFile("", "daisy")
+	if err != nil {
+		return "", fmt.Errorf("Error creating temp file: %v", err)
+	}
+	written, err := io.Copy(blockFile, body)
+	if err == nil && written != fileSize {
+		err = fmt.Errorf("Error decoding block: sizes don't match: %d vs %d", written, fileSize)
+	}
+	if cerr := blockFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(blockFile.Name())
+		return "", err
+	}
+	return blockFile.Name(), nil
+}
+
+// getchunk: a request to transfer an attachment chunk
+func (p2pc *p2pConnection) handleGetChunk(msg StrIfMap) {
+	hash, err := msg.GetString("hash")
+	if err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	if !chunkExists(hash) {
+		if cfg.relay && isValidChunkHash(hash) {
+			relayForwardRequest(p2pc, "chunk:"+hash, 0, p2pMsgGetChunkStruct{
+				p2pMsgHeader: p2pMsgHeader{
+					P2pID: p2pEphemeralID,
+					Root:  chainParams.GenesisBlockHash,
+					Msg:   p2pMsgGetChunk,
+				},
+				Hash: hash,
+			})
 		}
-		if written != fileSize {
-			log.Println("Error decoding block: sizes don't match:", written, "vs", fileSize)
-			blockFile.Close()
-			os.Remove(blockFile.Name())
+		return
+	}
+	data, err := chunkRead(hash)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var msgChunkEncoding, msgChunkData string
+	if p2pc.sendInline() {
+		msgChunkEncoding = "zlib-base64"
+		if msgChunkData, err = zlibBase64Encode(data); err != nil {
+			log.Println(err)
 			return
 		}
-		err = blockFile.Close()
-		if err != nil {
-			log.Printf("handleBlock blockFile.Close: %v", err)
-		}
-		defer func() {
-			err = os.Remove(blockFile.Name())
-			if err != nil {
-				log.Printf("remove: %v", err)
-			}
-		}()
 	} else {
-		log.Println("Unknown block encoding:", encoding)
-		return
+		msgChunkEncoding = "http"
+		msgChunkData = fmt.Sprintf("http://%s:%d/chunk/%s", getLocalAddresses()[0], cfg.httpPort, hash)
+	}
+	p2pc.chanToPeer <- p2pMsgChunkStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgChunk,
+		},
+		Hash:     hash,
+		Size:     int64(len(data)),
+		Encoding: msgChunkEncoding,
+		Data:     msgChunkData,
 	}
+}
 
-	blk, err := OpenBlockFile(blockFile.Name())
+// chunk: An attachment chunk is received
+func (p2pc *p2pConnection) handleChunk(msg StrIfMap) {
+	hash, err := msg.GetString("hash")
 	if err != nil {
-		log.Println("Error opening block file", p2pc.conn, err)
+		log.Println(err)
+		return
+	}
+	if cfg.relay {
+		relayDeliver("chunk:"+hash, msg)
+		return
+	}
+	if !p2pc.requestedChunks.Has(hash) || !dbMissingChunkExists(hash) {
+		log.Println("Ignoring unsolicited chunk", hash, "from", p2pc.address)
 		return
 	}
-	blk.HashSignature, err = hex.DecodeString(hashSignature)
+	if chunkExists(hash) {
+		return
+	}
+	if diskSpaceIsCritical() {
+		log.Println("Not storing chunk", hash, "from", p2pc.address, "because disk space is critical")
+		return
+	}
+	size, err := msg.GetInt64("size")
 	if err != nil {
-		log.Println("Error decoding hash signature", p2pc.conn, err)
+		log.Println(err)
 		return
 	}
-	height, err := checkAcceptBlock(blk)
+	if size > attachmentChunkSize {
+		log.Println("Chunk", hash, "from", p2pc.address, "is too large:", size)
+		return
+	}
+	dataString, err := msg.GetString("data")
 	if err != nil {
-		log.Println("Cannot import block:", err)
+		log.Println(err)
 		return
 	}
-	blk.Height = height
-	blk.DbBlockchainBlock.TimeAccepted = time.Now()
-	err = blockchainCopyFile(blockFile.Name(), height)
+	encoding, err := msg.GetString("encoding")
 	if err != nil {
-		log.Println("Cannot copy block file:", err)
+		log.Printf("encoding: %v", err)
 		return
 	}
-	err = dbInsertBlock(blk.DbBlockchainBlock)
+	var data []byte
+	if encoding == "zlib-base64" {
+		data, err = zlibBase64Decode(dataString, attachmentChunkSize)
+	} else if encoding == "http" {
+		data, err = httpGetLimited(dataString, attachmentChunkSize)
+	} else {
+		err = fmt.Errorf("Unknown chunk encoding: %s", encoding)
+	}
 	if err != nil {
-		log.Println("Cannot insert block:", err)
+		log.Println("Error receiving chunk", hash, "from", p2pc.address, err)
 		return
 	}
-	log.Println("Accepted block", blk.Hash, "at height", blk.Height)
-	blk.Close()
+	if err = chunkStore(hash, data); err != nil {
+		log.Println("Cannot store chunk from", p2pc.address, err)
+		return
+	}
+	dbRemoveMissingChunk(hash)
+	p2pc.requestedChunks.Remove(hash)
+}
+
+// Compresses data with zlib and encodes it as base64
+func zlibBase64Encode(data []byte) (string, error) {
+	var zbuf bytes.Buffer
+	w := zlib.NewWriter(&zbuf)
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(zbuf.Bytes()), nil
+}
+
+// Decodes base64 zlib-compressed data, which must not be larger than maxSize when decompressed
+func zlibBase64Decode(s string, maxSize int64) ([]byte, error) {
+	zlibData, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	r, err := zlib.NewReader(bytes.NewReader(zlibData))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("Decoded data is larger than %d bytes", maxSize)
+	}
+	return data, nil
+}
+
+// Fetches the given URL, refusing responses larger than maxSize
+func httpGetLimited(url string, maxSize int64) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %d from %s", resp.StatusCode, url)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("Response from %s is larger than %d bytes", url, maxSize)
+	}
+	return data, nil
 }
 
 // Connect to a peer. Does everything except starting the handler goroutine.
@@ -757,12 +1612,17 @@ func p2pConnectPeer(address string) (*p2pConnection, error) {
 		return nil, fmt.Errorf("Refusing to connect to myself at %s", addr.IP)
 	}
 
-	conn, err := net.Dial("tcp", address)
+	conn, err := p2pDial(address)
 	if err != nil {
 		log.Println("Error connecting to", address, err)
 		return nil, err
 	}
-	return p2pSetupPeer(address, conn)
+	p2pc, err := p2pSetupPeer(address, conn)
+	if err == nil {
+		p2pc.outbound = true
+		p2pc.dialAddress = address
+	}
+	return p2pc, err
 }
 
 // Creates the p2pConnection structure for the peer and adds it to the peer list.
@@ -773,6 +1633,8 @@ func p2pSetupPeer(address string, conn net.Conn) (*p2pConnection, error) {
 		address:      address,
 		chanToPeer:   make(chan interface{}, 5),
 		chanFromPeer: make(chan StrIfMap, 5),
+		// Outlives the re-request interval of the coordinator, so slow answers are still accepted
+		requestedChunks: NewStringSetWithExpiry(2 * time.Minute),
 	}
 	p2pPeers.Add(&p2pc)
 	return &p2pc, nil
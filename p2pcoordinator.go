@@ -1,9 +1,10 @@
-package main
+package daisy
 
 import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"time"
 )
 
@@ -21,6 +22,67 @@ type p2pCtrlMessage struct {
 
 var p2pCtrlChannel = make(chan p2pCtrlMessage, 8)
 
+// The defaults of the coordinator's intervals, which can be tuned e.g. to react faster on
+// small LANs or to generate less traffic on slow WAN links
+const (
+	// DefaultP2PTickInterval is the default interval of the coordinator's periodic tasks
+	DefaultP2PTickInterval = "10s"
+	// DefaultP2PReconnectInterval is the default interval of connecting to more peers
+	DefaultP2PReconnectInterval = "1m"
+	// DefaultP2PRequestExpiry is the default time after which a block is requested again
+	DefaultP2PRequestExpiry = "5s"
+	// DefaultP2PBadPeerTTL is the default time for which a failing peer isn't dialed
+	DefaultP2PBadPeerTTL = "15m"
+)
+
+// The coordinator's intervals, from the configuration
+var (
+	p2pTickInterval      time.Duration
+	p2pReconnectInterval time.Duration
+)
+
+// Parses a duration setting, which must be within the bounds
+func parseDurationSetting(name, value string, min, max time.Duration) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid -%s: %q is not a duration", name, value)
+	}
+	if d < min || d > max {
+		return 0, fmt.Errorf("Invalid -%s: %v (expecting %v to %v)", name, d, min, max)
+	}
+	return d, nil
+}
+
+// Parses the coordinator's intervals from the configuration
+func p2pCoordinatorConfigure() error {
+	var err error
+	if p2pTickInterval, err = parseDurationSetting("p2p-tick", cfg.P2pTickInterval, time.Second, time.Minute); err != nil {
+		return err
+	}
+	if p2pReconnectInterval, err = parseDurationSetting("p2p-reconnect-interval", cfg.P2pReconnectInterval, 10*time.Second, time.Hour); err != nil {
+		return err
+	}
+	requestExpiry, err := parseDurationSetting("p2p-request-expiry", cfg.P2pRequestExpiry, time.Second, 5*time.Minute)
+	if err != nil {
+		return err
+	}
+	badPeerTTL, err := parseDurationSetting("p2p-bad-peer-ttl", cfg.P2pBadPeerTTL, time.Minute, 24*time.Hour)
+	if err != nil {
+		return err
+	}
+	// The coordinator isn't running yet
+	p2pCoordinator.recentlyRequestedBlocks = NewStringSetWithExpiry(requestExpiry)
+	p2pCoordinator.badPeers = NewStringSetWithExpiry(badPeerTTL)
+	return nil
+}
+
+// The largest difference in chain heights for which set reconciliation is used instead of
+// asking for all the block hashes
+const reconcileMaxDifference = 1000
+
+// The number of our most recent blocks included in set reconciliation
+const reconcileWindow = 16
+
 // Data related to the (single instance of) the global p2p coordinator. This is also a
 // single-threaded object, its fields and methods are only expected to be accessed from
 // the Run() goroutine.
@@ -28,21 +90,32 @@ type p2pCoordinatorType struct {
 	timeTicks                chan int
 	lastTickBlockchainHeight int
 	recentlyRequestedBlocks  *StringSetWithExpiry
+	recentlyRequestedChunks  *StringSetWithExpiry
 	lastReconnectTime        time.Time
+	lastRotationTime         time.Time
+	startTime                time.Time
 	badPeers                 *StringSetWithExpiry
+	rotatedPeers             *StringSetWithExpiry
+	syncPeer                 *p2pConnection // the peer the missing blocks are downloaded from
 }
 
-// XXX: singletons in go?
+// XXX: singletons in go? The sets whose expiry is configured are created by
+// p2pCoordinatorConfigure().
 var p2pCoordinator = p2pCoordinatorType{
-	recentlyRequestedBlocks: NewStringSetWithExpiry(5 * time.Second),
+	recentlyRequestedChunks: NewStringSetWithExpiry(1 * time.Minute),
 	lastReconnectTime:       time.Now(),
+	lastRotationTime:        time.Now(),
 	timeTicks:               make(chan int),
-	badPeers:                NewStringSetWithExpiry(15 * time.Minute),
+	rotatedPeers:            NewStringSetWithExpiry(peerRotationCooldown),
 }
 
 func (co *p2pCoordinatorType) Run() {
 	co.lastTickBlockchainHeight = dbGetBlockchainHeight()
-	ticker := time.NewTicker(10 * time.Second)
+	co.startTime = time.Now()
+	if wd := sdWatchdogInterval(); wd != 0 && wd < 2*p2pTickInterval {
+		log.Println("WARNING: the systemd watchdog interval", wd, "is too short, it should be at least", 2*p2pTickInterval)
+	}
+	ticker := time.NewTicker(p2pTickInterval)
 	defer ticker.Stop()
 	for {
 		select {
@@ -55,24 +128,96 @@ func (co *p2pCoordinatorType) Run() {
 			}
 		case <-ticker.C:
 			co.handleTimeTick()
+		case <-nodeQuit:
+			return
 		}
 	}
 }
 
-// Retrieves block hashes from a node which apparently has more blocks than we do.
+// Retrieves block hashes from the best of the nodes which apparently have more blocks
+// than we do, when one of them is found.
 // ToDo: This is a simplistic version. Make it better by introducing quorums.
 func (co *p2pCoordinatorType) handleSearchForBlocks(p2pcStart *p2pConnection) {
+	if diskSpaceIsCritical() {
+		log.Println("Not searching for new blocks because disk space is critically low")
+		return
+	}
+	p2pc := co.selectSyncPeer(dbGetBlockchainHeight(), p2pcStart, nil)
+	if p2pc == nil {
+		return
+	}
+	if p2pc != p2pcStart {
+		log.Println("Syncing from", p2pc.address, "instead of", p2pcStart.address, "which is expected to be slower")
+	}
+	co.searchForBlocks(p2pc)
+}
+
+// Retrieves block hashes from the node which has more blocks than we do
+func (co *p2pCoordinatorType) searchForBlocks(p2pcStart *p2pConnection) {
+	if co.syncPeer != nil && co.syncPeer != p2pcStart {
+		co.syncPeer.syncDropQueue()
+	}
+	co.syncPeer = p2pcStart
+	myHeight := dbGetBlockchainHeight()
+	start := time.Now()
+	traceID := traceNewID()
+	if inStrings(p2pFeatureReconcile, p2pcStart.features) && p2pcStart.chainHeight-myHeight <= reconcileMaxDifference {
+		co.reconcile(p2pcStart, myHeight, traceID)
+		return
+	}
 	msg := p2pMsgGetBlockHashesStruct{
 		p2pMsgHeader: p2pMsgHeader{
-			P2pID: p2pEphemeralID,
-			Root:  chainParams.GenesisBlockHash,
-			Msg:   p2pMsgGetBlockHashes,
+			P2pID:   p2pEphemeralID,
+			Root:    chainParams.GenesisBlockHash,
+			Msg:     p2pMsgGetBlockHashes,
+			TraceID: traceID,
 		},
-		MinBlockHeight: dbGetBlockchainHeight(),
+		MinBlockHeight: myHeight,
 		MaxBlockHeight: p2pcStart.chainHeight,
 	}
+	batch := memorySyncBatch()
+	if batch == 0 || batch > p2pMaxHashesPerMsg {
+		batch = p2pMaxHashesPerMsg
+	}
+	if msg.MaxBlockHeight-msg.MinBlockHeight > batch {
+		// The rest is asked for when the blocks of this batch have been downloaded
+		msg.MaxBlockHeight = msg.MinBlockHeight + batch
+		p2pcStart.syncSetBatch(msg.MaxBlockHeight)
+	}
 	log.Printf("Searching for blocks from %d to %d", msg.MinBlockHeight, msg.MaxBlockHeight)
 	p2pcStart.chanToPeer <- msg
+	traceStage(traceID, traceStageGetBlockHashes, start, nil, "peer", p2pcStart.address, "min_height", strconv.Itoa(msg.MinBlockHeight), "max_height", strconv.Itoa(msg.MaxBlockHeight))
+}
+
+// Sends the peer an IBLT of our recent blocks, so it can reply with only the blocks we're
+// missing. The window of recent blocks also catches the case where our last blocks differ
+// from the peer's.
+func (co *p2pCoordinatorType) reconcile(p2pc *p2pConnection, myHeight int, traceID string) {
+	start := time.Now()
+	minHeight := myHeight - reconcileWindow
+	if minHeight < 0 {
+		minHeight = 0
+	}
+	cells := ibltCellsForDifference(p2pc.chainHeight - myHeight + 2*reconcileWindow)
+	t, err := blockchainMakeIBLT(minHeight, p2pc.chainHeight, cells)
+	if err != nil {
+		log.Println(err)
+		traceStage(traceID, traceStageReconcile, start, err, "peer", p2pc.address)
+		return
+	}
+	log.Printf("Reconciling blocks from %d to %d with %s", minHeight, p2pc.chainHeight, p2pc.address)
+	p2pc.chanToPeer <- p2pMsgReconcileStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID:   p2pEphemeralID,
+			Root:    chainParams.GenesisBlockHash,
+			Msg:     p2pMsgReconcile,
+			TraceID: traceID,
+		},
+		MinBlockHeight: minHeight,
+		MaxBlockHeight: p2pc.chainHeight,
+		Cells:          t.Encode(),
+	}
+	traceStage(traceID, traceStageReconcile, start, nil, "peer", p2pc.address, "min_height", strconv.Itoa(minHeight), "max_height", strconv.Itoa(p2pc.chainHeight))
 }
 
 func (co *p2pCoordinatorType) handleConnectPeers(addresses []string) {
@@ -85,7 +230,7 @@ func (co *p2pCoordinatorType) handleConnectPeers(addresses []string) {
 			continue
 		}
 		canonicalAddress := fmt.Sprintf("%s:%d", host, DefaultP2PPort)
-		if p2pPeers.HasAddress(canonicalAddress) || co.badPeers.Has(canonicalAddress) {
+		if p2pPeers.HasAddress(canonicalAddress) || co.badPeers.Has(canonicalAddress) || p2pPanicBanned(canonicalAddress) || governanceBanned(canonicalAddress) {
 			continue
 		}
 		addr, err := net.ResolveTCPAddr("tcp", canonicalAddress)
@@ -96,7 +241,7 @@ func (co *p2pCoordinatorType) handleConnectPeers(addresses []string) {
 			continue
 		}
 		// Detect if there's a canonical peer on the other side, somewhat brute-forceish
-		conn, err := net.DialTCP("tcp", nil, addr)
+		conn, err := p2pDial(addr.String())
 		if err != nil {
 			return
 		}
@@ -105,6 +250,8 @@ func (co *p2pCoordinatorType) handleConnectPeers(addresses []string) {
 			log.Println("handleConnectPeers:", err)
 			continue
 		}
+		p2pc.outbound = true
+		p2pc.dialAddress = address
 		go p2pc.handleConnection()
 		log.Println("Detected canonical peer at", canonicalAddress)
 		dbSavePeer(canonicalAddress)
@@ -114,50 +261,107 @@ func (co *p2pCoordinatorType) handleConnectPeers(addresses []string) {
 // Executed periodically to perform time-dependant actions. Do not rely on the
 // time period to be predictable or precise.
 func (co *p2pCoordinatorType) handleTimeTick() {
+	sdNotifyWatchdog()
+	if len(p2pPeers.GetAddresses(false)) > 0 || time.Since(co.startTime) >= sdReadyTimeout {
+		sdNotifyReady()
+	}
+	if maintenanceIsExclusive() {
+		// A database is being vacuumed or a block file moved, the work is done in the next tick
+		return
+	}
+	checkDiskSpace()
+	memoryCheck()
+	co.checkSyncPeer()
 	newHeight := dbGetBlockchainHeight()
 	if newHeight > co.lastTickBlockchainHeight {
 		log.Println("New blocks detected. New max height:", newHeight)
 		co.floodPeersWithNewBlocks(co.lastTickBlockchainHeight, newHeight)
 		co.lastTickBlockchainHeight = newHeight
 	}
-	if time.Since(co.lastReconnectTime) >= 10*time.Minute {
+	if time.Since(co.lastReconnectTime) >= p2pReconnectInterval {
 		co.lastReconnectTime = time.Now()
 		p2pPeers.saveConnectablePeers()
-		co.connectDbPeers()
+		co.rotatePeers()
+		dbOutboxExpire(time.Now().Add(-outboxMaxAge).Unix())
+		dbPeerRecordsExpire(time.Now().Add(-p2pPeerRecordMaxAge).Unix())
+		p2pPendingPeerRecordsExpire(time.Now().Add(-p2pPeerRecordMaxAge))
+		stallCheck()
 	}
 	p2pPeers.tryPeersConnectable()
+	blockRepairRequest()
+	if cfg.relay {
+		relayExpireForwards()
+	}
+	if !diskSpaceIsCritical() {
+		co.requestMissingChunks()
+	}
 }
 
-func (co *p2pCoordinatorType) floodPeersWithNewBlocks(minHeight, maxHeight int) {
-	blockHashes := dbGetHeightHashes(minHeight, maxHeight)
-	msg := p2pMsgBlockHashesStruct{
-		p2pMsgHeader: p2pMsgHeader{
-			P2pID: p2pEphemeralID,
-			Root:  chainParams.GenesisBlockHash,
-			Msg:   p2pMsgBlockHashes,
-		},
-		Hashes: blockHashes,
+// Asks the peers which have the blocks referencing them for attachment chunks we don't have yet.
+// Since the list of missing chunks is kept in the database, interrupted transfers are resumed
+// after a restart.
+func (co *p2pCoordinatorType) requestMissingChunks() {
+	chunks := dbGetMissingChunks(32)
+	if len(chunks) == 0 {
+		return
 	}
+	var peers []*p2pConnection
 	p2pPeers.lock.With(func() {
 		for p2pc := range p2pPeers.peers {
-			p2pc.chanToPeer <- msg
+			peers = append(peers, p2pc)
 		}
 	})
-}
-
-func (co *p2pCoordinatorType) connectDbPeers() {
-	peers := dbGetSavedPeers()
-	for peer := range peers {
-		if p2pPeers.HasAddress(peer) {
+	for hash, height := range chunks {
+		if chunkExists(hash) {
+			dbRemoveMissingChunk(hash)
 			continue
 		}
-		if co.badPeers.Has(peer) {
+		if co.recentlyRequestedChunks.TestAndSet(hash) {
 			continue
 		}
-		p2pc, err := p2pConnectPeer(peer)
-		if err != nil {
-			continue
+		msg := p2pMsgGetChunkStruct{
+			p2pMsgHeader: p2pMsgHeader{
+				P2pID: p2pEphemeralID,
+				Root:  chainParams.GenesisBlockHash,
+				Msg:   p2pMsgGetChunk,
+			},
+			Hash: hash,
 		}
-		go p2pc.handleConnection()
+		for _, p2pc := range peers {
+			if p2pc.chainHeight >= height {
+				p2pc.requestedChunks.Add(hash)
+				p2pc.chanToPeer <- msg
+			}
+		}
+	}
+}
+
+// Announces the new blocks to the peers, in the order of their flooding priorities
+func (co *p2pCoordinatorType) floodPeersWithNewBlocks(minHeight, maxHeight int) {
+	blockHashes := dbGetHeightHashes(minHeight, maxHeight)
+	groups := p2pPeersByFloodPriority()
+	if len(groups) == 0 {
+		return
 	}
+	for _, p2pc := range groups[0] {
+		p2pc.announceBlocks(blockHashes, maxHeight)
+	}
+	if len(groups) == 1 {
+		return
+	}
+	go func() {
+		for _, peers := range groups[1:] {
+			time.Sleep(p2pFloodPriorityDelay)
+			for _, p2pc := range peers {
+				if p2pPeers.Has(p2pc) {
+					p2pc.announceBlocks(blockHashes, maxHeight)
+				}
+			}
+		}
+	}()
+}
+
+// Connects to the saved peers, up to the target number of outbound connections
+func (co *p2pCoordinatorType) connectDbPeers() {
+	co.dialPeers(co.peerCandidates(), tunableP2pOutboundPeers()-len(p2pPeers.outbound()))
 }
@@ -0,0 +1,107 @@
+package daisy
+
+import (
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// A bug triggered by a peer's messages mustn't take down the node: the goroutines of a
+// p2p connection (the message handler, the readers and the writers) recover from panics,
+// log the stack, and tear down only that connection. The panics are counted in the
+// metrics. Only the runtime errors in the message handlers are blamed on the peer: the
+// log.Panic()s for database and disk errors, and the panics in the readers and writers,
+// are local faults. A host whose messages cause p2pPanicBanThreshold such panics within
+// p2pPanicWindow is banned for p2pPanicBanTTL, in both directions, since it's either
+// malicious or reliably hitting the same bug.
+
+// How many panics within the window get a host banned
+const p2pPanicBanThreshold = 3
+
+// The window in which the panics of a host are counted
+const p2pPanicWindow = time.Hour
+
+// How long a host whose connections keep panicking is banned
+const p2pPanicBanTTL = 24 * time.Hour
+
+var p2pPanics = struct {
+	lock  WithMutex
+	total int64 // accessed atomically
+	hosts map[string][]time.Duration
+	bans  *StringSetWithExpiry
+}{
+	hosts: map[string][]time.Duration{},
+	bans:  NewStringSetWithExpiry(p2pPanicBanTTL),
+}
+
+// Returns the host part of a peer's address
+func p2pPanicHost(address string) string {
+	if host, _, err := splitAddress(address); err == nil && host != "" {
+		return host
+	}
+	return address
+}
+
+// Returns true if the peer at the address is banned for causing panics
+func p2pPanicBanned(address string) bool {
+	return p2pPanics.bans.Has(p2pPanicHost(address))
+}
+
+// Recovers from a panic in one of the connection's goroutines. Must be deferred directly.
+func (p2pc *p2pConnection) recoverPanic(where string) {
+	if r := recover(); r != nil {
+		p2pc.panicked(where, r, false)
+	}
+}
+
+// Logs a recovered panic and closes the connection. If peerFault is set and the panic is
+// a runtime error, it's counted against the peer's host.
+func (p2pc *p2pConnection) panicked(where string, r interface{}, peerFault bool) {
+	log.Printf("Panic in %s of the connection to %s: %v\n%s", where, p2pc.address, r, debug.Stack())
+	atomic.AddInt64(&p2pPanics.total, 1)
+	// The handler and the other goroutines of the connection notice it and exit
+	defer p2pc.conn.Close()
+	if _, ok := r.(runtime.Error); !ok || !peerFault {
+		return
+	}
+	host := p2pPanicHost(p2pc.address)
+	now := monoClock()
+	ban := false
+	p2pPanics.lock.With(func() {
+		// Forget the panics which have left the window, so the map doesn't grow forever
+		for h, times := range p2pPanics.hosts {
+			var recent []time.Duration
+			for _, t := range times {
+				if now-t < p2pPanicWindow {
+					recent = append(recent, t)
+				}
+			}
+			if len(recent) == 0 {
+				delete(p2pPanics.hosts, h)
+			} else {
+				p2pPanics.hosts[h] = recent
+			}
+		}
+		recent := append(p2pPanics.hosts[host], now)
+		if len(recent) >= p2pPanicBanThreshold {
+			delete(p2pPanics.hosts, host)
+			ban = true
+		} else {
+			p2pPanics.hosts[host] = recent
+		}
+	})
+	if ban {
+		log.Println("Banning", host, "for", p2pPanicBanTTL, "after", p2pPanicBanThreshold, "panics in its connections")
+		p2pPanics.bans.Add(host)
+	}
+}
+
+// Returns the panic counters for the metrics
+func p2pPanicMetrics() map[string]interface{} {
+	return map[string]interface{}{
+		"total":  atomic.LoadInt64(&p2pPanics.total),
+		"banned": len(p2pPanics.bans.TTLs()),
+	}
+}
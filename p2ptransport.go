@@ -0,0 +1,87 @@
+package daisy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Peer connections are established over pluggable transports. The p2p protocol only needs
+// a reliable byte stream per peer (a net.Conn), so transports only need to dial and listen.
+// Transports which can multiplex streams may also provide a separate stream for bulk
+// transfers, see p2pBulkConn.
+
+// The timeout for establishing a connection to a peer
+const p2pDialTimeout = 15 * time.Second
+
+// DefaultP2PTransports is the default list of transports
+const DefaultP2PTransports = "tcp"
+
+type p2pTransport interface {
+	Name() string
+	Listen(address string) (net.Listener, error)
+	Dial(address string) (net.Conn, error)
+}
+
+// p2pBulkConn is implemented by connections which have a separate stream for bulk data
+// (blocks and chunks), so that large transfers don't delay the control messages.
+type p2pBulkConn interface {
+	BulkStream() io.ReadWriter
+}
+
+// The known transports, by name
+var p2pTransports = map[string]p2pTransport{
+	"tcp":  tcpTransport{},
+	"quic": &quicTransport{},
+	"tls":  tlsTransport{},
+}
+
+// The transports configured with -p2p-transports, in order of preference
+var p2pEnabledTransports []p2pTransport
+
+// Parses the comma-separated list of transport names
+func p2pParseTransports(names string) ([]p2pTransport, error) {
+	var result []p2pTransport
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		t, ok := p2pTransports[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown p2p transport: %s", name)
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+// Connects to the peer with the first configured transport which succeeds
+func p2pDial(address string) (net.Conn, error) {
+	var err error
+	for _, t := range p2pEnabledTransports {
+		var conn net.Conn
+		if conn, err = t.Dial(address); err == nil {
+			return conn, nil
+		}
+		if len(p2pEnabledTransports) > 1 {
+			log.Println("Cannot connect to", address, "over", t.Name(), err)
+		}
+	}
+	return nil, err
+}
+
+// The default transport: a single TCP connection per peer
+type tcpTransport struct{}
+
+func (tcpTransport) Name() string {
+	return "tcp"
+}
+
+func (tcpTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func (tcpTransport) Dial(address string) (net.Conn, error) {
+	return net.DialTimeout("tcp", address, p2pDialTimeout)
+}
@@ -0,0 +1,244 @@
+package daisy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// The QUIC transport runs over UDP on the same port number as TCP. Each peer connection
+// has two streams: the control stream for the p2p messages and the bulk stream for
+// blocks and chunks. QUIC recovers from packet loss per stream and survives changes of
+// the client's address, which makes it better suited to lossy and mobile links.
+//
+// TLS is mandatory in QUIC, but as with TCP, peers are not authenticated by the transport:
+// each node uses an ephemeral self-signed certificate, and the data is authenticated by
+// the block signatures.
+
+// The ALPN protocol name for daisy p2p connections
+const quicALPN = "daisy-p2p"
+
+// The first byte written on each stream identifies its purpose
+const (
+	quicStreamControl = iota
+	quicStreamBulk
+)
+
+type quicTransport struct {
+	tlsOnce   sync.Once
+	tlsConfig *tls.Config
+	tlsErr    error
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: p2pDialTimeout,
+		MaxIdleTimeout:       5 * time.Minute,
+		KeepAlivePeriod:      30 * time.Second,
+	}
+}
+
+func (t *quicTransport) Name() string {
+	return "quic"
+}
+
+// Returns the server TLS configuration with an ephemeral self-signed certificate
+func (t *quicTransport) getTLSConfig() (*tls.Config, error) {
+	t.tlsOnce.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.tlsErr = err
+			return
+		}
+		template := x509.Certificate{
+			SerialNumber: big.NewInt(p2pEphemeralID),
+			Subject:      pkix.Name{CommonName: fmt.Sprintf("daisy-%x", p2pEphemeralID)},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		}
+		certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+		if err != nil {
+			t.tlsErr = err
+			return
+		}
+		t.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: key}},
+			NextProtos:   []string{quicALPN},
+		}
+	})
+	return t.tlsConfig, t.tlsErr
+}
+
+func (t *quicTransport) Listen(address string) (net.Listener, error) {
+	tlsConfig, err := t.getTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	l, err := quic.ListenAddr(address, tlsConfig, quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	ql := quicListener{l: l, conns: make(chan net.Conn), done: make(chan error, 1)}
+	go ql.run()
+	return &ql, nil
+}
+
+func (t *quicTransport) Dial(address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p2pDialTimeout)
+	defer cancel()
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true, // see the comment at the top of this file
+		NextProtos:         []string{quicALPN},
+	}
+	qc, err := quic.DialAddr(ctx, address, tlsConfig, quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	c := quicConn{qc: qc}
+	if c.control, err = quicOpenStream(ctx, qc, quicStreamControl); err == nil {
+		c.bulk, err = quicOpenStream(ctx, qc, quicStreamBulk)
+	}
+	if err != nil {
+		qc.CloseWithError(1, "cannot open streams")
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Opens a stream and announces its purpose to the peer
+func quicOpenStream(ctx context.Context, qc quic.Connection, streamType byte) (quic.Stream, error) {
+	s, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.Write([]byte{streamType}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// quicListener adapts the QUIC listener to net.Listener, accepting the connections' streams
+type quicListener struct {
+	l     *quic.Listener
+	conns chan net.Conn
+	done  chan error
+}
+
+func (ql *quicListener) run() {
+	for {
+		qc, err := ql.l.Accept(context.Background())
+		if err != nil {
+			ql.done <- err
+			return
+		}
+		go func() {
+			c, err := quicAcceptStreams(qc)
+			if err != nil {
+				log.Println("Error setting up QUIC connection from", qc.RemoteAddr(), err)
+				qc.CloseWithError(1, "cannot accept streams")
+				return
+			}
+			ql.conns <- c
+		}()
+	}
+}
+
+// Waits for the dialing peer to open the control and the bulk streams
+func quicAcceptStreams(qc quic.Connection) (*quicConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p2pDialTimeout)
+	defer cancel()
+	c := quicConn{qc: qc}
+	for c.control == nil || c.bulk == nil {
+		s, err := qc.AcceptStream(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var streamType [1]byte
+		if _, err = io.ReadFull(s, streamType[:]); err != nil {
+			return nil, err
+		}
+		switch streamType[0] {
+		case quicStreamControl:
+			c.control = s
+		case quicStreamBulk:
+			c.bulk = s
+		default:
+			return nil, fmt.Errorf("Unknown QUIC stream type %d", streamType[0])
+		}
+	}
+	return &c, nil
+}
+
+func (ql *quicListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ql.conns:
+		return c, nil
+	case err := <-ql.done:
+		ql.done <- err
+		return nil, err
+	}
+}
+
+func (ql *quicListener) Close() error {
+	return ql.l.Close()
+}
+
+func (ql *quicListener) Addr() net.Addr {
+	return ql.l.Addr()
+}
+
+// quicConn is a net.Conn over the control stream of a QUIC connection
+type quicConn struct {
+	qc      quic.Connection
+	control quic.Stream
+	bulk    quic.Stream
+}
+
+func (c *quicConn) Read(b []byte) (int, error) {
+	return c.control.Read(b)
+}
+
+func (c *quicConn) Write(b []byte) (int, error) {
+	return c.control.Write(b)
+}
+
+func (c *quicConn) Close() error {
+	return c.qc.CloseWithError(0, "")
+}
+
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.qc.LocalAddr()
+}
+
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.qc.RemoteAddr()
+}
+
+func (c *quicConn) SetDeadline(t time.Time) error {
+	return c.control.SetDeadline(t)
+}
+
+func (c *quicConn) SetReadDeadline(t time.Time) error {
+	return c.control.SetReadDeadline(t)
+}
+
+func (c *quicConn) SetWriteDeadline(t time.Time) error {
+	return c.control.SetWriteDeadline(t)
+}
+
+func (c *quicConn) BulkStream() io.ReadWriter {
+	return c.bulk
+}
@@ -0,0 +1,134 @@
+package daisy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The tls transport runs the p2p protocol over TLS on the node's HTTPS port, so a node
+// needs only one open TCP port: the HTTPS server hands the connections which negotiate
+// the daisy-p2p ALPN protocol to the p2p server, and serves the others as HTTP. It needs
+// -http-tls-cert, and the p2p port must be the HTTP port. As with the other transports,
+// peers are not authenticated by the transport, so their certificates are not verified.
+
+type tlsTransport struct{}
+
+// A listener for the p2p connections accepted by the HTTPS server
+type p2pConnListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	addr      net.Addr
+}
+
+// The listener of the tls transport, nil until the transport listens
+var tlsP2pListener struct {
+	lock WithMutex
+	l    *p2pConnListener
+}
+
+// A p2p connection accepted by the HTTPS server, which must be kept open until the p2p
+// server closes it
+type p2pTLSConn struct {
+	*tls.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *p2pTLSConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return err
+}
+
+func (l *p2pConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *p2pConnListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *p2pConnListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (tlsTransport) Name() string {
+	return "tls"
+}
+
+// Returns a listener for the p2p connections which the HTTPS server accepts on its port
+func (tlsTransport) Listen(address string) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	l := &p2pConnListener{conns: make(chan net.Conn), closed: make(chan struct{}), addr: addr}
+	tlsP2pListener.lock.With(func() {
+		tlsP2pListener.l = l
+	})
+	return l, nil
+}
+
+func (tlsTransport) Dial(address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: p2pDialTimeout}
+	tlsConfig := tls.Config{
+		NextProtos:         []string{quicALPN},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	}
+	conn, err := tls.DialWithDialer(&dialer, "tcp", address, &tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if conn.ConnectionState().NegotiatedProtocol != quicALPN {
+		conn.Close()
+		return nil, fmt.Errorf("%s doesn't accept p2p connections over TLS", address)
+	}
+	return conn, nil
+}
+
+// Returns true if p2p connections are accepted by the HTTPS server
+func p2pTLSEnabled() bool {
+	for _, t := range p2pEnabledTransports {
+		if t.Name() == "tls" {
+			return true
+		}
+	}
+	return false
+}
+
+// Passes a connection which negotiated the p2p protocol from the HTTPS server to the p2p
+// server. The HTTPS server closes the connection when this returns, so it waits until the
+// p2p server is done with it.
+func p2pServeTLS(s *http.Server, conn *tls.Conn, h http.Handler) {
+	var l *p2pConnListener
+	tlsP2pListener.lock.With(func() {
+		l = tlsP2pListener.l
+	})
+	if l == nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	c := &p2pTLSConn{Conn: conn, done: make(chan struct{})}
+	select {
+	case l.conns <- c:
+	case <-l.closed:
+		return
+	}
+	<-c.done
+}
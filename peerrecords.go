@@ -0,0 +1,390 @@
+package daisy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Peers exchange signed peer records instead of bare addresses. Every node has a stable
+// identity key (in node.key in the data directory) with which it signs a record of its own
+// address and the current time, and sends it in the hello message together with the
+// records it has confirmed. Peers prove that they have the key they claim in the hello
+// message by signing the random challenge we send them (the nodeproof message).
+// Records which are unsigned, badly signed or older than a day are rejected, and the
+// others are only kept pending until we connect to their address: they are confirmed if
+// the node there proves it has the record's key, and dropped otherwise. Only confirmed
+// records are passed on.
+
+// The file with the node's identity key
+const nodeKeyFileName = "node.key"
+
+// How long peer records are valid
+const p2pPeerRecordMaxAge = 24 * time.Hour
+
+// How far in the future the timestamp of a peer record can be, for clock differences
+const p2pPeerRecordMaxSkew = 10 * time.Minute
+
+// How many peer records a hello message carries
+const p2pMaxPeerRecords = 50
+
+// How many unconfirmed peer records are kept
+const p2pMaxPendingPeerRecords = 1000
+
+// How many outbound peers must see us at the same address before we advertise it
+const p2pMyHostQuorum = 3
+
+const canonicalPeerRecordMagic = "DAISYPER"
+
+const canonicalNodeProofMagic = "DAISYNOD"
+
+// A peer address signed by the node at the address
+type p2pPeerRecord struct {
+	Address   string `json:"address"`
+	NodeKey   string `json:"node_key"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
+// The peer records received from peers, waiting to be confirmed by connecting to their
+// addresses, by address
+var p2pPendingPeerRecords = struct {
+	lock    WithMutex
+	records map[string]p2pPeerRecord
+}{records: make(map[string]p2pPeerRecord)}
+
+// The identity key of this node
+var nodeKey *ecdsa.PrivateKey
+
+// The hex-encoded public identity key of this node
+var nodeKeyPublicHex string
+
+// The public address of this node, as configured or as seen by our outbound peers
+var p2pMyAddress = struct {
+	lock  WithMutex
+	host  string
+	votes map[string]string // the address under which each peer's host sees us
+}{votes: make(map[string]string)}
+
+// Loads the node's identity key, generating it on the first run
+func nodeKeyInit() error {
+	fileName := filepath.Join(cfg.DataDir, nodeKeyFileName)
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		if err = ioutil.WriteFile(fileName, data, 0600); err != nil {
+			return err
+		}
+		log.Println("Generated the node identity key in", fileName)
+	} else if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("No key found in %s", fileName)
+	}
+	if nodeKey, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+		return err
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&nodeKey.PublicKey)
+	if err != nil {
+		return err
+	}
+	nodeKeyPublicHex = hex.EncodeToString(publicKey)
+	if cfg.P2pAdvertiseHost != "" {
+		p2pMyAddress.host = cfg.P2pAdvertiseHost
+	}
+	return nil
+}
+
+// Returns the hash of the signed part of the record
+func (r *p2pPeerRecord) signedHash() string {
+	var w canonicalWriter
+	w.WriteString(canonicalPeerRecordMagic)
+	w.WriteByte(CanonicalVersion)
+	w.writeString(r.Address)
+	w.writeString(r.NodeKey)
+	w.writeUint(uint64(r.Timestamp))
+	return hashBytesToHexString(w.Bytes())
+}
+
+// Checks the record's signature and age
+func (r *p2pPeerRecord) verify(now time.Time) error {
+	ts := time.Unix(r.Timestamp, 0)
+	if ts.Before(now.Add(-p2pPeerRecordMaxAge)) {
+		return fmt.Errorf("Peer record for %s is stale", r.Address)
+	}
+	if ts.After(now.Add(p2pPeerRecordMaxSkew)) {
+		return fmt.Errorf("Peer record for %s is from the future", r.Address)
+	}
+	host, port, err := splitAddress(r.Address)
+	if err != nil || host == "" || port < 1 || port > 65535 {
+		return fmt.Errorf("Invalid address in peer record: %s", r.Address)
+	}
+	if r.Signature == "" {
+		return fmt.Errorf("Peer record for %s is not signed", r.Address)
+	}
+	keyBytes, err := hex.DecodeString(r.NodeKey)
+	if err != nil {
+		return err
+	}
+	publicKey, err := cryptoDecodePublicKeyBytes(keyBytes)
+	if err != nil {
+		return err
+	}
+	return cryptoVerifyHex(publicKey, r.signedHash(), r.Signature)
+}
+
+// Returns this node's own signed record, or nil if its address is unknown
+func p2pMyPeerRecord() *p2pPeerRecord {
+	var host string
+	p2pMyAddress.lock.With(func() {
+		host = p2pMyAddress.host
+	})
+	if nodeKey == nil || host == "" || cfg.readOnly {
+		return nil
+	}
+	r := p2pPeerRecord{
+		Address:   fmt.Sprintf("%s:%d", host, cfg.P2pPort),
+		NodeKey:   nodeKeyPublicHex,
+		Timestamp: time.Now().Unix(),
+	}
+	signature, err := cryptoSignHex(nodeKey, r.signedHash())
+	if err != nil {
+		log.Println("Cannot sign my peer record:", err)
+		return nil
+	}
+	r.Signature = signature
+	return &r
+}
+
+// Returns the peer records to send in a hello message: ours and the confirmed ones
+func p2pPeerRecordsToSend() []p2pPeerRecord {
+	var result []p2pPeerRecord
+	if r := p2pMyPeerRecord(); r != nil {
+		result = append(result, *r)
+	}
+	return append(result, dbGetPeerRecords(p2pMaxPeerRecords)...)
+}
+
+// Records the address under which an outbound peer sees us. Unless it's configured, our
+// address changes when p2pMyHostQuorum peers on different hosts agree on it.
+func p2pSetMyHost(peerAddress string, host string) {
+	if host == "" || cfg.P2pAdvertiseHost != "" {
+		return
+	}
+	peerHost, _, err := splitAddress(peerAddress)
+	if err != nil {
+		return
+	}
+	p2pMyAddress.lock.With(func() {
+		if _, ok := p2pMyAddress.votes[peerHost]; !ok && len(p2pMyAddress.votes) >= 4*p2pMyHostQuorum {
+			// Only the recent peers count
+			for h := range p2pMyAddress.votes {
+				delete(p2pMyAddress.votes, h)
+				break
+			}
+		}
+		p2pMyAddress.votes[peerHost] = host
+		agree := 0
+		for _, h := range p2pMyAddress.votes {
+			if h == host {
+				agree++
+			}
+		}
+		if agree >= p2pMyHostQuorum && p2pMyAddress.host != host {
+			log.Println("Peers see this node at", host)
+			p2pMyAddress.host = host
+		}
+	})
+}
+
+// Verifies the peer records from a hello message, and keeps the ones not yet confirmed
+// pending. Returns the addresses of the new records, to connect to and confirm them.
+func (p2pc *p2pConnection) handlePeerRecords(msg StrIfMap) []string {
+	var records []p2pPeerRecord
+	data, err := json.Marshal(msg["peer_records"])
+	if err == nil {
+		err = json.Unmarshal(data, &records)
+	}
+	if err != nil {
+		log.Println(p2pc.address, "sent invalid peer records:", err)
+		return nil
+	}
+	if len(records) > p2pMaxPeerRecords+1 {
+		records = records[:p2pMaxPeerRecords+1]
+	}
+	now := time.Now()
+	var newAddresses []string
+	rejected := 0
+	for i := range records {
+		r := &records[i]
+		if r.NodeKey == nodeKeyPublicHex {
+			continue
+		}
+		if err = r.verify(now); err != nil {
+			rejected++
+			continue
+		}
+		old := dbGetPeerRecord(r.Address)
+		if old != nil && old.NodeKey != r.NodeKey {
+			// The confirmed record stands until it expires or is disproved by connecting
+			// to its address
+			rejected++
+			continue
+		}
+		if old != nil {
+			if old.Timestamp < r.Timestamp {
+				// The node at the address has proven it has the key
+				dbSavePeerRecord(r)
+			}
+			continue
+		}
+		p2pPendingPeerRecords.lock.With(func() {
+			pending, ok := p2pPendingPeerRecords.records[r.Address]
+			if !ok && len(p2pPendingPeerRecords.records) >= p2pMaxPendingPeerRecords {
+				rejected++
+				return
+			}
+			if !ok || pending.Timestamp < r.Timestamp {
+				p2pPendingPeerRecords.records[r.Address] = *r
+			}
+			if !ok {
+				newAddresses = append(newAddresses, r.Address)
+			}
+		})
+	}
+	if rejected > 0 {
+		log.Println("Rejected", rejected, "peer records from", p2pc.address)
+	}
+	return newAddresses
+}
+
+// Removes the pending peer records signed before the given time
+func p2pPendingPeerRecordsExpire(before time.Time) {
+	p2pPendingPeerRecords.lock.With(func() {
+		for address, r := range p2pPendingPeerRecords.records {
+			if time.Unix(r.Timestamp, 0).Before(before) {
+				delete(p2pPendingPeerRecords.records, address)
+			}
+		}
+	})
+}
+
+// Confirms the pending records for the address of the outbound peer which have its proven
+// identity key, and drops the records for it signed by other keys
+func (p2pc *p2pConnection) checkPeerRecord(peerNodeKey string) {
+	if !p2pc.outbound {
+		return
+	}
+	host, _, err := splitAddress(p2pc.address)
+	if err != nil {
+		return
+	}
+	for _, address := range []string{p2pc.dialAddress, p2pc.address, host + ":" + strconv.Itoa(DefaultP2PPort)} {
+		var pending p2pPeerRecord
+		var ok bool
+		p2pPendingPeerRecords.lock.With(func() {
+			if pending, ok = p2pPendingPeerRecords.records[address]; ok {
+				delete(p2pPendingPeerRecords.records, address)
+			}
+		})
+		if ok && pending.NodeKey == peerNodeKey {
+			dbSavePeerRecord(&pending)
+		} else if ok {
+			log.Println("The peer record for", address, "was signed by another node, dropping it")
+		}
+		if r := dbGetPeerRecord(address); r != nil && r.NodeKey != peerNodeKey {
+			log.Println("The peer record for", address, "was signed by another node, dropping it")
+			dbDeletePeerRecord(address)
+		}
+	}
+}
+
+// Returns the hash signed by a node to prove it has its identity key
+func nodeProofHash(challenge string, key string) string {
+	var w canonicalWriter
+	w.WriteString(canonicalNodeProofMagic)
+	w.WriteByte(CanonicalVersion)
+	w.writeString(chainParams.GenesisBlockHash)
+	w.writeString(challenge)
+	w.writeString(key)
+	return hashBytesToHexString(w.Bytes())
+}
+
+// Returns a new random challenge for the peer to sign
+func nodeProofChallenge() string {
+	return fmt.Sprintf("%016x%016x", randInt63(), randInt63())
+}
+
+// Answers the challenge from the peer's hello message by signing it with our identity key
+func (p2pc *p2pConnection) sendNodeProof(challenge string) {
+	if nodeKey == nil || challenge == "" || len(challenge) > 64 {
+		return
+	}
+	signature, err := cryptoSignHex(nodeKey, nodeProofHash(challenge, nodeKeyPublicHex))
+	if err != nil {
+		log.Println("Cannot sign the node proof:", err)
+		return
+	}
+	p2pc.chanToPeer <- p2pMsgNodeProofStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgNodeProof,
+		},
+		NodeKey:   nodeKeyPublicHex,
+		Signature: signature,
+	}
+}
+
+// nodeproof: the peer has signed our challenge with the identity key it claimed in its
+// hello message, which it is now known to have
+func (p2pc *p2pConnection) handleNodeProof(msg StrIfMap) {
+	key, err := msg.GetString("node_key")
+	if err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	signature, err := msg.GetString("signature")
+	if err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	if p2pc.nodeKey != "" || key != p2pc.claimedNodeKey || p2pc.challenge == "" {
+		return
+	}
+	keyBytes, err := hex.DecodeString(key)
+	if err == nil {
+		var publicKey *ecdsa.PublicKey
+		if publicKey, err = cryptoDecodePublicKeyBytes(keyBytes); err == nil {
+			err = cryptoVerifyHex(publicKey, nodeProofHash(p2pc.challenge, key), signature)
+		}
+	}
+	if err != nil {
+		log.Println(p2pc.address, "sent an invalid node proof:", err)
+		return
+	}
+	p2pc.nodeKey = key
+	p2pc.updatePolicy()
+	p2pc.checkPeerRecord(key)
+}
@@ -0,0 +1,124 @@
+package daisy
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Outbound peers are rotated gradually: the coordinator keeps dialing saved peers until it
+// has the target number of outbound connections, and every rotation interval it replaces
+// a small fraction of them, disconnecting the worst-scoring peers only after the fresh
+// ones have connected, so the number of connections never dips.
+
+// DefaultP2POutboundPeers is the default target number of outbound connections
+const DefaultP2POutboundPeers = 8
+
+// How often a fraction of the outbound peers is rotated
+const peerRotationInterval = 10 * time.Minute
+
+// The fraction of outbound peers rotated every interval (at least one)
+const peerRotationFraction = 0.125
+
+// How long a rotated-out peer is not dialed again
+const peerRotationCooldown = 1 * time.Hour
+
+// Returns the score of the peer: higher is better. Peers which deliver blocks get points,
+// and those which are behind us lose them.
+func (p2pc *p2pConnection) score(myHeight int) int {
+	score := 10 * p2pc.blocksReceived
+	if lag := myHeight - p2pc.chainHeight; lag > 0 {
+		score -= int(math.Min(float64(lag), 100))
+	}
+	if p2pc.isRelay {
+		score--
+	}
+	return score
+}
+
+// Returns the outbound connections
+func (p *p2pPeersSet) outbound() []*p2pConnection {
+	var result []*p2pConnection
+	p.lock.With(func() {
+		for peer := range p.peers {
+			if peer.outbound {
+				result = append(result, peer)
+			}
+		}
+	})
+	return result
+}
+
+// Returns the saved peers which can be dialed, in random order
+func (co *p2pCoordinatorType) peerCandidates() []string {
+	var candidates []string
+	for peer := range dbGetSavedPeers() {
+		if p2pPeers.HasAddress(peer) || co.badPeers.Has(peer) || co.rotatedPeers.Has(peer) || p2pPanicBanned(peer) || governanceBanned(peer) {
+			continue
+		}
+		candidates = append(candidates, peer)
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	return candidates
+}
+
+// Dials candidates until n of them are connected or there are no candidates left. Returns
+// the number of new connections.
+func (co *p2pCoordinatorType) dialPeers(candidates []string, n int) int {
+	connected := 0
+	for _, peer := range candidates {
+		if connected >= n {
+			break
+		}
+		p2pc, err := p2pConnectPeer(peer)
+		if err != nil {
+			continue
+		}
+		go p2pc.handleConnection()
+		connected++
+	}
+	return connected
+}
+
+// Tops up the outbound connections to the target number, and rotates a fraction of them
+// if the rotation interval has passed
+func (co *p2pCoordinatorType) rotatePeers() {
+	outbound := p2pPeers.outbound()
+	candidates := co.peerCandidates()
+	if missing := tunableP2pOutboundPeers() - len(outbound); missing > 0 {
+		co.dialPeers(candidates, missing)
+		return
+	}
+	if time.Since(co.lastRotationTime) < peerRotationInterval || len(candidates) == 0 {
+		return
+	}
+	co.lastRotationTime = time.Now()
+	n := int(math.Ceil(float64(len(outbound)) * peerRotationFraction))
+	connected := co.dialPeers(candidates, n)
+	if connected == 0 {
+		return
+	}
+	// Disconnect as many of the worst peers as have been replaced
+	myHeight := dbGetBlockchainHeight()
+	for i := 0; i < connected; i++ {
+		var worst *p2pConnection
+		for _, p2pc := range outbound {
+			if p2pc != nil && (worst == nil || p2pc.score(myHeight) < worst.score(myHeight)) {
+				worst = p2pc
+			}
+		}
+		for j := range outbound {
+			if outbound[j] == worst {
+				outbound[j] = nil
+			}
+		}
+		log.Println("Rotating out peer", worst.address, "with score", worst.score(myHeight))
+		co.rotatedPeers.Add(worst.address)
+		if err := worst.conn.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package daisy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Peers can be tagged, e.g. "datacenter", "branch-office" or "archival", to give them
+// different policies on heterogeneous networks. The peer_tags config setting maps peers,
+// given by IP address, CIDR range or node key, to their tags, and admins can change the
+// tags at runtime with the /peer-tags endpoint (until the node restarts). The
+// peer_policies config setting defines the policy of each tag: the flooding priority (new
+// blocks are announced to the peers with higher priorities first, and to each lower
+// priority p2pFloodPriorityDelay later, so the important peers get them before the links
+// are busy), a cap on the bytes per second sent to the peer, and whether the peer may be
+// a source of the blocks when syncing. A peer with several tags gets the highest priority,
+// the lowest cap, and is excluded from syncing if any of its tags is. The node key
+// selectors only match the peers which have proven to have the key, and the policy of a
+// connection is computed once, and again only when it proves its key or the tags change.
+
+// PeerPolicy is the policy for the peers with a tag
+type PeerPolicy struct {
+	// The flooding priority of the peers, higher is earlier, 0 by default
+	FloodPriority int `json:"flood_priority"`
+	// The maximum number of bytes per second sent to each of the peers, 0 for no limit
+	MaxBytesPerSecond int64 `json:"max_bytes_per_second"`
+	// True if the blocks mustn't be synced from the peers
+	NoSync bool `json:"no_sync"`
+}
+
+// The delay between flooding the new blocks to the peers of one priority and the next
+const p2pFloodPriorityDelay = 2 * time.Second
+
+// The largest burst of bytes sent to a peer with a bandwidth cap, in seconds of its cap
+const peerBandwidthBurst = 1.0
+
+// A parsed peer selector from the peer tags
+type peerSelector struct {
+	text    string
+	network *net.IPNet // for CIDR ranges and IP addresses
+}
+
+var peerTags struct {
+	lock      WithMutex
+	selectors []peerSelector
+	tags      map[string][]string // selector text -> tags, from the config and the API
+}
+
+// Parses a peer selector: an IP address, a CIDR range or a node key
+func peerSelectorParse(s string) (peerSelector, error) {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return peerSelector{text: s, network: network}, nil
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * len(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return peerSelector{text: s, network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	}
+	if s == "" || strings.ContainsAny(s, " /") {
+		return peerSelector{}, fmt.Errorf("Invalid peer %q: expecting an IP address, a CIDR range or a node key", s)
+	}
+	return peerSelector{text: s}, nil
+}
+
+// Returns true if the selector selects the peer with the given address and node key
+func (ps peerSelector) matches(ip net.IP, nodeKey string) bool {
+	if ps.network != nil {
+		return ip != nil && ps.network.Contains(ip)
+	}
+	return nodeKey != "" && ps.text == nodeKey
+}
+
+// Sets the tags of the peers selected by the selector, removing them if there are none
+func peerTagsSet(selector string, tags []string) error {
+	ps, err := peerSelectorParse(selector)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if tag == "" {
+			return fmt.Errorf("Empty tag for the peer %s", selector)
+		}
+	}
+	peerTags.lock.With(func() {
+		if peerTags.tags == nil {
+			peerTags.tags = map[string][]string{}
+		}
+		if _, ok := peerTags.tags[selector]; !ok {
+			peerTags.selectors = append(peerTags.selectors, ps)
+		}
+		if len(tags) > 0 {
+			peerTags.tags[selector] = tags
+			return
+		}
+		delete(peerTags.tags, selector)
+		for i := range peerTags.selectors {
+			if peerTags.selectors[i].text == selector {
+				peerTags.selectors = append(peerTags.selectors[:i], peerTags.selectors[i+1:]...)
+				break
+			}
+		}
+	})
+	var peers []*p2pConnection
+	p2pPeers.lock.With(func() {
+		for p2pc := range p2pPeers.peers {
+			peers = append(peers, p2pc)
+		}
+	})
+	for _, p2pc := range peers {
+		p2pc.updatePolicy()
+	}
+	return nil
+}
+
+// Loads the peer tags from the config and checks the policies
+func peerTagsConfigure() error {
+	for selector, tags := range cfg.PeerTags {
+		if err := peerTagsSet(selector, tags); err != nil {
+			return err
+		}
+	}
+	for tag, policy := range cfg.PeerPolicies {
+		if policy.MaxBytesPerSecond < 0 {
+			return fmt.Errorf("Invalid max_bytes_per_second of the peer tag %s: %d", tag, policy.MaxBytesPerSecond)
+		}
+	}
+	return nil
+}
+
+// Returns the sorted tags of the peer. The node key selectors only match once the peer has
+// proven to have the key.
+func (p2pc *p2pConnection) tags() []string {
+	host, _, err := splitAddress(p2pc.address)
+	if err != nil {
+		host = p2pc.address
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	seen := map[string]bool{}
+	result := []string{}
+	peerTags.lock.With(func() {
+		for _, ps := range peerTags.selectors {
+			if !ps.matches(ip, p2pc.nodeKey) {
+				continue
+			}
+			for _, tag := range peerTags.tags[ps.text] {
+				if !seen[tag] {
+					seen[tag] = true
+					result = append(result, tag)
+				}
+			}
+		}
+	})
+	sort.Strings(result)
+	return result
+}
+
+// Returns the combined policy of the peer's tags, computing it on the first call
+func (p2pc *p2pConnection) policy() PeerPolicy {
+	var result PeerPolicy
+	computed := false
+	p2pc.policyLock.With(func() {
+		result, computed = p2pc.cachedPolicy, p2pc.policyComputed
+	})
+	if computed {
+		return result
+	}
+	return p2pc.updatePolicy()
+}
+
+// Recomputes the policy of the peer, after its node key or the tags have changed
+func (p2pc *p2pConnection) updatePolicy() PeerPolicy {
+	result := p2pc.computePolicy()
+	p2pc.policyLock.With(func() {
+		p2pc.cachedPolicy, p2pc.policyComputed = result, true
+	})
+	return result
+}
+
+// Combines the policies of the peer's tags
+func (p2pc *p2pConnection) computePolicy() PeerPolicy {
+	var result PeerPolicy
+	for i, tag := range p2pc.tags() {
+		policy := cfg.PeerPolicies[tag]
+		if i == 0 || policy.FloodPriority > result.FloodPriority {
+			result.FloodPriority = policy.FloodPriority
+		}
+		if policy.MaxBytesPerSecond > 0 && (result.MaxBytesPerSecond == 0 || policy.MaxBytesPerSecond < result.MaxBytesPerSecond) {
+			result.MaxBytesPerSecond = policy.MaxBytesPerSecond
+		}
+		result.NoSync = result.NoSync || policy.NoSync
+	}
+	return result
+}
+
+// Limits the bytes sent to a peer, over all its streams, to its bandwidth cap, with a
+// token bucket
+type peerBandwidth struct {
+	lock      WithMutex
+	allowance float64
+	last      time.Time
+}
+
+// Accounts for the bytes just sent to the peer, and waits until the peer is back under
+// its cap
+func (b *peerBandwidth) wait(n int, limit int64) {
+	if limit <= 0 {
+		return
+	}
+	var delay time.Duration
+	b.lock.With(func() {
+		now := time.Now()
+		if b.last.IsZero() {
+			b.allowance = float64(limit) * peerBandwidthBurst
+		} else {
+			b.allowance += now.Sub(b.last).Seconds() * float64(limit)
+			if max := float64(limit) * peerBandwidthBurst; b.allowance > max {
+				b.allowance = max
+			}
+		}
+		b.last = now
+		b.allowance -= float64(n)
+		if b.allowance < 0 {
+			delay = time.Duration(-b.allowance / float64(limit) * float64(time.Second))
+		}
+	})
+	time.Sleep(delay)
+}
+
+// Returns the peers grouped by flooding priority, highest first
+func p2pPeersByFloodPriority() [][]*p2pConnection {
+	var peers []*p2pConnection
+	p2pPeers.lock.With(func() {
+		for p2pc := range p2pPeers.peers {
+			peers = append(peers, p2pc)
+		}
+	})
+	byPriority := map[int][]*p2pConnection{}
+	var priorities []int
+	for _, p2pc := range peers {
+		priority := p2pc.policy().FloodPriority
+		if _, ok := byPriority[priority]; !ok {
+			priorities = append(priorities, priority)
+		}
+		byPriority[priority] = append(byPriority[priority], p2pc)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+	var groups [][]*p2pConnection
+	for _, priority := range priorities {
+		groups = append(groups, byPriority[priority])
+	}
+	return groups
+}
+
+// The body of a POST to /peer-tags
+type peerTagsRequest struct {
+	Peer string   `json:"peer"`
+	Tags []string `json:"tags"`
+}
+
+// /peer-tags returns the peer tags and policies, and sets the tags of a peer on POST
+func blockWebPeerTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req peerTagsRequest
+		if err = json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = peerTagsSet(req.Peer, req.Tags); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Println("Set the tags of", req.Peer, "to", req.Tags)
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "Expecting GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	tags := map[string][]string{}
+	peerTags.lock.With(func() {
+		for selector, t := range peerTags.tags {
+			tags[selector] = t
+		}
+	})
+	policies := cfg.PeerPolicies
+	if policies == nil {
+		policies = map[string]PeerPolicy{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err := w.Write(jsonifyWhateverToBytes(map[string]interface{}{"tags": tags, "policies": policies}))
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package daisy
+
+import (
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+)
+
+// Returns the default data directory: ~/.daisy
+func defaultDataDir() string {
+	u, err := user.Current()
+	if err != nil {
+		log.Panicln(err)
+	}
+	return filepath.Join(u.HomeDir, DefaultDataDir)
+}
+
+// Renames the file, replacing the destination if it exists
+func renameFile(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
@@ -0,0 +1,64 @@
+//go:build windows
+// +build windows
+
+package daisy
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// The name of the data directory under %LOCALAPPDATA% or %ProgramData%
+const windowsDataDirName = "Daisy"
+
+// Returns the default data directory. The services (which usually run as LocalSystem) use
+// %ProgramData%\Daisy, and users %LOCALAPPDATA%\Daisy. An existing %USERPROFILE%\.daisy
+// from older versions is still used.
+func defaultDataDir() string {
+	u, err := user.Current()
+	if err != nil {
+		log.Panicln(err)
+	}
+	legacy := filepath.Join(u.HomeDir, DefaultDataDir)
+	if fileExists(legacy) {
+		return legacy
+	}
+	if isService, _ := windowsIsService(); isService {
+		if dir := os.Getenv("ProgramData"); dir != "" {
+			return filepath.Join(dir, windowsDataDirName)
+		}
+	}
+	if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+		return filepath.Join(dir, windowsDataDirName)
+	}
+	return legacy
+}
+
+// The errors returned while another process (e.g. an antivirus scanner or a backup tool)
+// has the file open without sharing it
+const (
+	errorAccessDenied     = syscall.Errno(5)
+	errorSharingViolation = syscall.Errno(32)
+	errorLockViolation    = syscall.Errno(33)
+)
+
+// Renames the file, replacing the destination if it exists. On Windows, files which are
+// open in other processes cannot be renamed or replaced, so this is retried for a while.
+func renameFile(oldName, newName string) error {
+	var err error
+	for i := 0; i < 20; i++ {
+		if err = os.Rename(oldName, newName); err == nil {
+			return nil
+		}
+		if !errors.Is(err, errorSharingViolation) && !errors.Is(err, errorLockViolation) && !errors.Is(err, errorAccessDenied) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package daisy
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A chain profile, selected with -profile, sets the defaults for running a node of one
+// kind of network: its ports, the subdirectory of the default data directory, the
+// bootstrap peers, and how the genesis block is obtained. The mainnet profile is the
+// default and is the built-in Daisy chain. The testnet profile keeps its data apart from
+// the mainnet's and has no built-in genesis block: a testnet is joined with pull or
+// started with newchain. The devnet profile is for development on a single machine: on
+// the first start it creates a fresh chain signed by the node's own key, whose params
+// require a quorum of one signature for key ops at any height, and seals the pending
+// documents into blocks every second. The flags and the config file override the
+// profile's defaults.
+
+// The chain profiles
+const (
+	ProfileMainnet = "mainnet"
+	ProfileTestnet = "testnet"
+	ProfileDevnet  = "devnet"
+)
+
+// DefaultProfile is the default chain profile
+const DefaultProfile = ProfileMainnet
+
+// The defaults of a chain profile
+type chainProfile struct {
+	p2pPort  int
+	httpPort int
+	// The subdirectory of the default data directory, or "" for the directory itself
+	dataSubdir string
+	// The interval of the default block schedule, or "" for none
+	blockSchedule string
+	// True if the built-in genesis block is used for an empty data directory
+	builtinGenesis bool
+	// True if a fresh chain is created for an empty data directory
+	createChain bool
+	// True if blocks can be sealed instantly, without the startup tip check
+	relaxed bool
+}
+
+var chainProfiles = map[string]chainProfile{
+	ProfileMainnet: {p2pPort: DefaultP2PPort, httpPort: DefaultBlockWebServerPort, builtinGenesis: true},
+	ProfileTestnet: {p2pPort: 2027, httpPort: 2028, dataSubdir: "testnet"},
+	ProfileDevnet:  {p2pPort: 2037, httpPort: 2038, dataSubdir: "devnet", blockSchedule: "1s", createChain: true, relaxed: true},
+}
+
+// The profile in use
+var currentProfile = chainProfiles[DefaultProfile]
+
+// Applies the defaults of the named profile to the configuration, before the config file
+// and the flags are parsed
+func profileApply(name string) error {
+	profile, ok := chainProfiles[name]
+	if !ok {
+		return fmt.Errorf("Unknown chain profile %q (expecting %s, %s or %s)", name, ProfileMainnet, ProfileTestnet, ProfileDevnet)
+	}
+	cfg.profile = name
+	currentProfile = profile
+	cfg.P2pPort = profile.p2pPort
+	cfg.httpPort = profile.httpPort
+	if profile.dataSubdir != "" {
+		cfg.DataDir = filepath.Join(defaultDataDir(), profile.dataSubdir)
+	}
+	cfg.BlockSchedule = profile.blockSchedule
+	if !profile.builtinGenesis {
+		// Only the mainnet's peers are known
+		bootstrapPeers = peerStringMap{}
+	}
+	return nil
+}
+
+// Returns true if the profile relaxes the validation for development
+func profileRelaxed() bool {
+	return currentProfile.relaxed
+}
+
+// Returns true if the data directory has no blockchain yet
+func profileDataDirEmpty() bool {
+	return !fileExists(filepath.Join(cfg.DataDir, mainDbFileName)) && !fileExists(filepath.Join(cfg.DataDir, chainParamsBaseName))
+}
+
+// Creates a fresh chain in the empty data directory if the profile calls for one
+func profileInitChain() {
+	if !currentProfile.createChain || cfg.readOnly || !profileDataDirEmpty() {
+		return
+	}
+	hostname, _ := os.Hostname()
+	log.Println("Creating a fresh", cfg.profile, "chain in", cfg.DataDir)
+	newChainCreate(NewChainParams{
+		ChainParams: ChainParams{
+			Creator:               fmt.Sprintf("%s@%s", cfg.profile, hostname),
+			Description:           fmt.Sprintf("Daisy %s chain", cfg.profile),
+			GenesisBlockTimestamp: time.Now().Format(time.RFC3339),
+			KeyOpQuorum:           1,
+		},
+	})
+	// The node opens the system databases again
+	mainDb.Close()
+	privateDb.Close()
+}
+
+// Checks that the profile can start a node with the empty data directory
+func profileCheckGenesis() error {
+	if currentProfile.builtinGenesis || currentProfile.createChain {
+		return nil
+	}
+	return fmt.Errorf("The %s profile has no built-in genesis block: join a %s with pull, or start one with newchain", cfg.profile, cfg.profile)
+}
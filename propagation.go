@@ -0,0 +1,185 @@
+package daisy
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// The node measures how fast new blocks reach it: when a block announced by the peers is
+// accepted, the delay from the block's own timestamp to its acceptance, and from its first
+// announcement to its acceptance, are recorded in the block_propagation table, together
+// with the peer which announced it first. For every peer, it also counts the blocks it
+// announced, how many of them it announced first, and how far behind the first announcer
+// it was for the others, so slow links and misconfigured nodes stand out. The block
+// timestamps have a resolution of a second and come from the clock of the node which
+// produced the block, so the delays are only as good as the clocks are synchronised.
+// Blocks which are synced rather than announced aren't measured. The per-peer statistics
+// are in the daisy_block_propagation metric, and the stats command summarises the delays
+// and the first announcers of a range of blocks. At most 1000 blocks are tracked at a
+// time, at most 100 of them first announced by the same peer.
+
+// How long the announcements of a block are tracked
+const propagationAnnouncementTTL = 10 * time.Minute
+
+// How many of the most recent delays the metrics summarise
+const propagationSamples = 1000
+
+// The maximum number of blocks whose announcements are tracked, in total and first
+// announced by any one peer, so a peer announcing made-up hashes can't fill the memory
+const (
+	propagationMaxAnnouncements     = 1000
+	propagationMaxPeerAnnouncements = 100
+)
+
+// The maximum number of peers whose statistics are kept
+const propagationMaxPeers = 1000
+
+// The announcements of a block
+type propagationAnnouncement struct {
+	firstPeer string
+	first     time.Time
+	peers     map[string]bool
+}
+
+// The announcement statistics of a peer
+type propagationPeerStats struct {
+	announced int
+	first     int
+	lags      []float64 // seconds behind the first announcer, the most recent ones
+	tracked   int       // the tracked announcements it was the first of
+}
+
+var propagation = struct {
+	lock          WithMutex
+	announcements map[string]*propagationAnnouncement // by block hash
+	peers         map[string]*propagationPeerStats    // by peer address
+	delays        []float64                           // seconds from creation to acceptance
+}{
+	announcements: map[string]*propagationAnnouncement{},
+	peers:         map[string]*propagationPeerStats{},
+}
+
+// Appends the value to the samples, keeping only the most recent ones
+func propagationAppendSample(samples []float64, v float64) []float64 {
+	samples = append(samples, v)
+	if len(samples) > propagationSamples {
+		samples = samples[len(samples)-propagationSamples:]
+	}
+	return samples
+}
+
+// Records that the peer has announced the blocks
+func (p2pc *p2pConnection) propagationAnnounced(hashes map[int]string) {
+	now := time.Now()
+	peer := p2pc.outboxAddress()
+	// The blocks this node already has, old ones or its own, aren't measured
+	known := map[string]bool{}
+	for h, hash := range hashes {
+		known[hash] = dbBlockHeightExists(h)
+	}
+	propagation.lock.With(func() {
+		for hash, a := range propagation.announcements {
+			if now.Sub(a.first) > propagationAnnouncementTTL {
+				delete(propagation.announcements, hash)
+				if fps := propagation.peers[a.firstPeer]; fps != nil {
+					fps.tracked--
+				}
+			}
+		}
+		ps := propagation.peers[peer]
+		if ps == nil {
+			if len(propagation.peers) >= propagationMaxPeers {
+				return
+			}
+			ps = &propagationPeerStats{}
+			propagation.peers[peer] = ps
+		}
+		for _, hash := range hashes {
+			a := propagation.announcements[hash]
+			if a == nil {
+				if known[hash] || len(propagation.announcements) >= propagationMaxAnnouncements ||
+					ps.tracked >= propagationMaxPeerAnnouncements || memoryCacheFull(len(propagation.announcements)) {
+					continue
+				}
+				propagation.announcements[hash] = &propagationAnnouncement{firstPeer: peer, first: now, peers: map[string]bool{peer: true}}
+				ps.announced++
+				ps.first++
+				ps.tracked++
+				continue
+			}
+			if a.peers[peer] {
+				// Resent from the peer's outbox
+				continue
+			}
+			a.peers[peer] = true
+			ps.announced++
+			ps.lags = propagationAppendSample(ps.lags, now.Sub(a.first).Seconds())
+		}
+	})
+}
+
+// Records the propagation delays of the block, just accepted from a peer, if it has been
+// announced
+func propagationAccepted(blk *Block) {
+	now := time.Now()
+	var a propagationAnnouncement
+	announced := false
+	propagation.lock.With(func() {
+		if pa := propagation.announcements[blk.Hash]; pa != nil {
+			a, announced = *pa, true
+		}
+	})
+	if !announced {
+		return
+	}
+	created, err := blk.dbGetMetaTime("Timestamp")
+	if err != nil {
+		return
+	}
+	delay := now.Sub(created)
+	propagation.lock.With(func() {
+		propagation.delays = propagationAppendSample(propagation.delays, delay.Seconds())
+	})
+	if err = dbInsertPropagation(blk.Height, blk.Hash, delay, now.Sub(a.first), a.firstPeer); err != nil {
+		log.Println("Cannot record the propagation of block", blk.Height, err)
+	}
+}
+
+// Returns the propagation statistics for the metrics
+func propagationMetrics() map[string]interface{} {
+	peers := map[string]interface{}{}
+	var delays []float64
+	propagation.lock.With(func() {
+		for peer, ps := range propagation.peers {
+			lags := append([]float64(nil), ps.lags...)
+			peers[peer] = map[string]interface{}{
+				"announced":   ps.announced,
+				"first":       ps.first,
+				"lag_seconds": statsDistribution(lags),
+			}
+		}
+		delays = append(delays, propagation.delays...)
+	})
+	return map[string]interface{}{
+		"blocks":        len(delays),
+		"delay_seconds": statsDistribution(delays),
+		"peers":         peers,
+	}
+}
+
+// Returns the first announcers of the blocks, with the number of blocks each announced
+// first, most first
+func propagationFirstAnnouncers(firstPeers map[string]int, total int) []StatsAnnouncer {
+	result := []StatsAnnouncer{}
+	for peer, n := range firstPeers {
+		result = append(result, StatsAnnouncer{Peer: peer, Blocks: n, Percent: 100 * float64(n) / float64(total)})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Blocks != result[j].Blocks {
+			return result[i].Blocks > result[j].Blocks
+		}
+		return result[i].Peer < result[j].Peer
+	})
+	return result
+}
@@ -0,0 +1,806 @@
+// Package prototest checks that a node speaks the Daisy p2p protocol correctly.
+//
+// It connects to a node over plain TCP, does the handshake, and exercises the protocol:
+// the block hash and header queries, the transfer of a block, ping, and the handling of
+// unknown messages, messages for other chains, malformed fields, malformed JSON and
+// oversized messages. A conforming node answers the queries with consistent data, ignores
+// the messages it doesn't understand, drops the connections which send invalid JSON or
+// oversized messages, and keeps serving other connections throughout. Each check passes,
+// fails or is skipped (when the node doesn't announce the feature it needs), and the
+// results are collected in a Report. The answers to getblockhashes are told apart from the
+// blocks the node announces by their trace IDs, which the node must echo.
+//
+// The package only depends on the standard library, so it can be used to test other
+// implementations of the protocol without building the daisy node.
+package prototest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha3"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UserAgent is the version string the test suite announces in its hello message
+const UserAgent = "daisy-prototest/0.1"
+
+// The longest message read from the node
+const maxMessageSize = 512 * 1024 * 1024
+
+// How many of the latest blocks the hash and header queries ask for
+const queryBlocks = 10
+
+// Config configures a test run
+type Config struct {
+	// The p2p address of the node, as host:port
+	Address string
+	// The genesis block hash of the chain the node must be on, or empty to accept the one
+	// in its hello message
+	Root string
+	// How long to wait for each answer
+	Timeout time.Duration
+	// The size of the oversized message, which must be larger than the node's limit
+	OversizeBytes int64
+}
+
+// Result is the outcome of one check
+type Result struct {
+	Name     string  `json:"name"`
+	Passed   bool    `json:"passed"`
+	Skipped  bool    `json:"skipped,omitempty"`
+	Detail   string  `json:"detail,omitempty"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// Report is the outcome of a test run
+type Report struct {
+	Address     string   `json:"address"`
+	UserAgent   string   `json:"user_agent"`
+	Root        string   `json:"root"`
+	ChainHeight int      `json:"chain_height"`
+	Features    []string `json:"features"`
+	Results     []Result `json:"results"`
+	Passed      int      `json:"passed"`
+	Failed      int      `json:"failed"`
+	Skipped     int      `json:"skipped"`
+}
+
+// OK returns true if no check has failed
+func (r *Report) OK() bool {
+	return r.Failed == 0
+}
+
+// errSkip is returned by the checks which don't apply to the node
+type errSkip struct {
+	reason string
+}
+
+func (e errSkip) Error() string {
+	return e.reason
+}
+
+// A message to or from the node
+type message map[string]interface{}
+
+func (m message) str(key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func (m message) num(key string) (int64, bool) {
+	f, ok := m[key].(float64)
+	return int64(f), ok
+}
+
+// A connection to the node, after the handshake
+type conn struct {
+	c       net.Conn
+	w       *bufio.Writer
+	wlock   sync.Mutex
+	msgs    chan message
+	readErr chan error
+	timeout time.Duration
+	root    string
+	p2pID   int64
+	hello   message
+}
+
+// Returns a random positive 48-bit number, like the nodes' p2p IDs
+func randomID() int64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return int64(binary.BigEndian.Uint64(b[:]) & 0xffffffffffff)
+}
+
+// Returns a random trace ID
+func randomTraceID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// Connects to the node and reads its hello message
+func dial(cfg *Config) (*conn, error) {
+	c, err := net.DialTimeout("tcp", cfg.Address, cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	pc := &conn{
+		c:       c,
+		w:       bufio.NewWriter(c),
+		msgs:    make(chan message, 100),
+		readErr: make(chan error, 1),
+		timeout: cfg.Timeout,
+		p2pID:   randomID(),
+	}
+	go pc.read()
+	hello, err := pc.await("hello", nil)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("No hello message from the node: %v", err)
+	}
+	pc.hello = hello
+	pc.root = hello.str("root")
+	return pc, nil
+}
+
+// Reads the messages from the node, answering its pings
+func (pc *conn) read() {
+	r := bufio.NewReaderSize(pc.c, 64*1024)
+	for {
+		var line []byte
+		for {
+			frag, err := r.ReadSlice('\n')
+			if len(line)+len(frag) > maxMessageSize {
+				pc.readErr <- fmt.Errorf("The node sent a message longer than %d bytes", maxMessageSize)
+				return
+			}
+			line = append(line, frag...)
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil {
+				pc.readErr <- err
+				return
+			}
+			break
+		}
+		var msg message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			pc.readErr <- fmt.Errorf("The node sent invalid JSON: %v", err)
+			return
+		}
+		if msg.str("msg") == "ping" {
+			nonce, _ := msg.num("nonce")
+			go pc.send(message{"msg": "pong", "nonce": nonce})
+			continue
+		}
+		pc.msgs <- msg
+	}
+}
+
+// Sends the message, adding the header fields it doesn't have
+func (pc *conn) send(msg message) error {
+	if _, ok := msg["root"]; !ok {
+		msg["root"] = pc.root
+	}
+	if _, ok := msg["p2p_id"]; !ok {
+		msg["p2p_id"] = pc.p2pID
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return pc.sendRaw(append(data, '\n'))
+}
+
+// Sends the bytes as they are
+func (pc *conn) sendRaw(data []byte) error {
+	pc.wlock.Lock()
+	defer pc.wlock.Unlock()
+	pc.c.SetWriteDeadline(time.Now().Add(pc.timeout))
+	if _, err := pc.w.Write(data); err != nil {
+		return err
+	}
+	return pc.w.Flush()
+}
+
+// Waits for a message of the given type for which match returns true, if it isn't nil,
+// skipping the others
+func (pc *conn) await(msgType string, match func(message) bool) (message, error) {
+	return pc.awaitMatch("a "+msgType+" message", func(m message) bool {
+		return m.str("msg") == msgType && (match == nil || match(m))
+	})
+}
+
+// Waits for a message for which match returns true, skipping the others
+func (pc *conn) awaitMatch(what string, match func(message) bool) (message, error) {
+	deadline := time.After(pc.timeout)
+	for {
+		select {
+		case msg := <-pc.msgs:
+			if match(msg) {
+				return msg, nil
+			}
+		case err := <-pc.readErr:
+			pc.readErr <- err
+			return nil, err
+		case <-deadline:
+			return nil, fmt.Errorf("Timed out waiting for %s", what)
+		}
+	}
+}
+
+// Waits for the node to close the connection, skipping its messages
+func (pc *conn) awaitClose() error {
+	deadline := time.After(pc.timeout)
+	for {
+		select {
+		case <-pc.msgs:
+		case <-pc.readErr:
+			return nil
+		case <-deadline:
+			return fmt.Errorf("The node didn't close the connection")
+		}
+	}
+}
+
+// Sends our hello message
+func (pc *conn) sayHello() error {
+	return pc.send(message{
+		"msg":          "hello",
+		"version":      UserAgent,
+		"chain_height": 0,
+		"my_peers":     []string{},
+		"features":     []string{"ping"},
+	})
+}
+
+// Returns the block hashes in the blockhashes message
+func parseBlockHashes(msg message) (map[int]string, error) {
+	raw, ok := msg["hashes"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("The blockhashes message has no hashes object")
+	}
+	hashes := map[int]string{}
+	for k, v := range raw {
+		var h int
+		if _, err := fmt.Sscanf(k, "%d", &h); err != nil {
+			return nil, fmt.Errorf("Invalid height %q in blockhashes", k)
+		}
+		hash, ok := v.(string)
+		if !ok || !isHash(hash) {
+			return nil, fmt.Errorf("Invalid hash for height %d in blockhashes: %v", h, v)
+		}
+		hashes[h] = hash
+	}
+	return hashes, nil
+}
+
+// Returns the block hashes the node reports for the range of heights. The request has a
+// trace ID, which tells the answer from the blocks the node announces by itself.
+func (pc *conn) blockHashes(min, max int) (map[int]string, error) {
+	traceID := randomTraceID()
+	if err := pc.send(message{"msg": "getblockhashes", "trace_id": traceID, "min_block_height": min, "max_block_height": max}); err != nil {
+		return nil, err
+	}
+	msg, err := pc.await("blockhashes", func(m message) bool {
+		return strings.EqualFold(m.str("trace_id"), traceID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseBlockHashes(msg)
+}
+
+// Checks that the connection still works, by asking for the genesis block hash
+func (pc *conn) alive() error {
+	hashes, err := pc.blockHashes(0, 0)
+	if err != nil {
+		return fmt.Errorf("The connection stopped working: %v", err)
+	}
+	if len(hashes) == 0 {
+		return fmt.Errorf("The connection stopped working: no genesis block hash")
+	}
+	return nil
+}
+
+func (pc *conn) close() {
+	pc.c.Close()
+}
+
+// The hash algorithms of the chains, by the type prefixed to their hashes, e.g. "2:..."
+// for SHA3-256. SHA256 hashes have no prefix.
+var hashAlgorithms = map[int]func() hash.Hash{
+	1: sha256.New,
+	2: func() hash.Hash { return sha3.New256() },
+}
+
+// Parses a hash into its type and 32-byte digest. Hashes without a type prefix are SHA256.
+func parseHash(s string) (int, []byte, error) {
+	hashType := 1
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		var err error
+		if hashType, err = strconv.Atoi(s[:i]); err != nil || hashType < 2 {
+			return 0, nil, fmt.Errorf("Invalid hash type in %q", s)
+		}
+		s = s[i+1:]
+	}
+	digest, err := hex.DecodeString(s)
+	if err != nil || len(digest) != 32 {
+		return 0, nil, fmt.Errorf("Invalid hash %q", s)
+	}
+	return hashType, digest, nil
+}
+
+// Returns true if the string is a hash, of any type
+func isHash(s string) bool {
+	_, _, err := parseHash(s)
+	return err == nil
+}
+
+// The state shared by the checks
+type suite struct {
+	cfg    Config
+	report *Report
+	pc     *conn // the main connection, after the handshake
+	hashes map[int]string
+}
+
+// Runs the checks against the node
+func Run(cfg Config) *Report {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 15 * time.Second
+	}
+	if cfg.OversizeBytes == 0 {
+		cfg.OversizeBytes = 300 * 1024 * 1024
+	}
+	s := suite{cfg: cfg, report: &Report{Address: cfg.Address}}
+	checks := []struct {
+		name string
+		run  func() error
+	}{
+		{"handshake", s.checkHandshake},
+		{"getblockhashes", s.checkBlockHashes},
+		{"getheaders", s.checkHeaders},
+		{"getblock", s.checkBlock},
+		{"getblock-unknown", s.checkUnknownBlock},
+		{"ping", s.checkPing},
+		{"unknown-message", s.checkUnknownMessage},
+		{"wrong-chain", s.checkWrongChain},
+		{"malformed-fields", s.checkMalformedFields},
+		{"malformed-json", s.checkMalformedJSON},
+		{"oversized-message", s.checkOversized},
+		{"still-serving", s.checkStillServing},
+	}
+	for _, c := range checks {
+		start := time.Now()
+		var err error
+		if s.pc == nil && c.name != "handshake" && c.name != "malformed-json" && c.name != "oversized-message" && c.name != "still-serving" {
+			err = errSkip{"the handshake failed"}
+		} else {
+			err = c.run()
+		}
+		r := Result{Name: c.name, Passed: err == nil, Duration: time.Since(start).Seconds()}
+		if skip, ok := err.(errSkip); ok {
+			r.Passed, r.Skipped, r.Detail = true, true, skip.reason
+			s.report.Skipped++
+		} else if err != nil {
+			r.Detail = err.Error()
+			s.report.Failed++
+		} else {
+			s.report.Passed++
+		}
+		s.report.Results = append(s.report.Results, r)
+	}
+	if s.pc != nil {
+		s.pc.close()
+	}
+	return s.report
+}
+
+// Returns true if the node announced the feature
+func (s *suite) hasFeature(feature string) bool {
+	for _, f := range s.report.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// The node sends a well-formed hello message, and accepts ours
+func (s *suite) checkHandshake() error {
+	pc, err := dial(&s.cfg)
+	if err != nil {
+		return err
+	}
+	hello := pc.hello
+	s.report.UserAgent = hello.str("version")
+	s.report.Root = pc.root
+	height, ok := hello.num("chain_height")
+	s.report.ChainHeight = int(height)
+	if features, ok := hello["features"].([]interface{}); ok {
+		for _, f := range features {
+			if fs, ok := f.(string); ok {
+				s.report.Features = append(s.report.Features, fs)
+			}
+		}
+	}
+	var problems []string
+	if !isHash(pc.root) {
+		problems = append(problems, "the root isn't a hash")
+	} else if s.cfg.Root != "" && !strings.EqualFold(pc.root, s.cfg.Root) {
+		problems = append(problems, "the node is on the chain "+pc.root)
+	}
+	if !ok || height < 0 {
+		problems = append(problems, "no valid chain_height")
+	}
+	if s.report.UserAgent == "" {
+		problems = append(problems, "no version")
+	}
+	if _, ok := hello.num("p2p_id"); !ok {
+		problems = append(problems, "no p2p_id")
+	}
+	if len(problems) > 0 {
+		pc.close()
+		return fmt.Errorf("Invalid hello message: %s", strings.Join(problems, ", "))
+	}
+	if err = pc.sayHello(); err != nil {
+		pc.close()
+		return err
+	}
+	if err = pc.alive(); err != nil {
+		pc.close()
+		return fmt.Errorf("The node didn't accept our hello: %v", err)
+	}
+	s.pc = pc
+	return nil
+}
+
+// The node reports the hashes of the latest blocks, and the genesis block's is the root
+func (s *suite) checkBlockHashes() error {
+	min := s.report.ChainHeight - queryBlocks + 1
+	if min < 0 {
+		min = 0
+	}
+	hashes, err := s.pc.blockHashes(min, s.report.ChainHeight)
+	if err != nil {
+		return err
+	}
+	for h := min; h <= s.report.ChainHeight; h++ {
+		if _, ok := hashes[h]; !ok {
+			return fmt.Errorf("No hash for block %d", h)
+		}
+	}
+	for h := range hashes {
+		if h < min || h > s.report.ChainHeight {
+			return fmt.Errorf("A hash for block %d, outside of the range asked for", h)
+		}
+	}
+	genesis, err := s.pc.blockHashes(0, 0)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(genesis[0], s.pc.root) {
+		return fmt.Errorf("The genesis block hash %s isn't the root %s", genesis[0], s.pc.root)
+	}
+	s.hashes = hashes
+	return nil
+}
+
+// The node returns the headers of the latest blocks, which match their hashes and link up
+func (s *suite) checkHeaders() error {
+	if len(s.hashes) == 0 {
+		return errSkip{"no block hashes"}
+	}
+	min := s.report.ChainHeight - len(s.hashes) + 1
+	if err := s.pc.send(message{"msg": "getheaders", "min_block_height": min, "max_block_height": s.report.ChainHeight}); err != nil {
+		return err
+	}
+	msg, err := s.pc.await("headers", nil)
+	if err != nil {
+		return err
+	}
+	var headers []struct {
+		Height            int    `json:"height"`
+		Hash              string `json:"hash"`
+		PreviousBlockHash string `json:"previous_block_hash"`
+	}
+	data, _ := json.Marshal(msg["headers"])
+	if err = json.Unmarshal(data, &headers); err != nil {
+		return fmt.Errorf("Invalid headers: %v", err)
+	}
+	if len(headers) != len(s.hashes) {
+		return fmt.Errorf("%d headers instead of %d", len(headers), len(s.hashes))
+	}
+	for _, hdr := range headers {
+		if !strings.EqualFold(hdr.Hash, s.hashes[hdr.Height]) {
+			return fmt.Errorf("The header of block %d has the hash %s, but blockhashes said %s", hdr.Height, hdr.Hash, s.hashes[hdr.Height])
+		}
+		if prev, ok := s.hashes[hdr.Height-1]; ok && !strings.EqualFold(hdr.PreviousBlockHash, prev) {
+			return fmt.Errorf("The header of block %d doesn't link to block %d", hdr.Height, hdr.Height-1)
+		}
+	}
+	return nil
+}
+
+// The node sends the latest block, whose contents match its hash and size
+func (s *suite) checkBlock() error {
+	hash, ok := s.hashes[s.report.ChainHeight]
+	if !ok {
+		return errSkip{"no block hashes"}
+	}
+	if err := s.pc.send(message{"msg": "getblock", "hash": hash}); err != nil {
+		return err
+	}
+	msg, err := s.pc.await("block", func(m message) bool {
+		return strings.EqualFold(m.str("hash"), hash)
+	})
+	if err != nil {
+		return err
+	}
+	size, ok := msg.num("size")
+	if !ok {
+		return fmt.Errorf("The block message has no size")
+	}
+	var body io.Reader
+	switch encoding := msg.str("encoding"); encoding {
+	case "zlib-base64":
+		zdata, err := base64.StdEncoding.DecodeString(msg.str("data"))
+		if err != nil {
+			return fmt.Errorf("Invalid base64 block data: %v", err)
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(zdata))
+		if err != nil {
+			return fmt.Errorf("Invalid zlib block data: %v", err)
+		}
+		defer zr.Close()
+		body = zr
+	case "http":
+		client := http.Client{Timeout: s.cfg.Timeout}
+		resp, err := client.Get(msg.str("data"))
+		if err != nil {
+			return fmt.Errorf("Cannot get the block from %s: %v", msg.str("data"), err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Cannot get the block from %s: %s", msg.str("data"), resp.Status)
+		}
+		body = resp.Body
+	default:
+		return fmt.Errorf("Unknown block encoding %q", encoding)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, size+1))
+	if err != nil {
+		return fmt.Errorf("Cannot decode the block: %v", err)
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("The block has %d bytes, but the message says %d", len(data), size)
+	}
+	hashType, digest, err := parseHash(hash)
+	if err != nil {
+		return err
+	}
+	newHash, ok := hashAlgorithms[hashType]
+	if !ok {
+		return fmt.Errorf("Cannot check the block with the unknown hash type %d", hashType)
+	}
+	h := newHash()
+	h.Write(data)
+	if !bytes.Equal(h.Sum(nil), digest) {
+		return fmt.Errorf("The block's contents don't match its hash")
+	}
+	return nil
+}
+
+// The node doesn't send a block it doesn't have, and keeps the connection
+func (s *suite) checkUnknownBlock() error {
+	var b [32]byte
+	rand.Read(b[:])
+	hash := hex.EncodeToString(b[:])
+	if err := s.pc.send(message{"msg": "getblock", "hash": hash}); err != nil {
+		return err
+	}
+	// The answer to the next request must come without the block
+	probeID := randomTraceID()
+	if err := s.pc.send(message{"msg": "getblockhashes", "trace_id": probeID, "min_block_height": 0, "max_block_height": 0}); err != nil {
+		return err
+	}
+	msg, err := s.pc.awaitMatch("the answer to getblockhashes", func(m message) bool {
+		return m.str("msg") == "block" && strings.EqualFold(m.str("hash"), hash) ||
+			m.str("msg") == "blockhashes" && strings.EqualFold(m.str("trace_id"), probeID)
+	})
+	if err != nil {
+		return fmt.Errorf("The connection stopped working: %v", err)
+	}
+	if msg.str("msg") == "block" {
+		return fmt.Errorf("The node sent a block it can't have")
+	}
+	return nil
+}
+
+// The node answers a ping with a pong with the same nonce
+func (s *suite) checkPing() error {
+	if !s.hasFeature("ping") {
+		return errSkip{"the node doesn't announce the ping feature"}
+	}
+	nonce := randomID()
+	if err := s.pc.send(message{"msg": "ping", "nonce": nonce}); err != nil {
+		return err
+	}
+	_, err := s.pc.await("pong", func(m message) bool {
+		n, _ := m.num("nonce")
+		return n == nonce
+	})
+	return err
+}
+
+// The node ignores a message type it doesn't know
+func (s *suite) checkUnknownMessage() error {
+	if err := s.pc.send(message{"msg": "prototest-unknown", "data": "x"}); err != nil {
+		return err
+	}
+	return s.pc.alive()
+}
+
+// The node ignores a message for another chain
+func (s *suite) checkWrongChain() error {
+	var b [32]byte
+	rand.Read(b[:])
+	traceID := randomTraceID()
+	if err := s.pc.send(message{"msg": "getblockhashes", "root": hex.EncodeToString(b[:]), "trace_id": traceID, "min_block_height": 0, "max_block_height": 0}); err != nil {
+		return err
+	}
+	// The answer to a request for this chain, sent next, must come without the other one
+	probeID := randomTraceID()
+	if err := s.pc.send(message{"msg": "getblockhashes", "trace_id": probeID, "min_block_height": 0, "max_block_height": 0}); err != nil {
+		return err
+	}
+	msg, err := s.pc.await("blockhashes", func(m message) bool {
+		id := m.str("trace_id")
+		return strings.EqualFold(id, traceID) || strings.EqualFold(id, probeID)
+	})
+	if err != nil {
+		return fmt.Errorf("The connection stopped working: %v", err)
+	}
+	if strings.EqualFold(msg.str("trace_id"), traceID) {
+		return fmt.Errorf("The node answered a message for another chain")
+	}
+	return nil
+}
+
+// The node survives messages whose fields have the wrong types, or are missing
+func (s *suite) checkMalformedFields() error {
+	malformed := []message{
+		{"msg": "getblockhashes", "min_block_height": "zero", "max_block_height": []int{1}},
+		{"msg": "getblock", "hash": 12345},
+		{"msg": "getheaders"},
+		{"msg": "blockhashes", "hashes": "none"},
+		{"msg": "block", "hash": strings.Repeat("0", 64), "data": 7, "encoding": "none"},
+		{"msg": "ping", "nonce": "x"},
+	}
+	for _, msg := range malformed {
+		if err := s.pc.send(msg); err != nil {
+			return err
+		}
+	}
+	if err := s.pc.alive(); err != nil {
+		return err
+	}
+	return s.checkServing()
+}
+
+// The node drops a connection which sends invalid JSON
+func (s *suite) checkMalformedJSON() error {
+	pc, err := dial(&s.cfg)
+	if err != nil {
+		return err
+	}
+	defer pc.close()
+	if err = pc.sendRaw([]byte("{\"msg\": \"hello\", this isn't JSON\n")); err != nil {
+		return err
+	}
+	return pc.awaitClose()
+}
+
+// The node drops a connection which sends a message larger than it accepts, without
+// reading all of it
+func (s *suite) checkOversized() error {
+	pc, err := dial(&s.cfg)
+	if err != nil {
+		return err
+	}
+	defer pc.close()
+	prefix := fmt.Sprintf("{\"msg\":\"prototest-oversized\",\"root\":%q,\"p2p_id\":%d,\"data\":\"", pc.root, pc.p2pID)
+	if err = pc.sendRaw([]byte(prefix)); err != nil {
+		return err
+	}
+	chunk := bytes.Repeat([]byte("a"), 1024*1024)
+	for sent := int64(len(prefix)); sent < s.cfg.OversizeBytes; sent += int64(len(chunk)) {
+		if err = pc.sendRaw(chunk); err != nil {
+			// Dropped by the node
+			return nil
+		}
+	}
+	if err = pc.sendRaw([]byte("\"}\n")); err != nil {
+		return nil
+	}
+	if err = pc.awaitClose(); err != nil {
+		return fmt.Errorf("The node accepted a message of %d bytes", s.cfg.OversizeBytes)
+	}
+	return nil
+}
+
+// The node still accepts connections after the abuse
+func (s *suite) checkStillServing() error {
+	return s.checkServing()
+}
+
+// Checks that a new connection gets a hello
+func (s *suite) checkServing() error {
+	pc, err := dial(&s.cfg)
+	if err != nil {
+		return fmt.Errorf("The node stopped accepting connections: %v", err)
+	}
+	pc.close()
+	return nil
+}
+
+// ErrFailed is returned by RunAndPrint when a check has failed
+var ErrFailed = errors.New("The node doesn't conform to the protocol")
+
+// Runs the checks and writes the report to w, as JSON or as text
+func RunAndPrint(cfg Config, w io.Writer, asJSON bool) error {
+	report := Run(cfg)
+	if asJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(data))
+	} else {
+		fmt.Fprintf(w, "Node:      %s (%s)\n", report.Address, report.UserAgent)
+		fmt.Fprintf(w, "Chain:     %s at height %d\n", report.Root, report.ChainHeight)
+		fmt.Fprintf(w, "Features:  %s\n", strings.Join(report.Features, ", "))
+		for _, r := range report.Results {
+			status := "PASS"
+			if r.Skipped {
+				status = "SKIP"
+			} else if !r.Passed {
+				status = "FAIL"
+			}
+			line := fmt.Sprintf("%s  %-18s %6.2fs", status, r.Name, r.Duration)
+			if r.Detail != "" {
+				line += "  " + r.Detail
+			}
+			fmt.Fprintln(w, line)
+		}
+		fmt.Fprintf(w, "%d passed, %d failed, %d skipped\n", report.Passed, report.Failed, report.Skipped)
+	}
+	if !report.OK() {
+		return ErrFailed
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package daisy
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Damaged or unaccounted-for block files are moved to this subdirectory of the data directory
+const quarantineSubdirectoryBaseName = "quarantine"
+
+// Moves the given block file into the quarantine directory, under a name which records
+// its height and the time it was quarantined.
+func quarantineBlockFile(fileName string, height int) error {
+	quarantineDir := filepath.Join(cfg.DataDir, quarantineSubdirectoryBaseName)
+	if err := os.MkdirAll(quarantineDir, 0700); err != nil {
+		return err
+	}
+	dest := filepath.Join(quarantineDir, fmt.Sprintf("block_%08x_%d.db", height, time.Now().Unix()))
+	log.Println("Quarantining block file", fileName, "to", dest)
+	return moveFile(fileName, dest)
+}
+
+// Quarantines all the blocks from the given height to the top of the blockchain, and rolls
+// back the blockchain index so that the block at height-1 is the last one.
+func blockchainQuarantineFrom(height int) error {
+	maxHeight := dbGetBlockchainHeight()
+	for h := maxHeight; h >= height; h-- {
+		fileName := blockchainGetFilename(h)
+		if !fileExists(fileName) {
+			continue
+		}
+		if err := quarantineBlockFile(fileName, h); err != nil {
+			return err
+		}
+	}
+	return dbRollbackToHeight(height - 1)
+}
+
+// Quarantines block files which exist beyond the top of the blockchain index. These are
+// usually left behind if the process was interrupted while importing a block.
+func blockchainQuarantineStrayFiles() {
+	for h := dbGetBlockchainHeight() + 1; ; h++ {
+		fileName := blockchainGetFilename(h)
+		if !fileExists(fileName) {
+			return
+		}
+		if err := quarantineBlockFile(fileName, h); err != nil {
+			log.Println("Cannot quarantine stray block file", fileName, err)
+			return
+		}
+	}
+}
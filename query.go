@@ -0,0 +1,181 @@
+package daisy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// The queries over the blocks come from the command line, the HTTP API and embedding
+// programs, so they're run through their own SQLite driver, whose connections can't
+// attach other databases, and whose authorizer only allows reading tables and calling
+// functions. This keeps the queries out of the system databases (the private keys
+// among them) and away from the file system, which the read-only mode of the block
+// files alone doesn't: it doesn't apply to attached databases. Only one statement is
+// accepted, and it must be a read-only one.
+
+// The name under which the driver for the queries is registered
+const queryDriverName = "sqlite3_daisy_query"
+
+// SQLITE_RECURSIVE, which go-sqlite3 doesn't define, is authorized for recursive CTEs
+const sqliteRecursive = 33
+
+var errQueryNotReadOnly = errors.New("Only read-only queries can be run over the blocks")
+
+func init() {
+	sql.Register(queryDriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			conn.SetLimit(sqlite3.SQLITE_LIMIT_ATTACHED, 0)
+			conn.RegisterAuthorizer(queryAuthorizer)
+			return nil
+		},
+	})
+}
+
+// Allows the queries to select, read tables and call functions, and nothing else
+func queryAuthorizer(op int, arg1, arg2, arg3 string) int {
+	switch op {
+	case sqlite3.SQLITE_SELECT, sqlite3.SQLITE_READ, sqlite3.SQLITE_FUNCTION, sqliteRecursive:
+		return sqlite3.SQLITE_OK
+	}
+	return sqlite3.SQLITE_DENY
+}
+
+// Checks that the query is a single statement, i.e. that it doesn't contain semicolons
+// other than at its end, outside of string literals, quoted identifiers and comments.
+// Returns the query without the semicolons at its end.
+func queryCheck(q string) (string, error) {
+	q = strings.TrimRight(strings.TrimSpace(q), "; \t\r\n")
+	if q == "" {
+		return "", fmt.Errorf("The query is empty")
+	}
+	for i := 0; i < len(q); i++ {
+		var end string
+		switch {
+		case q[i] == '\'' || q[i] == '"' || q[i] == '`':
+			end = q[i : i+1]
+		case q[i] == '[':
+			end = "]"
+		case strings.HasPrefix(q[i:], "--"):
+			end = "\n"
+		case strings.HasPrefix(q[i:], "/*"):
+			end = "*/"
+			i++
+		case q[i] == ';':
+			return "", fmt.Errorf("Only a single statement can be run over the blocks")
+		default:
+			continue
+		}
+		// Doubled quotes inside literals are skipped over as two literals
+		n := strings.Index(q[i+1:], end)
+		if n == -1 {
+			return q, nil
+		}
+		i += n + len(end)
+	}
+	return q, nil
+}
+
+// Runs the given SQL query over all the blocks, from the newest to the oldest, and calls
+// rowFunc for each result row. Blocks where the query fails (e.g. because a table doesn't
+// exist) are skipped. Returns the number of blocks in which the query failed.
+func blockchainQuery(q string, rowFunc func(height int, row map[string]interface{}) error) (int, error) {
+	q, err := queryCheck(q)
+	if err != nil {
+		return 0, err
+	}
+	errCount := 0
+	for h := dbGetBlockchainHeight(); h > 0; h-- {
+		failed, err := blockchainQueryBlock(h, q, rowFunc)
+		if err != nil {
+			return errCount, err
+		}
+		if failed {
+			errCount++
+		}
+	}
+	return errCount, nil
+}
+
+// Runs the query in the block at the given height. Returns true if the query failed in
+// the block.
+func blockchainQueryBlock(height int, q string, rowFunc func(height int, row map[string]interface{}) error) (bool, error) {
+	db, err := sql.Open(queryDriverName, sqliteFileURI(blockchainGetFilename(height))+"?mode=ro")
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return true, nil
+	}
+	defer conn.Close()
+	err = conn.Raw(func(driverConn interface{}) error {
+		stmt, err := driverConn.(*sqlite3.SQLiteConn).Prepare(q)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		if !stmt.(*sqlite3.SQLiteStmt).Readonly() {
+			return errQueryNotReadOnly
+		}
+		return nil
+	})
+	if err == errQueryNotReadOnly {
+		return false, err
+	}
+	if err != nil {
+		return true, nil
+	}
+	rows, err := conn.QueryContext(ctx, q)
+	if err != nil {
+		return true, nil
+	}
+	defer rows.Close()
+	return false, blockchainQueryRows(height, rows, rowFunc)
+}
+
+type sqlRows interface {
+	Columns() ([]string, error)
+	Next() bool
+	Scan(dest ...interface{}) error
+}
+
+// Converts the rows of a query result into maps and passes them to rowFunc
+func blockchainQueryRows(height int, rows sqlRows, rowFunc func(height int, row map[string]interface{}) error) error {
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		columns := make([]interface{}, len(cols))
+		columnPointers := make([]interface{}, len(cols))
+		for i := range columns {
+			columnPointers[i] = &columns[i]
+		}
+		if err := rows.Scan(columnPointers...); err != nil {
+			return err
+		}
+		row := make(map[string]interface{})
+		for i, colName := range cols {
+			val := columnPointers[i].(*interface{})
+			if *val != nil && reflect.TypeOf(*val).String() == "[]uint8" {
+				row[colName] = string((*val).([]byte))
+			} else {
+				row[colName] = *val
+			}
+		}
+		if err = rowFunc(height, row); err != nil {
+			log.Println("blockchainQuery:", err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package daisy
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueryCheck(t *testing.T) {
+	for _, q := range []string{
+		"SELECT 1",
+		"SELECT 1;",
+		"SELECT ';' FROM t;; ",
+		"SELECT \"a;b\", [c;d], `e;f` FROM t",
+		"SELECT 'it''s; fine' -- no; more\n FROM t",
+		"SELECT /* ; */ 1",
+	} {
+		if _, err := queryCheck(q); err != nil {
+			t.Errorf("%q: %v", q, err)
+		}
+	}
+	for _, q := range []string{
+		"",
+		" ; ",
+		"SELECT 1; DELETE FROM t",
+		"SELECT 'a'; ATTACH 'x' AS y",
+		"SELECT /* ; */ 1; SELECT 2",
+	} {
+		if _, err := queryCheck(q); err == nil {
+			t.Errorf("%q was accepted", q)
+		}
+	}
+}
+
+func TestQueryDriver(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"block.db", "secret.db"} {
+		db, err := sql.Open("sqlite3", filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.Exec("CREATE TABLE t (k VARCHAR); INSERT INTO t VALUES ('x')"); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+	db, err := sql.Open(queryDriverName, sqliteFileURI(filepath.Join(dir, "block.db"))+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var k string
+	if err = db.QueryRow("WITH RECURSIVE r(n) AS (SELECT 1 UNION ALL SELECT n+1 FROM r WHERE n < 3) SELECT k FROM t, r WHERE n = 3").Scan(&k); err != nil || k != "x" {
+		t.Errorf("SELECT: %q, %v", k, err)
+	}
+	for _, q := range []string{
+		"ATTACH '" + filepath.Join(dir, "secret.db") + "' AS p",
+		"ATTACH '" + filepath.Join(dir, "new.db") + "' AS n",
+		"DELETE FROM t",
+		"CREATE TABLE z (a)",
+		"PRAGMA writable_schema = 1",
+	} {
+		if _, err = db.Exec(q); err == nil {
+			t.Errorf("%q was allowed", q)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "new.db")); err == nil {
+		t.Error("a new database file was created")
+	}
+}
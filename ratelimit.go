@@ -0,0 +1,168 @@
+package daisy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// The query endpoints of the HTTP API can be limited per client (a token or certificate
+// name, or the IP address of anonymous clients): the request rate with a token bucket,
+// the number of concurrent requests, and the size of the responses. There is also a cap
+// on the total number of concurrent requests. Clients with the admin role are not limited.
+// All the limits are off by default.
+
+// DefaultHTTPRateBurst is the default number of requests a client can make in a burst
+const DefaultHTTPRateBurst = 10
+
+// Above this number of tracked clients, the idle ones are forgotten
+const httpMaxTrackedClients = 10000
+
+var errHTTPResponseTooLarge = errors.New("Response size limit reached")
+
+type httpClientQuota struct {
+	tokens float64
+	last   time.Time
+	active int
+}
+
+var httpQuotas = struct {
+	lock    WithMutex
+	clients map[string]*httpClientQuota
+	active  int
+}{
+	clients: map[string]*httpClientQuota{},
+}
+
+// Returns true if any of the limits is configured
+func httpLimitsEnabled() bool {
+	return tunableHTTPRateLimit() > 0 || cfg.HTTPMaxConcurrent > 0 || cfg.HTTPMaxConcurrentPerClient > 0 || tunableHTTPMaxResponseBytes() > 0
+}
+
+// Returns the key under which the client's quota is kept
+func httpClientKey(r *http.Request, name string) string {
+	if name != "" {
+		return "name:" + name
+	}
+	host, _, err := splitAddress(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Forgets the clients which are idle and have a full bucket. Called with the lock held.
+func httpQuotasPrune(now time.Time, rateLimit float64) {
+	for key, q := range httpQuotas.clients {
+		if q.active == 0 && (rateLimit == 0 || now.Sub(q.last).Seconds()*rateLimit >= float64(cfg.HTTPRateBurst)) {
+			delete(httpQuotas.clients, key)
+		}
+	}
+}
+
+// Takes a request from the client's quota. Returns the HTTP status code with which the
+// request should be rejected and the number of seconds after which it can be retried,
+// or 0 if the request can proceed, in which case httpQuotaRelease() must be called after it.
+func httpQuotaAcquire(key string) (int, int) {
+	status, retryAfter := 0, 0
+	now := time.Now()
+	rateLimit := tunableHTTPRateLimit()
+	httpQuotas.lock.With(func() {
+		q, ok := httpQuotas.clients[key]
+		if !ok {
+			if len(httpQuotas.clients) >= httpMaxTrackedClients {
+				httpQuotasPrune(now, rateLimit)
+			}
+			q = &httpClientQuota{tokens: float64(cfg.HTTPRateBurst), last: now}
+			httpQuotas.clients[key] = q
+		}
+		if cfg.HTTPMaxConcurrent > 0 && httpQuotas.active >= cfg.HTTPMaxConcurrent {
+			status, retryAfter = http.StatusServiceUnavailable, 1
+			return
+		}
+		if cfg.HTTPMaxConcurrentPerClient > 0 && q.active >= cfg.HTTPMaxConcurrentPerClient {
+			status, retryAfter = http.StatusTooManyRequests, 1
+			return
+		}
+		if rateLimit > 0 {
+			q.tokens = math.Min(float64(cfg.HTTPRateBurst), q.tokens+now.Sub(q.last).Seconds()*rateLimit)
+			q.last = now
+			if q.tokens < 1 {
+				status, retryAfter = http.StatusTooManyRequests, int(math.Ceil((1-q.tokens)/rateLimit))
+				return
+			}
+			q.tokens--
+		}
+		q.active++
+		httpQuotas.active++
+	})
+	return status, retryAfter
+}
+
+func httpQuotaRelease(key string) {
+	httpQuotas.lock.With(func() {
+		if q, ok := httpQuotas.clients[key]; ok {
+			q.active--
+		}
+		httpQuotas.active--
+	})
+}
+
+// limitedResponseWriter fails the writes after the given number of bytes
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	remaining int64
+	sent      bool
+	truncated bool
+}
+
+func (lw *limitedResponseWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > lw.remaining {
+		if !lw.truncated && !lw.sent {
+			// Nothing has been sent yet, so the client can be told why
+			http.Error(lw.ResponseWriter, "Response too large, request a smaller range", http.StatusInternalServerError)
+		}
+		lw.truncated = true
+		return 0, errHTTPResponseTooLarge
+	}
+	lw.remaining -= int64(len(b))
+	lw.sent = true
+	return lw.ResponseWriter.Write(b)
+}
+
+// Flush is needed by the streaming handlers
+func (lw *limitedResponseWriter) Flush() {
+	if f, ok := lw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Wraps the handler so that the requests are subject to the clients' quotas
+func httpLimit(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		role, name := httpRequestRole(r)
+		if !httpLimitsEnabled() || role >= httpRoleAdmin {
+			h(w, r)
+			return
+		}
+		key := httpClientKey(r, name)
+		if status, retryAfter := httpQuotaAcquire(key); status != 0 {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+			w.WriteHeader(status)
+			return
+		}
+		defer httpQuotaRelease(key)
+		if maxBytes := tunableHTTPMaxResponseBytes(); maxBytes > 0 {
+			lw := limitedResponseWriter{ResponseWriter: w, remaining: maxBytes}
+			h(&lw, r)
+			if lw.truncated {
+				log.Println("HTTP response to", key, "for", r.URL.Path, "truncated at", maxBytes, "bytes")
+			}
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,335 @@
+package daisy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Receipts are portable proofs that a document existed at the time a block was created.
+// Like RFC 3161 timestamp tokens, a receipt binds a message imprint (the document's hash)
+// to a time and a signer, but the trust comes from the chain: the receipt carries the
+// Merkle inclusion proof of the document in its block, the block's header, and the headers
+// of the following blocks which confirm it. Receipts can be verified without a running node.
+//
+// The block's timestamp and documents root are bound to it by the seal signature, which
+// signs the canonical seal (see canonical.go) of the chain root, the block's height and
+// previous block hash, its timestamp and its documents root. The seal can't contain the
+// block's own hash, as it is stored in the block, but the previous block hash and the
+// height pin the block to one place in the chain, and the confirmations link to its hash.
+
+// The version of the receipt file format
+const receiptVersion = 1
+
+// The number of confirming headers included in receipts by default
+const receiptDefaultConfirmations = 6
+
+// BlockHeader is the portable description of a block, containing everything needed to
+// verify its signatures without the block file.
+type BlockHeader struct {
+	Height                     int    `json:"height"`
+	Hash                       string `json:"hash"`
+	HashSignature              string `json:"hash_signature"`
+	PreviousBlockHash          string `json:"previous_block_hash"`
+	PreviousBlockHashSignature string `json:"previous_block_hash_signature"`
+	CreatorPublicKeyHash       string `json:"creator_public_key_hash"`
+	CreatorPublicKey           string `json:"creator_public_key"`
+	Timestamp                  string `json:"timestamp"`
+	DocumentsRoot              string `json:"documents_root,omitempty"`
+	DocumentsRootSignature     string `json:"documents_root_signature,omitempty"`
+	SealSignature              string `json:"seal_signature,omitempty"`
+	HeaderHash                 string `json:"header_hash,omitempty"`
+}
+
+// TimestampReceipt is the content of a receipt file
+type TimestampReceipt struct {
+	Version       int               `json:"version"`
+	HashAlgorithm string            `json:"hash_algorithm"`
+	ChainRoot     string            `json:"chain_root"`
+	DocumentHash  string            `json:"document_hash"`
+	DocumentName  string            `json:"document_name"`
+	DocumentSize  int64             `json:"document_size"`
+	MerkleProof   []MerkleProofStep `json:"merkle_proof"`
+	Block         BlockHeader       `json:"block"`
+	Confirmations []BlockHeader     `json:"confirmations"`
+}
+
+// Returns the hashes of the documents (attachments) in the block, sorted
+func (b *Block) dbGetDocumentHashes() ([]string, error) {
+	atts, err := b.dbGetAttachments()
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(atts))
+	for i, att := range atts {
+		hashes[i] = att.hash
+	}
+	return hashes, nil
+}
+
+// Checks that the documents root recorded in the block's metadata, if any, matches its
+// documents and is signed by the given key.
+func (b *Block) dbVerifyDocumentsRoot(creatorKeyBytes []byte) error {
+	root, err := b.dbGetMetaString("DocumentsRoot")
+	if err != nil {
+		// Blocks without documents don't have a documents root
+		return nil
+	}
+	hashes, err := b.dbGetDocumentHashes()
+	if err != nil {
+		return err
+	}
+	if len(hashes) == 0 {
+		return fmt.Errorf("Block has a documents root but no documents")
+	}
+	actualRoot, _, err := merkleRootAndProof(hashes, -1)
+	if err != nil {
+		return err
+	}
+	if actualRoot != root {
+		return fmt.Errorf("Documents root doesn't match: %s vs %s", root, actualRoot)
+	}
+	signature, err := b.dbGetMetaString("DocumentsRootSignature")
+	if err != nil {
+		return fmt.Errorf("Documents root is not signed")
+	}
+	creatorKey, err := cryptoDecodePublicKeyBytes(creatorKeyBytes)
+	if err != nil {
+		return err
+	}
+	return cryptoVerifyHex(creatorKey, root, signature)
+}
+
+// Checks the block's seal signature, if it has one, made by the given key for a block at
+// the given height
+func (b *Block) dbVerifySeal(height int, creatorKeyBytes []byte) error {
+	signature, err := b.dbGetMetaString("SealSignature")
+	if err != nil {
+		// Blocks made by older nodes aren't sealed
+		return nil
+	}
+	hdr := BlockHeader{Height: height, PreviousBlockHash: b.PreviousBlockHash}
+	if hdr.Timestamp, err = b.dbGetMetaString("Timestamp"); err != nil {
+		return fmt.Errorf("Sealed block has no timestamp")
+	}
+	hdr.DocumentsRoot, _ = b.dbGetMetaString("DocumentsRoot")
+	creatorKey, err := cryptoDecodePublicKeyBytes(creatorKeyBytes)
+	if err != nil {
+		return err
+	}
+	return cryptoVerifyHex(creatorKey, hashBytesToHexString(canonicalSealBytes(chainParams.GenesisBlockHash, &hdr)), signature)
+}
+
+// Returns the part of the block header which is stored in the blockchain table
+func blockHeaderFromDb(dbb *DbBlockchainBlock) BlockHeader {
+	hdr := BlockHeader{
+		Height:                     dbb.Height,
+		Hash:                       dbb.Hash,
+		HashSignature:              hex.EncodeToString(dbb.HashSignature),
+		PreviousBlockHash:          dbb.PreviousBlockHash,
+		PreviousBlockHashSignature: hex.EncodeToString(dbb.PreviousBlockHashSignature),
+		CreatorPublicKeyHash:       dbb.SignaturePublicKeyHash,
+		Timestamp:                  dbb.TimeAccepted.UTC().Format(time.RFC3339),
+	}
+	hdr.HeaderHash = canonicalHeaderHash(&hdr)
+	return hdr
+}
+
+// Returns the header of the block at the given height
+func blockchainGetHeader(height int) (*BlockHeader, error) {
+	dbb, err := dbGetBlockByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	dbpk, err := dbGetPublicKey(dbb.SignaturePublicKeyHash)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get public key %s: %v", dbb.SignaturePublicKeyHash, err)
+	}
+	hdr := blockHeaderFromDb(dbb)
+	hdr.CreatorPublicKey = hex.EncodeToString(dbpk.publicKeyBytes)
+	b, err := OpenBlockByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+	if ts, err := b.dbGetMetaString("Timestamp"); err == nil {
+		hdr.Timestamp = ts
+	}
+	if root, err := b.dbGetMetaString("DocumentsRoot"); err == nil {
+		hdr.DocumentsRoot = root
+		hdr.DocumentsRootSignature, _ = b.dbGetMetaString("DocumentsRootSignature")
+	}
+	hdr.SealSignature, _ = b.dbGetMetaString("SealSignature")
+	return &hdr, nil
+}
+
+// Returns the headers of the blocks in the given range of heights, up to p2pMaxHeadersPerMsg
+func blockchainGetHeaders(minHeight, maxHeight int) ([]BlockHeader, error) {
+	if maxHeight-minHeight >= p2pMaxHeadersPerMsg {
+		maxHeight = minHeight + p2pMaxHeadersPerMsg - 1
+	}
+	headers := []BlockHeader{}
+	for h := minHeight; h <= maxHeight && dbBlockHeightExists(h); h++ {
+		hdr, err := blockchainGetAnyHeader(h)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, *hdr)
+	}
+	return headers, nil
+}
+
+// Returns the header of the block at the height, or the part of it from the blockchain
+// table if the block file isn't there
+func blockchainGetAnyHeader(h int) (*BlockHeader, error) {
+	if fileExists(blockchainGetFilename(h)) {
+		hdr, err := blockchainGetHeader(h)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot get header for block %d: %v", h, err)
+		}
+		return hdr, nil
+	}
+	// Relays only have the part of the header from the blockchain table
+	dbb, err := dbGetBlockByHeight(h)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get header for block %d: %v", h, err)
+	}
+	hdr := blockHeaderFromDb(dbb)
+	return &hdr, nil
+}
+
+// Verifies the signatures in the block header against the public key it carries. The
+// seal is verified for the chain with the given root (genesis block hash).
+func (hdr *BlockHeader) Verify(chainRoot string) error {
+	publicKeyBytes, err := hex.DecodeString(hdr.CreatorPublicKey)
+	if err != nil {
+		return err
+	}
+	if getPubKeyHash(publicKeyBytes) != hdr.CreatorPublicKeyHash {
+		return fmt.Errorf("block %d: public key doesn't match its hash %s", hdr.Height, hdr.CreatorPublicKeyHash)
+	}
+	publicKey, err := cryptoDecodePublicKeyBytes(publicKeyBytes)
+	if err != nil {
+		return err
+	}
+	if err = cryptoVerifyHex(publicKey, hdr.Hash, hdr.HashSignature); err != nil {
+		return fmt.Errorf("block %d: invalid block hash signature: %v", hdr.Height, err)
+	}
+	if err = cryptoVerifyHex(publicKey, hdr.PreviousBlockHash, hdr.PreviousBlockHashSignature); err != nil {
+		return fmt.Errorf("block %d: invalid previous block hash signature: %v", hdr.Height, err)
+	}
+	if hdr.SealSignature != "" {
+		// The seal is hashed with the algorithm of the block's hash
+		a, _, err := hashParse(hdr.Hash)
+		if err != nil {
+			return fmt.Errorf("block %d: %v", hdr.Height, err)
+		}
+		if err = cryptoVerifyHex(publicKey, a.hashBytes(canonicalSealBytes(chainRoot, hdr)), hdr.SealSignature); err != nil {
+			return fmt.Errorf("block %d: invalid seal signature: %v", hdr.Height, err)
+		}
+	} else if hdr.DocumentsRoot != "" {
+		if err = cryptoVerifyHex(publicKey, hdr.DocumentsRoot, hdr.DocumentsRootSignature); err != nil {
+			return fmt.Errorf("block %d: invalid documents root signature: %v", hdr.Height, err)
+		}
+	}
+	return nil
+}
+
+// Creates a receipt for the document with the given hash
+func blockchainMakeReceipt(documentHash string, confirmations int) (*TimestampReceipt, error) {
+	att, height, err := blockchainFindAttachment(documentHash)
+	if err != nil {
+		return nil, err
+	}
+	b, err := OpenBlockByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := b.dbGetDocumentHashes()
+	b.Close()
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := blockchainGetHeader(height)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.DocumentsRoot == "" || hdr.SealSignature == "" {
+		return nil, fmt.Errorf("Block %d doesn't have a sealed documents root", height)
+	}
+	idx := -1
+	for i, h := range hashes {
+		if h == documentHash {
+			idx = i
+		}
+	}
+	_, proof, err := merkleRootAndProof(hashes, idx)
+	if err != nil {
+		return nil, err
+	}
+	receipt := TimestampReceipt{
+		Version:       receiptVersion,
+		HashAlgorithm: chainHash.name,
+		ChainRoot:     chainParams.GenesisBlockHash,
+		DocumentHash:  documentHash,
+		DocumentName:  att.name,
+		DocumentSize:  att.size,
+		MerkleProof:   proof,
+		Block:         *hdr,
+	}
+	maxHeight := dbGetBlockchainHeight()
+	for h := height + 1; h <= maxHeight && h <= height+confirmations; h++ {
+		chdr, err := blockchainGetHeader(h)
+		if err != nil {
+			return nil, err
+		}
+		receipt.Confirmations = append(receipt.Confirmations, *chdr)
+	}
+	return &receipt, nil
+}
+
+// Verifies a receipt: the document's inclusion in the block, and all the header signatures
+// and links. Returns the list of public key hashes which signed the headers, so they can be
+// compared with the known signatories of the chain.
+func (receipt *TimestampReceipt) Verify() ([]string, error) {
+	if receipt.Version != receiptVersion {
+		return nil, fmt.Errorf("Unsupported receipt version %d", receipt.Version)
+	}
+	if receipt.HashAlgorithm == "" {
+		return nil, fmt.Errorf("The receipt doesn't name its hash algorithm")
+	}
+	// The receipt is verified with its own hash algorithm, not the one of this node's chain
+	hashAlgorithm, err := hashAlgorithmByName(receipt.HashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	root, err := merkleRootFromProof(hashAlgorithm, receipt.DocumentHash, receipt.MerkleProof)
+	if err != nil {
+		return nil, err
+	}
+	if root != receipt.Block.DocumentsRoot {
+		return nil, fmt.Errorf("The Merkle proof doesn't lead to the block's documents root")
+	}
+	if receipt.Block.SealSignature == "" {
+		// Without the seal, the timestamp and the documents root aren't bound to the block
+		return nil, fmt.Errorf("The receipt's block is not sealed")
+	}
+	if err = receipt.Block.Verify(receipt.ChainRoot); err != nil {
+		return nil, err
+	}
+	signers := []string{receipt.Block.CreatorPublicKeyHash}
+	prev := receipt.Block
+	for _, hdr := range receipt.Confirmations {
+		if hdr.PreviousBlockHash != prev.Hash || hdr.Height != prev.Height+1 {
+			return nil, fmt.Errorf("Confirmation header %d doesn't follow block %d", hdr.Height, prev.Height)
+		}
+		if err = hdr.Verify(receipt.ChainRoot); err != nil {
+			return nil, err
+		}
+		if !inStrings(hdr.CreatorPublicKeyHash, signers) {
+			signers = append(signers, hdr.CreatorPublicKeyHash)
+		}
+		prev = hdr
+	}
+	return signers, nil
+}
@@ -0,0 +1,253 @@
+package daisy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// Record types are named tables in the block databases whose contents are validated before
+// a block which contains them is accepted. They can be registered from code with a validation
+// function, or loaded from a JSON file containing a (subset of) JSON schema for each table row.
+// Like in SQLite, the table and column names are case-insensitive, so a block can't dodge the
+// validation by changing their case.
+
+// The JSON schema subset used to validate the rows of a record type table. Every row is
+// treated as an object whose properties are the table columns.
+type recordSchema struct {
+	Type                 string                   `json:"type"`
+	Properties           map[string]*recordSchema `json:"properties"`
+	Required             []string                 `json:"required"`
+	AdditionalProperties *bool                    `json:"additionalProperties"`
+	Enum                 []interface{}            `json:"enum"`
+	Minimum              *float64                 `json:"minimum"`
+	Maximum              *float64                 `json:"maximum"`
+	MinLength            *int                     `json:"minLength"`
+	MaxLength            *int                     `json:"maxLength"`
+	Pattern              string                   `json:"pattern"`
+	pattern              *regexp.Regexp
+	properties           map[string]*recordSchema // Properties, keyed by the lower-case names
+	required             []string                 // Required, in lower case
+}
+
+type recordType struct {
+	name     string
+	schema   *recordSchema
+	validate func(b *Block) error
+}
+
+// The registry of record types, keyed by the lower-case table name
+var recordTypes = map[string]*recordType{}
+
+var recordTypeNameRegexp = regexp.MustCompile("^[A-Za-z][A-Za-z0-9_]*$")
+
+// Registers a record type whose table is validated by the given function
+func registerRecordType(name string, validate func(b *Block) error) {
+	if !recordTypeNameRegexp.MatchString(name) {
+		log.Panicln("Invalid record type name:", name)
+	}
+	if _, ok := recordTypes[strings.ToLower(name)]; ok {
+		log.Panicln("Record type already registered:", name)
+	}
+	recordTypes[strings.ToLower(name)] = &recordType{name: name, validate: validate}
+}
+
+// Loads record type schemas from a JSON file containing a map of table names to schemas
+func loadRecordTypesFile(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	var schemas map[string]*recordSchema
+	if err = json.Unmarshal(data, &schemas); err != nil {
+		return err
+	}
+	for name, schema := range schemas {
+		if !recordTypeNameRegexp.MatchString(name) {
+			return fmt.Errorf("Invalid record type name: %s", name)
+		}
+		if _, ok := recordTypes[strings.ToLower(name)]; ok {
+			return fmt.Errorf("Record type already registered: %s", name)
+		}
+		if err = schema.compile(); err != nil {
+			return fmt.Errorf("Record type %s: %v", name, err)
+		}
+		recordTypes[strings.ToLower(name)] = &recordType{name: name, schema: schema}
+	}
+	log.Println("Loaded", len(schemas), "record types from", fileName)
+	return nil
+}
+
+// Prepares the schema and its sub-schemas for validation
+func (s *recordSchema) compile() error {
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return err
+		}
+		s.pattern = re
+	}
+	s.properties = map[string]*recordSchema{}
+	for name, p := range s.Properties {
+		if err := p.compile(); err != nil {
+			return err
+		}
+		if _, ok := s.properties[strings.ToLower(name)]; ok {
+			return fmt.Errorf("Duplicate property %s", name)
+		}
+		s.properties[strings.ToLower(name)] = p
+	}
+	s.required = nil
+	for _, req := range s.Required {
+		s.required = append(s.required, strings.ToLower(req))
+	}
+	return nil
+}
+
+// Validates a single value (table column or row) against the schema
+func (s *recordSchema) validateValue(name string, v interface{}) error {
+	switch s.Type {
+	case "", "any":
+	case "null":
+		if v != nil {
+			return fmt.Errorf("%s must be null", name)
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s must be a string", name)
+		}
+	case "integer":
+		switch n := v.(type) {
+		case int64:
+		case float64:
+			if n != math.Trunc(n) {
+				return fmt.Errorf("%s must be an integer", name)
+			}
+		default:
+			return fmt.Errorf("%s must be an integer", name)
+		}
+	case "number":
+		switch v.(type) {
+		case int64, float64:
+		default:
+			return fmt.Errorf("%s must be a number", name)
+		}
+	case "boolean":
+		if n, ok := v.(int64); !ok || (n != 0 && n != 1) {
+			return fmt.Errorf("%s must be a boolean (0 or 1)", name)
+		}
+	case "object":
+		row, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", name)
+		}
+		return s.validateRow(row)
+	default:
+		return fmt.Errorf("%s: unsupported schema type %s", name, s.Type)
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if fmt.Sprint(e) == fmt.Sprint(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s is not one of the allowed values", name)
+		}
+	}
+	var num float64
+	isNum := false
+	switch n := v.(type) {
+	case int64:
+		num, isNum = float64(n), true
+	case float64:
+		num, isNum = n, true
+	}
+	if isNum && s.Minimum != nil && num < *s.Minimum {
+		return fmt.Errorf("%s must be at least %v", name, *s.Minimum)
+	}
+	if isNum && s.Maximum != nil && num > *s.Maximum {
+		return fmt.Errorf("%s must be at most %v", name, *s.Maximum)
+	}
+	if str, ok := v.(string); ok {
+		if s.MinLength != nil && len(str) < *s.MinLength {
+			return fmt.Errorf("%s must be at least %d characters long", name, *s.MinLength)
+		}
+		if s.MaxLength != nil && len(str) > *s.MaxLength {
+			return fmt.Errorf("%s must be at most %d characters long", name, *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			return fmt.Errorf("%s doesn't match the pattern %s", name, s.Pattern)
+		}
+	}
+	return nil
+}
+
+// Validates a table row against an object schema
+func (s *recordSchema) validateRow(row map[string]interface{}) error {
+	lowerRow := map[string]interface{}{}
+	for col, v := range row {
+		lowerRow[strings.ToLower(col)] = v
+	}
+	for _, req := range s.required {
+		if v, ok := lowerRow[req]; !ok || v == nil {
+			return fmt.Errorf("column %s is required", req)
+		}
+	}
+	for col, v := range row {
+		p, ok := s.properties[strings.ToLower(col)]
+		if !ok {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				return fmt.Errorf("column %s is not allowed", col)
+			}
+			continue
+		}
+		if v == nil {
+			continue
+		}
+		if err := p.validateValue("column "+col, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validates the tables in the block which belong to registered record types
+func blockchainValidateRecordTypes(b *Block) error {
+	for _, rt := range recordTypes {
+		name := rt.name
+		if !dbTableExists(b.db, name) {
+			continue
+		}
+		if rt.validate != nil {
+			if err := rt.validate(b); err != nil {
+				return fmt.Errorf("Record type %s: %v", name, err)
+			}
+		}
+		if rt.schema != nil {
+			rows, err := b.db.Query(fmt.Sprintf("SELECT * FROM \"%s\"", name))
+			if err != nil {
+				return err
+			}
+			n := 0
+			err = blockchainQueryRows(b.Height, rows, func(height int, row map[string]interface{}) error {
+				n++
+				if err := rt.schema.validateRow(row); err != nil {
+					return fmt.Errorf("row %d: %v", n, err)
+				}
+				return nil
+			})
+			rows.Close()
+			if err != nil {
+				return fmt.Errorf("Record type %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
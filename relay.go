@@ -0,0 +1,173 @@
+package daisy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+)
+
+// Relay nodes store only the block headers (the blockchain table), not the blocks or the
+// attachments, and don't validate blocks beyond checking that the headers link together.
+// They take part in the gossip like full nodes, and forward the requests for blocks and
+// chunks they don't have to full peers, passing the replies back to the requesting peers.
+// This way new blocks propagate through relays in both directions, while the relays
+// themselves need very little disk space and CPU.
+
+// The maximum number of headers sent in a single headers message
+const p2pMaxHeadersPerMsg = 500
+
+// How long the forwarded requests wait for a reply
+const relayForwardTimeout = 1 * time.Minute
+
+type relayForward struct {
+	time    time.Time
+	waiting []*p2pConnection
+}
+
+// Requests forwarded to full peers, by "block:<hash>" or "chunk:<hash>", with the list of
+// connections waiting for the reply
+var relayForwards = struct {
+	lock     WithMutex
+	requests map[string]*relayForward
+}{
+	requests: map[string]*relayForward{},
+}
+
+// Forwards the request to a full peer which should be able to answer it. The reply is
+// passed to the requesting peer with relayDeliver().
+func relayForwardRequest(p2pc *p2pConnection, key string, height int, msg interface{}) {
+	first := false
+	relayForwards.lock.With(func() {
+		rf, ok := relayForwards.requests[key]
+		if !ok {
+			rf = &relayForward{time: time.Now()}
+			relayForwards.requests[key] = rf
+			first = true
+		}
+		if !inPeers(p2pc, rf.waiting) {
+			rf.waiting = append(rf.waiting, p2pc)
+		}
+	})
+	if !first {
+		// Already waiting for the reply from a full peer
+		return
+	}
+	var fullPeer *p2pConnection
+	p2pPeers.lock.With(func() {
+		for p := range p2pPeers.peers {
+			if p != p2pc && !p.isRelay && p.chainHeight >= height {
+				fullPeer = p
+				break
+			}
+		}
+	})
+	if fullPeer == nil {
+		log.Println("Relay: no full peer to forward", key, "to")
+		relayForwards.lock.With(func() {
+			delete(relayForwards.requests, key)
+		})
+		return
+	}
+	log.Println("Relay: forwarding", key, "from", p2pc.address, "to", fullPeer.address)
+	fullPeer.chanToPeer <- msg
+}
+
+// Passes the reply to a forwarded request to the peers waiting for it
+func relayDeliver(key string, msg StrIfMap) {
+	var waiting []*p2pConnection
+	relayForwards.lock.With(func() {
+		if rf, ok := relayForwards.requests[key]; ok {
+			waiting = rf.waiting
+			delete(relayForwards.requests, key)
+		}
+	})
+	for _, p2pc := range waiting {
+		if p2pPeers.Has(p2pc) {
+			p2pc.chanToPeer <- msg
+		}
+	}
+}
+
+// Drops the forwarded requests which haven't been answered in time
+func relayExpireForwards() {
+	relayForwards.lock.With(func() {
+		for key, rf := range relayForwards.requests {
+			if time.Since(rf.time) > relayForwardTimeout {
+				delete(relayForwards.requests, key)
+			}
+		}
+	})
+}
+
+func inPeers(p2pc *p2pConnection, list []*p2pConnection) bool {
+	for _, p := range list {
+		if p == p2pc {
+			return true
+		}
+	}
+	return false
+}
+
+// Stores the received headers which extend our chain of headers. Headers are only checked
+// for linking with the previous ones, not for signatures.
+func relayStoreHeaders(headers []BlockHeader) int {
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].Height < headers[j].Height
+	})
+	n := 0
+	for _, hdr := range headers {
+		height := dbGetBlockchainHeight()
+		if hdr.Height <= height {
+			continue
+		}
+		if hdr.Height != height+1 || hdr.PreviousBlockHash != dbGetBlockHashByHeight(height) {
+			log.Println("Relay: header", hdr.Height, hdr.Hash, "doesn't follow my chain")
+			break
+		}
+		// The header hash is optional, but a peer which sends a wrong one disagrees with us
+		// on the canonical serialization
+		if hdr.HeaderHash != "" && hdr.HeaderHash != canonicalHeaderHash(&hdr) {
+			log.Println("Relay: header", hdr.Height, hdr.Hash, "has an invalid header hash")
+			break
+		}
+		hashSignature, err := hex.DecodeString(hdr.HashSignature)
+		if err != nil {
+			log.Println("Relay: invalid header", hdr.Height, err)
+			break
+		}
+		prevHashSignature, err := hex.DecodeString(hdr.PreviousBlockHashSignature)
+		if err != nil {
+			log.Println("Relay: invalid header", hdr.Height, err)
+			break
+		}
+		dbb := DbBlockchainBlock{
+			Height:                     hdr.Height,
+			Hash:                       hdr.Hash,
+			PreviousBlockHash:          hdr.PreviousBlockHash,
+			SignaturePublicKeyHash:     hdr.CreatorPublicKeyHash,
+			PreviousBlockHashSignature: prevHashSignature,
+			HashSignature:              hashSignature,
+			TimeAccepted:               time.Now(),
+			Version:                    CurrentBlockVersion,
+		}
+		if err = dbInsertBlock(&dbb); err != nil {
+			log.Println("Relay: cannot insert header", hdr.Height, err)
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// Decodes the list of headers from a headers message
+func p2pGetHeaders(msg StrIfMap) ([]BlockHeader, error) {
+	var headers []BlockHeader
+	data, err := json.Marshal(msg["headers"])
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &headers)
+	return headers, err
+}
@@ -0,0 +1,443 @@
+package daisy
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	// The PostgreSQL driver for the replication targets
+	_ "github.com/lib/pq"
+	"github.com/segmentio/kafka-go"
+)
+
+// Replication streams the accepted blocks, with their documents, into external databases,
+// so the chain's contents can be queried with BI tools without loading the node. Every
+// target in the replication config setting keeps its own offset: the height of the last
+// block written to it, which is stored in the target itself, in the same commit as the
+// blocks, so a replicator resumes exactly where it stopped, and no block is written twice
+// or skipped, even if the node or the target crashed mid-write.
+//
+// A PostgreSQL target gets the daisy_blocks and daisy_documents tables, and the offset is
+// kept in the daisy_replication table, updated in the transaction which inserts the
+// blocks. A Kafka target gets one message per block, an ExportBlock in JSON keyed by the
+// block hash, on partition 0 of its topic, so the blocks stay in order. The batches of
+// blocks are appended atomically, and the offset is the height in the last message of the
+// partition, which must not be written to by anything else. The document contents are not
+// replicated; they can be fetched from the node's HTTP API by their hashes.
+
+// The replication target types
+const (
+	replicationTypePostgres = "postgres"
+	replicationTypeKafka    = "kafka"
+)
+
+// The maximum number of blocks written to a target in one commit
+const replicationBatchSize = 100
+
+// How often the blockchain is checked for new blocks to replicate
+const replicationPollInterval = 2 * time.Second
+
+// The delay before reconnecting to a failed target, doubled on each failure
+const (
+	replicationRetryDelay    = 5 * time.Second
+	replicationMaxRetryDelay = 5 * time.Minute
+)
+
+// The Kafka message headers with the chain and the block height
+const (
+	replicationKafkaHeaderChain  = "daisy-chain"
+	replicationKafkaHeaderHeight = "daisy-height"
+)
+
+// ReplicationConfig is the configuration of a replication target
+type ReplicationConfig struct {
+	// "postgres" or "kafka"
+	Type string `json:"type"`
+	// The name of the target in the log and /status, by default its type (and topic)
+	Name string `json:"name"`
+	// The PostgreSQL connection string, e.g. "postgres://daisy@db.example.com/daisy"
+	DSN string `json:"dsn"`
+	// The Kafka brokers, as host:port
+	Brokers []string `json:"brokers"`
+	// The Kafka topic
+	Topic string `json:"topic"`
+}
+
+// A replication target, which is written to by a single replicator
+type replicationTarget interface {
+	// Connects to the target, creating its schema if needed
+	open() error
+	// Returns the height and hash of the last block written to the target, or -1 if none
+	offset() (int, string, error)
+	// Writes the blocks, which follow the offset, and advances the offset in one commit
+	write(blocks []*ExportBlock) error
+	close()
+}
+
+type replicator struct {
+	config ReplicationConfig
+	target replicationTarget
+	lock   WithMutex
+	height int
+	err    string
+}
+
+var replicators []*replicator
+
+// Checks the replication config and creates the replicators
+func replicationConfigure() error {
+	names := map[string]bool{}
+	for _, rc := range cfg.Replication {
+		var target replicationTarget
+		switch rc.Type {
+		case replicationTypePostgres:
+			if rc.DSN == "" {
+				return fmt.Errorf("The postgres replication target needs a dsn")
+			}
+			if rc.Name == "" {
+				// Not the DSN, which can contain a password
+				rc.Name = rc.Type
+			}
+			target = &replicationPostgres{dsn: rc.DSN}
+		case replicationTypeKafka:
+			if len(rc.Brokers) == 0 || rc.Topic == "" {
+				return fmt.Errorf("The kafka replication target needs brokers and a topic")
+			}
+			if rc.Name == "" {
+				rc.Name = rc.Type + ":" + rc.Topic
+			}
+			target = &replicationKafka{brokers: rc.Brokers, topic: rc.Topic}
+		default:
+			return fmt.Errorf("Unknown replication target type %q (expecting postgres or kafka)", rc.Type)
+		}
+		if names[rc.Name] {
+			return fmt.Errorf("Duplicate replication target name: %s", rc.Name)
+		}
+		names[rc.Name] = true
+		replicators = append(replicators, &replicator{config: rc, target: target, height: -1})
+	}
+	return nil
+}
+
+// Starts the replicators
+func replicationStart() {
+	for _, r := range replicators {
+		nodeGo(r.run)
+	}
+	if len(replicators) > 0 {
+		log.Println("Replicating the blockchain to", len(replicators), "targets")
+	}
+}
+
+// Records the replicator's state for /status
+func (r *replicator) setState(height int, err error) {
+	r.lock.With(func() {
+		if height >= 0 {
+			r.height = height
+		}
+		if err != nil {
+			r.err = err.Error()
+		} else {
+			r.err = ""
+		}
+	})
+}
+
+// Connects to the target and returns the height of the next block to write to it
+func (r *replicator) connect() (int, error) {
+	if err := r.target.open(); err != nil {
+		return 0, err
+	}
+	height, hash, err := r.target.offset()
+	if err != nil {
+		r.target.close()
+		return 0, err
+	}
+	if height >= 0 {
+		if local := dbGetBlockHashByHeight(height); local != hash {
+			r.target.close()
+			return 0, fmt.Errorf("The target's block %d is %s, but the local block is %q: it's replicated from another chain", height, hash, local)
+		}
+	}
+	r.setState(height, nil)
+	return height + 1, nil
+}
+
+// Writes the new blocks to the target until the node stops. After a failure it reconnects
+// and reads the offset from the target again, since the failed commit may have succeeded.
+func (r *replicator) run() {
+	ticker := time.NewTicker(replicationPollInterval)
+	defer ticker.Stop()
+	connected := false
+	next := 0
+	delay := replicationRetryDelay
+	for {
+		var err error
+		if !connected {
+			if next, err = r.connect(); err == nil {
+				connected = true
+				delay = replicationRetryDelay
+				log.Println("Replicating to", r.config.Name, "from block", next)
+			}
+		}
+		if connected {
+			for err == nil && next <= dbGetBlockchainHeight() {
+				var n int
+				if n, err = r.replicate(next); err == nil {
+					next += n
+					r.setState(next-1, nil)
+				}
+			}
+		}
+		if err != nil {
+			log.Println("Replication to", r.config.Name, "failed:", err)
+			r.setState(-1, err)
+			if connected {
+				r.target.close()
+				connected = false
+			}
+			select {
+			case <-nodeQuit:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > replicationMaxRetryDelay {
+				delay = replicationMaxRetryDelay
+			}
+			continue
+		}
+		select {
+		case <-nodeQuit:
+			if connected {
+				r.target.close()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Writes a batch of blocks starting at the height to the target. Returns the number of blocks.
+func (r *replicator) replicate(from int) (int, error) {
+	to := dbGetBlockchainHeight()
+	if to >= from+replicationBatchSize {
+		to = from + replicationBatchSize - 1
+	}
+	var blocks []*ExportBlock
+	for h := from; h <= to; h++ {
+		eb, err := blockchainExportBlock(h, false)
+		if err != nil {
+			return 0, fmt.Errorf("Cannot read block %d: %v", h, err)
+		}
+		blocks = append(blocks, eb)
+	}
+	if err := r.target.write(blocks); err != nil {
+		return 0, err
+	}
+	return len(blocks), nil
+}
+
+// Returns the replicators' states for /status
+func replicationStatus() map[string]interface{} {
+	status := map[string]interface{}{}
+	for _, r := range replicators {
+		r.lock.With(func() {
+			s := map[string]interface{}{"height": r.height}
+			if r.err != "" {
+				s["error"] = r.err
+			}
+			status[r.config.Name] = s
+		})
+	}
+	return status
+}
+
+// Replicates into PostgreSQL
+type replicationPostgres struct {
+	dsn string
+	db  *sql.DB
+}
+
+const replicationPostgresSchema = `
+CREATE TABLE IF NOT EXISTS daisy_blocks (
+	chain TEXT NOT NULL,
+	height INTEGER NOT NULL,
+	hash TEXT NOT NULL,
+	previous_block_hash TEXT NOT NULL,
+	creator_public_key_hash TEXT NOT NULL,
+	time_created TIMESTAMPTZ,
+	documents_root TEXT,
+	manifest_hash TEXT,
+	PRIMARY KEY (chain, height)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS daisy_blocks_hash ON daisy_blocks (hash);
+CREATE TABLE IF NOT EXISTS daisy_documents (
+	chain TEXT NOT NULL,
+	block_height INTEGER NOT NULL,
+	hash TEXT NOT NULL,
+	name TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	bundle TEXT,
+	PRIMARY KEY (chain, block_height, hash)
+);
+CREATE INDEX IF NOT EXISTS daisy_documents_hash ON daisy_documents (hash);
+CREATE TABLE IF NOT EXISTS daisy_replication (
+	chain TEXT PRIMARY KEY,
+	height INTEGER NOT NULL,
+	hash TEXT NOT NULL,
+	time_updated TIMESTAMPTZ NOT NULL
+);
+`
+
+func (t *replicationPostgres) open() error {
+	var err error
+	if t.db, err = sql.Open("postgres", t.dsn); err != nil {
+		return err
+	}
+	if _, err = t.db.Exec(replicationPostgresSchema); err != nil {
+		t.db.Close()
+		return err
+	}
+	return nil
+}
+
+func (t *replicationPostgres) offset() (int, string, error) {
+	var height int
+	var hash string
+	err := t.db.QueryRow("SELECT height, hash FROM daisy_replication WHERE chain = $1", chainParams.GenesisBlockHash).Scan(&height, &hash)
+	if err == sql.ErrNoRows {
+		return -1, "", nil
+	}
+	return height, hash, err
+}
+
+func (t *replicationPostgres) write(blocks []*ExportBlock) error {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	chain := chainParams.GenesisBlockHash
+	for _, eb := range blocks {
+		var created interface{}
+		if ts, err := time.Parse(time.RFC3339, eb.Timestamp); err == nil {
+			created = ts
+		}
+		if _, err = tx.Exec("INSERT INTO daisy_blocks (chain, height, hash, previous_block_hash, creator_public_key_hash, time_created, documents_root, manifest_hash) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+			chain, eb.Height, eb.Hash, eb.PreviousBlockHash, eb.CreatorPublicKeyHash, created, eb.DocumentsRoot, eb.ManifestHash); err != nil {
+			return fmt.Errorf("Block %d: %v", eb.Height, err)
+		}
+		for _, doc := range eb.Documents {
+			if _, err = tx.Exec("INSERT INTO daisy_documents (chain, block_height, hash, name, size, bundle) VALUES ($1, $2, $3, $4, $5, $6)",
+				chain, eb.Height, doc.Hash, doc.Name, doc.Size, doc.Bundle); err != nil {
+				return fmt.Errorf("Block %d: %v", eb.Height, err)
+			}
+		}
+	}
+	last := blocks[len(blocks)-1]
+	if _, err = tx.Exec("INSERT INTO daisy_replication (chain, height, hash, time_updated) VALUES ($1, $2, $3, $4) ON CONFLICT (chain) DO UPDATE SET height = EXCLUDED.height, hash = EXCLUDED.hash, time_updated = EXCLUDED.time_updated",
+		chain, last.Height, last.Hash, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (t *replicationPostgres) close() {
+	t.db.Close()
+}
+
+// Replicates into a Kafka topic
+type replicationKafka struct {
+	brokers []string
+	topic   string
+	conn    *kafka.Conn
+}
+
+// The timeout of the Kafka requests
+const replicationKafkaTimeout = 30 * time.Second
+
+// The largest message read back from the topic
+const replicationKafkaMaxMessage = 16 * 1024 * 1024
+
+func (t *replicationKafka) open() error {
+	var err error
+	for _, broker := range t.brokers {
+		ctx, cancel := context.WithTimeout(context.Background(), replicationKafkaTimeout)
+		t.conn, err = kafka.DialLeader(ctx, "tcp", broker, t.topic, 0)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// The offset is the height in the message at the end of the partition
+func (t *replicationKafka) offset() (int, string, error) {
+	t.conn.SetDeadline(time.Now().Add(replicationKafkaTimeout))
+	first, err := t.conn.ReadFirstOffset()
+	if err != nil {
+		return 0, "", err
+	}
+	last, err := t.conn.ReadLastOffset()
+	if err != nil {
+		return 0, "", err
+	}
+	if last <= first {
+		return -1, "", nil
+	}
+	if _, err = t.conn.Seek(last-1, kafka.SeekAbsolute); err != nil {
+		return 0, "", err
+	}
+	msg, err := t.conn.ReadMessage(replicationKafkaMaxMessage)
+	if err != nil {
+		return 0, "", err
+	}
+	var chain, height string
+	for _, h := range msg.Headers {
+		switch h.Key {
+		case replicationKafkaHeaderChain:
+			chain = string(h.Value)
+		case replicationKafkaHeaderHeight:
+			height = string(h.Value)
+		}
+	}
+	if chain != chainParams.GenesisBlockHash {
+		return 0, "", fmt.Errorf("The last message in the topic %s is not a block of this chain", t.topic)
+	}
+	h, err := strconv.Atoi(height)
+	if err != nil {
+		return 0, "", fmt.Errorf("The last message in the topic %s has an invalid height: %q", t.topic, height)
+	}
+	return h, string(msg.Key), nil
+}
+
+func (t *replicationKafka) write(blocks []*ExportBlock) error {
+	msgs := make([]kafka.Message, 0, len(blocks))
+	for _, eb := range blocks {
+		value, err := json.Marshal(eb)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, kafka.Message{
+			Key:   []byte(eb.Hash),
+			Value: value,
+			Headers: []kafka.Header{
+				{Key: replicationKafkaHeaderChain, Value: []byte(chainParams.GenesisBlockHash)},
+				{Key: replicationKafkaHeaderHeight, Value: []byte(strconv.Itoa(eb.Height))},
+			},
+		})
+	}
+	t.conn.SetDeadline(time.Now().Add(replicationKafkaTimeout))
+	// The messages are sent as a single batch, which the partition appends atomically
+	_, err := t.conn.WriteMessages(msgs...)
+	return err
+}
+
+func (t *replicationKafka) close() {
+	t.conn.Close()
+}
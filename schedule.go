@@ -0,0 +1,313 @@
+package daisy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With a block schedule, the node periodically seals the documents waiting in the pending
+// subdirectory of the data directory into a new block. The schedule is an interval ("10m"
+// or "@every 10m"), a cron expression with the fields minute, hour, day of month, month
+// and day of week ("0 0 * * *" is daily at midnight, in the local time zone), or one of
+// @hourly, @daily, @weekly and @monthly. If the node was down at a scheduled time, it
+// seals the pending documents once when it starts, instead of once for every missed time.
+
+// The subdirectory of the data directory with the documents waiting for the next block
+const pendingSubdirectoryBaseName = "pending"
+
+// The config table key under which the time of the last scheduled run is kept
+const blockScheduleLastRunKey = "block_schedule_last_run"
+
+// A parsed block production schedule: either an interval or the cron fields as bit sets
+type blockSchedule struct {
+	every                         time.Duration
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var blockScheduleAliases = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// The parsed -block-schedule, or nil
+var blockProductionSchedule *blockSchedule
+
+// Parses an interval or a cron expression
+func parseBlockSchedule(s string) (*blockSchedule, error) {
+	s = strings.TrimSpace(s)
+	if alias, ok := blockScheduleAliases[s]; ok {
+		s = alias
+	}
+	if d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(s, "@every"))); err == nil {
+		minInterval := time.Minute
+		if profileRelaxed() {
+			// Blocks are sealed almost instantly on a devnet
+			minInterval = time.Second
+		}
+		if d < minInterval {
+			return nil, fmt.Errorf("The block schedule interval must be at least %v", minInterval)
+		}
+		return &blockSchedule{every: d}, nil
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid block schedule %q: expecting an interval or 5 cron fields", s)
+	}
+	var sched blockSchedule
+	var err error
+	if sched.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if sched.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if sched.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if sched.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if sched.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// Both 0 and 7 are Sunday
+	if sched.dow&(1<<7) != 0 {
+		sched.dow |= 1
+	}
+	sched.domAny = fields[2] == "*"
+	sched.dowAny = fields[4] == "*"
+	return &sched, nil
+}
+
+// Parses a cron field made of comma-separated values, ranges (a-b) and steps (*/n, a-b/n)
+// into a bit set
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("Invalid step in cron field %q", field)
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			bounds := strings.SplitN(part, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("Invalid cron field %q", field)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("Invalid cron field %q", field)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("Cron field %q is out of range %d-%d", field, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// Returns true if the day matches the day of month and day of week fields. As in cron,
+// if both are restricted, a day matching either of them matches.
+func (s *blockSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if !s.domAny && !s.dowAny {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// Returns the first scheduled time after t
+func (s *blockSchedule) next(t time.Time) time.Time {
+	if s.every != 0 {
+		return t.Add(s.every)
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every valid expression matches at least once in a few years (e.g. on February 29th)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return limit
+}
+
+// Returns the directory with the pending documents
+func pendingGetDirectory() string {
+	return filepath.Join(cfg.DataDir, pendingSubdirectoryBaseName)
+}
+
+// Returns the regular files and the subdirectories in the directory, skipping those whose
+// names start with a dot
+func pendingListFiles(dir string) ([]string, []string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var files, dirs []string
+	for _, fi := range entries {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		if fi.Mode().IsRegular() {
+			files = append(files, filepath.Join(dir, fi.Name()))
+		} else if fi.IsDir() {
+			dirs = append(dirs, filepath.Join(dir, fi.Name()))
+		}
+	}
+	return files, dirs, nil
+}
+
+// Returns the files waiting to be sealed into a block, and the bundles: the files in each
+// subdirectory are sealed as a bundle. Files and directories whose names start with a dot
+// are skipped, so documents can be written under such a name and renamed when complete.
+func pendingGetFiles() ([]string, [][]string, []string, error) {
+	files, dirs, err := pendingListFiles(pendingGetDirectory())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var bundles [][]string
+	var bundleDirs []string
+	for _, dir := range dirs {
+		bundle, _, err := pendingListFiles(dir)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if len(bundle) == 0 {
+			continue
+		}
+		if len(bundle) == 1 {
+			// A bundle of one is just a document
+			files = append(files, bundle[0])
+		} else {
+			bundles = append(bundles, bundle)
+		}
+		bundleDirs = append(bundleDirs, dir)
+	}
+	return files, bundles, bundleDirs, nil
+}
+
+// Seals the pending documents into new blocks, if there are any. The documents are
+// sealed into as many blocks as the chain's block limits require.
+func blockScheduleSeal() {
+	if err := blockProductionError(); err != nil {
+		log.Println("Not sealing the pending documents:", err)
+		return
+	}
+	for {
+		files, bundles, bundleDirs, err := pendingGetFiles()
+		if err != nil {
+			log.Println("Cannot read the pending documents:", err)
+			return
+		}
+		if len(files) == 0 && len(bundles) == 0 {
+			return
+		}
+		allFiles, allBundles := len(files), len(bundles)
+		if files, bundles, err = blockLimitsFit(files, bundles); err != nil {
+			log.Println("Scheduled block production failed:", err)
+			return
+		}
+		height, err := blockchainCreateBlock(files, bundles)
+		if err != nil {
+			log.Println("Scheduled block production failed:", err)
+			return
+		}
+		sealed := map[string]bool{}
+		for _, fileName := range files {
+			sealed[fileName] = true
+			if err = os.Remove(fileName); err != nil {
+				log.Println(err)
+			}
+		}
+		for _, bundle := range bundles {
+			for _, fileName := range bundle {
+				sealed[fileName] = true
+			}
+		}
+		for _, dir := range bundleDirs {
+			// Only the bundles sealed in this block are removed
+			if dirFiles, _, err := pendingListFiles(dir); err == nil && len(dirFiles) > 0 && !sealed[dirFiles[0]] {
+				continue
+			}
+			if err = os.RemoveAll(dir); err != nil {
+				log.Println(err)
+			}
+		}
+		log.Println("Sealed", len(files), "pending documents and", len(bundles), "bundles into block", height)
+		if len(files) == allFiles && len(bundles) == allBundles {
+			return
+		}
+	}
+}
+
+// Runs the block production schedule
+func blockScheduleRun() {
+	if err := os.MkdirAll(pendingGetDirectory(), 0700); err != nil {
+		log.Println("Cannot create the pending documents directory:", err)
+		return
+	}
+	lastRun := time.Now()
+	if value, ok := dbGetConfig(blockScheduleLastRunKey); ok {
+		if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+			lastRun = time.Unix(ts, 0)
+		}
+	} else {
+		dbSetConfig(blockScheduleLastRunKey, strconv.FormatInt(lastRun.Unix(), 10))
+	}
+	log.Println("Sealing the documents in", pendingGetDirectory(), "into blocks on the schedule", cfg.BlockSchedule)
+	for {
+		next := blockProductionSchedule.next(lastRun)
+		if wait := time.Until(next); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-nodeQuit:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		} else {
+			log.Println("Catching up on the scheduled block production missed at", next.Format(time.RFC3339))
+		}
+		lastRun = time.Now()
+		dbSetConfig(blockScheduleLastRunKey, strconv.FormatInt(lastRun.Unix(), 10))
+		blockScheduleSeal()
+	}
+}
@@ -0,0 +1,77 @@
+package daisy
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Support for the systemd service notification protocol (sd_notify): when started by
+// systemd with Type=notify, the NOTIFY_SOCKET environment variable names a datagram socket
+// to which the service reports when it's ready, when it's stopping, and (with WatchdogSec)
+// that it's still alive. Without NOTIFY_SOCKET, the notifications are not sent.
+
+// How long to wait for the first peer before reporting readiness anyway
+const sdReadyTimeout = 30 * time.Second
+
+var sdReadyOnce sync.Once
+
+// Sends the state (e.g. "READY=1") to systemd
+func sdNotify(state string) error {
+	socketName := os.Getenv("NOTIFY_SOCKET")
+	if socketName == "" {
+		return nil
+	}
+	if socketName[0] == '@' {
+		// An abstract socket
+		socketName = "\x00" + socketName[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketName, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Reports that the node is ready, only once
+func sdNotifyReady() {
+	sdReadyOnce.Do(func() {
+		if err := sdNotify("READY=1\nSTATUS=Running"); err != nil {
+			log.Println("sd_notify:", err)
+		}
+	})
+}
+
+// Reports that the node is shutting down
+func sdNotifyStopping() {
+	if err := sdNotify("STOPPING=1"); err != nil {
+		log.Println("sd_notify:", err)
+	}
+}
+
+// Returns the interval of the systemd watchdog, or 0 if it's not enabled for this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Tells the systemd watchdog that the node is alive
+func sdNotifyWatchdog() {
+	if sdWatchdogInterval() == 0 {
+		return
+	}
+	if err := sdNotify("WATCHDOG=1"); err != nil {
+		log.Println("sd_notify:", err)
+	}
+}
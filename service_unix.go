@@ -0,0 +1,93 @@
+//go:build !windows
+// +build !windows
+
+package daisy
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// The default location of the generated systemd unit file
+const systemdUnitFile = "/etc/systemd/system/daisy.service"
+
+const systemdUnitTemplate = `[Unit]
+Description=Daisy blockchain node
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%s
+User=%s
+Restart=on-failure
+RestartSec=10
+TimeoutStartSec=120
+WatchdogSec=60
+NotifyAccess=main
+ExecReload=/bin/kill -USR2 $MAINPID
+LimitNOFILE=65536
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// Services are supervised by systemd with sd_notify, so nothing needs to be done here
+func osServiceRun() {
+}
+
+// Manages the OS service, run as: service install [-o unit file] [-user name]
+func actionService(args []string) {
+	if len(args) == 0 || args[0] != "install" {
+		log.Fatalln("Unknown service command, expecting: service install")
+	}
+	fs := flag.NewFlagSet("service install", flag.ExitOnError)
+	output := fs.String("o", systemdUnitFile, "The unit file to write, or - for standard output")
+	userName := fs.String("user", "", "The user to run the node as (default: the current user)")
+	fs.Parse(args[1:])
+
+	if *userName == "" {
+		u, err := user.Current()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		*userName = u.Username
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	dataDir, err := filepath.Abs(cfg.DataDir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	cmdLine := []string{exe, "-dir", dataDir}
+	if cfg.configFile != "" {
+		configFile, err := filepath.Abs(cfg.configFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cmdLine = append(cmdLine, "-conf", configFile)
+	}
+	for i := range cmdLine {
+		if strings.ContainsAny(cmdLine[i], " \t\"\\") {
+			cmdLine[i] = fmt.Sprintf("%q", cmdLine[i])
+		}
+	}
+	unit := fmt.Sprintf(systemdUnitTemplate, strings.Join(cmdLine, " "), *userName)
+	if *output == "-" {
+		fmt.Print(unit)
+		return
+	}
+	if err = ioutil.WriteFile(*output, []byte(unit), 0644); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Wrote", *output)
+	log.Println("Enable and start the service with: systemctl daemon-reload && systemctl enable --now", filepath.Base(*output))
+}
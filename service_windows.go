@@ -0,0 +1,139 @@
+//go:build windows
+// +build windows
+
+package daisy
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// The name of the Windows service
+const windowsServiceName = "daisy"
+
+// The log file in the data directory, used when running as a service
+const windowsServiceLogFile = "daisy.log"
+
+func windowsIsService() (bool, error) {
+	return svc.IsWindowsService()
+}
+
+// Manages the OS service, run as: service install|uninstall
+func actionService(args []string) {
+	if len(args) == 0 {
+		log.Fatalln("Expecting a service command: install or uninstall")
+	}
+	switch args[0] {
+	case "install":
+		windowsServiceInstall(args[1:])
+	case "uninstall":
+		windowsServiceUninstall()
+	default:
+		log.Fatalln("Unknown service command:", args[0])
+	}
+}
+
+func windowsServiceInstall(args []string) {
+	fs := flag.NewFlagSet("service install", flag.ExitOnError)
+	manual := fs.Bool("manual", false, "Don't start the service automatically when Windows starts")
+	fs.Parse(args)
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	dataDir, err := filepath.Abs(cfg.DataDir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	cmdArgs := []string{"-dir", dataDir}
+	if cfg.configFile != "" {
+		configFile, err := filepath.Abs(cfg.configFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cmdArgs = append(cmdArgs, "-conf", configFile)
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		log.Fatalln("Cannot connect to the service manager (are you an administrator?):", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(windowsServiceName); err == nil {
+		s.Close()
+		log.Fatalln("The", windowsServiceName, "service already exists")
+	}
+	startType := uint32(mgr.StartAutomatic)
+	if *manual {
+		startType = mgr.StartManual
+	}
+	s, err := m.CreateService(windowsServiceName, exe, mgr.Config{
+		DisplayName: "Daisy blockchain node",
+		Description: "Runs a Daisy blockchain node with the data directory " + dataDir,
+		StartType:   startType,
+	}, cmdArgs...)
+	if err != nil {
+		log.Fatalln("Cannot create the service:", err)
+	}
+	s.Close()
+	log.Println("Installed the", windowsServiceName, "service with the data directory", dataDir)
+	log.Println("Start it with: sc start", windowsServiceName)
+}
+
+func windowsServiceUninstall() {
+	m, err := mgr.Connect()
+	if err != nil {
+		log.Fatalln("Cannot connect to the service manager (are you an administrator?):", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(windowsServiceName)
+	if err != nil {
+		log.Fatalln("The", windowsServiceName, "service is not installed")
+	}
+	defer s.Close()
+	if err = s.Delete(); err != nil {
+		log.Fatalln("Cannot delete the service:", err)
+	}
+	log.Println("Uninstalled the", windowsServiceName, "service")
+}
+
+// windowsService reports the node's state to the service manager
+type windowsService struct{}
+
+func (ws *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for c := range r {
+		switch c.Cmd {
+		case svc.Interrogate:
+			changes <- c.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			changes <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// If running as a Windows service, redirects the log to a file in the data directory and
+// starts reporting to the service manager. The node quits when the service is stopped.
+func osServiceRun() {
+	isService, err := windowsIsService()
+	if err != nil || !isService {
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(cfg.DataDir, windowsServiceLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		log.SetOutput(f)
+	}
+	go func() {
+		if err := svc.Run(windowsServiceName, &windowsService{}); err != nil {
+			log.Println("Windows service error:", err)
+		}
+		sysEventChannel <- sysEventMessage{event: eventQuit, idata: 0}
+	}()
+}
@@ -0,0 +1,134 @@
+package daisy
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// The stall monitor raises an alert when no block has been accepted for longer than
+// -stall-alert-minutes in one of two cases: the peers report higher heights, so this node
+// is stuck, or this node is a block producer (it has a block schedule or created the last
+// block), so production has stalled. Alerts are logged, reported in the metrics and in
+// /status, and sent to the webhooks, as is the end of the stall.
+
+// The reasons of a stall
+const (
+	stallReasonStuck             = "stuck"
+	stallReasonProductionStalled = "production_stalled"
+)
+
+// StallReport is the webhook payload sent when the chain stops advancing ("stall") and
+// when it advances again ("stall_resolved")
+type StallReport struct {
+	Event          string `json:"event"`
+	Chain          string `json:"chain"`
+	Reason         string `json:"reason"`
+	Height         int    `json:"height"`
+	PeerHeight     int    `json:"peer_height"`
+	LastBlockTime  string `json:"last_block_time"`
+	StalledSeconds int64  `json:"stalled_seconds"`
+}
+
+var stallMonitor = struct {
+	lock       WithMutex
+	height     int
+	lastChange time.Time
+	reason     string // empty when there is no stall
+}{
+	lastChange: time.Now(),
+}
+
+// Returns the highest chain height reported by the peers
+func (p *p2pPeersSet) maxChainHeight() int {
+	max := 0
+	p.lock.With(func() {
+		for peer := range p.peers {
+			if peer.chainHeight > max {
+				max = peer.chainHeight
+			}
+		}
+	})
+	return max
+}
+
+// Returns true if this node produces blocks
+func stallIsProducer(height int) bool {
+	if failoverStandingBy() {
+		return false
+	}
+	if blockProductionSchedule != nil {
+		return true
+	}
+	dbb, err := dbGetBlockByHeight(height)
+	if err != nil {
+		return false
+	}
+	return inStrings(dbb.SignaturePublicKeyHash, dbGetMyPublicKeyHashes())
+}
+
+// Returns the current stall reason, or an empty string, and how long the chain hasn't advanced
+func stallStatus() (string, time.Duration) {
+	var reason string
+	var since time.Time
+	stallMonitor.lock.With(func() {
+		reason = stallMonitor.reason
+		since = stallMonitor.lastChange
+	})
+	return reason, time.Since(since)
+}
+
+// Checks whether the chain has stalled and sends the alerts. Called periodically by the
+// coordinator.
+func stallCheck() {
+	alertMinutes := tunableStallAlertMinutes()
+	if alertMinutes == 0 {
+		return
+	}
+	height := dbGetBlockchainHeight()
+	peerHeight := p2pPeers.maxChainHeight()
+	var oldReason string
+	var lastChange time.Time
+	stallMonitor.lock.With(func() {
+		if height != stallMonitor.height {
+			stallMonitor.height = height
+			stallMonitor.lastChange = time.Now()
+		}
+		oldReason = stallMonitor.reason
+		lastChange = stallMonitor.lastChange
+	})
+	stalled := time.Since(lastChange)
+	reason := ""
+	if stalled >= time.Duration(alertMinutes)*time.Minute {
+		if peerHeight > height {
+			reason = stallReasonStuck
+		} else if stallIsProducer(height) {
+			reason = stallReasonProductionStalled
+		}
+	}
+	if reason == oldReason {
+		return
+	}
+	stallMonitor.lock.With(func() {
+		stallMonitor.reason = reason
+	})
+	report := StallReport{
+		Event:          "stall",
+		Chain:          chainParams.GenesisBlockHash,
+		Reason:         reason,
+		Height:         height,
+		PeerHeight:     peerHeight,
+		LastBlockTime:  lastChange.UTC().Format(time.RFC3339),
+		StalledSeconds: int64(stalled.Seconds()),
+	}
+	if reason == "" {
+		report.Event = "stall_resolved"
+		report.Reason = oldReason
+		log.Println("The chain is advancing again at height", height)
+	} else if reason == stallReasonStuck {
+		log.Println("WARNING: no new blocks for", stalled.Round(time.Minute), "while the peers are at height", peerHeight, "and we're at", height)
+	} else {
+		log.Println("WARNING: no new blocks produced for", stalled.Round(time.Minute), "at height", height)
+	}
+	webhooksNotify(jsonifyWhateverToBytes(report), fmt.Sprintf("the %s alert", report.Event))
+}
@@ -0,0 +1,276 @@
+package daisy
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsDistribution summarises a set of values
+type StatsDistribution struct {
+	Min  float64 `json:"min"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+}
+
+// StatsSigner is the number of blocks signed by a key
+type StatsSigner struct {
+	PublicKeyHash string  `json:"public_key_hash"`
+	Blocks        int     `json:"blocks"`
+	Percent       float64 `json:"percent"`
+}
+
+// StatsAnnouncer is the number of blocks a peer announced first
+type StatsAnnouncer struct {
+	Peer    string  `json:"peer"`
+	Blocks  int     `json:"blocks"`
+	Percent float64 `json:"percent"`
+}
+
+// ChainStats are the statistics of a range of blocks
+type ChainStats struct {
+	MinHeight         int               `json:"min_height"`
+	MaxHeight         int               `json:"max_height"`
+	Blocks            int               `json:"blocks"`
+	FirstTimestamp    time.Time         `json:"first_timestamp"`
+	LastTimestamp     time.Time         `json:"last_timestamp"`
+	IntervalSeconds   StatsDistribution `json:"interval_seconds"`
+	SizeBytes         StatsDistribution `json:"size_bytes"`
+	TotalBytes        int64             `json:"total_bytes"`
+	DocumentsPerBlock StatsDistribution `json:"documents_per_block"`
+	TotalDocuments    int               `json:"total_documents"`
+	Signers           []StatsSigner     `json:"signers"`
+	QuarantinedBlocks int               `json:"quarantined_blocks"`
+	Rollbacks         int               `json:"rollbacks"`
+	BlocksPerDay      float64           `json:"blocks_per_day"`
+	BytesPerDay       float64           `json:"bytes_per_day"`
+	DocumentsPerDay   float64           `json:"documents_per_day"`
+	// The propagation of the blocks announced by the peers, as measured by this node
+	PropagatedBlocks     int               `json:"propagated_blocks"`
+	DelaySeconds         StatsDistribution `json:"delay_seconds"`
+	AnnounceDelaySeconds StatsDistribution `json:"announce_delay_seconds"`
+	FirstAnnouncers      []StatsAnnouncer  `json:"first_announcers"`
+}
+
+// Returns the distribution of the values, which are sorted in the process
+func statsDistribution(values []float64) StatsDistribution {
+	var d StatsDistribution
+	if len(values) == 0 {
+		return d
+	}
+	sort.Float64s(values)
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	pct := func(p float64) float64 {
+		return values[int(math.Ceil(p*float64(len(values))))-1]
+	}
+	d.Min = values[0]
+	d.P50 = pct(0.5)
+	d.P90 = pct(0.9)
+	d.P99 = pct(0.99)
+	d.Max = values[len(values)-1]
+	d.Mean = sum / float64(len(values))
+	return d
+}
+
+// Parses a duration which can also be given in days, e.g. "7d"
+func parseStatsWindow(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Counts the quarantined block files and the number of rollbacks they came from. Block
+// files are quarantined when blocks are rolled back, which is the closest thing to orphaned
+// blocks and reorgs in this blockchain.
+func statsQuarantine() (int, int) {
+	files, err := ioutil.ReadDir(filepath.Join(cfg.DataDir, quarantineSubdirectoryBaseName))
+	if err != nil {
+		return 0, 0
+	}
+	n := 0
+	events := map[string]bool{}
+	for _, fi := range files {
+		var height int
+		var ts int64
+		if _, err := fmt.Sscanf(fi.Name(), "block_%x_%d.db", &height, &ts); err != nil {
+			continue
+		}
+		n++
+		events[strconv.FormatInt(ts, 10)] = true
+	}
+	return n, len(events)
+}
+
+// Computes the statistics of the blocks in the given range of heights, which have been
+// created no earlier than the given time
+func blockchainStats(minHeight, maxHeight int, since time.Time) (*ChainStats, error) {
+	st := ChainStats{MinHeight: -1, MaxHeight: -1}
+	var intervals, sizes, docs []float64
+	signers := map[string]int{}
+	propagated, err := dbGetPropagation(minHeight, maxHeight)
+	if err != nil {
+		return nil, err
+	}
+	var delays, announceDelays []float64
+	firstPeers := map[string]int{}
+	var prevTime time.Time
+	for h := minHeight; h <= maxHeight; h++ {
+		dbb, err := dbGetBlockByHeight(h)
+		if err != nil {
+			return nil, fmt.Errorf("Block %d: %v", h, err)
+		}
+		fi, err := os.Stat(blockchainGetFilename(h))
+		if err != nil {
+			return nil, err
+		}
+		b, err := OpenBlockByHeight(h)
+		if err != nil {
+			return nil, err
+		}
+		// The block's own timestamp is used, since the time of acceptance only says when
+		// this node received it
+		ts, err := b.dbGetMetaTime("Timestamp")
+		if err != nil {
+			ts = dbb.TimeAccepted
+		}
+		atts, err := b.dbGetAttachments()
+		b.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Block %d: %v", h, err)
+		}
+		if ts.Before(since) {
+			continue
+		}
+		if st.Blocks == 0 {
+			st.MinHeight = h
+			st.FirstTimestamp = ts
+		} else {
+			intervals = append(intervals, ts.Sub(prevTime).Seconds())
+		}
+		prevTime = ts
+		st.MaxHeight = h
+		st.LastTimestamp = ts
+		st.Blocks++
+		st.TotalBytes += fi.Size()
+		st.TotalDocuments += len(atts)
+		sizes = append(sizes, float64(fi.Size()))
+		docs = append(docs, float64(len(atts)))
+		signers[dbb.SignaturePublicKeyHash]++
+		if p, ok := propagated[h]; ok {
+			delays = append(delays, p.delay.Seconds())
+			announceDelays = append(announceDelays, p.announceDelay.Seconds())
+			firstPeers[p.firstPeer]++
+		}
+	}
+	st.IntervalSeconds = statsDistribution(intervals)
+	st.SizeBytes = statsDistribution(sizes)
+	st.DocumentsPerBlock = statsDistribution(docs)
+	for key, n := range signers {
+		st.Signers = append(st.Signers, StatsSigner{PublicKeyHash: key, Blocks: n, Percent: 100 * float64(n) / float64(st.Blocks)})
+	}
+	sort.Slice(st.Signers, func(i, j int) bool {
+		return st.Signers[i].Blocks > st.Signers[j].Blocks
+	})
+	st.PropagatedBlocks = len(delays)
+	st.DelaySeconds = statsDistribution(delays)
+	st.AnnounceDelaySeconds = statsDistribution(announceDelays)
+	st.FirstAnnouncers = propagationFirstAnnouncers(firstPeers, len(delays))
+	st.QuarantinedBlocks, st.Rollbacks = statsQuarantine()
+	if days := st.LastTimestamp.Sub(st.FirstTimestamp).Hours() / 24; days > 0 {
+		st.BlocksPerDay = float64(st.Blocks) / days
+		st.BytesPerDay = float64(st.TotalBytes) / days
+		st.DocumentsPerDay = float64(st.TotalDocuments) / days
+	}
+	return &st, nil
+}
+
+// Shows the chain statistics, run as: stats [-from height] [-to height] [-window duration] [-json]
+func actionStats(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	from := fs.Int("from", 0, "The first block height")
+	to := fs.Int("to", -1, "The last block height (default: the last block)")
+	window := fs.String("window", "", "Only include the blocks created in this period before now, e.g. 24h or 30d")
+	asJSON := fs.Bool("json", false, "Output the statistics as JSON")
+	fs.Parse(args)
+
+	height := dbGetBlockchainHeight()
+	if *to < 0 || *to > height {
+		*to = height
+	}
+	if *from < 0 || *from > *to {
+		log.Fatalln("Invalid range of heights:", *from, "to", *to)
+	}
+	var since time.Time
+	if *window != "" {
+		d, err := parseStatsWindow(*window)
+		if err != nil {
+			log.Fatalln("Invalid window:", *window, err)
+		}
+		since = time.Now().Add(-d)
+	}
+	st, err := blockchainStats(*from, *to, since)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *asJSON {
+		data, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	if st.Blocks == 0 {
+		fmt.Println("No blocks in the selected range")
+		return
+	}
+	printDist := func(name string, d StatsDistribution) {
+		fmt.Printf("%-20s min %.0f  p50 %.0f  p90 %.0f  p99 %.0f  max %.0f  mean %.1f\n", name, d.Min, d.P50, d.P90, d.P99, d.Max, d.Mean)
+	}
+	fmt.Printf("Blocks:              %d (heights %d to %d)\n", st.Blocks, st.MinHeight, st.MaxHeight)
+	fmt.Printf("Period:              %s to %s\n", st.FirstTimestamp.Format(time.RFC3339), st.LastTimestamp.Format(time.RFC3339))
+	printDist("Interval (s):", st.IntervalSeconds)
+	printDist("Size (bytes):", st.SizeBytes)
+	printDist("Documents/block:", st.DocumentsPerBlock)
+	fmt.Printf("Total size:          %d bytes\n", st.TotalBytes)
+	fmt.Printf("Total documents:     %d\n", st.TotalDocuments)
+	fmt.Printf("Growth:              %.1f blocks/day, %.0f bytes/day, %.1f documents/day\n", st.BlocksPerDay, st.BytesPerDay, st.DocumentsPerDay)
+	fmt.Printf("Quarantined blocks:  %d (from %d rollbacks)\n", st.QuarantinedBlocks, st.Rollbacks)
+	fmt.Println("Signers:")
+	for _, s := range st.Signers {
+		fmt.Printf("\t%s\t%d\t%.1f%%\n", s.PublicKeyHash, s.Blocks, s.Percent)
+	}
+	if st.PropagatedBlocks == 0 {
+		return
+	}
+	fmt.Printf("Propagated blocks:   %d\n", st.PropagatedBlocks)
+	printDistSeconds := func(name string, d StatsDistribution) {
+		fmt.Printf("%-20s min %.1f  p50 %.1f  p90 %.1f  p99 %.1f  max %.1f  mean %.2f\n", name, d.Min, d.P50, d.P90, d.P99, d.Max, d.Mean)
+	}
+	printDistSeconds("Delay (s):", st.DelaySeconds)
+	printDistSeconds("After announce (s):", st.AnnounceDelaySeconds)
+	fmt.Println("First announcers:")
+	for _, a := range st.FirstAnnouncers {
+		fmt.Printf("\t%s\t%d\t%.1f%%\n", a.Peer, a.Blocks, a.Percent)
+	}
+}
@@ -0,0 +1,251 @@
+package daisy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Block files can be spread over several directories, e.g. on bulk disks, while the main
+// database and the chunks stay in the data directory. The block_storage config setting
+// lists the directories with the blocks they hold: a range of heights ("heights":
+// "0-499999", or "500000-" for all the blocks above), block hashes whose hex digits start
+// with one of the given prefixes ("hash_prefixes": ["0", "1"]), or both. A block is stored in the
+// first directory it matches, and in the blocks subdirectory of the data directory if it
+// matches none. The genesis block is never matched by hash prefixes. Blocks are still
+// found after the layout changes, and the movestorage command moves them to where the
+// current layout puts them.
+
+// BlockStorageConfig is a directory holding block files, in the block_storage setting
+type BlockStorageConfig struct {
+	Dir          string   `json:"dir"`
+	Heights      string   `json:"heights"`
+	HashPrefixes []string `json:"hash_prefixes"`
+}
+
+// A parsed block storage directory
+type blockStorageRule struct {
+	dir       string
+	minHeight int
+	maxHeight int // -1 for no limit
+	prefixes  []string
+}
+
+// The parsed block_storage setting
+var blockStorageRules []blockStorageRule
+
+// Parses the block_storage setting
+func blockStorageParse() error {
+	blockStorageRules = nil
+	for _, bs := range cfg.BlockStorage {
+		if !filepath.IsAbs(bs.Dir) {
+			return fmt.Errorf("The block storage directory must be an absolute path: %q", bs.Dir)
+		}
+		rule := blockStorageRule{dir: filepath.Clean(bs.Dir), maxHeight: -1}
+		if bs.Heights != "" {
+			bounds := strings.SplitN(bs.Heights, "-", 2)
+			var err error
+			if len(bounds) != 2 {
+				return fmt.Errorf("Invalid block storage heights %q: expecting a range like 0-99999 or 100000-", bs.Heights)
+			}
+			if rule.minHeight, err = strconv.Atoi(bounds[0]); err != nil || rule.minHeight < 0 {
+				return fmt.Errorf("Invalid block storage heights %q", bs.Heights)
+			}
+			if bounds[1] != "" {
+				if rule.maxHeight, err = strconv.Atoi(bounds[1]); err != nil || rule.maxHeight < rule.minHeight {
+					return fmt.Errorf("Invalid block storage heights %q", bs.Heights)
+				}
+			}
+		}
+		for _, p := range bs.HashPrefixes {
+			p = strings.ToLower(p)
+			if _, err := strconv.ParseUint(p, 16, 64); err != nil || len(p) > 8 {
+				return fmt.Errorf("Invalid block storage hash prefix %q: expecting up to 8 hex digits", p)
+			}
+			rule.prefixes = append(rule.prefixes, p)
+		}
+		if bs.Heights == "" && len(rule.prefixes) == 0 {
+			return fmt.Errorf("The block storage directory %s needs heights or hash prefixes", bs.Dir)
+		}
+		if !cfg.readOnly {
+			if err := os.MkdirAll(rule.dir, 0700); err != nil {
+				return fmt.Errorf("Cannot create the block storage directory: %v", err)
+			}
+		}
+		blockStorageRules = append(blockStorageRules, rule)
+	}
+	return nil
+}
+
+// Returns true if the block matches the rule
+func (r *blockStorageRule) matches(height int, hash string) bool {
+	if height < r.minHeight || (r.maxHeight != -1 && height > r.maxHeight) {
+		return false
+	}
+	if len(r.prefixes) == 0 {
+		return true
+	}
+	if height == 0 || hash == "" {
+		return false
+	}
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(hashHex(hash), p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if some block storage directories are selected by the block hash
+func blockStorageUsesHashes() bool {
+	for _, r := range blockStorageRules {
+		if len(r.prefixes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the directory where the block with the given height and hash is to be stored
+func blockStorageDir(height int, hash string) string {
+	for i := range blockStorageRules {
+		if blockStorageRules[i].matches(height, hash) {
+			return blockStorageRules[i].dir
+		}
+	}
+	return blockchainSubdirectory
+}
+
+// Returns all the directories which can hold blocks
+func blockStorageAllDirs() []string {
+	dirs := []string{blockchainSubdirectory}
+	for _, r := range blockStorageRules {
+		if !inStrings(r.dir, dirs) {
+			dirs = append(dirs, r.dir)
+		}
+	}
+	return dirs
+}
+
+// Removes the temporary files older than the given age, left in the block directories by
+// interrupted copies. Returns the number of files removed.
+func blockStorageRemoveTmpFiles(minAge time.Duration) int {
+	removed := 0
+	for _, dir := range blockStorageAllDirs() {
+		filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.Mode().IsRegular() || !strings.HasSuffix(path, ".tmp") {
+				return nil
+			}
+			if time.Since(fi.ModTime()) < minAge {
+				return nil
+			}
+			if err = os.Remove(path); err != nil {
+				log.Println(err)
+				return nil
+			}
+			removed++
+			return nil
+		})
+	}
+	return removed
+}
+
+// Returns the directories in which new blocks above the given height can be stored
+func blockStorageWritableDirs(height int) []string {
+	dirs := []string{blockchainSubdirectory}
+	for _, r := range blockStorageRules {
+		if (r.maxHeight == -1 || r.maxHeight > height) && !inStrings(r.dir, dirs) {
+			dirs = append(dirs, r.dir)
+		}
+	}
+	return dirs
+}
+
+// Returns the name of the block file with the given height in the directory
+func blockStorageFilename(dir string, height int) string {
+	return fmt.Sprintf(rawBlockFilenameFormat, dir, height/65536, height)
+}
+
+// Returns the hash of the accepted block at the height, if the layout needs it
+func blockStorageHash(height int) string {
+	if height == 0 || !blockStorageUsesHashes() {
+		return ""
+	}
+	return dbGetBlockHashByHeight(height)
+}
+
+// Moves a file, copying it if it's on another file system
+func moveFile(oldName, newName string) error {
+	if err := renameFile(oldName, newName); err == nil {
+		return nil
+	}
+	in, err := os.Open(oldName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmpName := newName + ".tmp"
+	out, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = renameFile(tmpName, newName)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	in.Close()
+	return os.Remove(oldName)
+}
+
+// Moves the block file with the given height into the directory where the current
+// block_storage setting puts it. Returns true if the file was moved.
+func blockStorageRepackBlock(height int) (bool, error) {
+	dir := blockStorageDir(height, blockStorageHash(height))
+	fileName := blockStorageFilename(dir, height)
+	if fileExists(fileName) {
+		return false, nil
+	}
+	current := blockchainGetFilename(height)
+	if !fileExists(current) {
+		log.Println("Block file for height", height, "not found")
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return false, err
+	}
+	if err := moveFile(current, fileName); err != nil {
+		return false, fmt.Errorf("Cannot move %s to %s: %v", current, fileName, err)
+	}
+	return true, nil
+}
+
+// Moves the block files into the directories where the current block_storage setting
+// puts them, run as: movestorage
+func actionMoveStorage() {
+	moved := 0
+	for h := 0; h <= dbGetBlockchainHeight(); h++ {
+		ok, err := blockStorageRepackBlock(h)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if ok {
+			moved++
+		}
+	}
+	log.Println("Moved", moved, "block files")
+}
@@ -0,0 +1,423 @@
+package daisy
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+// When several peers have the blocks this node is missing, the blocks are downloaded from
+// the one expected to deliver them fastest, not from whichever peer happened to announce
+// its height. For every peer, the node measures the round trip time of ping messages, the
+// throughput of its block downloads and the rate of failed downloads, and estimates how
+// long fetching a typical block from it would take. While syncing, the peer the blocks
+// are downloaded from is replaced if it disconnects, stalls, or becomes much slower than
+// another peer which has the blocks. With a memory budget, the hashes of the missing
+// blocks are asked for in batches, and only a few of the blocks are downloaded at a time.
+
+// The feature of answering ping messages with pong messages
+const p2pFeaturePing = "ping"
+
+// The message asking the peer to reply with a pong, for measuring the round trip time
+const p2pMsgPing = "ping"
+
+type p2pMsgPingStruct struct {
+	p2pMsgHeader
+	Nonce int64 `json:"nonce"`
+}
+
+// The reply to a ping message, with its nonce
+const p2pMsgPong = "pong"
+
+type p2pMsgPongStruct struct {
+	p2pMsgHeader
+	Nonce int64 `json:"nonce"`
+}
+
+// How often the peers are pinged
+const p2pPingInterval = 30 * time.Second
+
+// How long a ping is waited for before it's forgotten
+const p2pPingTimeout = 10 * p2pPingInterval
+
+// The weight of a new measurement in the smoothed round trip time and throughput
+const p2pSyncSmoothing = 0.3
+
+// The size of the typical block whose download time is estimated for choosing peers
+const p2pSyncTypicalBlockSize = 1024 * 1024
+
+// The smallest block whose download time says something about the throughput, rather
+// than only about the latency
+const p2pSyncMinMeasuredSize = 64 * 1024
+
+// The estimates assumed for the peers which haven't been measured yet
+const (
+	p2pSyncDefaultRTT        = 500 * time.Millisecond
+	p2pSyncDefaultThroughput = 1024 * 1024
+)
+
+// How long a peer has to deliver a requested block before it's considered stalled
+const p2pSyncStallTimeout = 30 * time.Second
+
+// How long a request is kept for a peer which isn't checked for stalling because it's not
+// the one being synced from
+const p2pSyncRequestTimeout = 4 * p2pSyncStallTimeout
+
+// How much slower than another peer the peer being synced from has to become to be
+// replaced
+const p2pSyncSwitchFactor = 2
+
+// The measured sync performance of a peer
+type p2pSyncStats struct {
+	lock       WithMutex
+	rtt        time.Duration // smoothed ping round trip time, 0 until measured
+	lastPing   time.Time
+	pings      map[int64]time.Time // the random nonces of the pings waiting for a pong
+	throughput float64             // smoothed block download throughput in bytes/s, 0 until measured
+	blocks     int                 // the number of blocks downloaded
+	errors     int                 // the number of failed and timed out block downloads
+	requested  map[string]time.Time
+	queue      []p2pSyncQueued // the blocks to request, when downloads are limited
+	batchEnd   int             // the last height of the batch being synced, 0 if not batched
+}
+
+// A block waiting to be requested
+type p2pSyncQueued struct {
+	height  int
+	hash    string
+	traceID string
+}
+
+// Sends a ping if the peer supports it and it's time to measure the round trip time again
+func (p2pc *p2pConnection) pingIfDue() {
+	if !p2pc.helloReceived || !inStrings(p2pFeaturePing, p2pc.features) {
+		return
+	}
+	now := time.Now()
+	nonce := randInt63()
+	due := false
+	p2pc.syncStats.lock.With(func() {
+		if now.Sub(p2pc.syncStats.lastPing) >= p2pPingInterval {
+			p2pc.syncStats.lastPing = now
+			if p2pc.syncStats.pings == nil {
+				p2pc.syncStats.pings = map[int64]time.Time{}
+			}
+			p2pc.syncStats.pings[nonce] = now
+			due = true
+		}
+	})
+	if !due {
+		return
+	}
+	p2pc.queueMsg(p2pMsgPingStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgPing,
+		},
+		Nonce: nonce,
+	})
+}
+
+// Forgets the pings which haven't been answered, and the block requests of a peer which
+// isn't checked for stalling, counting them as errors. Called periodically by the
+// connection handler.
+func (p2pc *p2pConnection) syncExpire() {
+	p2pc.syncStats.lock.With(func() {
+		for nonce, sendTime := range p2pc.syncStats.pings {
+			if time.Since(sendTime) >= p2pPingTimeout {
+				delete(p2pc.syncStats.pings, nonce)
+			}
+		}
+		for hash, requestTime := range p2pc.syncStats.requested {
+			if time.Since(requestTime) >= p2pSyncRequestTimeout {
+				delete(p2pc.syncStats.requested, hash)
+				p2pc.syncStats.errors++
+			}
+		}
+	})
+}
+
+// ping: reply with a pong carrying the same nonce
+func (p2pc *p2pConnection) handlePing(msg StrIfMap) {
+	nonce, err := msg.GetInt64("nonce")
+	if err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	p2pc.queueMsg(p2pMsgPongStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgPong,
+		},
+		Nonce: nonce,
+	})
+}
+
+// pong: the reply to our ping, whose round trip time is measured from the time we have
+// recorded for its nonce
+func (p2pc *p2pConnection) handlePong(msg StrIfMap) {
+	nonce, err := msg.GetInt64("nonce")
+	if err != nil {
+		log.Println(p2pc.conn, err)
+		return
+	}
+	p2pc.syncStats.lock.With(func() {
+		sendTime, ok := p2pc.syncStats.pings[nonce]
+		if !ok {
+			// Not a nonce we sent, or already answered
+			return
+		}
+		delete(p2pc.syncStats.pings, nonce)
+		rtt := time.Since(sendTime)
+		if p2pc.syncStats.rtt == 0 {
+			p2pc.syncStats.rtt = rtt
+		} else {
+			p2pc.syncStats.rtt = time.Duration(p2pSyncSmoothing*float64(rtt) + (1-p2pSyncSmoothing)*float64(p2pc.syncStats.rtt))
+		}
+	})
+}
+
+// Records that the block has been requested from the peer
+func (p2pc *p2pConnection) syncRequested(hash string) {
+	p2pc.syncStats.lock.With(func() {
+		if p2pc.syncStats.requested == nil {
+			p2pc.syncStats.requested = map[string]time.Time{}
+		}
+		p2pc.syncStats.requested[hash] = time.Now()
+	})
+}
+
+// Records the outcome of receiving a block of the given size from the peer
+func (p2pc *p2pConnection) syncReceived(hash string, size int64, err error) {
+	p2pc.syncStats.lock.With(func() {
+		if err != nil {
+			p2pc.syncStats.errors++
+			delete(p2pc.syncStats.requested, hash)
+			return
+		}
+		p2pc.syncStats.blocks++
+		requestTime, ok := p2pc.syncStats.requested[hash]
+		if !ok {
+			// An announced block, whose download time is unknown
+			return
+		}
+		delete(p2pc.syncStats.requested, hash)
+		if size < p2pSyncMinMeasuredSize {
+			return
+		}
+		// The round trip of the request isn't part of the transfer
+		elapsed := (time.Since(requestTime) - p2pc.syncStats.rtt).Seconds()
+		if elapsed < 0.001 {
+			elapsed = 0.001
+		}
+		throughput := float64(size) / elapsed
+		if p2pc.syncStats.throughput == 0 {
+			p2pc.syncStats.throughput = throughput
+		} else {
+			p2pc.syncStats.throughput = p2pSyncSmoothing*throughput + (1-p2pSyncSmoothing)*p2pc.syncStats.throughput
+		}
+	})
+}
+
+// Adds the blocks to the ones to request from the peer
+func (p2pc *p2pConnection) syncQueue(blocks []p2pSyncQueued) {
+	p2pc.syncStats.lock.With(func() {
+		p2pc.syncStats.queue = append(p2pc.syncStats.queue, blocks...)
+	})
+}
+
+// Requests the queued blocks from the peer, as many as the memory budget lets be
+// downloaded at the same time
+func (p2pc *p2pConnection) syncRequestMore() {
+	max := memorySyncDownloads()
+	for {
+		var q p2pSyncQueued
+		ok := false
+		p2pc.syncStats.lock.With(func() {
+			if len(p2pc.syncStats.queue) > 0 && (max == 0 || len(p2pc.syncStats.requested) < max) {
+				q, ok = p2pc.syncStats.queue[0], true
+				p2pc.syncStats.queue = p2pc.syncStats.queue[1:]
+			}
+		})
+		if !ok {
+			return
+		}
+		if dbBlockHeightExists(q.height) || p2pCoordinator.recentlyRequestedBlocks.TestAndSet(q.hash) {
+			continue
+		}
+		log.Println("Requesting block", q.hash)
+		start := time.Now()
+		traceRememberBlock(q.hash, q.traceID)
+		p2pc.syncRequested(q.hash)
+		p2pc.queueMsg(p2pMsgGetBlockStruct{
+			p2pMsgHeader: p2pMsgHeader{
+				P2pID:   p2pEphemeralID,
+				Root:    chainParams.GenesisBlockHash,
+				Msg:     p2pMsgGetBlock,
+				TraceID: q.traceID,
+			},
+			Hash: q.hash,
+		})
+		traceStage(q.traceID, traceStageGetBlock, start, nil, "peer", p2pc.address, "height", strconv.Itoa(q.height), "hash", q.hash)
+	}
+}
+
+// Sets the last height of the batch of blocks being synced from the peer
+func (p2pc *p2pConnection) syncSetBatch(end int) {
+	p2pc.syncStats.lock.With(func() {
+		p2pc.syncStats.batchEnd = end
+	})
+}
+
+// Forgets the blocks still to be requested from the peer, when syncing from another one
+func (p2pc *p2pConnection) syncDropQueue() {
+	p2pc.syncStats.lock.With(func() {
+		p2pc.syncStats.queue = nil
+		p2pc.syncStats.batchEnd = 0
+	})
+}
+
+// Returns true if all the blocks of the batch being synced from the peer have been
+// received, or have failed
+func (p2pc *p2pConnection) syncBatchDone() bool {
+	done := false
+	p2pc.syncStats.lock.With(func() {
+		done = p2pc.syncStats.batchEnd > 0 && len(p2pc.syncStats.queue) == 0 && len(p2pc.syncStats.requested) == 0
+	})
+	return done
+}
+
+// Requests more of the queued blocks after one has been received from the peer, and asks
+// the coordinator for the next batch when the batch is done
+func (p2pc *p2pConnection) syncContinue() {
+	p2pc.syncRequestMore()
+	if !p2pc.syncBatchDone() || p2pc.chainHeight <= dbGetBlockchainHeight() {
+		return
+	}
+	select {
+	case p2pCtrlChannel <- p2pCtrlMessage{msgType: p2pCtrlSearchForBlocks, payload: p2pc}:
+		p2pc.syncSetBatch(0)
+	default:
+		// The coordinator is busy, and will continue the sync on its next tick
+	}
+}
+
+// Drops the requests the peer hasn't answered in time, counting them as errors. Returns
+// true if there were any.
+func (p2pc *p2pConnection) syncExpireRequests() bool {
+	stalled := false
+	p2pc.syncStats.lock.With(func() {
+		for hash, requestTime := range p2pc.syncStats.requested {
+			if time.Since(requestTime) >= p2pSyncStallTimeout {
+				delete(p2pc.syncStats.requested, hash)
+				p2pc.syncStats.errors++
+				stalled = true
+			}
+		}
+	})
+	return stalled
+}
+
+// Returns the estimated time in seconds to download a typical block from the peer, taking
+// into account the retries needed at its error rate
+func (p2pc *p2pConnection) syncCost() float64 {
+	var cost float64
+	p2pc.syncStats.lock.With(func() {
+		rtt := p2pc.syncStats.rtt
+		if rtt == 0 {
+			rtt = p2pSyncDefaultRTT
+		}
+		throughput := p2pc.syncStats.throughput
+		if throughput == 0 {
+			throughput = p2pSyncDefaultThroughput
+		}
+		// The added 1 keeps the first failure of a new peer from ruling it out
+		errorRate := float64(p2pc.syncStats.errors) / float64(p2pc.syncStats.blocks+p2pc.syncStats.errors+1)
+		cost = (rtt.Seconds() + p2pSyncTypicalBlockSize/throughput) / (1 - errorRate)
+	})
+	return cost
+}
+
+// Returns the peer's measurements for the /peers API
+func (p2pc *p2pConnection) syncStatsMap() map[string]interface{} {
+	var m map[string]interface{}
+	p2pc.syncStats.lock.With(func() {
+		m = map[string]interface{}{
+			"rtt_ms":           p2pc.syncStats.rtt.Seconds() * 1000,
+			"throughput_bytes": int64(p2pc.syncStats.throughput),
+			"blocks":           p2pc.syncStats.blocks,
+			"errors":           p2pc.syncStats.errors,
+		}
+	})
+	return m
+}
+
+// Returns the peer with the lowest sync cost among those which have blocks above the
+// given height, other than the excluded one. The preferred peer wins ties. Returns nil if
+// there is no such peer.
+func (co *p2pCoordinatorType) selectSyncPeer(myHeight int, preferred, excluded *p2pConnection) *p2pConnection {
+	var candidates []*p2pConnection
+	p2pPeers.lock.With(func() {
+		for p2pc := range p2pPeers.peers {
+			if p2pc != excluded && p2pc.helloReceived && p2pc.chainHeight > myHeight && !p2pc.policy().NoSync {
+				candidates = append(candidates, p2pc)
+			}
+		}
+	})
+	var best *p2pConnection
+	bestCost := 0.0
+	if preferred != nil && preferred != excluded && preferred.chainHeight > myHeight && p2pPeers.Has(preferred) && !preferred.policy().NoSync {
+		best, bestCost = preferred, preferred.syncCost()
+	}
+	for _, p2pc := range candidates {
+		if cost := p2pc.syncCost(); best == nil || cost < bestCost {
+			best, bestCost = p2pc, cost
+		}
+	}
+	return best
+}
+
+// Replaces the peer the blocks are being downloaded from if it has disconnected, has
+// stalled or has become much slower than another peer with the needed blocks. Called
+// periodically by the coordinator.
+func (co *p2pCoordinatorType) checkSyncPeer() {
+	current := co.syncPeer
+	if current == nil {
+		return
+	}
+	myHeight := dbGetBlockchainHeight()
+	if p2pPeers.maxChainHeight() <= myHeight {
+		// Synced
+		co.syncPeer = nil
+		return
+	}
+	stalled := current.syncExpireRequests()
+	if !stalled && p2pPeers.Has(current) && current.chainHeight > myHeight && current.syncBatchDone() {
+		// The batch has been downloaded, but the next one hasn't been asked for
+		co.searchForBlocks(current)
+		return
+	}
+	var reason string
+	switch {
+	case !p2pPeers.Has(current):
+		reason = "it has disconnected"
+	case current.chainHeight <= myHeight:
+		reason = "it doesn't have the missing blocks"
+	case stalled:
+		reason = "it has stalled"
+	}
+	next := co.selectSyncPeer(myHeight, nil, current)
+	if next == nil {
+		return
+	}
+	if reason == "" {
+		if next.syncCost()*p2pSyncSwitchFactor >= current.syncCost() {
+			return
+		}
+		reason = "it has become slower than " + next.address
+	}
+	log.Println("Switching the sync from", current.address, "to", next.address, "because", reason)
+	co.searchForBlocks(next)
+}
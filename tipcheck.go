@@ -0,0 +1,327 @@
+package daisy
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A node restored from an old backup, or started with a data directory left behind by the
+// network, would fork the chain if it sealed blocks right away. So before the node
+// produces its first block, it asks the peers it has dialed, or whose addresses it has
+// saved, for the header of the block at its height (or at theirs, if they're behind), and
+// holds production until -tip-check-peers of them have answered. The peers which connect
+// to the node aren't asked, since anyone could connect enough of them to outvote the
+// network. If most of the answers have a different block, the node has forked and
+// production stays held until the operator resolves it, or releases the hold with POST
+// /tip-check or the tip-check-override command; if most of them are more than
+// -tip-check-max-lag blocks ahead, production is held until the node has caught up. If
+// not enough peers answer within -tip-check-timeout the node proceeds, flagging its tip as
+// unverified, so a lone node can still produce.
+
+// Defaults of the tip check
+const (
+	DefaultTipCheckPeers   = 3
+	DefaultTipCheckTimeout = "2m"
+	DefaultTipCheckMaxLag  = 10
+)
+
+// The states of the tip check
+const (
+	tipCheckPending    = "pending"
+	tipCheckOK         = "ok"
+	tipCheckBehind     = "behind"
+	tipCheckForked     = "forked"
+	tipCheckUnverified = "unverified"
+	tipCheckOverridden = "overridden"
+)
+
+// A peer's answer: its height, and if it has our block at the lower of the two heights
+type tipCheckAnswer struct {
+	height  int
+	matches bool
+}
+
+var tipCheck = struct {
+	lock    WithMutex
+	state   string
+	detail  string
+	asked   map[*p2pConnection]int // the peers asked, and the height asked for
+	answers map[string]tipCheckAnswer
+	target  int // the height to catch up to when behind
+}{
+	state: tipCheckOK,
+}
+
+// The parsed -tip-check-timeout
+var tipCheckTimeout time.Duration
+
+// Checks the tip check settings
+func tipCheckConfigure() error {
+	if cfg.TipCheckPeers < 0 {
+		return fmt.Errorf("Invalid -tip-check-peers: %d", cfg.TipCheckPeers)
+	}
+	if cfg.TipCheckMaxLag < 0 {
+		return fmt.Errorf("Invalid -tip-check-max-lag: %d", cfg.TipCheckMaxLag)
+	}
+	var err error
+	tipCheckTimeout, err = parseDurationSetting("tip-check-timeout", cfg.TipCheckTimeout, time.Second, time.Hour)
+	return err
+}
+
+// Starts the tip check, unless it's disabled or the node doesn't produce blocks
+func tipCheckStart() {
+	if cfg.TipCheckPeers == 0 || profileRelaxed() {
+		return
+	}
+	tipCheck.lock.With(func() {
+		tipCheck.state = tipCheckPending
+		tipCheck.asked = map[*p2pConnection]int{}
+		tipCheck.answers = map[string]tipCheckAnswer{}
+	})
+	log.Println("Holding block production until", cfg.TipCheckPeers, "peers have confirmed the chain tip")
+	go func() {
+		select {
+		case <-nodeQuit:
+			return
+		case <-time.After(tipCheckTimeout):
+		}
+		tipCheck.lock.With(func() {
+			if tipCheck.state != tipCheckPending {
+				return
+			}
+			tipCheck.state = tipCheckUnverified
+			tipCheck.detail = fmt.Sprintf("only %d of %d peers answered within %v", len(tipCheck.answers), cfg.TipCheckPeers, tipCheckTimeout)
+			log.Println("WARNING: producing blocks with an unverified chain tip:", tipCheck.detail)
+		})
+	}()
+}
+
+// Returns true if the peer's answer counts in the tip check: we have connected to it, or
+// its address is one of the saved peers
+func (p2pc *p2pConnection) tipCheckTrusted() bool {
+	if p2pc.outbound {
+		return true
+	}
+	saved := dbGetSavedPeers()
+	_, ok := saved[p2pc.outboxAddress()]
+	return ok
+}
+
+// Asks the peer, which has just said hello, for its block at our height, if the check is
+// still waiting for answers and the peer is trusted to answer
+func (p2pc *p2pConnection) tipCheckAsk() {
+	pending := false
+	tipCheck.lock.With(func() {
+		pending = tipCheck.state == tipCheckPending
+	})
+	if !pending || !p2pc.tipCheckTrusted() {
+		return
+	}
+	height := dbGetBlockchainHeight()
+	if p2pc.chainHeight < height {
+		height = p2pc.chainHeight
+	}
+	if height < 0 {
+		return
+	}
+	ask := false
+	tipCheck.lock.With(func() {
+		if tipCheck.state != tipCheckPending {
+			return
+		}
+		if _, answered := tipCheck.answers[p2pc.outboxAddress()]; answered {
+			return
+		}
+		if _, ok := tipCheck.asked[p2pc]; !ok {
+			tipCheck.asked[p2pc] = height
+			ask = true
+		}
+	})
+	if !ask {
+		return
+	}
+	p2pc.queueMsg(p2pMsgGetHeadersStruct{
+		p2pMsgHeader: p2pMsgHeader{
+			P2pID: p2pEphemeralID,
+			Root:  chainParams.GenesisBlockHash,
+			Msg:   p2pMsgGetHeaders,
+		},
+		MinBlockHeight: height,
+		MaxBlockHeight: height,
+	})
+}
+
+// Records the peer's answer to the tip check, if it was asked
+func (p2pc *p2pConnection) tipCheckRecord(headers []BlockHeader) {
+	var height int
+	asked := false
+	tipCheck.lock.With(func() {
+		height, asked = tipCheck.asked[p2pc]
+		delete(tipCheck.asked, p2pc)
+	})
+	if !asked {
+		return
+	}
+	answer := tipCheckAnswer{height: p2pc.chainHeight}
+	for _, hdr := range headers {
+		if hdr.Height == height {
+			answer.matches = hdr.Hash == dbGetBlockHashByHeight(height)
+		}
+	}
+	tipCheck.lock.With(func() {
+		if tipCheck.state != tipCheckPending {
+			return
+		}
+		tipCheck.answers[p2pc.outboxAddress()] = answer
+		if len(tipCheck.answers) >= cfg.TipCheckPeers {
+			tipCheckDecide()
+		}
+	})
+}
+
+// Decides the outcome of the check from the answers. Called with the lock held.
+func tipCheckDecide() {
+	myHeight := dbGetBlockchainHeight()
+	n := len(tipCheck.answers)
+	forked, ahead := 0, 0
+	var heights []int
+	for _, a := range tipCheck.answers {
+		if !a.matches {
+			forked++
+		}
+		if a.height-myHeight > cfg.TipCheckMaxLag {
+			ahead++
+		}
+		heights = append(heights, a.height)
+	}
+	sort.Ints(heights)
+	switch {
+	case forked*2 > n:
+		tipCheck.state = tipCheckForked
+		tipCheck.detail = fmt.Sprintf("%d of %d peers have a different block at our height %d; the data directory may be restored from an old backup", forked, n, myHeight)
+		log.Println("ERROR: not producing blocks:", tipCheck.detail)
+	case ahead*2 > n:
+		tipCheck.state = tipCheckBehind
+		tipCheck.target = heights[n/2]
+		tipCheck.detail = fmt.Sprintf("%d of %d peers are more than %d blocks ahead, at height %d", ahead, n, cfg.TipCheckMaxLag, tipCheck.target)
+		log.Println("Holding block production until the blockchain catches up:", tipCheck.detail)
+	default:
+		tipCheck.state = tipCheckOK
+		tipCheck.detail = ""
+		log.Println("The chain tip has been confirmed by", n, "peers")
+	}
+	tipCheck.asked = nil
+}
+
+// Returns an error if block production is being held by the tip check
+func tipCheckError() error {
+	var err error
+	tipCheck.lock.With(func() {
+		switch tipCheck.state {
+		case tipCheckPending:
+			err = fmt.Errorf("Block production is held until %d peers confirm the chain tip", cfg.TipCheckPeers)
+		case tipCheckBehind:
+			if dbGetBlockchainHeight() >= tipCheck.target-cfg.TipCheckMaxLag {
+				log.Println("The blockchain has caught up with the peers, resuming block production")
+				tipCheck.state = tipCheckOK
+				tipCheck.detail = ""
+				return
+			}
+			err = fmt.Errorf("Block production is held: %s", tipCheck.detail)
+		case tipCheckForked:
+			err = fmt.Errorf("Block production is held: %s", tipCheck.detail)
+		}
+	})
+	return err
+}
+
+// Releases the hold on block production, on the operator's word that the chain tip is
+// right. Returns an error if production isn't held.
+func tipCheckOverride(who string) error {
+	var err error
+	tipCheck.lock.With(func() {
+		switch tipCheck.state {
+		case tipCheckPending, tipCheckBehind, tipCheckForked:
+			log.Println("WARNING: the tip check hold on block production was released by", who, "in the state", tipCheck.state)
+			tipCheck.state = tipCheckOverridden
+			tipCheck.detail = "released by " + who
+			tipCheck.asked = nil
+		default:
+			err = fmt.Errorf("Block production isn't held by the tip check")
+		}
+	})
+	return err
+}
+
+// /tip-check returns the state of the tip check, and releases its hold on block production
+// on POST
+func blockWebTipCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if err := tipCheckOverride("an admin from " + r.RemoteAddr); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	} else if r.Method != http.MethodGet {
+		http.Error(w, "Expecting GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	status := tipCheckStatus()
+	if status == nil {
+		status = map[string]interface{}{"state": tipCheckOK}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(jsonifyWhateverToBytes(status)); err != nil {
+		log.Println(err)
+	}
+}
+
+// Asks a running node to release the tip check hold on its block production
+func actionTipCheckOverride(args []string) {
+	fs := flag.NewFlagSet("tip-check-override", flag.ExitOnError)
+	node := fs.String("node", fmt.Sprintf("localhost:%d", DefaultBlockWebServerPort), "The HTTP address of the node, as host:port or a URL")
+	token := fs.String("token", "", "Bearer token for the node's HTTP API")
+	fs.Parse(args)
+	baseURL := strings.TrimSuffix(*node, "/")
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		baseURL = "http://" + baseURL
+	}
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/tip-check", nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalln("The node refused:", resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Println(strings.TrimSpace(string(body)))
+}
+
+// Returns the state of the tip check for /status, or nil when there's nothing to report
+func tipCheckStatus() map[string]interface{} {
+	var status map[string]interface{}
+	tipCheck.lock.With(func() {
+		if tipCheck.state == tipCheckOK {
+			return
+		}
+		status = map[string]interface{}{"state": tipCheck.state, "answers": len(tipCheck.answers)}
+		if tipCheck.detail != "" {
+			status["detail"] = tipCheck.detail
+		}
+	})
+	return status
+}
@@ -0,0 +1,247 @@
+package daisy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every sync gets a correlation ID (a trace ID) when the coordinator asks a peer for block
+// hashes. The ID is sent in the trace_id field of the requests, echoed by the peers in
+// their responses and passed on to the block requests, so the request, the hashes, the
+// block requests, the downloads, the validation and the commit of the blocks are all
+// logged with it, on this node and on the peers serving the sync. Blocks announced by the
+// peers get a new ID. With -otlp-endpoint, the stages are also exported as OpenTelemetry
+// spans over OTLP/HTTP, with the span of the first stage as the parent of the others.
+
+// The stages of a sync
+const (
+	traceStageGetBlockHashes   = "getblockhashes"
+	traceStageReconcile        = "reconcile"
+	traceStageAnnouncement     = "announcement"
+	traceStageServeBlockHashes = "serve_blockhashes"
+	traceStageBlockHashes      = "blockhashes"
+	traceStageGetBlock         = "getblock"
+	traceStageServeBlock       = "serve_block"
+	traceStageDownload         = "download"
+	traceStageValidate         = "validate"
+	traceStageCommit           = "commit"
+)
+
+// The stages which start a trace
+var traceRootStages = map[string]bool{
+	traceStageGetBlockHashes: true,
+	traceStageReconcile:      true,
+	traceStageAnnouncement:   true,
+}
+
+// How long the trace ID of a requested block is remembered
+const traceBlockMaxAge = 10 * time.Minute
+
+// How many spans are buffered for the OTLP exporter; spans beyond it are dropped
+const traceMaxQueuedSpans = 1000
+
+// A finished stage of a sync
+type traceSpan struct {
+	traceID string
+	name    string // the stage
+	start   time.Time
+	end     time.Time
+	attrs   []string // key, value pairs
+	err     error
+}
+
+// The trace IDs of the requested blocks, by block hash
+var traceBlocks = struct {
+	lock WithMutex
+	ids  map[string]string
+	time map[string]time.Duration
+}{
+	ids:  map[string]string{},
+	time: map[string]time.Duration{},
+}
+
+// The spans waiting to be exported, nil without -otlp-endpoint
+var traceSpans chan traceSpan
+
+// Returns a new random trace ID
+func traceNewID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// Returns the trace ID of the message, or an empty string if it doesn't have a valid one
+func traceIDFromMsg(msg StrIfMap) string {
+	id, err := msg.GetString("trace_id")
+	if err != nil || len(id) != 32 {
+		return ""
+	}
+	if _, err = hex.DecodeString(id); err != nil {
+		return ""
+	}
+	return strings.ToLower(id)
+}
+
+// Remembers the trace ID under which the block was requested
+func traceRememberBlock(hash, traceID string) {
+	now := monoClock()
+	traceBlocks.lock.With(func() {
+		for h, t := range traceBlocks.time {
+			if now-t >= traceBlockMaxAge {
+				delete(traceBlocks.ids, h)
+				delete(traceBlocks.time, h)
+			}
+		}
+		if memoryCacheFull(len(traceBlocks.ids)) {
+			// The block's trace ends at its request
+			return
+		}
+		traceBlocks.ids[hash] = traceID
+		traceBlocks.time[hash] = now
+	})
+}
+
+// Returns the trace ID under which the block was requested and forgets it, or an empty
+// string if it wasn't requested
+func traceForBlock(hash string) string {
+	var id string
+	traceBlocks.lock.With(func() {
+		id = traceBlocks.ids[hash]
+		delete(traceBlocks.ids, hash)
+		delete(traceBlocks.time, hash)
+	})
+	return id
+}
+
+// Logs the end of a sync stage which started at the given time, and queues its span for
+// the exporter. The attributes are key, value pairs.
+func traceStage(traceID, stage string, start time.Time, err error, attrs ...string) {
+	if traceID == "" {
+		return
+	}
+	end := time.Now()
+	var desc strings.Builder
+	for i := 0; i+1 < len(attrs); i += 2 {
+		fmt.Fprintf(&desc, " %s=%s", attrs[i], attrs[i+1])
+	}
+	duration := end.Sub(start).Round(time.Millisecond)
+	if err != nil {
+		log.Printf("Sync %s: %s%s failed after %v: %v", traceID, stage, desc.String(), duration, err)
+	} else {
+		log.Printf("Sync %s: %s%s in %v", traceID, stage, desc.String(), duration)
+	}
+	if traceSpans == nil {
+		return
+	}
+	select {
+	case traceSpans <- traceSpan{traceID: traceID, name: stage, start: start, end: end, attrs: attrs, err: err}:
+	default:
+		// The exporter is behind, the span is only logged
+	}
+}
+
+// Returns the span ID of the first stage of the trace, derived from the trace ID so all
+// the stages, on all the nodes, can refer to it as their parent
+func traceRootSpanID(traceID string) string {
+	return traceID[:16]
+}
+
+// Returns the span as an OTLP JSON span
+func (s *traceSpan) otlp() map[string]interface{} {
+	spanID := traceRootSpanID(s.traceID)
+	parentSpanID := ""
+	if !traceRootStages[s.name] {
+		spanID = traceNewID()[:16]
+		parentSpanID = traceRootSpanID(s.traceID)
+	}
+	attrs := []map[string]interface{}{}
+	for i := 0; i+1 < len(s.attrs); i += 2 {
+		attrs = append(attrs, map[string]interface{}{"key": "daisy." + s.attrs[i], "value": map[string]string{"stringValue": s.attrs[i+1]}})
+	}
+	status := map[string]interface{}{"code": 1}
+	if s.err != nil {
+		status = map[string]interface{}{"code": 2, "message": s.err.Error()}
+	}
+	return map[string]interface{}{
+		"traceId":           s.traceID,
+		"spanId":            spanID,
+		"parentSpanId":      parentSpanID,
+		"name":              "sync." + s.name,
+		"kind":              1,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        attrs,
+		"status":            status,
+	}
+}
+
+// Sends the spans to the OTLP/HTTP endpoint
+func traceExport(client *http.Client, spans []traceSpan) error {
+	otlpSpans := make([]map[string]interface{}, len(spans))
+	for i := range spans {
+		otlpSpans[i] = spans[i].otlp()
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{
+					map[string]interface{}{"key": "service.name", "value": map[string]string{"stringValue": "daisy"}},
+					map[string]interface{}{"key": "service.version", "value": map[string]string{"stringValue": p2pClientVersionString}},
+				},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "daisy.sync"},
+				"spans": otlpSpans,
+			}},
+		}},
+	}
+	url := strings.TrimSuffix(cfg.OtlpEndpoint, "/") + "/v1/traces"
+	resp, err := client.Post(url, "application/json", bytes.NewReader(jsonifyWhateverToBytes(payload)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// Exports the queued spans in batches, until the node stops
+func traceExportRun() {
+	client := http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var batch []traceSpan
+	for {
+		select {
+		case s := <-traceSpans:
+			batch = append(batch, s)
+			if len(batch) < 100 {
+				continue
+			}
+		case <-ticker.C:
+		case <-nodeQuit:
+			if len(batch) > 0 {
+				traceExport(&client, batch)
+			}
+			return
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if err := traceExport(&client, batch); err != nil {
+			log.Println("Cannot export", len(batch), "trace spans:", err)
+		}
+		batch = nil
+	}
+}
@@ -1,7 +1,6 @@
-package main
+package daisy
 
 import (
-	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -23,8 +22,9 @@ type WithMutex struct {
 // With executes the given function with the mutex locked
 func (m *WithMutex) With(f func()) {
 	m.Mutex.Lock()
+	// Deferred so that a panic recovered further up doesn't leave the mutex locked
+	defer m.Mutex.Unlock()
 	f()
-	m.Mutex.Unlock()
 }
 
 // Converts the given Unix timestamp to time.Time
@@ -46,13 +46,12 @@ func stringMap2JsonBytes(m map[string]string) []byte {
 	return b
 }
 
-// Returns a hex-encoded hash of the given byte slice
+// Returns the hash of the given byte slice, made with the chain's hash algorithm
 func hashBytesToHexString(b []byte) string {
-	hash := sha256.Sum256(b)
-	return hex.EncodeToString(hash[:])
+	return chainHash.hashBytes(b)
 }
 
-// Returns a hex-encoded hash of the given file
+// Returns the hash of the given file, made with the chain's hash algorithm
 func hashFileToHexString(fileName string) (string, error) {
 	file, err := os.Open(fileName)
 	if err != nil {
@@ -64,12 +63,12 @@ func hashFileToHexString(fileName string) (string, error) {
 			log.Printf("hashFileToHexString file.Close: %v", err)
 		}
 	}()
-	hash := sha256.New()
+	hash := chainHash.newHash()
 	_, err = io.Copy(hash, file)
 	if err != nil {
 		return "", err
 	}
-	return hex.EncodeToString(hash.Sum(nil)), nil
+	return chainHash.format(hash.Sum(nil)), nil
 }
 
 func hashFileToBytes(fileName string) ([]byte, error) {
@@ -83,7 +82,7 @@ func hashFileToBytes(fileName string) ([]byte, error) {
 			log.Printf("hashFileToHexString file.Close: %v", err)
 		}
 	}()
-	hash := sha256.New()
+	hash := chainHash.newHash()
 	_, err = io.Copy(hash, file)
 	if err != nil {
 		return nil, err
@@ -193,34 +192,52 @@ func (m StrIfMap) GetStringList(key string) ([]string, error) {
 }
 
 // StringSetWithExpiry is a set of strings whose entries disappear after a given time.
+// The entry times are read from the monotonic clock, so changes of the wall clock don't
+// affect the expiry.
 type StringSetWithExpiry struct {
-	data map[string]time.Time
+	data map[string]time.Duration
 	age  time.Duration
 	lock WithMutex
 }
 
 // NewStringSetWithExpiry returns a new StringSetWithExpiry, with the given expiry duration.
 func NewStringSetWithExpiry(d time.Duration) *StringSetWithExpiry {
-	ss := StringSetWithExpiry{data: make(map[string]time.Time), age: d}
+	ss := StringSetWithExpiry{data: make(map[string]time.Duration), age: d}
 	return &ss
 }
 
-// Add adds the given string to the set
+// Add adds the given string to the set, restarting its expiry if it's already there
 func (ss *StringSetWithExpiry) Add(s string) {
 	ss.lock.With(func() {
-		ss.data[s] = time.Now()
+		ss.data[s] = monoClock()
 	})
 	ss.CheckExpire()
 }
 
+// AddWithTTL adds the given string to the set, expiring after ttl instead of the set's
+// expiry duration, which it mustn't exceed
+func (ss *StringSetWithExpiry) AddWithTTL(s string, ttl time.Duration) {
+	ss.lock.With(func() {
+		ss.data[s] = monoClock() - (ss.age - ttl)
+	})
+	ss.CheckExpire()
+}
+
+// Remove removes the given string from the set
+func (ss *StringSetWithExpiry) Remove(s string) {
+	ss.lock.With(func() {
+		delete(ss.data, s)
+	})
+}
+
 // CheckExpire walks the set and removes the entries which have expired.
 func (ss *StringSetWithExpiry) CheckExpire() int {
 	count := 0
+	now := monoClock()
 	ss.lock.With(func() {
 		var toExpire []string
 		for s, t := range ss.data {
-			d := time.Since(t)
-			if d >= ss.age {
+			if now-t >= ss.age {
 				toExpire = append(toExpire, s)
 			}
 		}
@@ -234,34 +251,54 @@ func (ss *StringSetWithExpiry) CheckExpire() int {
 
 // Has tests if a string is present and not expired in this set.
 func (ss *StringSetWithExpiry) Has(s string) bool {
-	var ok bool
+	_, ok := ss.TTL(s)
+	return ok
+}
+
+// TTL returns the time left until the string expires, and false if it's not in the set
+// or has expired
+func (ss *StringSetWithExpiry) TTL(s string) (time.Duration, bool) {
+	var ttl time.Duration
+	now := monoClock()
 	ss.lock.With(func() {
-		var t time.Time
-		t, ok = ss.data[s]
-		if ok {
-			if time.Since(t) >= ss.age {
-				// It's there but it's expired.
-				ok = false
+		if t, ok := ss.data[s]; ok {
+			ttl = ss.age - (now - t)
+		}
+	})
+	if ttl <= 0 {
+		return 0, false
+	}
+	return ttl, true
+}
+
+// TTLs returns the unexpired strings with the time left until they expire
+func (ss *StringSetWithExpiry) TTLs() map[string]time.Duration {
+	result := map[string]time.Duration{}
+	now := monoClock()
+	ss.lock.With(func() {
+		for s, t := range ss.data {
+			if ttl := ss.age - (now - t); ttl > 0 {
+				result[s] = ttl
 			}
 		}
 	})
-	return ok
+	return result
 }
 
 // TestAndSet atomically tests if the string s is present in the set and adds it if it isn't.
 // Returns true iff it was in the set.
 func (ss *StringSetWithExpiry) TestAndSet(s string) bool {
 	var ok bool
+	now := monoClock()
 	ss.lock.With(func() {
-		var t time.Time
+		var t time.Duration
 		t, ok = ss.data[s]
+		if ok && now-t >= ss.age {
+			// It's there but it's expired.
+			ok = false
+		}
 		if !ok {
-			ss.data[s] = time.Now()
-		} else {
-			if time.Since(t) >= ss.age {
-				// It's there but it's expired.
-				ok = false
-			}
+			ss.data[s] = now
 		}
 	})
 	return ok
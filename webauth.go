@@ -0,0 +1,157 @@
+package daisy
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// The HTTP API can be protected with TLS and with authentication carrying roles. Clients
+// authenticate with a bearer token from the http_tokens list, or with a TLS client
+// certificate signed by the -http-client-ca. Each endpoint requires a minimal role; the
+// endpoints used by peers and light clients (blocks, chunks, chain params, headers and
+// proofs) stay public, since everything they serve is public and signed anyway.
+// Without any tokens or client CA, anonymous clients have the read-only role, as before.
+// The roles only apply to the HTTP API: the p2p protocol (including the p2p connections
+// the tls transport accepts on the HTTPS port, which bypass the HTTP handlers), the
+// signed governance orders and the command line actions, which need access to the data
+// directory, have their own rules and don't look at them.
+// /query needs the role given by -http-query-role, the read-only role by default. The
+// queries can only read the blocks (see query.go), but they can be expensive, so the
+// role can be raised, or /query turned off.
+
+// The roles, in increasing order of privilege
+const (
+	httpRoleNone = iota
+	httpRoleReadOnly
+	httpRoleSubmitter
+	httpRoleAdmin
+)
+
+// DefaultHTTPQueryRole is the default role needed for /query
+const DefaultHTTPQueryRole = "read-only"
+
+// The -http-query-role which disables /query
+const httpQueryRoleOff = "off"
+
+var httpRoleNames = map[string]int{
+	"read-only": httpRoleReadOnly,
+	"submitter": httpRoleSubmitter,
+	"admin":     httpRoleAdmin,
+}
+
+// HTTPToken is a bearer token accepted by the HTTP API
+type HTTPToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Role  string `json:"role"`
+}
+
+// Validates the authentication configuration
+func httpAuthConfigCheck() error {
+	if (cfg.HTTPTLSCert == "") != (cfg.HTTPTLSKey == "") {
+		return fmt.Errorf("Both -http-tls-cert and -http-tls-key are needed for TLS")
+	}
+	if cfg.HTTPClientCA != "" && cfg.HTTPTLSCert == "" {
+		return fmt.Errorf("Client certificates need TLS: -http-client-ca requires -http-tls-cert")
+	}
+	for _, t := range cfg.HTTPTokens {
+		if len(t.Token) < 16 {
+			return fmt.Errorf("The HTTP token %s is too short, use at least 16 characters", t.Name)
+		}
+		if _, ok := httpRoleNames[t.Role]; !ok {
+			return fmt.Errorf("Unknown role %s for HTTP token %s", t.Role, t.Name)
+		}
+	}
+	if _, ok := httpRoleNames[cfg.HTTPQueryRole]; !ok && cfg.HTTPQueryRole != httpQueryRoleOff {
+		return fmt.Errorf("Unknown -http-query-role %s", cfg.HTTPQueryRole)
+	}
+	for cn, role := range cfg.HTTPClientRoles {
+		if _, ok := httpRoleNames[role]; !ok {
+			return fmt.Errorf("Unknown role %s for client certificate %s", role, cn)
+		}
+	}
+	return nil
+}
+
+// Returns true if clients need to authenticate for the non-public endpoints
+func httpAuthEnabled() bool {
+	return len(cfg.HTTPTokens) > 0 || cfg.HTTPClientCA != ""
+}
+
+// Returns the role and the name of the client making the request
+func httpRequestRole(r *http.Request) (int, string) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+		for _, t := range cfg.HTTPTokens {
+			if subtle.ConstantTimeCompare(token, []byte(t.Token)) == 1 {
+				return httpRoleNames[t.Role], t.Name
+			}
+		}
+		return httpRoleNone, ""
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		// The certificate has been verified against the client CA by the TLS server
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if role, ok := cfg.HTTPClientRoles[cn]; ok {
+			return httpRoleNames[role], cn
+		}
+		return httpRoleReadOnly, cn
+	}
+	if !httpAuthEnabled() {
+		return httpRoleReadOnly, ""
+	}
+	return httpRoleNone, ""
+}
+
+// Wraps the handler so it's only executed for clients with at least the given role
+func httpRequireRole(role int, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientRole, name := httpRequestRole(r)
+		if clientRole < role {
+			if clientRole == httpRoleNone {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+			} else {
+				log.Println("HTTP client", name, "at", r.RemoteAddr, "is not allowed to access", r.URL.Path)
+				w.WriteHeader(http.StatusForbidden)
+			}
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Returns the TLS configuration of the HTTP server, or nil if TLS is not configured
+func httpTLSConfig() (*tls.Config, error) {
+	if cfg.HTTPTLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.HTTPTLSCert, cfg.HTTPTLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.HTTPClientCA != "" {
+		pem, err := ioutil.ReadFile(cfg.HTTPClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", cfg.HTTPClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		// Client certificates are optional, since peers and token clients don't have them
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return &tlsConfig, nil
+}